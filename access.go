@@ -0,0 +1,104 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+)
+
+const (
+	repoConfigFileName = ".ci-helper.yaml"
+	optInCacheTTL      = 10 * time.Minute
+)
+
+type optInEntry struct {
+	optedIn   bool
+	checkedAt time.Time
+}
+
+// accessPolicy decides which orgs and repositories
+// the app acts on, based on the AccessConfig
+type accessPolicy struct {
+	config AccessConfig
+
+	mu         sync.Mutex
+	optInCache map[string]optInEntry
+}
+
+func newAccessPolicy(cfg AccessConfig) *accessPolicy {
+	return &accessPolicy{config: cfg, optInCache: map[string]optInEntry{}}
+}
+
+// allowed returns whether the app may act on the given repository,
+// and if not, the reason why
+func (p *accessPolicy) allowed(ctx context.Context, client *github.Client, owner, repo string) (bool, string) {
+	fullName := owner + "/" + repo
+
+	if containsFold(p.config.DeniedOrgs, owner) || containsFold(p.config.DeniedRepos, fullName) {
+		return false, "the repository is on the deny list"
+	}
+
+	if len(p.config.AllowedOrgs) > 0 || len(p.config.AllowedRepos) > 0 {
+		if !containsFold(p.config.AllowedOrgs, owner) && !containsFold(p.config.AllowedRepos, fullName) {
+			return false, "the repository isn't on the allow list"
+		}
+	}
+
+	if p.config.OptIn && !p.optedIn(ctx, client, owner, repo) {
+		return false, "the repository doesn't contain the " + repoConfigFileName + " file"
+	}
+
+	return true, ""
+}
+
+// optedIn returns whether the repository contains the app's config file.
+// The result is cached for a while to spare API calls
+func (p *accessPolicy) optedIn(ctx context.Context, client *github.Client, owner, repo string) bool {
+	fullName := owner + "/" + repo
+
+	p.mu.Lock()
+	entry, ok := p.optInCache[fullName]
+	p.mu.Unlock()
+	if ok && time.Since(entry.checkedAt) < optInCacheTTL {
+		return entry.optedIn
+	}
+
+	_, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, repoConfigFileName, nil)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		// don't cache transient errors, and don't act on the repository meanwhile
+		return false
+	}
+
+	p.mu.Lock()
+	p.optInCache[fullName] = optInEntry{optedIn: err == nil, checkedAt: time.Now()}
+	p.mu.Unlock()
+
+	return err == nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the child runs of an aggregated job analysed at most
+	maxChildJobs = 10
+	// the end of the aggregator's build log the child runs are looked up in
+	aggregatorLogTailSize = 1024 * 1024
+	LogKeyChildProwJobURL = "child_prow_job_url"
+)
+
+// childJobURLRegex matches the Spyglass URLs of the child runs the
+// aggregator (or multi-stage) jobs print within their build log
+var childJobURLRegex = regexp.MustCompile(`https://[\w.-]+/view/gs/[\w.-]+/(?:pr-logs/pull|logs)/[^\s)"'<>\]]+`)
+
+// childJobURLs returns the Spyglass URLs of the child runs the job's build log references
+func childJobURLs(ctx context.Context, client *storage.Client, prowJobURL string) ([]string, error) {
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+	buildLog, err := readObjectTail(ctx, client, jobPrefix+"/"+rootBuildLogFileName, aggregatorLogTailSize)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := parseProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var children []string
+	for _, url := range childJobURLRegex.FindAllString(buildLog, -1) {
+		url = strings.TrimRight(url, "/.,;:")
+		loc, err := parseProwJobURL(url)
+		if err != nil || seen[url] || (loc.job == parent.job && loc.buildID == parent.buildID) {
+			continue
+		}
+		seen[url] = true
+		children = append(children, url)
+		if len(children) == maxChildJobs {
+			break
+		}
+	}
+	return children, nil
+}
+
+// analyzeChildJobs reports the failures of the child runs of the job, grouped by child
+// run, when the job (e.g. an aggregator) has no junit of its own but references child
+// runs within its build log. The report is left as it is when no child run failed
+func (h *PRCommentHandler) analyzeChildJobs(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner, scanURL string, rc RepositoryConfig, failedTCReport *FailedTestCasesReport) {
+	children, err := childJobURLs(ctx, scanner.Client, scanURL)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to look up the child runs of the job")
+		return
+	}
+	if len(children) == 0 {
+		return
+	}
+	logger.Debug().Msgf("The job has no junit, analysing its %d child run(s)", len(children))
+
+	var failures []failedTestCase
+	failedChildren, kind := 0, ""
+	for _, child := range children {
+		childLogger := logger.With().Str(LogKeyChildProwJobURL, child).Logger()
+		childScanner, _, err := h.scanProwJob(ctx, childLogger, child, rc)
+		if err != nil {
+			childLogger.Error().Err(err).Msg("Failed to scan the artifacts of the child run")
+			continue
+		}
+		childReport, _, err := h.extractFailures(ctx, childLogger, childScanner, true, rc)
+		if err != nil {
+			childLogger.Error().Err(err).Msg("Failed to extract the failures of the child run")
+			continue
+		}
+		if len(childReport.failedTestCases) == 0 {
+			continue
+		}
+
+		failedChildren++
+		if kind == "" {
+			kind = childReport.failureKind
+		}
+		for _, tc := range childReport.failedTestCases {
+			tc.childJobURL = child
+			failures = append(failures, tc)
+		}
+	}
+	if len(failures) == 0 {
+		return
+	}
+
+	failedTCReport.headerString = fmt.Sprintf(":rotating_light: **%d of the %d child run(s) of this aggregated job failed**, list of their failures: \n", failedChildren, len(children))
+	failedTCReport.failedTestCases = failures
+	failedTCReport.failureKind = kind
+}
+
+// childJobSection returns the heading of the failures of the child run
+func childJobSection(key, childJobURL string) reportSection {
+	return reportSection{key: key, content: fmt.Sprintf("\n:arrow_down: **Child run [%s](%s)**\n", jobNameFromProwJobURL(childJobURL), childJobURL)}
+}
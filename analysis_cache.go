@@ -0,0 +1,108 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	defaultAnalysisCacheCapacity = 1000
+)
+
+// analysis is the latest report the app
+// put into a comment of a pull request
+type analysis struct {
+	commentID   int64
+	commentBody string
+	prowJobURL  string
+	report      *FailedTestCasesReport
+	// how the report was posted, empty if it wasn't
+	reportedBy string
+}
+
+// analysisCache keeps the latest analysis and the report preferences of up
+// to 'capacity' PRs, those least recently added to the cache being evicted
+type analysisCache struct {
+	mu       sync.Mutex
+	capacity int
+	// the PRs having an analysis or a report format, in the order they were added
+	keys          []string
+	analyses      map[string]*analysis
+	reportFormats map[string]string
+}
+
+func newAnalysisCache(capacity int) *analysisCache {
+	return &analysisCache{
+		capacity:      capacity,
+		analyses:      map[string]*analysis{},
+		reportFormats: map[string]string{},
+	}
+}
+
+func prKey(repoFullName string, prNumber int) string {
+	return fmt.Sprintf("%s#%d", repoFullName, prNumber)
+}
+
+func (c *analysisCache) add(repoFullName string, prNumber int, a *analysis) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := prKey(repoFullName, prNumber)
+	c.track(key)
+	c.analyses[key] = a
+}
+
+// track adds the PR to the cache's keys, unless it's already cached, and
+// evicts the oldest PR beyond the capacity. It's called with the lock held
+func (c *analysisCache) track(key string) {
+	_, analysed := c.analyses[key]
+	_, formatted := c.reportFormats[key]
+	if analysed || formatted {
+		return
+	}
+	c.keys = append(c.keys, key)
+
+	if len(c.keys) > c.capacity {
+		evicted := c.keys[0]
+		c.keys = c.keys[1:]
+		delete(c.analyses, evicted)
+		delete(c.reportFormats, evicted)
+	}
+}
+
+func (c *analysisCache) get(repoFullName string, prNumber int) *analysis {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.analyses[prKey(repoFullName, prNumber)]
+}
+
+func (c *analysisCache) setReportFormat(repoFullName string, prNumber int, format string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := prKey(repoFullName, prNumber)
+	c.track(key)
+	c.reportFormats[key] = format
+}
+
+func (c *analysisCache) reportFormat(repoFullName string, prNumber int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reportFormats[prKey(repoFullName, prNumber)]
+}
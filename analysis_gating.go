@@ -0,0 +1,302 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	analysisGatingOff              = "off"
+	analysisGatingRequiredContexts = "required_contexts"
+
+	// the held analyses run after this long whatever their contexts, e.g. when
+	// a required context is never reported for the commit
+	maxAnalysisGateWait    = 4 * time.Hour
+	analysisGatesInterval  = 5 * time.Minute
+	maxGatedContextsListed = 5
+)
+
+// gateReleasedKey marks the context of the analyses released after
+// maxAnalysisGateWait, which aren't held again
+type gateReleasedKey struct{}
+
+// gatedAnalysis is the analysis of a failed job held until the required
+// contexts of its PR's head commit complete
+type gatedAnalysis struct {
+	deliveryID string
+	payload    []byte
+	since      time.Time
+}
+
+// analysisGates holds the analyses of the failed jobs until all the required
+// contexts (commit statuses and check runs) of their PR's head commit
+// completed, so that a report doesn't tell about one failed job while the
+// jobs still running may change the picture. A nil analysisGates holds nothing
+type analysisGates struct {
+	mu sync.Mutex
+	// keyed by "<repo>@<sha>", then by the analysis' burstKey
+	held map[string]map[string]*gatedAnalysis
+}
+
+func newAnalysisGates() *analysisGates {
+	return &analysisGates{held: map[string]map[string]*gatedAnalysis{}}
+}
+
+func gatedCommitKey(repoFullName, sha string) string {
+	return repoFullName + "@" + sha
+}
+
+// hold returns whether the analysis of the job must wait for the required
+// contexts of the PR's head commit, in which case it's held and the job's
+// comment gets a short note telling so. The analysis isn't held when the
+// contexts can't be told
+func (h *PRCommentHandler) hold(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, deliveryID string, payload []byte, key string, rc RepositoryConfig) bool {
+	g := h.Gates
+	if g == nil || rc.AnalysisGating != analysisGatingRequiredContexts {
+		return false
+	}
+	if ctx.Value(gateReleasedKey{}) != nil {
+		logger.Info().Msgf("The analysis waited for the required contexts for %s already, analysing the job anyway", maxAnalysisGateWait)
+		return false
+	}
+
+	repoOwner, repoName := event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName()
+	pr, _, err := client.PullRequests.Get(ctx, repoOwner, repoName, event.GetIssue().GetNumber())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to fetch the PR's head commit, analysing the job without waiting for its required contexts")
+		return false
+	}
+	commitKey := gatedCommitKey(event.GetRepo().GetFullName(), pr.GetHead().GetSHA())
+	pending, err := pendingRequiredContexts(ctx, client, repoOwner, repoName, pr.GetHead().GetSHA(), pr.GetBase().GetRef(), rc.RequiredContexts)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the required contexts, analysing the job without waiting for them")
+		g.forget(commitKey, key)
+		return false
+	}
+	if len(pending) == 0 {
+		g.forget(commitKey, key)
+		return false
+	}
+
+	g.mu.Lock()
+	if g.held[commitKey] == nil {
+		g.held[commitKey] = map[string]*gatedAnalysis{}
+	}
+	since := time.Now()
+	if previous, ok := g.held[commitKey][key]; ok {
+		since = previous.since
+	}
+	g.held[commitKey][key] = &gatedAnalysis{deliveryID: deliveryID, payload: payload, since: since}
+	g.mu.Unlock()
+	logger.Info().Msgf("Holding the analysis until the required contexts %s complete", strings.Join(pending, ", "))
+
+	if h.Outage.isReadOnly() {
+		return true
+	}
+	note := reportSection{key: "header", content: gatedAnalysisNote(pending)}
+	if err := editReport(ctx, logger, client, h.CommentLint, h.CommentEdits, repoOwner, repoName, event.GetComment().GetID(), event.GetComment().GetBody(), h.reportIdentity(event.GetRepo().GetFullName()), []reportSection{note}); err != nil {
+		logger.Error().Err(err).Msg("Failed to note the analysis waits for the required contexts")
+	}
+	return true
+}
+
+// gatedAnalysisNote tells the job's failures will be analysed once the pending contexts complete
+func gatedAnalysisNote(pending []string) string {
+	listed := make([]string, 0, maxGatedContextsListed)
+	for i, context := range pending {
+		if i == maxGatedContextsListed {
+			listed = append(listed, fmt.Sprintf("and %d more", len(pending)-i))
+			break
+		}
+		listed = append(listed, inlineCode(context))
+	}
+	return fmt.Sprintf(":hourglass_flowing_sand: **%d required check(s) of this commit are still running** (%s). "+
+		"The failures of this job will be analysed once they complete, as their results may change the picture.\n", len(pending), strings.Join(listed, ", "))
+}
+
+// pendingRequiredContexts returns the required contexts of the commit which
+// didn't complete yet, those which weren't reported yet included. The required
+// contexts are the configured ones, defaulting to those the protection of the
+// PR's base branch requires
+func pendingRequiredContexts(ctx context.Context, client *github.Client, owner, repo, sha, base string, configured []string) ([]string, error) {
+	required := configured
+	if len(required) == 0 {
+		checks, resp, err := client.Repositories.GetRequiredStatusChecks(ctx, owner, repo, base)
+		if err != nil {
+			// the base branch isn't protected, or doesn't require any check
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "failed to get the required status checks of %s", base)
+		}
+		for _, check := range checks.Checks {
+			required = append(required, check.Context)
+		}
+		if len(checks.Checks) == 0 {
+			required = checks.Contexts
+		}
+	}
+	if len(required) == 0 {
+		return nil, nil
+	}
+
+	completed := map[string]bool{}
+	statuses, _, err := client.Repositories.GetCombinedStatus(ctx, owner, repo, sha, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the statuses of the commit")
+	}
+	for _, status := range statuses.Statuses {
+		completed[status.GetContext()] = status.GetState() != "pending"
+	}
+	checkRuns, _, err := client.Checks.ListCheckRunsForRef(ctx, owner, repo, sha, &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the check runs of the commit")
+	}
+	for _, checkRun := range checkRuns.CheckRuns {
+		completed[checkRun.GetName()] = checkRun.GetStatus() == "completed"
+	}
+
+	var pending []string
+	for _, context := range required {
+		if !completed[context] {
+			pending = append(pending, context)
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// heldFor returns the analyses held for the commit. They stay held until
+// their contexts are found completed, or they expire
+func (g *analysisGates) heldFor(commitKey string) []*gatedAnalysis {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var analyses []*gatedAnalysis
+	for _, analysis := range g.held[commitKey] {
+		analyses = append(analyses, analysis)
+	}
+	return analyses
+}
+
+// forget stops holding the analysis
+func (g *analysisGates) forget(commitKey, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if held, ok := g.held[commitKey]; ok {
+		delete(held, key)
+		if len(held) == 0 {
+			delete(g.held, commitKey)
+		}
+	}
+}
+
+// expired returns the analyses held for longer than maxAnalysisGateWait, forgetting them
+func (g *analysisGates) expired() []*gatedAnalysis {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var analyses []*gatedAnalysis
+	for commitKey, held := range g.held {
+		for key, analysis := range held {
+			if time.Since(analysis.since) < maxAnalysisGateWait {
+				continue
+			}
+			analyses = append(analyses, analysis)
+			delete(held, key)
+		}
+		if len(held) == 0 {
+			delete(g.held, commitKey)
+		}
+	}
+	return analyses
+}
+
+// AnalysisGatesHandler resumes the held analyses once a check run of their
+// commit completes, their contexts being checked again. The StatusHandler
+// resumes them on the commit statuses
+type AnalysisGatesHandler struct {
+	Handler *PRCommentHandler
+	Logger  zerolog.Logger
+}
+
+func (h *AnalysisGatesHandler) Handles() []string {
+	return []string{"check_run"}
+}
+
+func (h *AnalysisGatesHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	var event github.CheckRunEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return errors.Wrap(err, "failed to parse check run event payload")
+	}
+	if event.GetAction() == "completed" {
+		h.contextCompleted(ctx, event.GetRepo().GetFullName(), event.GetCheckRun().GetHeadSHA())
+	}
+	return nil
+}
+
+// contextCompleted resumes the analyses held for the commit, those whose
+// contexts are still pending staying held
+func (h *AnalysisGatesHandler) contextCompleted(ctx context.Context, repoFullName, sha string) {
+	if h == nil {
+		return
+	}
+	for _, analysis := range h.Handler.Gates.heldFor(gatedCommitKey(repoFullName, sha)) {
+		h.resume(ctx, analysis)
+	}
+}
+
+// run resumes the analyses held for too long every interval, until the context is done
+func (h *AnalysisGatesHandler) run(ctx context.Context) {
+	ticker := time.NewTicker(analysisGatesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, analysis := range h.Handler.Gates.expired() {
+				h.resume(context.WithValue(ctx, gateReleasedKey{}, true), analysis)
+			}
+		}
+	}
+}
+
+// resume handles the job's comment again, as if it was just created
+func (h *AnalysisGatesHandler) resume(ctx context.Context, analysis *gatedAnalysis) {
+	if err := h.Handler.Handle(ctx, "issue_comment", analysis.deliveryID, analysis.payload); err != nil {
+		h.Logger.Error().Err(err).Msgf("Failed to resume the held analysis of the delivery %s", analysis.deliveryID)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/onsi/ginkgo/v2/reporters"
+	"github.com/rs/zerolog"
+)
+
+const (
+	AnalysisJUnitRoute      string = "/admin/analyses/junit"
+	analysisJUnitSuiteName         = "ci-helper-analysis"
+	analysisJUnitObjectName        = "junit_ci-helper.xml"
+	// the analysis in the API's schema, stored next to its junit file
+	analysisJSONObjectName = "ci-helper-analysis.json"
+)
+
+// analysisJUnit renders the analysis as a junit file, with a test case per
+// failure found by the analysis and classified by its kind, so that the
+// reporting systems which only understand junit can ingest the classifications
+func analysisJUnit(repoFullName string, prNumber int, prowJobURL string, report *FailedTestCasesReport) ([]byte, error) {
+	suite := reporters.JUnitTestSuite{
+		Name:      analysisJUnitSuiteName,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Properties: reporters.JUnitProperties{Properties: []reporters.JUnitProperty{
+			{Name: "repository", Value: repoFullName},
+			{Name: "pull_request", Value: strconv.Itoa(prNumber)},
+			{Name: "prow_job_url", Value: prowJobURL},
+			{Name: "failure_kind", Value: report.failureKind},
+			{Name: "reported_by", Value: report.reportedBy},
+			{Name: "schema_version", Value: strconv.Itoa(client.AnalysisSchemaVersion)},
+		}},
+	}
+
+	header := plainText(markdownEmphasisRegex.ReplaceAllString(report.headerString, ""))
+	for _, tc := range report.failedTestCases {
+		name := tc.name
+		if name == "" {
+			// e.g. the dump of the build log, whose cause is the header's
+			name = header
+		}
+		message := tc.message
+		if message == "" {
+			message = header
+		}
+		suite.TestCases = append(suite.TestCases, reporters.JUnitTestCase{
+			Name:      name,
+			Classname: report.failureKind,
+			Status:    "failed",
+			Failure: &reporters.JUnitFailure{
+				Message:     message,
+				Type:        report.failureKind,
+				Description: plainText(tc.details),
+			},
+		})
+	}
+	suite.Tests = len(suite.TestCases)
+	suite.Failures = len(suite.TestCases)
+
+	suites := reporters.JUnitTestSuites{Tests: suite.Tests, Failures: suite.Failures, TestSuites: []reporters.JUnitTestSuite{suite}}
+	content, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), content...), nil
+}
+
+// analysisJUnitUploader uploads the junit file of each analysis
+// to GCS, next to where the analysed job's artifacts would be
+type analysisJUnitUploader struct {
+	client *storage.Client
+	bucket string
+	prefix string
+	// counts the failed uploads among the subsystems' errors
+	telemetry *telemetry
+}
+
+func newAnalysisJUnitUploader(ctx context.Context, cfg AnalysisJUnitConfig) (*analysisJUnitUploader, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %+v", err)
+	}
+	return &analysisJUnitUploader{client: client, bucket: cfg.GCSBucket, prefix: strings.Trim(cfg.Prefix, "/")}, nil
+}
+
+// objectName returns e.g. "<prefix>/<job>/<build ID>/<name>"
+func (u *analysisJUnitUploader) objectName(prowJobURL, name string) (string, error) {
+	loc, err := parseProwJobURL(prowJobURL)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(u.prefix, loc.job, loc.buildID, name), nil
+}
+
+// upload uploads the junit file of the analysis, and the analysis in the
+// API's schema (see client.DecodeAnalysis). A nil uploader uploads nothing
+func (u *analysisJUnitUploader) upload(ctx context.Context, logger zerolog.Logger, repoFullName string, prNumber int, prowJobURL string, report *FailedTestCasesReport) {
+	if u == nil {
+		return
+	}
+
+	content, err := analysisJUnit(repoFullName, prNumber, prowJobURL, report)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to render the analysis' junit file")
+		return
+	}
+	u.write(ctx, logger, prowJobURL, analysisJUnitObjectName, "application/xml", content)
+
+	content, err = json.MarshalIndent(newAPIAnalysis(repoFullName, prNumber, prowJobURL, report), "", "  ")
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to render the analysis' JSON")
+		return
+	}
+	u.write(ctx, logger, prowJobURL, analysisJSONObjectName, "application/json", content)
+}
+
+func (u *analysisJUnitUploader) write(ctx context.Context, logger zerolog.Logger, prowJobURL, name, contentType string, content []byte) {
+	object, err := u.objectName(prowJobURL, name)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to name the analysis' %s", name)
+		return
+	}
+
+	writer := u.client.Bucket(u.bucket).Object(object).NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		logger.Error().Err(err).Msgf("Failed to upload the analysis' %s to gs://%s/%s", name, u.bucket, object)
+		u.telemetry.countError("analysis_junit")
+		return
+	}
+	if err := writer.Close(); err != nil {
+		logger.Error().Err(err).Msgf("Failed to finalize the analysis' %s gs://%s/%s", name, u.bucket, object)
+		u.telemetry.countError("analysis_junit")
+		return
+	}
+	logger.Debug().Msgf("Uploaded the analysis' %s to gs://%s/%s", name, u.bucket, object)
+}
+
+// AnalysisJUnitHandler serves the latest analysis of a PR as a junit file
+type AnalysisJUnitHandler struct {
+	Analyses *analysisCache
+}
+
+func (h *AnalysisJUnitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prNumber, err := strconv.Atoi(query.Get("pr"))
+	if err != nil || query.Get("repo") == "" {
+		http.Error(w, "the 'repo' and 'pr' query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	a := h.Analyses.get(query.Get("repo"), prNumber)
+	if a == nil {
+		http.Error(w, "no recent analysis of the PR", http.StatusNotFound)
+		return
+	}
+
+	content, err := analysisJUnit(query.Get("repo"), prNumber, a.prowJobURL, a.report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(content)
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
+)
+
+// runAnalyzeCLI builds the report of a Prow job as the app does, and writes
+// its markdown to stdout or to a file, e.g.
+//
+//	ci-helper-app analyze --url https://prow.ci.openshift.org/view/gs/test-platform-results/logs/<job>/<build ID>
+//
+// It needs no GitHub App installation: the enrichments calling GitHub are skipped,
+// and the repository's settings are only read from the configuration file, if given
+func runAnalyzeCLI(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(analyzeCommand, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	prowJobURL := flags.String("url", "", "Spyglass URL of the Prow job")
+	output := flags.String("output", "", "file the report is written to, instead of stdout")
+	format := flags.String("format", reportFormatFull, "format of the report: "+reportFormatFull+" or "+reportFormatCompact)
+	repoFullName := flags.String("repo", "", "repository whose settings apply (<org>/<repo>), defaulting to the PR's one for the presubmit jobs")
+	configFile := flags.String("config", "", "configuration file of the app, e.g. "+configPath+"; the defaults apply when empty")
+	verbose := flags.Bool("verbose", false, "log the analysis to stderr")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *prowJobURL == "" {
+		flags.Usage()
+		return fmt.Errorf("the --url of the Prow job is required")
+	}
+	if *format != reportFormatFull && *format != reportFormatCompact {
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+
+	url := strings.TrimSuffix(strings.TrimSpace(*prowJobURL), "/")
+	loc, err := parseProwJobURL(url)
+	if err != nil {
+		return err
+	}
+	if *repoFullName == "" && loc.orgRepo != "" {
+		// e.g. konflux-ci_e2e-tests, the org names can't contain underscores
+		*repoFullName = strings.Replace(loc.orgRepo, "_", "/", 1)
+	}
+
+	config := &Config{}
+	if *configFile != "" {
+		if config, err = ReadConfig(*configFile); err != nil {
+			return err
+		}
+	}
+
+	logger := zerolog.Nop()
+	if *verbose {
+		logger = zerolog.New(zerolog.ConsoleWriter{Out: stderr}).With().Timestamp().Logger()
+	}
+	ctx = logger.WithContext(ctx)
+
+	h, err := newAnalyzeCLIHandler(ctx, config, logger)
+	if err != nil {
+		return err
+	}
+
+	owner, name, _ := strings.Cut(*repoFullName, "/")
+	event := github.IssueCommentEvent{
+		Repo:  &github.Repository{FullName: repoFullName, Name: &name, Owner: &github.User{Login: &owner}},
+		Issue: &github.Issue{Number: github.Int(loc.prNumber)},
+	}
+	rc := h.repositoryConfig(*repoFullName)
+	failedTCReport, _, _, err := h.buildReport(ctx, logger, nil, event, url, false, rc)
+	if err != nil {
+		return err
+	}
+	failedTCReport.nextStep = nextStep(failedTCReport, rc.NextSteps)
+	failedTCReport.identity = h.reportIdentity(*repoFullName)
+
+	var report strings.Builder
+	for _, s := range failedTCReport.sections(*format) {
+		report.WriteString(s.content)
+	}
+	if *output == "" {
+		_, err = io.WriteString(stdout, report.String())
+		return err
+	}
+	return errors.Wrapf(os.WriteFile(*output, []byte(report.String()), 0o644), "failed to write the report to %s", *output)
+}
+
+// newAnalyzeCLIHandler creates the handler building the reports of the
+// analyze subcommand, with the configured sources of the artifacts and
+// knowledge bases, and without any GitHub client
+func newAnalyzeCLIHandler(ctx context.Context, config *Config, logger zerolog.Logger) (*PRCommentHandler, error) {
+	h := &PRCommentHandler{
+		Config:      config,
+		Classifiers: newClassifiers(),
+	}
+
+	gcsClient, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	if err != nil {
+		return nil, err
+	}
+	h.GCS = gcsClient
+	if h.ArtifactSizes, err = newArtifactSizePolicies(config.ArtifactSizes); err != nil {
+		return nil, err
+	}
+	if h.Artifacts, err = newArtifactSource(ctx, config.ArtifactSource, gcsClient, h.ArtifactSizes); err != nil {
+		return nil, err
+	}
+	if len(config.PrivateSpyglass) > 0 {
+		if h.PrivateSpyglass, err = newPrivateSpyglass(ctx, config.PrivateSpyglass, config.FaultInjection); err != nil {
+			return nil, err
+		}
+	}
+	if h.Mentions, err = loadMentionOptOuts(ctx, config.Mentions.OptOutFile, nil); err != nil {
+		return nil, err
+	}
+	if config.Remediation.KBFile != "" {
+		if h.Remediations, err = loadRemediationKB(config.Remediation.KBFile, logger); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
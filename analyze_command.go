@@ -0,0 +1,99 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/rs/zerolog"
+)
+
+const (
+	analyzeCommand = "analyze"
+)
+
+// handleCIHelperAnalyze analyses the given Prow job on request of a member of
+// the repository's org, as if openshift-ci reported its failure: the report is
+// merged into a comment the app posts, e.g. for the jobs whose failure comment
+// was edited away. Only the PR's own presubmits are analysed, so that the
+// failures of another repository's jobs (e.g. a private one's) never get
+// posted on the PR
+func (h *PRCommentHandler) handleCIHelperAnalyze(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, deliveryID string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s %s <Prow job URL>", ciHelperCommand, analyzeCommand)
+	}
+
+	login := event.GetComment().GetUser().GetLogin()
+	member, err := isOrgMember(ctx, client, event)
+	if err != nil {
+		return fmt.Errorf("failed to check whether %s is a member of %s: %+v", login, event.GetRepo().GetOwner().GetLogin(), err)
+	}
+	if !member {
+		logger.Info().Msgf("Ignoring the analysis requested by %s, who isn't a member of the org", login)
+		return nil
+	}
+
+	// tolerate the URLs pasted as autolinks, e.g. <https://...>
+	prowJobURL := strings.TrimSuffix(strings.Trim(args[0], "<>"), "/")
+	loc, err := parseProwJobURL(prowJobURL)
+	if err != nil {
+		return err
+	}
+	// e.g. konflux-ci_e2e-tests for konflux-ci/e2e-tests
+	orgRepo := strings.Replace(event.GetRepo().GetFullName(), "/", "_", 1)
+	if loc.jobType != prowJobTypePresubmit || !strings.EqualFold(loc.orgRepo, orgRepo) || loc.prNumber != event.GetIssue().GetNumber() {
+		return fmt.Errorf("%s isn't a presubmit job of this PR, only those are analysed", prowJobURL)
+	}
+	logger = attachProwURLLogKeysToLogger(ctx, logger, prowJobURL)
+
+	repoOwner, repoName := event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName()
+	body := fmt.Sprintf(":mag: Analysing the Prow job [%s](%s) as requested by %s.\n", loc.job, prowJobURL, h.Mentions.mention(login))
+	comment, _, err := client.Issues.CreateComment(ctx, repoOwner, repoName, event.GetIssue().GetNumber(), &github.IssueComment{Body: &body})
+	if err != nil {
+		return fmt.Errorf("failed to post the comment of the requested analysis: %+v", err)
+	}
+
+	// the report gets merged into the app's comment, as for the watched jobs
+	analysisEvent := event
+	analysisEvent.Comment = &github.IssueComment{ID: comment.ID, Body: &body}
+	key := burstKey(event.GetRepo().GetFullName(), event.GetIssue().GetNumber(), prowJobURL)
+	return h.Queue.enqueue(ctx, logger, key, func(ctx context.Context) error {
+		return h.Locks.run(ctx, logger, event.GetRepo().GetFullName(), event.GetIssue().GetNumber(), func(ctx context.Context) error {
+			return h.analyzeContained(ctx, logger, client, analysisEvent, deliveryID, prowJobURL, func(ctx context.Context) error {
+				return h.analyze(ctx, logger, client, analysisEvent, body, prowJobURL, false, "")
+			})
+		})
+	})
+}
+
+// isOrgMember returns whether the commenter is the repository's owner or a
+// member of its org, the private memberships needing the app's members permission
+func isOrgMember(ctx context.Context, client *github.Client, event github.IssueCommentEvent) (bool, error) {
+	login := event.GetComment().GetUser().GetLogin()
+	owner := event.GetRepo().GetOwner().GetLogin()
+	if strings.EqualFold(login, owner) {
+		return true, nil
+	}
+	switch event.GetComment().GetAuthorAssociation() {
+	case "OWNER", "MEMBER":
+		return true, nil
+	}
+
+	member, _, err := client.Organizations.IsMember(ctx, owner, login)
+	return member, err
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFlakesWindow          = 7 * 24 * time.Hour
+	defaultFlakesMinPullRequests = 2
+)
+
+// the API's resources are those of the Go client, in pkg/client
+const (
+	AnalysesAPIRoute = client.AnalysesPath
+	FlakesAPIRoute   = client.FlakesPath
+)
+
+// commentCreatedPayload returns the payload of the event creating the comment,
+// replayed to the PRCommentHandler to analyse the comment outside of a webhook
+func commentCreatedPayload(installationID int64, owner, repo string, issue *github.Issue, comment *github.IssueComment) ([]byte, error) {
+	event := github.IssueCommentEvent{
+		Action:       github.String("created"),
+		Issue:        issue,
+		Comment:      comment,
+		Repo:         &github.Repository{Name: github.String(repo), FullName: github.String(owner + "/" + repo), Owner: &github.User{Login: github.String(owner)}},
+		Installation: &github.Installation{ID: github.Int64(installationID)},
+	}
+	return json.Marshal(event)
+}
+
+// AnalysesAPIHandler returns the latest analysis of a PR, and triggers
+// the analysis of a PR's failure comment with a POST request
+type AnalysesAPIHandler struct {
+	ClientCreator githubapp.ClientCreator
+	Handler       *PRCommentHandler
+	Logger        zerolog.Logger
+}
+
+func (h *AnalysesAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getAnalysis(w, r)
+	case http.MethodPost:
+		h.triggerAnalysis(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *AnalysesAPIHandler) getAnalysis(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prNumber, err := strconv.Atoi(query.Get("pull_request"))
+	if err != nil || query.Get("repository") == "" {
+		http.Error(w, "the 'repository' and 'pull_request' query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	a := h.Handler.Analyses.get(query.Get("repository"), prNumber)
+	if a == nil {
+		http.Error(w, "no recent analysis of the PR", http.StatusNotFound)
+		return
+	}
+
+	analysis := newAPIAnalysis(query.Get("repository"), prNumber, a.prowJobURL, a.report)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(analysis); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to encode the analysis")
+	}
+}
+
+// newAPIAnalysis returns the analysis in the current version of the API's schema
+func newAPIAnalysis(repoFullName string, prNumber int, prowJobURL string, report *FailedTestCasesReport) client.Analysis {
+	page := newReportPage("", repoFullName, prNumber, prowJobURL, report)
+	analysis := client.Analysis{
+		Repository:    page.Repository,
+		PullRequest:   page.PullRequest,
+		ProwJobURL:    page.ProwJobURL,
+		CreatedAt:     page.CreatedAt,
+		Header:        page.Header,
+		FailureKind:   report.failureKind,
+		NextStep:      page.NextStep,
+		SchemaVersion: client.AnalysisSchemaVersion,
+	}
+	for _, tc := range report.failedTestCases {
+		analysis.Failures = append(analysis.Failures, client.Failure{
+			Suite:       tc.suiteName,
+			Name:        tc.name,
+			Status:      tc.status,
+			Message:     tc.message,
+			Fingerprint: failureFingerprint(tc.suiteName, tc.name),
+		})
+	}
+	for _, link := range page.Links {
+		analysis.Links = append(analysis.Links, client.Link{Name: link.Name, URL: link.URL})
+	}
+	return analysis
+}
+
+// triggerAnalysis replays the creation of the failure comment to the
+// handler, the analysis being queued when the queue is enabled
+func (h *AnalysesAPIHandler) triggerAnalysis(w http.ResponseWriter, r *http.Request) {
+	var req client.TriggerAnalysisRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	owner, repo, ok := strings.Cut(req.Repository, "/")
+	if !ok || req.PullRequest <= 0 || req.CommentID <= 0 {
+		http.Error(w, "the 'repository' (org/repo), 'pull_request' and 'comment_id' fields are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	appClient, err := h.ClientCreator.NewAppClient()
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to create the app's client")
+		http.Error(w, "failed to create the app's client", http.StatusInternalServerError)
+		return
+	}
+	installation, _, err := appClient.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("the app isn't installed on %s", req.Repository), http.StatusNotFound)
+		return
+	}
+	installationClient, err := h.ClientCreator.NewInstallationClient(installation.GetID())
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to create the installation's client")
+		http.Error(w, "failed to create the installation's client", http.StatusInternalServerError)
+		return
+	}
+
+	issue, _, err := installationClient.Issues.Get(ctx, owner, repo, req.PullRequest)
+	if err != nil || !issue.IsPullRequest() {
+		http.Error(w, fmt.Sprintf("no such PR: %s#%d", req.Repository, req.PullRequest), http.StatusNotFound)
+		return
+	}
+	comment, _, err := installationClient.Issues.GetComment(ctx, owner, repo, req.CommentID)
+	if err != nil || !strings.HasSuffix(comment.GetIssueURL(), fmt.Sprintf("/issues/%d", req.PullRequest)) {
+		http.Error(w, fmt.Sprintf("no such comment on %s#%d: %d", req.Repository, req.PullRequest, req.CommentID), http.StatusNotFound)
+		return
+	}
+
+	payload, err := commentCreatedPayload(installation.GetID(), owner, repo, issue, comment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the analysis goes through the queue like the webhook's, or runs within the
+	// request without one; either way it outlives the client's disconnection
+	err = h.Handler.Handle(detachedContext{ctx}, "issue_comment", fmt.Sprintf("api-%d", req.CommentID), payload)
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		h.Logger.Error().Err(err).Msgf("Failed to analyse the comment %s", comment.GetHTMLURL())
+		http.Error(w, "failed to analyse the comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// FlakesAPIHandler returns the test cases failing on several PRs within a time range
+type FlakesAPIHandler struct {
+	Store  FailureStore
+	Logger zerolog.Logger
+}
+
+func (h *FlakesAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := parseTimeRange(r, defaultFlakesWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minPRs := defaultFlakesMinPullRequests
+	if v := r.URL.Query().Get("min_pull_requests"); v != "" {
+		if minPRs, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "the 'min_pull_requests' query parameter must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := h.Store.ListFailures(r.Context(), from, to)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to list the failures")
+		http.Error(w, "failed to list the failures", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(flakes(records, r.URL.Query().Get("repository"), minPRs)); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to encode the flakes")
+	}
+}
+
+// flakes returns the test cases of the records which failed on at least
+// 'minPRs' PRs, optionally of a single repository, the most widespread first
+func flakes(records []FailureRecord, repository string, minPRs int) []client.Flake {
+	type flake struct {
+		client.Flake
+		prs   map[string]bool
+		repos map[string]bool
+	}
+
+	byTest := map[string]*flake{}
+	for _, r := range records {
+		if r.TestCase == "" || r.SuiteName == analysisPanicSuiteName || (repository != "" && r.Repository != repository) {
+			continue
+		}
+		// the same test case, regardless of the Ginkgo version which reported it
+		key := failureFingerprint(r.SuiteName, r.TestCase)
+		f, ok := byTest[key]
+		if !ok {
+			f = &flake{Flake: client.Flake{Suite: r.SuiteName, Name: r.TestCase}, prs: map[string]bool{}, repos: map[string]bool{}}
+			byTest[key] = f
+		}
+		f.Failures++
+		f.prs[prKey(r.Repository, r.PullRequest)] = true
+		f.repos[r.Repository] = true
+		if r.Timestamp.After(f.LastFailure) {
+			f.LastFailure = r.Timestamp
+		}
+	}
+
+	result := []client.Flake{}
+	for _, f := range byTest {
+		if len(f.prs) < minPRs {
+			continue
+		}
+		f.PullRequests = len(f.prs)
+		for repo := range f.repos {
+			f.Repositories = append(f.Repositories, repo)
+		}
+		sort.Strings(f.Repositories)
+		result = append(result, f.Flake)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].PullRequests != result[j].PullRequests {
+			return result[i].PullRequests > result[j].PullRequests
+		}
+		if result[i].Failures != result[j].Failures {
+			return result[i].Failures > result[j].Failures
+		}
+		return result[i].Suite+result[i].Name < result[j].Suite+result[j].Name
+	})
+
+	return result
+}
@@ -0,0 +1,436 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ArchiveRoute       string = "/admin/archive"
+	archiveMonthLayout        = "2006-01"
+	archiveTopFlakes          = 20
+	// how often the archive checks whether the previous month was published
+	archiveInterval           = 6 * time.Hour
+	defaultArchivePrefix      = "ci-health"
+	defaultArchivePagesDir    = "ci-health"
+	defaultArchivePagesBranch = "gh-pages"
+)
+
+var archiveHTMLTemplate = template.Must(template.New("archive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CI health: {{.Month}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #dddddd; padding: 0.3em 0.6em; text-align: left; }
+td.number { text-align: right; }
+</style>
+</head>
+<body>
+<h1>CI health: {{.Month}}</h1>
+<p>{{.FailedJobs}} failed Prow job(s) analysed on {{.PullRequests}} PR(s) of {{len .Repositories}} repositories, {{.InfraJobs}} of them failed because of the infrastructure.</p>
+
+<h2>Repositories</h2>
+<table>
+<tr><th>Repository</th><th>Failed jobs</th><th>Infrastructure failures</th><th>Failed test cases</th></tr>
+{{range .Repositories}}<tr><td>{{.Name}}</td><td class="number">{{.FailedJobs}}</td><td class="number">{{.InfraJobs}}</td><td class="number">{{.Failures}}</td></tr>
+{{end}}</table>
+
+{{with .PassRates}}<h2>Main branch pass rates</h2>
+<table>
+<tr><th>Job</th><th>Runs</th><th>Passed</th><th>Pass rate</th></tr>
+{{range .}}<tr><td>{{.Job}}</td><td class="number">{{.Runs}}</td><td class="number">{{.Passed}}</td><td class="number">{{printf "%.0f" .Percent}}%</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Top flakes</h2>
+{{if .Flakes}}<table>
+<tr><th>Suite</th><th>Test case</th><th>PRs</th><th>Failures</th><th>Repositories</th></tr>
+{{range .Flakes}}<tr><td>{{.Suite}}</td><td>{{.Name}}</td><td class="number">{{.PullRequests}}</td><td class="number">{{.Failures}}</td><td>{{range $i, $r := .Repositories}}{{if $i}}, {{end}}{{$r}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No test case failed on several PRs.</p>
+{{end}}
+<h2>Infrastructure incidents</h2>
+{{if .Incidents}}<table>
+<tr><th>Day</th><th>Kind</th><th>Failed jobs</th><th>Repositories</th></tr>
+{{range .Incidents}}<tr><td>{{.Day}}</td><td>{{.Kind}}</td><td class="number">{{.Jobs}}</td><td>{{range $i, $r := .Repositories}}{{if $i}}, {{end}}{{$r}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No job failed because of the infrastructure.</p>
+{{end}}
+<p><small>Generated by ci-helper-app on {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}</small></p>
+</body>
+</html>
+`))
+
+// monthlyReport is the aggregate CI health of a month, published as a static page
+type monthlyReport struct {
+	Month        string
+	GeneratedAt  time.Time
+	FailedJobs   int
+	InfraJobs    int
+	PullRequests int
+	Repositories []repositoryHealth
+	PassRates    []jobPassRate
+	Flakes       []client.Flake
+	Incidents    []infraIncident
+}
+
+type repositoryHealth struct {
+	Name       string
+	FailedJobs int
+	InfraJobs  int
+	Failures   int
+}
+
+type jobPassRate struct {
+	Job     string
+	Runs    int
+	Passed  int
+	Percent float64
+}
+
+// infraIncident groups the jobs failed because of the infrastructure on the same day with the same kind
+type infraIncident struct {
+	Day          string
+	Kind         string
+	Jobs         int
+	Repositories []string
+}
+
+// buildMonthlyReport aggregates the failures recorded within the month
+func buildMonthlyReport(month string, records []FailureRecord, passRates []jobPassRate) *monthlyReport {
+	report := &monthlyReport{Month: month, GeneratedAt: time.Now().UTC(), PassRates: passRates}
+
+	jobs := map[string]FailureRecord{}
+	prs := map[string]bool{}
+	repos := map[string]*repositoryHealth{}
+	for _, r := range records {
+		if r.SuiteName == analysisPanicSuiteName {
+			continue
+		}
+		repo, ok := repos[r.Repository]
+		if !ok {
+			repo = &repositoryHealth{Name: r.Repository}
+			repos[r.Repository] = repo
+		}
+		repo.Failures++
+		prs[prKey(r.Repository, r.PullRequest)] = true
+		if _, ok := jobs[r.ProwJobURL]; !ok {
+			jobs[r.ProwJobURL] = r
+			repo.FailedJobs++
+			if containsFold(infraFailureKinds, r.FailureKind) {
+				repo.InfraJobs++
+				report.InfraJobs++
+			}
+		}
+	}
+	report.FailedJobs = len(jobs)
+	report.PullRequests = len(prs)
+
+	for _, repo := range repos {
+		report.Repositories = append(report.Repositories, *repo)
+	}
+	sort.Slice(report.Repositories, func(i, j int) bool {
+		if report.Repositories[i].FailedJobs != report.Repositories[j].FailedJobs {
+			return report.Repositories[i].FailedJobs > report.Repositories[j].FailedJobs
+		}
+		return report.Repositories[i].Name < report.Repositories[j].Name
+	})
+
+	report.Flakes = flakes(records, "", defaultFlakesMinPullRequests)
+	if len(report.Flakes) > archiveTopFlakes {
+		report.Flakes = report.Flakes[:archiveTopFlakes]
+	}
+
+	incidents := map[string]*infraIncident{}
+	incidentRepos := map[string]map[string]bool{}
+	for _, r := range jobs {
+		if !containsFold(infraFailureKinds, r.FailureKind) {
+			continue
+		}
+		key := r.Timestamp.UTC().Format("2006-01-02") + "/" + r.FailureKind
+		incident, ok := incidents[key]
+		if !ok {
+			incident = &infraIncident{Day: r.Timestamp.UTC().Format("2006-01-02"), Kind: r.FailureKind}
+			incidents[key] = incident
+			incidentRepos[key] = map[string]bool{}
+		}
+		incident.Jobs++
+		incidentRepos[key][r.Repository] = true
+	}
+	for key, incident := range incidents {
+		for repo := range incidentRepos[key] {
+			incident.Repositories = append(incident.Repositories, repo)
+		}
+		sort.Strings(incident.Repositories)
+		report.Incidents = append(report.Incidents, *incident)
+	}
+	sort.Slice(report.Incidents, func(i, j int) bool {
+		if report.Incidents[i].Day != report.Incidents[j].Day {
+			return report.Incidents[i].Day < report.Incidents[j].Day
+		}
+		return report.Incidents[i].Kind < report.Incidents[j].Kind
+	})
+
+	return report
+}
+
+// passRates returns the share of the runs of each main branch job started
+// within the time range which passed, among the runs within the lookback
+func (h *mainBranchHistory) passRates(ctx context.Context, logger zerolog.Logger, from, to time.Time) []jobPassRate {
+	if h == nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var rates []jobPassRate
+	for _, job := range h.jobs {
+		if seen[job] {
+			continue
+		}
+		seen[job] = true
+
+		runs, err := h.recentRuns(ctx, logger, job)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to list the runs of %s", job)
+			continue
+		}
+		rate := jobPassRate{Job: job}
+		for _, run := range runs {
+			if run.started.Before(from) || !run.started.Before(to) {
+				continue
+			}
+			rate.Runs++
+			if len(run.failedTests) == 0 {
+				rate.Passed++
+			}
+		}
+		if rate.Runs > 0 {
+			rate.Percent = float64(rate.Passed) * 100 / float64(rate.Runs)
+			rates = append(rates, rate)
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Job < rates[j].Job })
+
+	return rates
+}
+
+// archive renders the monthly CI health reports and publishes them to a GCS
+// bucket and/or to the GitHub Pages branch of a repository
+type archive struct {
+	config        ArchiveConfig
+	store         FailureStore
+	history       *mainBranchHistory
+	gcs           *storage.Client
+	clientCreator githubapp.ClientCreator
+	logger        zerolog.Logger
+
+	mu sync.Mutex
+	// the last month published since the app started
+	published string
+}
+
+func newArchive(ctx context.Context, cfg ArchiveConfig, store FailureStore, history *mainBranchHistory, cc githubapp.ClientCreator, logger zerolog.Logger) (*archive, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultArchivePrefix
+	}
+	if cfg.PagesBranch == "" {
+		cfg.PagesBranch = defaultArchivePagesBranch
+	}
+	if cfg.PagesDir == "" {
+		cfg.PagesDir = defaultArchivePagesDir
+	}
+	a := &archive{config: cfg, store: store, history: history, clientCreator: cc, logger: logger}
+	if cfg.GCSBucket != "" {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %+v", err)
+		}
+		a.gcs = client
+	}
+	return a, nil
+}
+
+// monthRange returns the bounds of the month, e.g. "2026-09"
+func monthRange(month string) (time.Time, time.Time, error) {
+	from, err := time.Parse(archiveMonthLayout, month)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid month %s, expected YYYY-MM", month)
+	}
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// render renders the report of the month as HTML
+func (a *archive) render(ctx context.Context, month string) ([]byte, error) {
+	from, to, err := monthRange(month)
+	if err != nil {
+		return nil, err
+	}
+	records, err := a.store.ListFailures(ctx, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the failures")
+	}
+
+	var b bytes.Buffer
+	if err := archiveHTMLTemplate.Execute(&b, buildMonthlyReport(month, records, a.history.passRates(ctx, a.logger, from, to))); err != nil {
+		return nil, errors.Wrap(err, "failed to render the monthly report")
+	}
+	return b.Bytes(), nil
+}
+
+// publish renders and publishes the report of the month, overwriting it if it was already published
+func (a *archive) publish(ctx context.Context, month string) error {
+	page, err := a.render(ctx, month)
+	if err != nil {
+		return err
+	}
+	name := month + ".html"
+
+	if a.config.GCSBucket != "" {
+		object := a.config.Prefix + "/" + name
+		writer := a.gcs.Bucket(a.config.GCSBucket).Object(object).NewWriter(ctx)
+		writer.ContentType = "text/html; charset=utf-8"
+		if _, err := writer.Write(page); err != nil {
+			writer.Close()
+			return errors.Wrapf(err, "failed to upload %s", object)
+		}
+		if err := writer.Close(); err != nil {
+			return errors.Wrapf(err, "failed to upload %s", object)
+		}
+		a.logger.Info().Msgf("Published the CI health report of %s to gs://%s/%s", month, a.config.GCSBucket, object)
+	}
+
+	if a.config.PagesRepository != "" {
+		if err := a.commitPage(ctx, a.config.PagesDir+"/"+name, page, fmt.Sprintf("Publish the CI health report of %s", month)); err != nil {
+			return err
+		}
+		a.logger.Info().Msgf("Published the CI health report of %s to %s", month, a.config.PagesRepository)
+	}
+
+	a.mu.Lock()
+	a.published = month
+	a.mu.Unlock()
+	return nil
+}
+
+// commitPage creates or updates the file on the GitHub Pages branch of the repository
+func (a *archive) commitPage(ctx context.Context, filePath string, content []byte, message string) error {
+	owner, repo, ok := strings.Cut(a.config.PagesRepository, "/")
+	if !ok {
+		return fmt.Errorf("invalid GitHub Pages repository %s, expected org/repo", a.config.PagesRepository)
+	}
+	appClient, err := a.clientCreator.NewAppClient()
+	if err != nil {
+		return err
+	}
+	installation, _, err := appClient.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		return errors.Wrapf(err, "the app isn't installed on %s", a.config.PagesRepository)
+	}
+	client, err := a.clientCreator.NewInstallationClient(installation.GetID())
+	if err != nil {
+		return err
+	}
+
+	opts := &github.RepositoryContentFileOptions{
+		Message: github.String(message),
+		Content: content,
+		Branch:  github.String(a.config.PagesBranch),
+	}
+	existing, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, filePath, &github.RepositoryContentGetOptions{Ref: a.config.PagesBranch})
+	switch {
+	case err == nil && existing != nil:
+		opts.SHA = existing.SHA
+		_, _, err = client.Repositories.UpdateFile(ctx, owner, repo, filePath, opts)
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		_, _, err = client.Repositories.CreateFile(ctx, owner, repo, filePath, opts)
+	}
+	return errors.Wrapf(err, "failed to commit %s to %s", filePath, a.config.PagesRepository)
+}
+
+// run publishes the report of each month once it's over, until the context is done
+func (a *archive) run(ctx context.Context) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		// the previous month, computed from the current month's first day
+		now := time.Now().UTC()
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0).Format(archiveMonthLayout)
+		a.mu.Lock()
+		published := a.published
+		a.mu.Unlock()
+		if month != published {
+			if err := a.publish(ctx, month); err != nil {
+				a.logger.Error().Err(err).Msgf("Failed to publish the CI health report of %s", month)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveHandler previews the CI health report of a month, e.g.
+// "?month=2026-09", and publishes it again with a POST request
+type ArchiveHandler struct {
+	Archive *archive
+}
+
+func (h *ArchiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format(archiveMonthLayout)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		page, err := h.Archive.render(r.Context(), month)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(page)
+	case http.MethodPost:
+		if err := h.Archive.publish(r.Context(), month); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultArtifactMaxSize = 50 << 20
+	defaultBuildLogTail    = 5 << 20
+	// an unknown object size, the size being read from the object's attributes
+	unknownArtifactSize = -1
+)
+
+var errArtifactTooLarge = errors.New("the artifact exceeds the maximum size of its type")
+
+// defaultArtifactSizePolicies never limit the junit files, and only
+// fetch the end of the build logs, where the failures are
+var defaultArtifactSizePolicies = []ArtifactSizePolicyConfig{
+	{Pattern: `junit[^/]*\.xml$`},
+	{Pattern: `build-log\.txt$`, TailSize: defaultBuildLogTail},
+}
+
+type artifactSizePolicy struct {
+	pattern *regexp.Regexp
+	// 0 when the files aren't limited
+	maxSize int64
+	// when > 0, only the last bytes of the files are fetched
+	tailSize int64
+}
+
+// artifactSizePolicies keep the time and memory taken by fetching the
+// artifacts of a job predictable, however large its files are. A nil
+// *artifactSizePolicies doesn't limit anything
+type artifactSizePolicies struct {
+	policies []artifactSizePolicy
+	fallback artifactSizePolicy
+}
+
+func newArtifactSizePolicies(cfg ArtifactSizesConfig) (*artifactSizePolicies, error) {
+	p := &artifactSizePolicies{fallback: artifactSizePolicy{maxSize: cfg.DefaultMaxSize}}
+	if cfg.DefaultMaxSize == 0 {
+		p.fallback.maxSize = defaultArtifactMaxSize
+	} else if cfg.DefaultMaxSize < 0 {
+		p.fallback.maxSize = 0
+	}
+
+	policies := cfg.Policies
+	if len(policies) == 0 {
+		policies = defaultArtifactSizePolicies
+	}
+	for _, pc := range policies {
+		r, err := regexp.Compile(pc.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid artifact size policy pattern: %s", pc.Pattern)
+		}
+		p.policies = append(p.policies, artifactSizePolicy{pattern: r, maxSize: pc.MaxSize, tailSize: pc.TailSize})
+	}
+
+	return p, nil
+}
+
+// policyFor returns the policy of the first pattern matching the object's name
+func (p *artifactSizePolicies) policyFor(objectName string) artifactSizePolicy {
+	for _, policy := range p.policies {
+		if policy.pattern.MatchString(objectName) {
+			return policy
+		}
+	}
+	return p.fallback
+}
+
+// streamable returns whether the object may be streamed whole when read,
+// rather than downloaded when scanned, within the limits of its policy
+func (p *artifactSizePolicies) streamable(objectName string, size int64) bool {
+	if p == nil {
+		return true
+	}
+	policy := p.policyFor(objectName)
+	return policy.tailSize == 0 && (policy.maxSize == 0 || size <= policy.maxSize)
+}
+
+// readArtifact returns the content of the given object within the limits of its
+// policy, or errArtifactTooLarge when the object is skipped. 'size' is the
+// object's size when already known (e.g. from a listing), or unknownArtifactSize
+func (p *artifactSizePolicies) readArtifact(ctx context.Context, client *storage.Client, objectName string, size int64) (string, error) {
+	if p == nil {
+		return readGCSObject(ctx, client, objectName)
+	}
+	policy := p.policyFor(objectName)
+	object := client.Bucket(prowArtifactsBucketName).Object(objectName)
+
+	if policy.tailSize > 0 && (size == unknownArtifactSize || size > policy.tailSize) {
+		rc, err := object.NewRangeReader(ctx, -policy.tailSize, -1)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to create reader for %s", objectName)
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read %s", objectName)
+		}
+		content := string(data)
+		// drop the partial line the range starts with, unless the whole object fit
+		if rc.Attrs.Size > int64(len(data)) {
+			if i := strings.IndexByte(content, '\n'); i >= 0 {
+				content = content[i+1:]
+			}
+		}
+		return content, nil
+	}
+
+	if policy.maxSize > 0 && size > policy.maxSize {
+		return "", errArtifactTooLarge
+	}
+
+	rc, err := object.NewReader(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create reader for %s", objectName)
+	}
+	defer rc.Close()
+	if policy.maxSize > 0 && rc.Attrs.Size > policy.maxSize {
+		return "", errArtifactTooLarge
+	}
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", objectName)
+	}
+
+	return string(data), nil
+}
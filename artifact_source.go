@@ -0,0 +1,420 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
+)
+
+const (
+	artifactSourceProw  = "prow"
+	artifactSourceGCS   = "gcs"
+	artifactSourceLocal = "local"
+	artifactSourceS3    = "s3"
+
+	// the largest artifact read from the local and S3 sources
+	maxObjectStoreArtifactSize = 50 * 1024 * 1024
+	defaultS3Region            = "us-east-1"
+	// the hash of the empty payload of the GET requests, signed along with them
+	emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// errNoGCSClient is returned by the enrichments reading more of the job's objects
+// from GCS, when the job's artifacts were scanned from another source
+var errNoGCSClient = errors.New("the job's artifacts weren't scanned from GCS")
+
+// ArtifactSource scans the artifacts of a Prow job, given the job's Spyglass
+// URL, into an ArtifactScanner the report is built from. The scanners of the
+// sources other than GCS have no storage client, the enrichments reading more
+// of the job's objects (e.g. the gathered CRs) being skipped
+type ArtifactSource interface {
+	// Scan reads the artifacts of the job whose name matches one of the filters
+	Scan(ctx context.Context, logger zerolog.Logger, prowJobURL string, fileNameFilter []string) (*prow.ArtifactScanner, error)
+}
+
+// newArtifactSource creates the configured source of the jobs' artifacts, the
+// Prow jobs' bucket read with the given (anonymous) client by default
+func newArtifactSource(ctx context.Context, cfg ArtifactSourceConfig, gcsClient *storage.Client, sizes *artifactSizePolicies) (ArtifactSource, error) {
+	switch cfg.Kind {
+	case "", artifactSourceProw:
+		return &gcsArtifactSource{client: gcsClient, sizes: sizes}, nil
+	case artifactSourceGCS:
+		if cfg.CredentialsFile == "" {
+			return nil, fmt.Errorf("the gcs artifact source needs a credentials file")
+		}
+		client, err := storage.NewClient(ctx, option.WithCredentialsFile(cfg.CredentialsFile))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed creating the storage client of the artifact source")
+		}
+		return &gcsArtifactSource{client: client, sizes: sizes}, nil
+	case artifactSourceLocal:
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("the local artifact source needs a directory")
+		}
+		return &objectStoreArtifactSource{store: &localObjectStore{root: cfg.Dir}}, nil
+	case artifactSourceS3:
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("the s3 artifact source needs both an endpoint and a bucket")
+		}
+		store := &s3ObjectStore{
+			endpoint: strings.TrimSuffix(cfg.S3Endpoint, "/"),
+			bucket:   cfg.S3Bucket,
+			region:   cfg.S3Region,
+			client:   http.DefaultClient,
+		}
+		if store.region == "" {
+			store.region = defaultS3Region
+		}
+		if (cfg.S3AccessKeyIDFile == "") != (cfg.S3SecretAccessKeyFile == "") {
+			return nil, fmt.Errorf("the s3 artifact source needs both an access key ID file and a secret access key file, or neither")
+		}
+		if cfg.S3AccessKeyIDFile != "" {
+			accessKeyID, err := os.ReadFile(cfg.S3AccessKeyIDFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed reading the S3 access key ID file: %s", cfg.S3AccessKeyIDFile)
+			}
+			secretAccessKey, err := os.ReadFile(cfg.S3SecretAccessKeyFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed reading the S3 secret access key file: %s", cfg.S3SecretAccessKeyFile)
+			}
+			store.accessKeyID = strings.TrimSpace(string(accessKeyID))
+			store.secretAccessKey = strings.TrimSpace(string(secretAccessKey))
+		}
+		return &objectStoreArtifactSource{store: store}, nil
+	default:
+		return nil, fmt.Errorf("unknown artifact source %q", cfg.Kind)
+	}
+}
+
+// gcsArtifactSource reads the artifacts from the Prow jobs' GCS bucket, with
+// the targeted scan plan or else with the qe-tools' scanner scraping Prow
+type gcsArtifactSource struct {
+	client *storage.Client
+	sizes  *artifactSizePolicies
+}
+
+func (s *gcsArtifactSource) Scan(ctx context.Context, logger zerolog.Logger, prowJobURL string, fileNameFilter []string) (*prow.ArtifactScanner, error) {
+	return runScan(ctx, logger, s.client, prowJobURL, fileNameFilter, s.sizes)
+}
+
+// objectStore is a store laid out as the Prow jobs' bucket, the objects
+// being named after their path within the bucket
+type objectStore interface {
+	// list returns the names of the objects under the prefix
+	list(ctx context.Context, prefix string) ([]string, error)
+	read(ctx context.Context, name string) (string, error)
+}
+
+// objectStoreArtifactSource reads the artifacts from a store other than GCS,
+// the artifacts of each step of the job's target being listed in full
+type objectStoreArtifactSource struct {
+	store objectStore
+}
+
+func (s *objectStoreArtifactSource) Scan(ctx context.Context, logger zerolog.Logger, prowJobURL string, fileNameFilter []string) (*prow.ArtifactScanner, error) {
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+	var filters []*regexp.Regexp
+	for _, f := range fileNameFilter {
+		r, err := regexp.Compile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid file name filter: %s", f)
+		}
+		filters = append(filters, r)
+	}
+
+	artifactsPrefix := jobPrefix + "/artifacts/"
+	objects, err := s.store.list(ctx, artifactsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := &prow.ArtifactScanner{ArtifactStepMap: map[prow.ArtifactStepName]prow.ArtifactFilenameMap{}}
+	for _, name := range objects {
+		// e.g. "<job prefix>/artifacts/e2e-tests/redhat-appstudio-e2e/artifacts/junit.xml"
+		parts := strings.SplitN(strings.TrimPrefix(name, artifactsPrefix), "/", 3)
+		if len(parts) < 3 || isGatherStep(parts[1]) || !matchesAny(filters, name) {
+			continue
+		}
+		scanner.ArtifactDirectoryPrefix = artifactsPrefix + parts[0] + "/"
+		if err := s.add(ctx, scanner, parts[1], name); err != nil {
+			return nil, err
+		}
+	}
+
+	// same as the ArtifactScanner, fall back to the root build-log.txt when no step ran
+	if len(scanner.ArtifactStepMap) == 0 {
+		logger.Debug().Msgf("No steps found within %s, reading the root %s", artifactsPrefix, rootBuildLogFileName)
+		if err := s.add(ctx, scanner, rootStepName, jobPrefix+"/"+rootBuildLogFileName); err != nil {
+			return nil, err
+		}
+	}
+	return scanner, nil
+}
+
+func (s *objectStoreArtifactSource) add(ctx context.Context, scanner *prow.ArtifactScanner, stepName, name string) error {
+	content, err := s.store.read(ctx, name)
+	if errors.Is(err, errArtifactTooLarge) {
+		zerolog.Ctx(ctx).Debug().Msgf("Skipping %s, which exceeds the maximum size of the artifacts", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	step := prow.ArtifactStepName(stepName)
+	if scanner.ArtifactStepMap[step] == nil {
+		scanner.ArtifactStepMap[step] = prow.ArtifactFilenameMap{}
+	}
+	scanner.ArtifactStepMap[step][prow.ArtifactFilename(path.Base(name))] = prow.Artifact{Content: content, FullName: name}
+	return nil
+}
+
+// localObjectStore reads the artifacts from a directory laid out as the
+// Prow jobs' bucket, e.g. a copy of a job's artifacts made with gsutil
+type localObjectStore struct {
+	root string
+}
+
+// file returns the path of the object within the directory
+func (s *localObjectStore) file(name string) (string, error) {
+	file := filepath.Join(s.root, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(s.root, file); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("the object %s is outside of the artifacts' directory", name)
+	}
+	return file, nil
+}
+
+func (s *localObjectStore) list(ctx context.Context, prefix string) ([]string, error) {
+	dir, err := s.file(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return names, err
+}
+
+func (s *localObjectStore) read(ctx context.Context, name string) (string, error) {
+	file, err := s.file(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open %s", name)
+	}
+	defer f.Close()
+
+	return readObjectStoreArtifact(f, name)
+}
+
+// s3ObjectStore reads the artifacts from a bucket of an S3-compatible storage,
+// signing the requests with the access key (AWS Signature Version 4) when
+// there's one, anonymously otherwise
+type s3ObjectStore struct {
+	endpoint        string
+	bucket          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// s3ListResult is the response of S3's ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3ObjectStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.get(ctx, s.endpoint+"/"+s3URIEncode(s.bucket, true)+"?"+s3CanonicalQuery(query))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the objects under %s", prefix)
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(body).Decode(&result)
+		body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode the objects under %s", prefix)
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3ObjectStore) read(ctx context.Context, name string) (string, error) {
+	body, err := s.get(ctx, s.endpoint+"/"+s3URIEncode(s.bucket, true)+"/"+s3URIEncode(name, false))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", name)
+	}
+	defer body.Close()
+
+	return readObjectStoreArtifact(body, name)
+}
+
+func (s *s3ObjectStore) get(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKeyID != "" {
+		s.sign(req, time.Now())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// sign signs the GET request with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3ObjectStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadSHA256)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + emptyPayloadSHA256 + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		emptyPayloadSHA256,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode percent-encodes all but the unreserved characters, as the
+// signatures expect, the slashes being kept unless told otherwise
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes the query sorted by its parameters, as the signatures expect
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// readObjectStoreArtifact reads the artifact, unless it's larger than maxObjectStoreArtifactSize
+func readObjectStoreArtifact(r io.Reader, name string) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxObjectStoreArtifactSize+1))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", name)
+	}
+	if len(data) > maxObjectStoreArtifactSize {
+		return "", fmt.Errorf("%s is larger than %d bytes: %w", name, maxObjectStoreArtifactSize, errArtifactTooLarge)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// buildah prints e.g. "STEP 12/18: RUN dnf install -y git"
+	buildahStepRegex = `STEP (\d+)/(\d+): (.*)$`
+	// docker prints e.g. "Step 12/18 : RUN dnf install -y git"
+	dockerStepRegex = `Step (\d+)/(\d+) : (.*)$`
+	// number of log lines preceding the error line to include in the report
+	imageBuildErrorContextLines = 10
+)
+
+var (
+	buildStepRegexps = []*regexp.Regexp{
+		regexp.MustCompile(buildahStepRegex),
+		regexp.MustCompile(dockerStepRegex),
+	}
+	imageBuildErrorRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`[Ee]rror:? building at STEP "(.*)": (.*)$`),
+		regexp.MustCompile(`The command '(.*)' returned a non-zero code: (\d+)`),
+		regexp.MustCompile(`error: build error: (.*)$`),
+	}
+)
+
+// imageBuildFailure describes the Dockerfile step
+// at which an image build (buildah/docker) failed
+type imageBuildFailure struct {
+	step         string
+	totalSteps   string
+	instruction  string
+	errorMessage string
+	logExcerpt   string
+}
+
+// summary returns a one-line description of the failure,
+// e.g. "failed at step 12/18: RUN dnf install -y git"
+func (f *imageBuildFailure) summary() string {
+	if f.step == "" {
+		return "failed while building the image"
+	}
+	return fmt.Sprintf("failed at step %s/%s: `%s`", f.step, f.totalSteps, f.instruction)
+}
+
+// parseImageBuildFailure scans the given build log for buildah/docker
+// build output and returns the Dockerfile step at which the build
+// failed, together with the error. It returns nil if the log
+// doesn't contain an image build error
+func parseImageBuildFailure(buildLog string) *imageBuildFailure {
+	lines := strings.Split(buildLog, "\n")
+	failure := &imageBuildFailure{}
+
+	for i, line := range lines {
+		for _, r := range buildStepRegexps {
+			if m := r.FindStringSubmatch(line); m != nil {
+				failure.step, failure.totalSteps, failure.instruction = m[1], m[2], strings.TrimSpace(m[3])
+			}
+		}
+
+		for _, r := range imageBuildErrorRegexps {
+			if m := r.FindStringSubmatch(line); m != nil {
+				failure.errorMessage = strings.TrimSpace(m[0])
+				start := i - imageBuildErrorContextLines
+				if start < 0 {
+					start = 0
+				}
+				failure.logExcerpt = strings.Join(lines[start:i+1], "\n")
+				return failure
+			}
+		}
+	}
+
+	return nil
+}
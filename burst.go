@@ -0,0 +1,108 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// pendingAnalysis is the analysis of the latest comment of a burst, which
+// runs once the cooldown is over in place of the analyses of the burst's comments
+type pendingAnalysis struct {
+	logger    zerolog.Logger
+	run       func(ctx context.Context) error
+	coalesced int
+}
+
+// burstGuard coalesces the analyses of the comments reporting the same job
+// of a PR in a rapid sequence (e.g. tide's retest loops): the analyses of a
+// PR's job start at most once per cooldown, the comments posted during the
+// cooldown being coalesced into a single analysis of the latest one once
+// the cooldown is over. A nil burstGuard runs all the analyses right away
+type burstGuard struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	// when the latest analysis of each PR's job started, keyed by burstKey
+	started map[string]time.Time
+	pending map[string]*pendingAnalysis
+}
+
+func newBurstGuard(cfg BurstConfig) *burstGuard {
+	return &burstGuard{cooldown: cfg.Cooldown, started: map[string]time.Time{}, pending: map[string]*pendingAnalysis{}}
+}
+
+// burstKey identifies the PR's job the comments report, e.g. "org/repo#1/pull-ci-org-repo-main-e2e"
+func burstKey(repoFullName string, prNumber int, prowJobURL string) string {
+	return prKey(repoFullName, prNumber) + "/" + jobNameFromProwJobURL(prowJobURL)
+}
+
+// admit runs the analysis right away, unless another analysis of the PR's job
+// started within the cooldown: the analysis then waits for the end of the
+// cooldown, replacing the analysis already waiting for it if any
+func (g *burstGuard) admit(ctx context.Context, logger zerolog.Logger, key string, run func(ctx context.Context) error) error {
+	if g == nil {
+		return run(ctx)
+	}
+
+	g.mu.Lock()
+	now := time.Now()
+	for k, started := range g.started {
+		if now.Sub(started) >= g.cooldown && g.pending[k] == nil {
+			delete(g.started, k)
+		}
+	}
+
+	if p, ok := g.pending[key]; ok {
+		p.logger, p.run = logger, run
+		p.coalesced++
+		coalesced := p.coalesced
+		g.mu.Unlock()
+		logger.Info().Msgf("Coalescing the analysis into the delayed one of the burst (%d comments)", coalesced)
+		return nil
+	}
+	if started, ok := g.started[key]; ok {
+		g.pending[key] = &pendingAnalysis{logger: logger, run: run, coalesced: 1}
+		delay := started.Add(g.cooldown).Sub(now)
+		// the analysis outlives the webhook's request
+		time.AfterFunc(delay, func() { g.fire(detachedContext{ctx}, key) })
+		g.mu.Unlock()
+		logger.Info().Msgf("The job was analysed %s ago, delaying the analysis by %s", now.Sub(started).Round(time.Second), delay.Round(time.Second))
+		return nil
+	}
+	g.started[key] = now
+	g.mu.Unlock()
+
+	return run(ctx)
+}
+
+// fire runs the pending analysis of the PR's job once the cooldown is over
+func (g *burstGuard) fire(ctx context.Context, key string) {
+	g.mu.Lock()
+	p := g.pending[key]
+	delete(g.pending, key)
+	g.started[key] = time.Now()
+	g.mu.Unlock()
+
+	if p.coalesced > 1 {
+		p.logger.Info().Msgf("Analysing the latest of the %d comments of the burst", p.coalesced)
+	}
+	if err := p.run(ctx); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to run the delayed analysis")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultBusinessHoursStart = "09:00"
+	defaultBusinessHoursEnd   = "17:00"
+	holidayDateLayout         = "2006-01-02"
+	// how often the deferred mentions are checked
+	deferredMentionsInterval = time.Minute
+)
+
+var (
+	defaultWorkingDays   = []string{"monday", "tuesday", "wednesday", "thursday", "friday"}
+	defaultCriticalKinds = []string{failureKindInfra, failureKindClusterPool}
+)
+
+// businessHours is the working calendar of the people the reports mention.
+// Outside of it, the mentions of the non-critical failures wait for the next
+// working window. A nil calendar is always open
+type businessHours struct {
+	location *time.Location
+	// minutes since midnight
+	start, end int
+	weekdays   map[time.Weekday]bool
+	holidays   map[string]bool
+	critical   []string
+}
+
+func newBusinessHours(cfg BusinessHoursConfig) (*businessHours, error) {
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid time zone of the business hours: %s", cfg.Timezone)
+	}
+
+	h := &businessHours{location: location, weekdays: map[time.Weekday]bool{}, holidays: map[string]bool{}, critical: cfg.CriticalKinds}
+	if len(h.critical) == 0 {
+		h.critical = defaultCriticalKinds
+	}
+
+	start, end := cfg.Start, cfg.End
+	if start == "" {
+		start = defaultBusinessHoursStart
+	}
+	if end == "" {
+		end = defaultBusinessHoursEnd
+	}
+	if h.start, err = parseTimeOfDay(start); err != nil {
+		return nil, err
+	}
+	if h.end, err = parseTimeOfDay(end); err != nil {
+		return nil, err
+	}
+	if h.start >= h.end {
+		return nil, fmt.Errorf("the business hours must start (%s) before they end (%s)", start, end)
+	}
+
+	weekdays := cfg.Weekdays
+	if len(weekdays) == 0 {
+		weekdays = defaultWorkingDays
+	}
+	for _, name := range weekdays {
+		day, ok := parseWeekday(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid working day: %s", name)
+		}
+		h.weekdays[day] = true
+	}
+
+	for _, date := range cfg.Holidays {
+		if _, err := time.Parse(holidayDateLayout, date); err != nil {
+			return nil, errors.Wrapf(err, "invalid holiday %s, expected YYYY-MM-DD", date)
+		}
+		h.holidays[date] = true
+	}
+
+	return h, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of e.g. "09:30"
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid time of the day %s, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// isOpen returns whether the time is within the working hours of a working day
+func (h *businessHours) isOpen(t time.Time) bool {
+	if h == nil {
+		return true
+	}
+	t = t.In(h.location)
+	if !h.weekdays[t.Weekday()] || h.holidays[t.Format(holidayDateLayout)] {
+		return false
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes >= h.start && minutes < h.end
+}
+
+// nextOpen returns when the next working window starts, or t if it's within one
+func (h *businessHours) nextOpen(t time.Time) time.Time {
+	if h.isOpen(t) {
+		return t
+	}
+	t = t.In(h.location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, h.location)
+	// a year of holidays at most
+	for i := 0; i < 366; i++ {
+		open := day.Add(time.Duration(h.start) * time.Minute)
+		if open.After(t) && h.isOpen(open) {
+			return open
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// defers returns whether the mention of the failure of the given kind waits
+// for the next working window, the critical failures being mentioned anytime
+func (h *businessHours) defers(kind string, t time.Time) bool {
+	return h != nil && !containsFold(h.critical, kind) && !h.isOpen(t)
+}
+
+type deferredMention struct {
+	installationID int64
+	owner, repo    string
+	prNumber       int
+	login          string
+	kind           string
+	dueAt          time.Time
+}
+
+// deferredMentions posts the mentions deferred by the business hours
+// as replies to the PRs, once the next working window starts
+type deferredMentions struct {
+	hours         *businessHours
+	clientCreator githubapp.ClientCreator
+	mentions      *mentionOptOuts
+	logger        zerolog.Logger
+
+	mu      sync.Mutex
+	pending map[string]*deferredMention
+}
+
+func newDeferredMentions(hours *businessHours, cc githubapp.ClientCreator, mentions *mentionOptOuts, logger zerolog.Logger) *deferredMentions {
+	return &deferredMentions{hours: hours, clientCreator: cc, mentions: mentions, logger: logger, pending: map[string]*deferredMention{}}
+}
+
+// add defers the mention of the user on the PR, a user being
+// mentioned once per PR however many failures were deferred
+func (d *deferredMentions) add(m deferredMention) {
+	if d == nil {
+		return
+	}
+	m.dueAt = d.hours.nextOpen(time.Now())
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[fmt.Sprintf("%s/%s#%d@%s", m.owner, m.repo, m.prNumber, strings.ToLower(m.login))] = &m
+}
+
+// run posts the due mentions until the context is done
+func (d *deferredMentions) run(ctx context.Context) {
+	ticker := time.NewTicker(deferredMentionsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, m := range d.due() {
+				if err := d.post(ctx, m); err != nil {
+					d.logger.Error().Err(err).Msgf("Failed to post the deferred mention of %s on %s/%s#%d", m.login, m.owner, m.repo, m.prNumber)
+				}
+			}
+		}
+	}
+}
+
+// due returns (and forgets) the mentions whose working window started
+func (d *deferredMentions) due() []*deferredMention {
+	now := time.Now()
+	if !d.hours.isOpen(now) {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var due []*deferredMention
+	for key, m := range d.pending {
+		if !now.Before(m.dueAt) {
+			due = append(due, m)
+			delete(d.pending, key)
+		}
+	}
+	return due
+}
+
+func (d *deferredMentions) post(ctx context.Context, m *deferredMention) error {
+	client, err := d.clientCreator.NewInstallationClient(m.installationID)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("cc %s, please take a look at the %s failure reported above, which happened outside of the business hours.",
+		d.mentions.mention(m.login), m.kind)
+	_, _, err = client.Issues.CreateComment(ctx, m.owner, m.repo, m.prNumber, &github.IssueComment{Body: &body})
+	return err
+}
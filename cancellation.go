@@ -0,0 +1,140 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CancelAnalysesRoute string = "/admin/analyses/cancel"
+)
+
+// detachedContext carries the values of its parent context, but not its
+// cancellation: GitHub closes the webhook request long before an
+// analysis finishes, which would otherwise cancel the analysis
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// analysisCancellations keeps track of the running analyses of each
+// PR, so that they can be aborted when the PR gets closed or updated,
+// on request, or when the app shuts down
+type analysisCancellations struct {
+	mu       sync.Mutex
+	nextID   int64
+	closed   bool
+	analyses map[string]map[int64]context.CancelFunc
+}
+
+func newAnalysisCancellations() *analysisCancellations {
+	return &analysisCancellations{analyses: map[string]map[int64]context.CancelFunc{}}
+}
+
+// start returns a context for an analysis of the given PR, detached from
+// the cancellation of 'parent'. The returned function must be called
+// once the analysis is over
+func (c *analysisCancellations) start(parent context.Context, repoFullName string, prNumber int) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(detachedContext{parent})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		cancel()
+		return ctx, func() {}
+	}
+
+	key := prKey(repoFullName, prNumber)
+	id := c.nextID
+	c.nextID++
+	if c.analyses[key] == nil {
+		c.analyses[key] = map[int64]context.CancelFunc{}
+	}
+	c.analyses[key][id] = cancel
+
+	return ctx, func() {
+		cancel()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.analyses[key], id)
+		if len(c.analyses[key]) == 0 {
+			delete(c.analyses, key)
+		}
+	}
+}
+
+// cancel aborts all the running analyses of the given
+// PR and returns how many of them were running
+func (c *analysisCancellations) cancel(repoFullName string, prNumber int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := prKey(repoFullName, prNumber)
+	cancelled := len(c.analyses[key])
+	for _, cancel := range c.analyses[key] {
+		cancel()
+	}
+	delete(c.analyses, key)
+
+	return cancelled
+}
+
+// cancelAll aborts all the running analyses and any analysis started later
+func (c *analysisCancellations) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for key, analyses := range c.analyses {
+		for _, cancel := range analyses {
+			cancel()
+		}
+		delete(c.analyses, key)
+	}
+}
+
+// CancelAnalysesHandler aborts the running and queued analyses of the PR
+// given by the 'repo' (e.g. "org/repo") and 'pr' query parameters
+type CancelAnalysesHandler struct {
+	Cancellations *analysisCancellations
+	Queue         *workQueue
+}
+
+func (h *CancelAnalysesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repo := r.URL.Query().Get("repo")
+	prNumber, err := strconv.Atoi(r.URL.Query().Get("pr"))
+	if repo == "" || err != nil {
+		http.Error(w, "the 'repo' and 'pr' query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	dropped := h.Queue.cancel(repo, prNumber)
+	fmt.Fprintf(w, "cancelled %d analyses, dropped or stopped retrying %d queued ones\n", h.Cancellations.cancel(repo, prNumber), dropped)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+)
+
+const (
+	// the conclusions of the check runs of the reports, "off" publishing none
+	checkRunOff     = "off"
+	checkRunNeutral = "neutral"
+	checkRunFailure = "failure"
+
+	// GitHub accepts at most 50 annotations per request
+	maxAnnotationsPerRequest = 50
+	// the failures annotated at most, GitHub's limit being per request only
+	maxCheckRunAnnotations = 500
+	// the longest title and message of an annotation
+	maxAnnotationTitleLength   = 255
+	maxAnnotationMessageLength = 64 * 1024
+	// the path the failures whose spec's file is unknown are annotated on, GitHub
+	// listing the annotations of the paths the commit lacks on the check run's page only
+	unlocatedAnnotationPath = ".github"
+)
+
+// checkRunAnnotations returns an annotation per failed test case of the report, on the
+// spec's file of the repository when the test case's report tells where the spec is
+func (failedTCReport *FailedTestCasesReport) checkRunAnnotations(repoName string) []*github.CheckRunAnnotation {
+	var annotations []*github.CheckRunAnnotation
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		if len(annotations) == maxCheckRunAnnotations {
+			break
+		}
+
+		path, line := unlocatedAnnotationPath, 1
+		if specPath, specLine, ok := parseSpecLocation(tc.location); ok {
+			if relative, ok := repositoryRelativePath(specPath, repoName); ok {
+				path, line = relative, specLine
+			}
+		}
+		message := strings.TrimSpace(tc.message)
+		if message == "" {
+			message = fmt.Sprintf("%s %s", tc.status, tc.name)
+		}
+		if len(message) > maxAnnotationMessageLength {
+			message = strings.ToValidUTF8(message[:maxAnnotationMessageLength], "")
+		}
+		title := fmt.Sprintf("[%s] %s", tc.status, tc.name)
+		if len(title) > maxAnnotationTitleLength {
+			title = strings.ToValidUTF8(title[:maxAnnotationTitleLength], "")
+		}
+
+		annotations = append(annotations, &github.CheckRunAnnotation{
+			Path:            github.String(path),
+			StartLine:       github.Int(line),
+			EndLine:         github.Int(line),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String(title),
+			Message:         github.String(message),
+		})
+	}
+	return annotations
+}
+
+// repositoryRelativePath returns the path of the spec's file within the repository,
+// the specs' locations being absolute paths within the test's environment, e.g.
+// "/go/src/github.com/konflux-ci/e2e-tests/tests/build/build.go"
+func repositoryRelativePath(path, repoName string) (string, bool) {
+	i := strings.LastIndex(path, "/"+repoName+"/")
+	if i < 0 {
+		return "", false
+	}
+	return path[i+len(repoName)+2:], true
+}
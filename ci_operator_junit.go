@@ -0,0 +1,120 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// the pseudo step holding the junit files ci-operator synthesizes for Spyglass
+	ciOperatorStepName    = "ci-operator"
+	ciOperatorJUnitPrefix = "artifacts/junit_"
+)
+
+// ciOperatorStepRegex matches the test cases ci-operator reports for each
+// step of a multi-stage test, e.g. "Run multi-stage test e2e - e2e-tests container test"
+var ciOperatorStepRegex = regexp.MustCompile(` - (\S+) container test$`)
+
+// fetchCIOperatorJUnit fetches the junit_*.xml files at the root of the job's
+// artifacts directory, which ci-operator writes even when the steps didn't
+// upload anything
+func fetchCIOperatorJUnit(ctx context.Context, scanner *prow.ArtifactScanner, sizes *artifactSizePolicies, jobPrefix string) error {
+	it := scanner.Client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: jobPrefix + "/" + ciOperatorJUnitPrefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to list the junit files of ci-operator")
+		}
+		if attrs.Prefix != "" || path.Ext(attrs.Name) != ".xml" {
+			continue
+		}
+		if err := addArtifactToStepMap(ctx, scanner, sizes, ciOperatorStepName, attrs.Name, attrs.Size); err != nil {
+			return err
+		}
+	}
+}
+
+// extractFailedStepsFromCIOperatorJUnit reports the steps ci-operator's junit
+// files mark as failed, and returns whether it found any. It's the fallback
+// of the runs whose steps didn't upload their own junit files
+func (failedTCReport *FailedTestCasesReport) extractFailedStepsFromCIOperatorJUnit(scanner *prow.ArtifactScanner, logger zerolog.Logger) bool {
+	asMap := scanner.ArtifactStepMap[prow.ArtifactStepName(ciOperatorStepName)]
+	filenames := make([]string, 0, len(asMap))
+	for filename := range asMap {
+		filenames = append(filenames, string(filename))
+	}
+	sort.Strings(filenames)
+
+	var steps, others []failedTestCase
+	for _, filename := range filenames {
+		suites, err := decodeJUnit(strings.NewReader(asMap[prow.ArtifactFilename(filename)].Content))
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Failed to decode the ci-operator's junit file %s", filename)
+			continue
+		}
+		for _, testSuite := range suites.TestSuites {
+			for _, tc := range testSuite.TestCases {
+				if tc.Failure == nil {
+					continue
+				}
+				message := strings.TrimSpace(tc.Failure.Message)
+				if message == "" {
+					message = strings.TrimSpace(tc.Failure.Description)
+				}
+				ftc := failedTestCase{suiteName: ciOperatorStepName, name: tc.Name, message: message, details: codeBlock(returnLastNLines(message, 16))}
+				if m := ciOperatorStepRegex.FindStringSubmatch(tc.Name); m != nil {
+					ftc.name = m[1]
+					steps = append(steps, ftc)
+				} else {
+					others = append(others, ftc)
+				}
+			}
+		}
+	}
+
+	// the steps' test cases are more specific than the test's overall one
+	failed := steps
+	if len(failed) == 0 {
+		failed = others
+	}
+	if len(failed) == 0 {
+		return false
+	}
+
+	names := make([]string, 0, len(failed))
+	for _, ftc := range failed {
+		names = append(names, inlineCode(ftc.name))
+	}
+	logger.Debug().Msgf("ci-operator reported the failure of: %s", strings.Join(names, ", "))
+	failedTCReport.headerString = fmt.Sprintf(":rotating_light: **The Prow job failed at %s, which didn't upload any test results.**\n", strings.Join(names, ", "))
+	failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failed...)
+
+	return true
+}
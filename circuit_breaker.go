@@ -0,0 +1,198 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = time.Minute
+
+	dependencyDeck              = "deck"
+	dependencyMainBranchHistory = "main_branch_history"
+)
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// breakerState is the state of a circuit breaker, exported as the value of its gauge
+type breakerState int
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops calling a dependency failing repeatedly for a while,
+// so that its outage degrades the reports instead of delaying them. A nil
+// breaker always lets the calls through
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	health    *dependencyHealth
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow returns whether the dependency may be called. Once the cooldown
+// elapses, a single call probes whether the dependency recovered
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// the probe is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record records the outcome of a call allowed by the breaker
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.health.failuresTotal.WithLabelValues(b.name).Inc()
+	b.health.telemetry.countError("dependency:" + b.name)
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// call calls the dependency through the breaker
+func (b *circuitBreaker) call(fn func() error) error {
+	if !b.allow() {
+		return fmt.Errorf("%s: %w", b.name, errCircuitOpen)
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	b.health.stateGauge.WithLabelValues(b.name).Set(float64(state))
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// dependencyHealth holds the circuit breakers of the optional
+// dependencies of the analyses, and exports their health
+type dependencyHealth struct {
+	config   CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+
+	stateGauge    *prometheus.GaugeVec
+	failuresTotal *prometheus.CounterVec
+	// counts the failed calls among the subsystems' errors
+	telemetry *telemetry
+}
+
+func newDependencyHealth(cfg CircuitBreakerConfig, registry *prometheus.Registry, t *telemetry) *dependencyHealth {
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = defaultBreakerCooldown
+	}
+
+	h := &dependencyHealth{
+		config:    cfg,
+		breakers:  map[string]*circuitBreaker{},
+		telemetry: t,
+		stateGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ci_helper_dependency_circuit_state",
+			Help: "State of the dependency's circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, []string{"dependency"}),
+		failuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_dependency_failures_total",
+			Help: "Number of failed calls to the dependency.",
+		}, []string{"dependency"}),
+	}
+	registry.MustRegister(h.stateGauge, h.failuresTotal)
+
+	return h
+}
+
+// breaker returns the circuit breaker of the dependency, creating it on first
+// use. The breakers are created while setting up the app, before any analysis
+func (h *dependencyHealth) breaker(name string) *circuitBreaker {
+	if b, ok := h.breakers[name]; ok {
+		return b
+	}
+	b := &circuitBreaker{name: name, threshold: h.config.FailureThreshold, cooldown: h.config.Cooldown, health: h}
+	h.breakers[name] = b
+	h.stateGauge.WithLabelValues(name).Set(float64(breakerClosed))
+	return b
+}
+
+// states returns the state of each dependency's breaker, by the dependencies' name
+func (h *dependencyHealth) states() []string {
+	var states []string
+	for name, b := range h.breakers {
+		states = append(states, fmt.Sprintf("%s: %s", name, b.currentState()))
+	}
+	sort.Strings(states)
+	return states
+}
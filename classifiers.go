@@ -0,0 +1,170 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// classifierEnv declares the variables the classifiers' rules are evaluated
+// against, e.g. `suite == "e2e" && message.contains("quay.io") && duration > 600.0`
+var classifierEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("name", cel.StringType),
+		cel.Variable("message", cel.StringType),
+		cel.Variable("suite", cel.StringType),
+		cel.Variable("status", cel.StringType),
+		// in seconds, 0 when unknown
+		cel.Variable("duration", cel.DoubleType),
+		// the report's failure kind, e.g. "e2e"
+		cel.Variable("kind", cel.StringType),
+		// the fetched artifacts, as "<step>/<file name>"
+		cel.Variable("artifacts", cel.ListType(cel.StringType)),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// classifiers compiles the repositories' classifiers on first use
+type classifiers struct {
+	mu       sync.Mutex
+	programs map[string]cel.Program
+	// the rules in compilation order, the oldest being evicted first
+	order []string
+}
+
+func newClassifiers() *classifiers {
+	return &classifiers{programs: map[string]cel.Program{}}
+}
+
+// compileClassifierRule compiles the rule, which must evaluate to a boolean
+func compileClassifierRule(rule string) (cel.Program, error) {
+	ast, iss := classifierEnv.Compile(rule)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if ast.OutputType().String() != cel.BoolType.String() {
+		return nil, fmt.Errorf("the rule evaluates to %s instead of a bool", ast.OutputType())
+	}
+	return classifierEnv.Program(ast, cel.CostLimit(celCostLimit))
+}
+
+// validateClassifiers compiles the classifiers of all the configured
+// organizations, groups and repositories, so that invalid rules fail fast
+func (c *Config) validateClassifiers() error {
+	var configs []ClassifierConfig
+	for _, rc := range c.Organizations {
+		configs = append(configs, rc.Classifiers...)
+	}
+	for _, group := range c.RepositoryGroups {
+		configs = append(configs, group.Classifiers...)
+	}
+	for _, rc := range c.Repositories {
+		configs = append(configs, rc.Classifiers...)
+	}
+	for _, cfg := range configs {
+		if _, err := compileClassifierRule(cfg.Rule); err != nil {
+			return errors.Wrapf(err, "invalid rule of the classifier %q", cfg.Name)
+		}
+	}
+	return nil
+}
+
+func (cs *classifiers) program(rule string) (cel.Program, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if prg, ok := cs.programs[rule]; ok {
+		return prg, nil
+	}
+	prg, err := compileClassifierRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	cs.programs[rule] = prg
+	cs.order = append(cs.order, rule)
+	if overflow := len(cs.order) - celProgramCacheCapacity; overflow > 0 {
+		for _, evicted := range cs.order[:overflow] {
+			delete(cs.programs, evicted)
+		}
+		cs.order = append([]string(nil), cs.order[overflow:]...)
+	}
+	return prg, nil
+}
+
+// classify adds a note to each failure matching a classifier's rule, and
+// reclassifies the report when the matching classifier sets a failure kind
+func (cs *classifiers) classify(logger zerolog.Logger, scanner *prow.ArtifactScanner, configs []ClassifierConfig, failedTCReport *FailedTestCasesReport) {
+	if cs == nil || len(configs) == 0 {
+		return
+	}
+
+	var artifacts []string
+	for step, files := range scanner.ArtifactStepMap {
+		for name := range files {
+			artifacts = append(artifacts, string(step)+"/"+string(name))
+		}
+	}
+	sort.Strings(artifacts)
+
+	kind := failedTCReport.failureKind
+	for i, tc := range failedTCReport.failedTestCases {
+		vars := map[string]interface{}{
+			"name":      tc.name,
+			"message":   tc.message,
+			"suite":     tc.suiteName,
+			"status":    tc.status,
+			"duration":  tc.duration.Seconds(),
+			"kind":      kind,
+			"artifacts": artifacts,
+		}
+		for _, cfg := range configs {
+			prg, err := cs.program(cfg.Rule)
+			if err != nil {
+				logger.Error().Err(err).Msgf("Invalid rule of the classifier %s", cfg.Name)
+				continue
+			}
+			out, _, err := prg.Eval(vars)
+			if err != nil {
+				logger.Debug().Err(err).Msgf("Failed to evaluate the classifier %s", cfg.Name)
+				continue
+			}
+			if matched, ok := out.Value().(bool); !ok || !matched {
+				continue
+			}
+
+			logger.Debug().Msgf("The failure %s matches the classifier %s", tc.name, cfg.Name)
+			note := fmt.Sprintf(":label: **%s**", cfg.Name)
+			if cfg.Note != "" {
+				note = note + ": " + cfg.Note
+			}
+			failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, note)
+			if cfg.Kind != "" {
+				failedTCReport.failureKind = cfg.Kind
+			}
+			// the first matching classifier wins
+			break
+		}
+	}
+}
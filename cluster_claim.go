@@ -0,0 +1,150 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// dumps of the Hive ClusterPool the job claims from, when the job uploads one
+	clusterPoolFilenameRegex = `(clusterpools?[^/]*\.(json|ya?ml))$`
+	clusterClaimContextLines = 10
+)
+
+var (
+	// ci-operator's errors when the cluster claim isn't fulfilled in time
+	clusterClaimFailureRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)failed to (wait for|acquire|create) .*cluster ?claim.*$`),
+		regexp.MustCompile(`(?i)cluster ?claim .*(timed out|not fulfilled|was not ready).*$`),
+		regexp.MustCompile(`(?i)timed out waiting for (the )?cluster ?claim.*$`),
+	}
+	// the lines ci-operator logs while claiming the cluster, the pool's state is only read from them
+	clusterClaimLineRegex = regexp.MustCompile(`(?i)cluster ?(claim|pool)`)
+	clusterPoolNameRegex  = regexp.MustCompile(`(?i)cluster ?pool[\s:"'\x60]+([a-z0-9][-a-z0-9.]*[a-z0-9])`)
+	clusterPoolReadyRegex = regexp.MustCompile(`(?i)(\d+)/(\d+) (clusters? )?(are )?ready`)
+)
+
+// clusterClaimFailure describes a job which couldn't acquire
+// a cluster from a Hive cluster pool
+type clusterClaimFailure struct {
+	pool         string
+	errorMessage string
+	logExcerpt   string
+	// ready and size are -1 when the pool's state is unknown
+	ready int
+	size  int
+}
+
+// gatheredClusterPool is the subset of a (list of) Hive ClusterPool
+type gatheredClusterPool struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Size int `json:"size"`
+	} `json:"spec"`
+	Status struct {
+		Ready int `json:"ready"`
+		Size  int `json:"size"`
+	} `json:"status"`
+	Items []gatheredClusterPool `json:"items"`
+}
+
+// summary returns a one-line description of the failure,
+// e.g. "cluster pool `aws-4.14` exhausted — 0/10 ready"
+func (f *clusterClaimFailure) summary() string {
+	pool := "cluster pool"
+	if f.pool != "" {
+		pool = "cluster pool `" + f.pool + "`"
+	}
+	if f.size < 0 {
+		return "failed to claim a cluster from the " + pool
+	}
+	if f.ready == 0 {
+		return fmt.Sprintf("%s exhausted — %d/%d ready", pool, f.ready, f.size)
+	}
+	return fmt.Sprintf("failed to claim a cluster from the %s — %d/%d ready", pool, f.ready, f.size)
+}
+
+// parseClusterClaimFailure returns the cluster claim failure found within the
+// job's build log, or nil if the job didn't fail acquiring a cluster
+func parseClusterClaimFailure(buildLog string) *clusterClaimFailure {
+	lines := strings.Split(buildLog, "\n")
+	failure := &clusterClaimFailure{ready: -1, size: -1}
+
+	for i, line := range lines {
+		for _, r := range clusterClaimFailureRegexps {
+			if m := r.FindString(line); m != "" && failure.errorMessage == "" {
+				failure.errorMessage = strings.TrimSpace(m)
+				start := i - clusterClaimContextLines
+				if start < 0 {
+					start = 0
+				}
+				failure.logExcerpt = strings.Join(lines[start:i+1], "\n")
+			}
+		}
+		if !clusterClaimLineRegex.MatchString(line) {
+			// e.g. the tests' own output, which may report "N/M ready" too
+			continue
+		}
+		if m := clusterPoolNameRegex.FindStringSubmatch(line); m != nil && failure.pool == "" {
+			failure.pool = m[1]
+		}
+		if m := clusterPoolReadyRegex.FindStringSubmatch(line); m != nil {
+			failure.ready, _ = strconv.Atoi(m[1])
+			failure.size, _ = strconv.Atoi(m[2])
+		}
+	}
+
+	if failure.errorMessage == "" {
+		return nil
+	}
+	return failure
+}
+
+// addClusterPoolState completes the failure with the state of the
+// cluster pool, as dumped within the job's artifacts if it was
+func (f *clusterClaimFailure) addClusterPoolState(scanner *prow.ArtifactScanner) {
+	r := regexp.MustCompile(clusterPoolFilenameRegex)
+	for _, step := range scanner.ArtifactStepMap {
+		for name, artifact := range step {
+			if !r.MatchString(string(name)) {
+				continue
+			}
+			pool := &gatheredClusterPool{}
+			if yaml.Unmarshal([]byte(artifact.Content), pool) != nil {
+				continue
+			}
+			pools := append([]gatheredClusterPool{*pool}, pool.Items...)
+			for _, p := range pools {
+				if p.Kind != "ClusterPool" || (f.pool != "" && p.Metadata.Name != f.pool) {
+					continue
+				}
+				f.pool = p.Metadata.Name
+				f.ready = p.Status.Ready
+				f.size = p.Spec.Size
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	FailureMessagesAPIRoute = client.FailureMessagesPath
+
+	defaultColdStoragePrefix        = "failure-messages"
+	defaultColdStorageExcerptLength = 500
+)
+
+// coldStorage keeps the full failure messages in a GCS bucket, each message
+// being stored once under the hash of its content, encrypted when the
+// failure store's messages are
+type coldStorage struct {
+	client  *storage.Client
+	bucket  string
+	prefix  string
+	keyring *keyring
+}
+
+func newColdStorage(ctx context.Context, cfg ColdStorageConfig, kr *keyring) (*coldStorage, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %+v", err)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix == "" {
+		prefix = defaultColdStoragePrefix
+	}
+	return &coldStorage{client: client, bucket: cfg.GCSBucket, prefix: prefix, keyring: kr}, nil
+}
+
+// ref returns the name of the object holding the message
+func (c *coldStorage) ref(message string) string {
+	return path.Join(c.prefix, fmt.Sprintf("%x", sha256.Sum256([]byte(message))))
+}
+
+// put stores the message and returns the reference it's retrieved by
+func (c *coldStorage) put(ctx context.Context, message string) (string, error) {
+	ref := c.ref(message)
+	content := message
+	if c.keyring != nil {
+		var err error
+		if content, err = c.keyring.encrypt(message); err != nil {
+			return "", err
+		}
+	}
+
+	// the messages are content-addressed, an existing object already holds the message
+	w := c.client.Bucket(c.bucket).Object(ref).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = "text/plain; charset=utf-8"
+	if _, err := io.WriteString(w, content); err != nil {
+		w.Close()
+		return "", errors.Wrapf(err, "failed to write %s", ref)
+	}
+	if err := w.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			return "", errors.Wrapf(err, "failed to write %s", ref)
+		}
+	}
+	return ref, nil
+}
+
+// get returns the message stored under the reference
+func (c *coldStorage) get(ctx context.Context, ref string) (string, error) {
+	// the references are the objects' names, only those of the messages are served
+	if path.Dir(ref) != c.prefix || path.Clean(ref) != ref {
+		return "", storage.ErrObjectNotExist
+	}
+	rc, err := c.client.Bucket(c.bucket).Object(ref).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", ref)
+	}
+	if c.keyring == nil {
+		return string(content), nil
+	}
+	return c.keyring.decrypt(string(content))
+}
+
+// reencrypt re-encrypts the stored messages with the keyring's primary key,
+// see KeyringReencryptHandler. It returns the number of re-encrypted messages
+// and of those which can't be decrypted anymore
+func (c *coldStorage) reencrypt(ctx context.Context) (int, int, error) {
+	if c.keyring == nil {
+		return 0, 0, nil
+	}
+
+	rewritten, undecryptable := 0, 0
+	it := c.client.Bucket(c.bucket).Objects(ctx, &storage.Query{Prefix: c.prefix + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return rewritten, undecryptable, nil
+		}
+		if err != nil {
+			return rewritten, undecryptable, errors.Wrap(err, "failed to list the cold storage's messages")
+		}
+
+		obj := c.client.Bucket(c.bucket).Object(attrs.Name)
+		rc, err := obj.NewReader(ctx)
+		if err != nil {
+			return rewritten, undecryptable, errors.Wrapf(err, "failed to read %s", attrs.Name)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return rewritten, undecryptable, errors.Wrapf(err, "failed to read %s", attrs.Name)
+		}
+
+		reencrypted, changed, err := c.keyring.reencrypt(string(content))
+		if errors.Is(err, errEncryptionKeyNotAvailable) {
+			undecryptable++
+			continue
+		}
+		if err != nil {
+			return rewritten, undecryptable, errors.Wrapf(err, "failed to re-encrypt %s", attrs.Name)
+		}
+		if !changed {
+			continue
+		}
+
+		// the object is left alone if it changed meanwhile
+		w := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+		w.ContentType = attrs.ContentType
+		if _, err := io.WriteString(w, reencrypted); err != nil {
+			w.Close()
+			return rewritten, undecryptable, errors.Wrapf(err, "failed to write %s", attrs.Name)
+		}
+		if err := w.Close(); err != nil {
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+				return rewritten, undecryptable, errors.Wrapf(err, "failed to write %s", attrs.Name)
+			}
+			continue
+		}
+		rewritten++
+	}
+}
+
+// excerpt returns the beginning of the message, up to 'length' characters
+func excerpt(message string, length int) string {
+	if utf8.RuneCountInString(message) <= length {
+		return message
+	}
+	return string([]rune(message)[:length])
+}
+
+// tieredFailureStore is a FailureStore which only keeps the excerpts of the
+// long failure messages in the underlying store, the full messages being
+// offloaded to the cold storage and retrieved through the API on demand
+type tieredFailureStore struct {
+	FailureStore
+	cold          *coldStorage
+	excerptLength int
+	logger        zerolog.Logger
+}
+
+func (s *tieredFailureStore) RecordFailures(ctx context.Context, records []FailureRecord) error {
+	hot := make([]FailureRecord, 0, len(records))
+	for _, r := range records {
+		if utf8.RuneCountInString(r.Message) > s.excerptLength {
+			if ref, err := s.cold.put(ctx, r.Message); err != nil {
+				// the full message stays hot rather than getting lost
+				s.logger.Error().Err(err).Msg("Failed to offload the failure message to the cold storage")
+			} else {
+				r.Message, r.MessageRef = excerpt(r.Message, s.excerptLength), ref
+			}
+		}
+		hot = append(hot, r)
+	}
+
+	return s.FailureStore.RecordFailures(ctx, hot)
+}
+
+func (s *tieredFailureStore) CountFailures(ctx context.Context, testCases []string, since time.Time, exceptJobURL string) (map[string]int, error) {
+	return countFailures(ctx, s.FailureStore, testCases, since, exceptJobURL)
+}
+
+func (s *tieredFailureStore) RecordJobDurations(ctx context.Context, durations []JobDuration) error {
+	return recordJobDurations(ctx, s.FailureStore, durations)
+}
+
+func (s *tieredFailureStore) ListJobDurations(ctx context.Context, from, to time.Time) ([]JobDuration, error) {
+	return listJobDurations(ctx, s.FailureStore, from, to)
+}
+
+func (s *tieredFailureStore) RecordCommentHash(ctx context.Context, commentID int64, hash string, at time.Time) error {
+	return recordCommentHash(ctx, s.FailureStore, commentID, hash, at)
+}
+
+func (s *tieredFailureStore) CommentHash(ctx context.Context, commentID int64) (string, time.Time, error) {
+	return commentHash(ctx, s.FailureStore, commentID)
+}
+
+func (s *tieredFailureStore) SetMentionOptOut(ctx context.Context, login string, optedOut bool) error {
+	return setMentionOptOut(ctx, s.FailureStore, login, optedOut)
+}
+
+func (s *tieredFailureStore) ListMentionOptOuts(ctx context.Context) ([]string, error) {
+	return listMentionOptOuts(ctx, s.FailureStore)
+}
+
+func (s *tieredFailureStore) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return acquireLock(ctx, s.FailureStore, key, owner, ttl)
+}
+
+func (s *tieredFailureStore) ReleaseLock(ctx context.Context, key, owner string) error {
+	return releaseLock(ctx, s.FailureStore, key, owner)
+}
+
+// FailureMessagesAPIHandler returns the full failure message offloaded
+// to the cold storage under the 'ref' query parameter
+type FailureMessagesAPIHandler struct {
+	Cold   *coldStorage
+	Logger zerolog.Logger
+}
+
+func (h *FailureMessagesAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		http.Error(w, "the 'ref' query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	message, err := h.Cold.get(ctx, ref)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		http.Error(w, "no such failure message", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Logger.Error().Err(err).Msgf("Failed to retrieve the failure message %s", ref)
+		http.Error(w, "failed to retrieve the failure message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(client.FailureMessage{Ref: ref, Message: message}); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to encode the failure message")
+	}
+}
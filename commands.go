@@ -0,0 +1,167 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/rs/zerolog"
+)
+
+const (
+	reportFormatCommand = "/report-format"
+	reportFormatFull    = "full"
+	reportFormatCompact = "compact"
+	// a short summary in the comment, the full report in a check run
+	reportFormatSummary = "summary"
+	// the subcommands of the app's own command, e.g. /ci-helper ping
+	ciHelperCommand = "/ci-helper"
+)
+
+// command is a slash command found within a PR comment
+type command struct {
+	name string
+	args []string
+}
+
+var knownCommands = []string{reportFormatCommand, heatmapCommand, ciHelperCommand, compareCommand, watchJobCommand}
+
+// parseCommand returns the first known slash command
+// found at the beginning of a line of the comment's body
+func parseCommand(body string) *command {
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, name := range knownCommands {
+			if fields[0] == name {
+				return &command{name: name, args: fields[1:]}
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleCommand executes the given slash command and
+// acknowledges it by reacting to the command's comment
+func (h *PRCommentHandler) handleCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, deliveryID string, cmd *command) error {
+	logger.Debug().Msgf("Handling the command %s %v", cmd.name, cmd.args)
+	h.Telemetry.count("command:" + cmd.name)
+
+	var err error
+	switch cmd.name {
+	case reportFormatCommand:
+		err = h.handleReportFormatCommand(ctx, logger, client, event, cmd.args)
+	case heatmapCommand:
+		err = h.handleHeatmapCommand(ctx, logger, client, event, cmd.args)
+	case ciHelperCommand:
+		err = h.handleCIHelperCommand(ctx, logger, client, event, deliveryID, cmd.args)
+	case compareCommand:
+		err = h.handleCompareCommand(ctx, logger, client, event, cmd.args)
+	case watchJobCommand:
+		err = h.handleWatchJobCommand(ctx, logger, client, event, cmd.args)
+	}
+	if err != nil {
+		return err
+	}
+
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	if _, _, err := client.Reactions.CreateIssueCommentReaction(ctx, repoOwner, repoName, event.GetComment().GetID(), "+1"); err != nil {
+		logger.Error().Err(err).Msg("Failed to react to the command's comment")
+	}
+
+	return nil
+}
+
+// handleReportFormatCommand stores the report format requested for the PR
+// and re-renders the PR's latest report in that format, if there is one
+func (h *PRCommentHandler) handleReportFormatCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, args []string) error {
+	if len(args) != 1 || (args[0] != reportFormatCompact && args[0] != reportFormatFull && args[0] != reportFormatSummary) {
+		return fmt.Errorf("usage: %s %s|%s|%s", reportFormatCommand, reportFormatCompact, reportFormatFull, reportFormatSummary)
+	}
+	format := args[0]
+
+	repoFullName := event.GetRepo().GetFullName()
+	prNumber := event.GetIssue().GetNumber()
+	h.Analyses.setReportFormat(repoFullName, prNumber, format)
+
+	a := h.Analyses.get(repoFullName, prNumber)
+	if a == nil {
+		logger.Debug().Msg("The PR has no report to re-render yet")
+		return nil
+	}
+
+	if a.reportedBy != "" && a.reportedBy != reportedByEdit {
+		logger.Debug().Msgf("The PR's latest report wasn't posted within the job's comment (%s), not re-rendering it", a.reportedBy)
+		return nil
+	}
+	if format == reportFormatSummary && a.report.detailsURL == "" {
+		a.report.publishDetails(ctx, logger, client, h.Telemetry, event, checkRunNeutral)
+	}
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	return editReport(ctx, logger, client, h.CommentLint, h.CommentEdits, repoOwner, repoName, a.commentID, a.commentBody, a.report.identity, a.report.sections(format))
+}
+
+// handleCIHelperCommand executes the subcommands of /ci-helper
+func (h *PRCommentHandler) handleCIHelperCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, deliveryID string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s|%s|%s|%s|%s", ciHelperCommand, pingCommand, analyzeCommand, fileIssueCommand, unsubscribeCommand, subscribeCommand)
+	}
+
+	switch args[0] {
+	case pingCommand:
+		return h.handleCIHelperPing(ctx, logger, client, event)
+	case analyzeCommand:
+		return h.handleCIHelperAnalyze(ctx, logger, client, event, deliveryID, args[1:])
+	case fileIssueCommand:
+		return h.handleCIHelperFileIssue(ctx, logger, client, event, args[1:])
+	case unsubscribeCommand, subscribeCommand:
+		login := event.GetComment().GetUser().GetLogin()
+		if !h.Mentions.persisted() {
+			// the opt-out would be lost on restart, and unknown to the other replicas
+			body := fmt.Sprintf(":warning: @%s, this instance of the app doesn't persist the mention opt-outs, so `%s %s` isn't supported.", login, ciHelperCommand, args[0])
+			if _, _, err := client.Issues.CreateComment(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber(), &github.IssueComment{Body: &body}); err != nil {
+				logger.Error().Err(err).Msg("Failed to refuse the mention opt-out")
+			}
+			return fmt.Errorf("nothing persists the mention opt-outs")
+		}
+		if err := h.Mentions.set(ctx, login, args[0] == unsubscribeCommand); err != nil {
+			return err
+		}
+		logger.Info().Msgf("%s %sd from the mentions", login, args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown subcommand %s %s", ciHelperCommand, args[0])
+	}
+}
+
+// reportFormat returns the report format requested for the
+// PR, falling back to the repository's default format
+func (h *PRCommentHandler) reportFormat(repoFullName string, prNumber int) string {
+	if format := h.Analyses.reportFormat(repoFullName, prNumber); format != "" {
+		return format
+	}
+	if format := h.repositoryConfig(repoFullName).ReportFormat; format != "" {
+		return format
+	}
+	return reportFormatFull
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	CommentConflictsRoute string = "/admin/comments/conflicts"
+	// the oldest written comments are forgotten past this many
+	maxTrackedComments = 10000
+)
+
+// writtenComment is the last body the app wrote to a comment
+type writtenComment struct {
+	repository string
+	hash       string
+	at         time.Time
+}
+
+type commentConflictStats struct {
+	Repository string `json:"repository"`
+	Edits      int    `json:"edits"`
+	// the edits skipped as the app already wrote the same body, e.g. on redeliveries
+	SkippedEdits int        `json:"skipped_edits"`
+	Conflicts    int        `json:"conflicts"`
+	ConflictRate float64    `json:"conflict_rate"`
+	LastConflict *time.Time `json:"last_conflict,omitempty"`
+}
+
+// commentEdits records the hash of every comment body the app writes, to
+// detect the comments modified by someone else between two of its edits,
+// e.g. by the bot posting the Prow job's results. The conflicts per
+// repository tell where the report should rather be kept in its own comment.
+// The hashes are shared by the replicas through the failure store, so that
+// the redeliveries are recognized after a restart or by another replica, the
+// replica's own hashes being used when the store fails. A nil history
+// records nothing
+type commentEdits struct {
+	store    FailureStore
+	mu       sync.Mutex
+	comments map[int64]*writtenComment
+	stats    map[string]*commentConflictStats
+}
+
+func newCommentEdits(store FailureStore) *commentEdits {
+	return &commentEdits{store: store, comments: map[int64]*writtenComment{}, stats: map[string]*commentConflictStats{}}
+}
+
+func commentBodyHash(body string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(body)))[:16]
+}
+
+// lastWritten returns the hash of the last body the app wrote to the comment and
+// when, or "" if it never wrote it
+func (e *commentEdits) lastWritten(ctx context.Context, logger zerolog.Logger, commentID int64) (string, time.Time) {
+	if e.store != nil {
+		hash, at, err := commentHash(ctx, e.store, commentID)
+		if err == nil {
+			return hash, at
+		}
+		logger.Error().Err(err).Msgf("Failed to get the hash of the comment (ID: %v) from the store, using the replica's own", commentID)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if written, ok := e.comments[commentID]; ok {
+		return written.hash, written.at
+	}
+	return "", time.Time{}
+}
+
+// check compares the current body of the comment with the last one the app
+// wrote, and returns whether it was modified since then
+func (e *commentEdits) check(ctx context.Context, logger zerolog.Logger, repoFullName string, commentID int64, currentBody string) bool {
+	if e == nil {
+		return false
+	}
+	hash, at := e.lastWritten(ctx, logger, commentID)
+	if hash == "" || hash == commentBodyHash(currentBody) {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	stats := e.repositoryStats(repoFullName)
+	stats.Conflicts++
+	stats.LastConflict = &now
+	logger.Warn().Msgf("The comment (ID: %v) was modified by someone else since the app edited it %s ago", commentID, now.Sub(at).Round(time.Second))
+
+	return true
+}
+
+// isLastWritten returns whether the body is the last one the app wrote to the
+// comment, whose edit would be a no-op. It counts the skipped edit if so
+func (e *commentEdits) isLastWritten(ctx context.Context, logger zerolog.Logger, repoFullName string, commentID int64, body string) bool {
+	if e == nil {
+		return false
+	}
+	if hash, _ := e.lastWritten(ctx, logger, commentID); hash == "" || hash != commentBodyHash(body) {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.repositoryStats(repoFullName).SkippedEdits++
+	return true
+}
+
+// record records the body the app wrote to the comment
+func (e *commentEdits) record(ctx context.Context, logger zerolog.Logger, repoFullName string, commentID int64, body string) {
+	if e == nil {
+		return
+	}
+	hash, now := commentBodyHash(body), time.Now()
+	if e.store != nil {
+		if err := recordCommentHash(ctx, e.store, commentID, hash, now); err != nil {
+			logger.Error().Err(err).Msgf("Failed to record the hash of the comment (ID: %v) in the store", commentID)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.repositoryStats(repoFullName).Edits++
+	e.comments[commentID] = &writtenComment{repository: repoFullName, hash: hash, at: now}
+
+	if len(e.comments) > maxTrackedComments {
+		var oldestID int64
+		var oldest time.Time
+		for id, c := range e.comments {
+			if oldest.IsZero() || c.at.Before(oldest) {
+				oldestID, oldest = id, c.at
+			}
+		}
+		delete(e.comments, oldestID)
+	}
+}
+
+func (e *commentEdits) repositoryStats(repoFullName string) *commentConflictStats {
+	stats, ok := e.stats[repoFullName]
+	if !ok {
+		stats = &commentConflictStats{Repository: repoFullName}
+		e.stats[repoFullName] = stats
+	}
+	return stats
+}
+
+// report returns the conflicts of each repository, the most conflicting first
+func (e *commentEdits) report() []commentConflictStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	report := make([]commentConflictStats, 0, len(e.stats))
+	for _, stats := range e.stats {
+		s := *stats
+		if s.Edits > 0 {
+			s.ConflictRate = float64(s.Conflicts) / float64(s.Edits)
+		}
+		report = append(report, s)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Conflicts != report[j].Conflicts {
+			return report[i].Conflicts > report[j].Conflicts
+		}
+		return report[i].Repository < report[j].Repository
+	})
+
+	return report
+}
+
+// CommentConflictsHandler reports how often the comments edited
+// by the app were modified by someone else, per repository
+type CommentConflictsHandler struct {
+	Edits  *commentEdits
+	Logger zerolog.Logger
+}
+
+func (h *CommentConflictsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Edits.report()); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to encode the comment conflicts")
+	}
+}
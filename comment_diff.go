@@ -0,0 +1,210 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the report is delimited by these hidden markers within the comment, so that
+	// it can be updated without touching the rest of the comment's body
+	reportStartMarker    = "<!-- ci-helper-report -->\n"
+	reportEndMarker      = "<!-- /ci-helper-report -->\n"
+	instanceMarkerPrefix = "<!-- ci-helper-report: "
+	instanceStartMarker  = instanceMarkerPrefix + "%s -->\n"
+	instanceEndMarker    = "<!-- /ci-helper-report: %s -->\n"
+	reportSeparator      = "\n-------------------------------\n\n"
+	sectionMarkerFormat  = "<!-- ci-helper-section: %s -->\n"
+	sectionMarkerRegex   = `(?m)^<!-- ci-helper-section: ([a-z0-9-]+) -->\n`
+)
+
+// reportSection is a part of the report which
+// can be compared across versions of the report
+type reportSection struct {
+	key     string
+	content string
+}
+
+// reportIdentity tells apart the reports of the app's instances (e.g. staging
+// and production) acting on the same repositories, each instance only
+// ever updating its own report within a comment
+type reportIdentity struct {
+	// empty for the default instance, whose markers aren't qualified
+	instance string
+	// rendered at the bottom of the report when set
+	signature string
+}
+
+func (id reportIdentity) startMarker() string {
+	if id.instance == "" {
+		return reportStartMarker
+	}
+	return fmt.Sprintf(instanceStartMarker, id.instance)
+}
+
+func (id reportIdentity) endMarker() string {
+	if id.instance == "" {
+		return reportEndMarker
+	}
+	return fmt.Sprintf(instanceEndMarker, id.instance)
+}
+
+// isAnnotated returns whether the comment's body already contains the instance's report
+func (id reportIdentity) isAnnotated(body string) bool {
+	if strings.Contains(body, id.startMarker()) {
+		return true
+	}
+	// the reports of the default instance written before the markers were introduced
+	return id.instance == "" && strings.Contains(body, reportSeparator) && !strings.Contains(body, instanceMarkerPrefix)
+}
+
+// detectAppSlug returns the slug of the GitHub App the instance authenticates as
+func detectAppSlug(ctx context.Context, cc githubapp.ClientCreator) (string, error) {
+	client, err := cc.NewAppClient()
+	if err != nil {
+		return "", err
+	}
+	app, _, err := client.Apps.Get(ctx, "")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get the GitHub App")
+	}
+	return app.GetSlug(), nil
+}
+
+// failedFingerprintKey returns the section key of the failed test case,
+// 'seen' counts the keys already used to keep them unique
+func failedFingerprintKey(tc failedTestCase, seen map[string]int) string {
+	key := "tc-" + failureFingerprint(tc.suiteName, tc.name)
+	seen[key]++
+	if seen[key] > 1 {
+		key = fmt.Sprintf("%s-%d", key, seen[key])
+	}
+	return key
+}
+
+// renderReportBlock renders the given sections, delimited by the report's markers
+func renderReportBlock(id reportIdentity, sections []reportSection) string {
+	var b strings.Builder
+
+	b.WriteString(id.startMarker())
+	for _, s := range sections {
+		fmt.Fprintf(&b, sectionMarkerFormat, s.key)
+		b.WriteString(s.content)
+	}
+	b.WriteString(reportSeparator)
+	b.WriteString(id.endMarker())
+
+	return b.String()
+}
+
+// parseReportBlock splits the comment's body around the report's block
+// and returns the sections of the report, if the body contains one
+func parseReportBlock(id reportIdentity, body string) (before string, sections []reportSection, after string, found bool) {
+	startMarker, endMarker := id.startMarker(), id.endMarker()
+	start := strings.Index(body, startMarker)
+	if start < 0 {
+		return "", nil, body, false
+	}
+	end := strings.Index(body[start:], endMarker)
+	if end < 0 {
+		return "", nil, body, false
+	}
+	end += start
+
+	block := strings.TrimSuffix(body[start+len(startMarker):end], reportSeparator)
+	r := regexp.MustCompile(sectionMarkerRegex)
+	markers := r.FindAllStringSubmatchIndex(block, -1)
+	for i, m := range markers {
+		contentEnd := len(block)
+		if i+1 < len(markers) {
+			contentEnd = markers[i+1][0]
+		}
+		sections = append(sections, reportSection{key: block[m[2]:m[3]], content: block[m[1]:contentEnd]})
+	}
+
+	return body[:start], sections, body[end+len(endMarker):], true
+}
+
+// mergeReportIntoComment replaces the report within the comment's body with the
+// given sections (or prepends them when there's no report yet), leaving the rest
+// of the body untouched. It also returns the keys of the added, updated or
+// removed sections
+func mergeReportIntoComment(id reportIdentity, body string, sections []reportSection) (string, []string) {
+	before, current, after, _ := parseReportBlock(id, body)
+
+	currentContent := map[string]string{}
+	for _, s := range current {
+		currentContent[s.key] = s.content
+	}
+
+	var changed []string
+	for _, s := range sections {
+		if content, ok := currentContent[s.key]; !ok || content != s.content {
+			changed = append(changed, s.key)
+		}
+		delete(currentContent, s.key)
+	}
+	for _, s := range current {
+		if _, ok := currentContent[s.key]; ok {
+			changed = append(changed, s.key)
+		}
+	}
+
+	return before + renderReportBlock(id, sections) + after, changed
+}
+
+// editReport updates the report within the PR comment with the given ID,
+// skipping the edit when none of the report's sections changed. If the
+// comment can't be fetched, 'commentBody' is used as its current body. The
+// report is repaired by the linter first, so that it renders on GitHub, and
+// the written body recorded to detect the comment's later modifications
+func editReport(ctx context.Context, logger zerolog.Logger, client *github.Client, lint *commentLint, edits *commentEdits, repoOwner, repoName string, commentID int64, commentBody string, id reportIdentity, sections []reportSection) error {
+	if comment, _, err := client.Issues.GetComment(ctx, repoOwner, repoName, commentID); err != nil {
+		logger.Error().Err(err).Msgf("Failed to fetch the current body of the comment (ID: %v), using the cached one", commentID)
+	} else {
+		commentBody = comment.GetBody()
+		edits.check(ctx, logger, repoOwner+"/"+repoName, commentID, commentBody)
+	}
+
+	sections = lint.repairSections(logger, sections)
+	body, changed := mergeReportIntoComment(id, commentBody, sections)
+	if len(changed) == 0 {
+		logger.Debug().Msgf("The report within the comment (ID: %v) is up to date", commentID)
+		return nil
+	}
+	logger.Debug().Msgf("Updating the section(s) %s of the report within the comment (ID: %v)", strings.Join(changed, ", "), commentID)
+
+	body = lint.fitComment(logger, id, body, sections)
+	// redeliveries and refreshes mostly render the body the app already wrote
+	if edits.isLastWritten(ctx, logger, repoOwner+"/"+repoName, commentID, body) {
+		logger.Debug().Msgf("The comment (ID: %v) already has the rendered body, skipping its edit", commentID)
+		return nil
+	}
+	if err := editComment(ctx, logger, client, repoOwner, repoName, commentID, body); err != nil {
+		return err
+	}
+	edits.record(ctx, logger, repoOwner+"/"+repoName, commentID, body)
+
+	return nil
+}
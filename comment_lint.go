@@ -0,0 +1,244 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// GitHub rejects the comments longer than this many characters
+	maxCommentLength = 65536
+	// the <details> nested deeper than this are hard to read, if rendered at all
+	maxDetailsDepth = 3
+
+	repairUnclosedFence  = "unclosed_fence"
+	repairUnbalancedHTML = "unbalanced_html"
+	repairNestingDepth   = "nesting_depth"
+	repairSize           = "size"
+
+	truncatedSectionNote = "\n… (truncated, the report exceeds the size of a GitHub comment)\n"
+)
+
+var (
+	// the HTML tags of the reports which must be balanced to not swallow the rest of the comment
+	commentHTMLTagRegex = regexp.MustCompile(`(?i)<(/?)(details|summary|pre|code|sub|sup|b|i)(\s[^>]*)?>`)
+	anyHTMLTagRegex     = regexp.MustCompile(`<[^>]+>`)
+	fenceRegex          = regexp.MustCompile("^ {0,3}(`{3,})")
+)
+
+// commentLint checks the rendered reports against what GitHub renders (and
+// accepts) before posting them, repairing them when needed. A nil linter
+// still repairs the reports, without exporting how often it had to
+type commentLint struct {
+	validations prometheus.Counter
+	repairs     *prometheus.CounterVec
+}
+
+func newCommentLint(registry *prometheus.Registry) *commentLint {
+	l := &commentLint{
+		validations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ci_helper_comment_validations_total",
+			Help: "Number of reports validated before posting them.",
+		}),
+		repairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_comment_repairs_total",
+			Help: "Number of repairs of the reports before posting them, by the kind of repair.",
+		}, []string{"repair"}),
+	}
+	registry.MustRegister(l.validations, l.repairs)
+
+	return l
+}
+
+// repairSections returns the sections with their unclosed code fences and
+// HTML tags closed, and the sections nesting <details> too deep as plain text
+func (l *commentLint) repairSections(logger zerolog.Logger, sections []reportSection) []reportSection {
+	if l != nil {
+		l.validations.Inc()
+	}
+
+	repaired := make([]reportSection, 0, len(sections))
+	for _, s := range sections {
+		content, repairs := lintMarkdown(s.content)
+		for _, repair := range repairs {
+			logger.Warn().Msgf("Repairing the section %s of the report: %s", s.key, repair)
+			l.count(repair)
+		}
+		repaired = append(repaired, reportSection{key: s.key, content: content})
+	}
+
+	return repaired
+}
+
+// fitComment falls back to the plain text of the sections when the comment
+// would exceed GitHub's limit, truncating the longest ones until it fits
+func (l *commentLint) fitComment(logger zerolog.Logger, id reportIdentity, body string, sections []reportSection) string {
+	if utf8.RuneCountInString(body) <= maxCommentLength {
+		return body
+	}
+	logger.Warn().Msgf("The comment has %d characters, more than GitHub's %d, falling back to the plain text report", utf8.RuneCountInString(body), maxCommentLength)
+	l.count(repairSize)
+
+	before, _, after, _ := parseReportBlock(id, body)
+	texts := make([][]rune, len(sections))
+	for i, s := range sections {
+		texts[i] = []rune(sectionText(s.content))
+	}
+
+	for {
+		plain := make([]reportSection, len(sections))
+		for i, s := range sections {
+			plain[i] = reportSection{key: s.key, content: textSection(string(texts[i]))}
+		}
+		body = before + renderReportBlock(id, plain) + after
+		excess := utf8.RuneCountInString(body) - maxCommentLength
+		if excess <= 0 {
+			return body
+		}
+
+		longest := 0
+		for i := range texts {
+			if len(texts[i]) > len(texts[longest]) {
+				longest = i
+			}
+		}
+		if len(texts[longest]) <= utf8.RuneCountInString(truncatedSectionNote) {
+			// nothing left to truncate, let GitHub reject the comment
+			return body
+		}
+		// the escaping of the text can still exceed the limit, truncating it again then
+		keep := len(texts[longest]) - excess - utf8.RuneCountInString(truncatedSectionNote)
+		if keep < 0 {
+			keep = 0
+		}
+		texts[longest] = append(texts[longest][:keep], []rune(truncatedSectionNote)...)
+	}
+}
+
+func (l *commentLint) count(repair string) {
+	if l != nil {
+		l.repairs.WithLabelValues(repair).Inc()
+	}
+}
+
+// lintMarkdown closes the unclosed code fences and HTML tags of the
+// content, dropping the stray closing tags, and returns the repairs made
+func lintMarkdown(content string) (string, []string) {
+	var (
+		repairs []string
+		b       strings.Builder
+		fence   string
+		open    []string
+		depth   int
+		deepest int
+		stray   bool
+	)
+
+	lines := strings.SplitAfter(content, "\n")
+	for _, line := range lines {
+		if m := fenceRegex.FindStringSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = m[1]
+			case len(m[1]) >= len(fence) && strings.TrimSpace(line) == m[1]:
+				fence = ""
+			}
+			b.WriteString(line)
+			continue
+		}
+		if fence != "" {
+			// verbatim within the code blocks
+			b.WriteString(line)
+			continue
+		}
+
+		b.WriteString(commentHTMLTagRegex.ReplaceAllStringFunc(line, func(tag string) string {
+			m := commentHTMLTagRegex.FindStringSubmatch(tag)
+			name := strings.ToLower(m[2])
+			if m[1] == "" {
+				open = append(open, name)
+				if name == "details" {
+					depth++
+					if depth > deepest {
+						deepest = depth
+					}
+				}
+				return tag
+			}
+
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				// the tags opened within this one can't outlive it
+				var closing string
+				for j := len(open) - 1; j > i; j-- {
+					closing += "</" + open[j] + ">"
+					stray = true
+				}
+				for _, o := range open[i:] {
+					if o == "details" {
+						depth--
+					}
+				}
+				open = open[:i]
+				return closing + tag
+			}
+			stray = true
+			return ""
+		}))
+	}
+
+	repaired := b.String()
+	if fence != "" {
+		repaired = strings.TrimSuffix(repaired, "\n") + "\n" + fence + "\n"
+		repairs = append(repairs, repairUnclosedFence)
+	}
+	if len(open) > 0 {
+		for i := len(open) - 1; i >= 0; i-- {
+			repaired += "</" + open[i] + ">"
+		}
+		repaired += "\n"
+		stray = true
+	}
+	if stray {
+		repairs = append(repairs, repairUnbalancedHTML)
+	}
+	if deepest > maxDetailsDepth {
+		repaired = textSection(sectionText(repaired))
+		repairs = append(repairs, repairNestingDepth)
+	}
+
+	return repaired, repairs
+}
+
+// sectionText returns the text of the section's content, without any markdown or HTML
+func sectionText(content string) string {
+	return strings.TrimSpace(plainText(anyHTMLTagRegex.ReplaceAllString(content, "")))
+}
+
+// textSection renders the text as the content of a section
+func textSection(text string) string {
+	if text == "" {
+		return "\n"
+	}
+	return preBlock(text)
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultCommentReconcilerInterval  = 30 * time.Minute
+	defaultCommentReconcilerLookback  = 24 * time.Hour
+	defaultCommentReconcilerGrace     = 15 * time.Minute
+	defaultCommentReconcilerMaxPerRun = 20
+	defaultMinRateRemaining           = 1000
+)
+
+var errRateLimitReached = errors.New("the remaining GitHub API rate limit is too low")
+
+// commentReconciler periodically looks for the failure comments of the
+// recently updated open PRs which the app didn't annotate (e.g. because
+// it was down or crashed meanwhile) and analyses them
+type commentReconciler struct {
+	clientCreator githubapp.ClientCreator
+	handler       githubapp.EventHandler
+	config        CommentReconcilerConfig
+	identity      reportIdentity
+	logger        zerolog.Logger
+
+	// IDs of the comments already submitted for analysis
+	attempted map[int64]time.Time
+}
+
+func newCommentReconciler(cc githubapp.ClientCreator, handler githubapp.EventHandler, cfg CommentReconcilerConfig, identity reportIdentity, logger zerolog.Logger) *commentReconciler {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultCommentReconcilerInterval
+	}
+	if cfg.Lookback == 0 {
+		cfg.Lookback = defaultCommentReconcilerLookback
+	}
+	if cfg.GracePeriod == 0 {
+		cfg.GracePeriod = defaultCommentReconcilerGrace
+	}
+	if cfg.MaxPerRun == 0 {
+		cfg.MaxPerRun = defaultCommentReconcilerMaxPerRun
+	}
+	if cfg.MinRateRemaining == 0 {
+		cfg.MinRateRemaining = defaultMinRateRemaining
+	}
+
+	return &commentReconciler{
+		clientCreator: cc,
+		handler:       handler,
+		config:        cfg,
+		identity:      identity,
+		logger:        logger,
+		attempted:     map[int64]time.Time{},
+	}
+}
+
+// run reconciles the comments every configured interval until the context is done
+func (r *commentReconciler) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reconcile(ctx); err != nil {
+				r.logger.Error().Err(err).Msg("Failed to reconcile the failure comments")
+			}
+		}
+	}
+}
+
+// reconcile goes through the recently updated open PRs of all installations
+func (r *commentReconciler) reconcile(ctx context.Context) error {
+	for id, at := range r.attempted {
+		if time.Since(at) > r.config.Lookback {
+			delete(r.attempted, id)
+		}
+	}
+
+	appClient, err := r.clientCreator.NewAppClient()
+	if err != nil {
+		return err
+	}
+	installations, err := listInstallations(ctx, appClient)
+	if err != nil {
+		return err
+	}
+
+	budget := r.config.MaxPerRun
+	for _, installation := range installations {
+		client, err := r.clientCreator.NewInstallationClient(installation.GetID())
+		if err != nil {
+			return err
+		}
+
+		since := time.Now().Add(-r.config.Lookback)
+		query := fmt.Sprintf("is:pr is:open commenter:%s updated:>=%s user:%s",
+			targetAuthor, since.UTC().Format(time.RFC3339), installation.GetAccount().GetLogin())
+		// the search responses carry the search's own rate limit (30/min), not the core one
+		opts := &github.SearchOptions{ListOptions: github.ListOptions{PerPage: 100}}
+		for {
+			result, resp, err := client.Search.Issues(ctx, query, opts)
+			if err != nil {
+				r.logger.Error().Err(err).Msgf("Failed to search for the PRs of %s", installation.GetAccount().GetLogin())
+				break
+			}
+
+			for _, issue := range result.Issues {
+				if budget <= 0 {
+					r.logger.Debug().Msg("Reached the maximum number of comments analysed per reconciliation")
+					return nil
+				}
+				submitted, err := r.reconcilePR(ctx, client, installation.GetID(), issue, since, budget)
+				budget -= submitted
+				if err != nil {
+					return err
+				}
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+	}
+
+	return nil
+}
+
+// reconcilePR submits the PR's unannotated failure comments for analysis,
+// up to 'budget' of them, and returns how many were submitted
+func (r *commentReconciler) reconcilePR(ctx context.Context, client *github.Client, installationID int64, issue *github.Issue, since time.Time, budget int) (int, error) {
+	owner, repo, err := repositoryFromIssue(issue)
+	if err != nil {
+		return 0, err
+	}
+
+	comments, resp, err := client.Issues.ListComments(ctx, owner, repo, issue.GetNumber(), &github.IssueListCommentsOptions{
+		Since:       &since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		r.logger.Error().Err(err).Msgf("Failed to list the comments of %s", issue.GetHTMLURL())
+		return 0, nil
+	}
+	if err := r.checkRate(resp); err != nil {
+		return 0, err
+	}
+
+	submitted := 0
+	for _, comment := range comments {
+		if submitted == budget {
+			break
+		}
+		if !r.needsAnalysis(comment) {
+			continue
+		}
+		r.attempted[comment.GetID()] = time.Now()
+		submitted++
+
+		r.logger.Info().Msgf("Analysing the unannotated comment %s", comment.GetHTMLURL())
+		if err := r.analyse(ctx, installationID, owner, repo, issue, comment); err != nil {
+			r.logger.Error().Err(err).Msgf("Failed to analyse the comment %s", comment.GetHTMLURL())
+		}
+	}
+
+	return submitted, nil
+}
+
+// needsAnalysis returns whether the comment is a failure comment which the app
+// didn't annotate, and whose live analysis would have finished by now
+func (r *commentReconciler) needsAnalysis(comment *github.IssueComment) bool {
+	if !strings.HasPrefix(comment.GetUser().GetLogin(), targetAuthor) {
+		return false
+	}
+	if _, ok := r.attempted[comment.GetID()]; ok {
+		return false
+	}
+	if time.Since(comment.GetCreatedAt().Time) < r.config.GracePeriod {
+		return false
+	}
+	if r.identity.isAnnotated(comment.GetBody()) {
+		return false
+	}
+	_, err := extractProwJobURLFromCommentBody(comment.GetBody())
+	return err == nil
+}
+
+// analyse replays the comment's creation to the handler
+func (r *commentReconciler) analyse(ctx context.Context, installationID int64, owner, repo string, issue *github.Issue, comment *github.IssueComment) error {
+	payload, err := commentCreatedPayload(installationID, owner, repo, issue, comment)
+	if err != nil {
+		return err
+	}
+
+	return r.handler.Handle(ctx, "issue_comment", fmt.Sprintf("reconciler-%d", comment.GetID()), payload)
+}
+
+// listInstallations lists all the installations of the app
+func listInstallations(ctx context.Context, appClient *github.Client) ([]*github.Installation, error) {
+	var installations []*github.Installation
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := appClient.Apps.ListInstallations(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list the app's installations")
+		}
+		installations = append(installations, page...)
+		if resp.NextPage == 0 {
+			return installations, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// checkRate fails once the core rate limit left is below the configured minimum
+func (r *commentReconciler) checkRate(resp *github.Response) error {
+	if resp != nil && resp.Rate.Limit > 0 && resp.Rate.Remaining < r.config.MinRateRemaining {
+		return errRateLimitReached
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/onsi/ginkgo/v2/reporters"
+	"github.com/rs/zerolog"
+)
+
+const (
+	compareCommand = "/compare"
+	// number of tests listed within the comparison's duration deltas
+	compareDurationDeltas = 5
+)
+
+// comparedJob is one of the two analysed jobs of a comparison
+type comparedJob struct {
+	url      string
+	name     string
+	duration time.Duration
+	report   *FailedTestCasesReport
+	// the durations of the junit test cases, keyed by "<suite>/<test case>"
+	testDurations map[string]time.Duration
+}
+
+// handleCompareCommand analyses the two given Prow jobs and posts which
+// failures they share, which ones only one of them has, and how their
+// durations differ, e.g. to check that a fix changed the CI's behavior
+func (h *PRCommentHandler) handleCompareCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <Prow job URL> <Prow job URL>", compareCommand)
+	}
+
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	prNumber := event.GetIssue().GetNumber()
+
+	ctx, done := h.Cancellations.start(ctx, event.GetRepo().GetFullName(), prNumber)
+	defer done()
+
+	var jobs [2]*comparedJob
+	for i, arg := range args {
+		// tolerate the URLs pasted as autolinks, e.g. <https://...>
+		prowJobURL := strings.TrimSuffix(strings.Trim(arg, "<>"), "/")
+		if _, err := parseProwJobURL(prowJobURL); err != nil {
+			return err
+		}
+		job, err := h.analyzeComparedJob(ctx, logger.With().Str(LogKeyProwJobURL, prowJobURL).Logger(), prowJobURL, h.repositoryConfig(event.GetRepo().GetFullName()))
+		if err != nil {
+			return fmt.Errorf("failed to analyse the Prow job %s: %+v", prowJobURL, err)
+		}
+		jobs[i] = job
+	}
+
+	body := renderComparison(jobs[0], jobs[1])
+	if _, _, err := client.Issues.CreateComment(ctx, repoOwner, repoName, prNumber, &github.IssueComment{Body: &body}); err != nil {
+		return fmt.Errorf("failed to post the comparison: %+v", err)
+	}
+	logger.Debug().Msgf("Posted the comparison of %s and %s", jobs[0].url, jobs[1].url)
+
+	return nil
+}
+
+// analyzeComparedJob scans and analyses the Prow job, as it would for its report
+func (h *PRCommentHandler) analyzeComparedJob(ctx context.Context, logger zerolog.Logger, prowJobURL string, rc RepositoryConfig) (*comparedJob, error) {
+	scanner, scanURL, err := h.scanProwJob(ctx, logger, prowJobURL, rc)
+	if err != nil {
+		return nil, err
+	}
+	report, suites, err := h.extractFailures(ctx, logger, scanner, true, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &comparedJob{
+		url:           prowJobURL,
+		name:          jobNameFromProwJobURL(prowJobURL),
+		report:        report,
+		testDurations: junitTestDurations(suites),
+	}
+	metadata := fetchJobMetadata(ctx, scanner.Client, scanURL, "", 0)
+	if !metadata.StartTime.IsZero() && !metadata.EndTime.IsZero() {
+		job.duration = metadata.EndTime.Sub(metadata.StartTime)
+	}
+
+	return job, nil
+}
+
+// junitTestDurations returns the durations of the suites' test cases, keyed by "<suite>/<test case>"
+func junitTestDurations(suites *reporters.JUnitTestSuites) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	for _, suite := range suites.TestSuites {
+		for _, tc := range suite.TestCases {
+			durations[suite.Name+"/"+tc.Name] = junitDuration(tc)
+		}
+	}
+	return durations
+}
+
+// failureNames returns the names of the report's failures, keyed by "<suite>/<test case>",
+// the failures without a name (e.g. a build log dump) are keyed by the report's header
+func (j *comparedJob) failureNames() map[string]string {
+	names := map[string]string{}
+	for _, tc := range j.report.failedTestCases {
+		if tc.name == "" {
+			header := strings.TrimSpace(j.report.headerString)
+			names["header/"+header] = header
+			continue
+		}
+		names[tc.suiteName+"/"+tc.name] = tc.name
+	}
+	return names
+}
+
+// renderComparison renders the comparison of the two jobs' failures and durations
+func renderComparison(a, b *comparedJob) string {
+	failuresA, failuresB := a.failureNames(), b.failureNames()
+	var onlyA, onlyB, shared []string
+	for key, name := range failuresA {
+		if _, ok := failuresB[key]; ok {
+			shared = append(shared, name)
+		} else {
+			onlyA = append(onlyA, name)
+		}
+	}
+	for key, name := range failuresB {
+		if _, ok := failuresA[key]; !ok {
+			onlyB = append(onlyB, name)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(":left_right_arrow: **Comparison of the Prow jobs**\n\n")
+	sb.WriteString("| | A | B |\n|---|---|---|\n")
+	fmt.Fprintf(&sb, "| Job | [%s](%s) | [%s](%s) |\n", a.name, a.url, b.name, b.url)
+	fmt.Fprintf(&sb, "| Duration | %s | %s |\n", formatJobDuration(a.duration), formatJobDuration(b.duration)+durationDelta(a.duration, b.duration))
+	fmt.Fprintf(&sb, "| Failures | %d | %d |\n", len(failuresA), len(failuresB))
+
+	for _, group := range []struct {
+		title string
+		names []string
+	}{
+		{"Failing only in A", onlyA},
+		{"Failing only in B", onlyB},
+		{"Failing in both", shared},
+	} {
+		if len(group.names) == 0 {
+			continue
+		}
+		sort.Strings(group.names)
+		fmt.Fprintf(&sb, "\n**%s** (%d)\n", group.title, len(group.names))
+		for _, name := range group.names {
+			fmt.Fprintf(&sb, "* %s\n", inlineCode(name))
+		}
+	}
+	if len(failuresA) == 0 && len(failuresB) == 0 {
+		sb.WriteString("\nNeither job has any failure.\n")
+	}
+
+	if deltas := testDurationDeltas(a.testDurations, b.testDurations, compareDurationDeltas); len(deltas) > 0 {
+		sb.WriteString("\n**Largest duration changes**\n\n| Test | A | B |\n|---|---|---|\n")
+		for _, key := range deltas {
+			// the pipes would end the table's cell, even within code
+			fmt.Fprintf(&sb, "| %s | %s | %s |\n", strings.ReplaceAll(inlineCode(key), "|", "\\|"), formatJobDuration(a.testDurations[key]),
+				formatJobDuration(b.testDurations[key])+durationDelta(a.testDurations[key], b.testDurations[key]))
+		}
+	}
+
+	return sb.String()
+}
+
+// testDurationDeltas returns the (at most n) tests run by both jobs whose duration changed the most
+func testDurationDeltas(a, b map[string]time.Duration, n int) []string {
+	var keys []string
+	for key, d := range a {
+		if other, ok := b[key]; ok && other != d {
+			keys = append(keys, key)
+		}
+	}
+	delta := func(key string) float64 {
+		return math.Abs(float64(b[key] - a[key]))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if delta(keys[i]) != delta(keys[j]) {
+			return delta(keys[i]) > delta(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func formatJobDuration(d time.Duration) string {
+	if d == 0 {
+		return "n/a"
+	}
+	return d.Round(time.Second).String()
+}
+
+// durationDelta renders the change from a to b, e.g. " (+1m30s)"
+func durationDelta(a, b time.Duration) string {
+	if a == 0 || b == 0 || a == b {
+		return ""
+	}
+	sign := "+"
+	if b < a {
+		sign = "-"
+	}
+	d := b - a
+	if d < 0 {
+		d = -d
+	}
+	return fmt.Sprintf(" (%s%s)", sign, d.Round(time.Second))
+}
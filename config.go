@@ -15,16 +15,80 @@
 package main
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/pkg/errors"
 	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Server HTTPConfig       `yaml:"server"`
-	Github githubapp.Config `yaml:"github"`
+	Server            HTTPConfig              `yaml:"server"`
+	Github            githubapp.Config        `yaml:"github"`
+	GithubKeys        GithubKeysConfig        `yaml:"github_keys"`
+	Admin             AdminConfig             `yaml:"admin"`
+	API               APIConfig               `yaml:"api"`
+	Export            ExportConfig            `yaml:"export"`
+	Encryption        EncryptionConfig        `yaml:"encryption"`
+	MainBranchHistory MainBranchHistoryConfig `yaml:"main_branch_history"`
+	IssueReconciler   IssueReconcilerConfig   `yaml:"issue_reconciler"`
+	CommentReconciler CommentReconcilerConfig `yaml:"comment_reconciler"`
+	Metrics           MetricsConfig           `yaml:"metrics"`
+	Access            AccessConfig            `yaml:"access"`
+	PayloadArchive    PayloadArchiveConfig    `yaml:"payload_archive"`
+	ProwPlugin        ProwPluginConfig        `yaml:"prow_plugin"`
+	ErrorBudget       ErrorBudgetConfig       `yaml:"error_budget"`
+	Deck              DeckConfig              `yaml:"deck"`
+	Telemetry         TelemetryConfig         `yaml:"telemetry"`
+	FaultInjection    FaultInjectionConfig    `yaml:"fault_injection"`
+	ReportPages       ReportPagesConfig       `yaml:"report_pages"`
+	Remediation       RemediationConfig       `yaml:"remediation"`
+	Identity          IdentityConfig          `yaml:"identity"`
+	ArtifactSizes     ArtifactSizesConfig     `yaml:"artifact_sizes"`
+	PendingWatchdog   PendingWatchdogConfig   `yaml:"pending_watchdog"`
+	Mentions          MentionsConfig          `yaml:"mentions"`
+	HeaderPolicy      HeaderPolicyConfig      `yaml:"header_policy"`
+	CircuitBreaker    CircuitBreakerConfig    `yaml:"circuit_breaker"`
+	SinkTemplates     SinkTemplatesConfig     `yaml:"sink_templates"`
+	Outage            OutageConfig            `yaml:"outage"`
+	AnalysisJUnit     AnalysisJUnitConfig     `yaml:"analysis_junit"`
+	AnalysisRetries   AnalysisRetriesConfig   `yaml:"analysis_retries"`
+	Regions           RegionsConfig           `yaml:"regions"`
+	BusinessHours     BusinessHoursConfig     `yaml:"business_hours"`
+	Archive           ArchiveConfig           `yaml:"archive"`
+	RetryAdvisor      RetryAdvisorConfig      `yaml:"retry_advisor"`
+	ColdStorage       ColdStorageConfig       `yaml:"cold_storage"`
+	// the detection of the test clusters running out of resources
+	ResourceExhaustion ResourceExhaustionConfig `yaml:"resource_exhaustion"`
+	Burst              BurstConfig              `yaml:"burst"`
+	ArtifactSource     ArtifactSourceConfig     `yaml:"artifact_source"`
+	Queue              QueueConfig              `yaml:"queue"`
+	InfraChanges       InfraChangesConfig       `yaml:"infra_changes"`
+	FailureStore       FailureStoreConfig       `yaml:"failure_store"`
+	Jira               JiraConfig               `yaml:"jira"`
+	DevServer          DevServerConfig          `yaml:"dev_server"`
+	PRLocks            PRLocksConfig            `yaml:"pr_locks"`
+	JobCosts           JobCostsConfig           `yaml:"job_costs"`
+	Scaling            ScalingConfig            `yaml:"scaling"`
+	// the alternative names of the junit properties the report links to (gather-extra,
+	// redhat-appstudio-gather and html-report-link), e.g. while the gather steps get renamed
+	PropertyAliases map[string][]string `yaml:"property_aliases"`
+	// the private Decks, whose jobs' artifacts need credentials
+	PrivateSpyglass []PrivateSpyglassConfig `yaml:"private_spyglass"`
+	// the default settings of the repositories of each organization, keyed by the organization's name
+	Organizations map[string]RepositoryConfig `yaml:"organizations"`
+	// the settings shared by groups of repositories, overriding their organization's defaults
+	RepositoryGroups map[string]RepositoryGroupConfig `yaml:"repository_groups"`
+	// per repository settings, keyed by the repository's full name (e.g. "org/repo"),
+	// overriding their group's settings
+	Repositories map[string]RepositoryConfig `yaml:"repositories"`
+
+	// identifies the configuration file's content, e.g. within /ci-helper ping's reply
+	hash string
 }
 
 type HTTPConfig struct {
@@ -32,6 +96,573 @@ type HTTPConfig struct {
 	Port    int    `yaml:"port"`
 }
 
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+// APIConfig protects the API called by the other services with pkg/client
+type APIConfig struct {
+	Token string `yaml:"token"`
+}
+
+type ExportConfig struct {
+	// GCS bucket the CSV exports are uploaded to on request; Parquet and
+	// S3 aren't supported
+	GCSBucket string `yaml:"gcs_bucket"`
+}
+
+type GithubKeysConfig struct {
+	// directory with the GitHub App's PEM-encoded private keys, replacing github.app.private_key
+	KeysDir        string        `yaml:"keys_dir"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type EncryptionConfig struct {
+	KeysDir string `yaml:"keys_dir"`
+}
+
+type MainBranchHistoryConfig struct {
+	// maps presubmit job names to the name of the job running on the main branch
+	Jobs     map[string]string `yaml:"jobs"`
+	Lookback int               `yaml:"lookback"`
+}
+
+type IssueReconcilerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// label marking the issues filed by the app
+	Label string `yaml:"label"`
+	// period after which an issue whose failure wasn't observed gets resolved
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Interval   time.Duration `yaml:"interval"`
+	// "close" (default) or "comment"
+	Action string `yaml:"action"`
+}
+
+type CommentReconcilerConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// how far back the failure comments are looked for
+	Lookback time.Duration `yaml:"lookback"`
+	// age under which a comment is left to the live analysis
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// maximum number of comments analysed per reconciliation
+	MaxPerRun int `yaml:"max_per_run"`
+	// the reconciliation stops when fewer GitHub API requests remain
+	MinRateRemaining int `yaml:"min_rate_remaining"`
+}
+
+type ReportPagesConfig struct {
+	// external URL of the app, the reports link to their page when set
+	BaseURL string `yaml:"base_url"`
+	// number of most recent report pages kept in memory
+	Capacity int `yaml:"capacity"`
+	// GCS bucket persisting the report pages, so that their links outlive the
+	// restarts and are served by every replica; when empty, a page's link
+	// stops working once the page is evicted or its replica restarts
+	GCSBucket string `yaml:"gcs_bucket"`
+	// objects' prefix within the bucket, "report-pages" by default
+	Prefix string `yaml:"prefix"`
+}
+
+type RemediationConfig struct {
+	// YAML file listing the known failures and their fixes
+	KBFile string `yaml:"kb_file"`
+	// how often the file is checked for changes, 0 reloading it on the admin route only
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// IdentityConfig lets several instances of the app (e.g. staging
+// and production) annotate the same repositories side by side
+type IdentityConfig struct {
+	// name of the instance qualifying the markers of its reports,
+	// empty for the default (production) instance
+	Instance string `yaml:"instance"`
+	// use the GitHub App's slug as the instance's name when none is set
+	DetectSlug bool `yaml:"detect_slug"`
+	// markdown rendered at the bottom of the reports
+	Signature string `yaml:"signature"`
+}
+
+type ArtifactSizesConfig struct {
+	// size (in bytes) over which the files no policy matches are skipped,
+	// defaults to 50MiB, a negative size meaning no limit
+	DefaultMaxSize int64 `yaml:"default_max_size"`
+	// evaluated in order, the first policy matching a file applies, defaults
+	// to no limit for the junit files and the last 5MiB of the build logs
+	Policies []ArtifactSizePolicyConfig `yaml:"policies"`
+}
+
+type ArtifactSizePolicyConfig struct {
+	// regular expression matched against the file's path
+	Pattern string `yaml:"pattern"`
+	// size (in bytes) over which the files are skipped, 0 for no limit
+	MaxSize int64 `yaml:"max_size"`
+	// when > 0, only this many last bytes of the files are fetched
+	TailSize int64 `yaml:"tail_size"`
+}
+
+type PendingWatchdogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// period after which a pending Prow job is considered stuck
+	Threshold time.Duration `yaml:"threshold"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+type MentionsConfig struct {
+	// JSON file persisting the users who opted out of the mentions
+	// (/ci-helper unsubscribe), ignored when the failure store is a SQL one,
+	// which persists them instead. Without either, the opt-outs are refused
+	OptOutFile string `yaml:"opt_out_file"`
+}
+
+type PrivateSpyglassConfig struct {
+	// host of the private Deck within the Prow jobs' URLs
+	Host string `yaml:"host"`
+	// bucket storing the private jobs' artifacts
+	Bucket string `yaml:"bucket"`
+	// storage API reachable with the credentials, GCS when empty
+	Endpoint string `yaml:"endpoint"`
+	// files holding the OIDC token sent as a bearer token, and the session cookie
+	TokenFile  string `yaml:"token_file"`
+	CookieFile string `yaml:"cookie_file"`
+}
+
+type HeaderPolicyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// the rules picking the header by the number of consecutive failures
+	// of a job on a PR, a calm and an escalated header when empty
+	Rules []HeaderRuleConfig `yaml:"rules"`
+	// user or team (e.g. "org/ci-oncall") mentioned by the escalated headers
+	OnCall string `yaml:"on_call"`
+	// period after which a job's failures are no longer consecutive
+	StreakTTL time.Duration `yaml:"streak_ttl"`
+}
+
+// ArchiveConfig publishes the monthly CI health reports as static HTML pages,
+// to a GCS bucket and/or to the GitHub Pages branch of a repository
+type ArchiveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// published as "<prefix>/<YYYY-MM>.html" within the bucket
+	GCSBucket string `yaml:"gcs_bucket"`
+	Prefix    string `yaml:"prefix"`
+	// the repository (e.g. "org/ci-health") the app commits the
+	// pages to, as "<pages_dir>/<YYYY-MM>.html" on the branch
+	PagesRepository string `yaml:"pages_repository"`
+	PagesBranch     string `yaml:"pages_branch"`
+	PagesDir        string `yaml:"pages_dir"`
+}
+
+// BusinessHoursConfig defers the escalation mentions of the non-critical
+// failures outside of the working hours, to the next working window
+type BusinessHoursConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// IANA name of the working hours' time zone, e.g. "Europe/Prague"
+	Timezone string `yaml:"timezone"`
+	// the working hours, as "HH:MM", defaulting to 09:00 and 17:00
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// the working days (e.g. "monday"), Monday to Friday when empty
+	Weekdays []string `yaml:"weekdays"`
+	// the non-working days, as "YYYY-MM-DD"
+	Holidays []string `yaml:"holidays"`
+	// the failure kinds mentioned anytime, the infra and cluster pool failures when empty
+	CriticalKinds []string `yaml:"critical_kinds"`
+}
+
+// RetryAdvisorConfig estimates the probability that a retest passes, from
+// the retests of the past runs which failed the same way
+type RetryAdvisorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// how far back the similar runs are looked up, defaults to 30 days
+	Lookback time.Duration `yaml:"lookback"`
+	// the retested similar runs needed for the estimate, defaults to 10
+	MinSamples int `yaml:"min_samples"`
+	// the most recent similar runs the estimate is based on, defaults to 150
+	MaxSamples int `yaml:"max_samples"`
+}
+
+// ColdStorageConfig offloads the long failure messages to a GCS bucket, the
+// failure store only keeping their excerpt
+type ColdStorageConfig struct {
+	// the bucket holding the full messages, the messages aren't offloaded when empty
+	GCSBucket string `yaml:"gcs_bucket"`
+	// the prefix of the messages' objects, defaults to "failure-messages"
+	Prefix string `yaml:"prefix"`
+	// the characters of the messages kept in the failure store, defaults to 500
+	ExcerptLength int `yaml:"excerpt_length"`
+}
+
+// ResourceExhaustionConfig warns in the reports when the test cluster's nodes
+// ran out of CPU, memory, disk or PIDs, as dumped by the gather-extra step
+type ResourceExhaustionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// the CPU or memory usage (in percent) of the saturated nodes, defaults to 90
+	Threshold int `yaml:"threshold"`
+}
+
+// BurstConfig coalesces the analyses of the comments reporting the same job of
+// a PR in a rapid sequence, e.g. while tide retests the PR in a loop
+type BurstConfig struct {
+	// the shortest delay between the analyses of a PR's job, the
+	// analyses aren't coalesced when zero
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// ArtifactSourceConfig picks where the jobs' artifacts are read from, the jobs
+// being given by their Spyglass URL whichever the source
+type ArtifactSourceConfig struct {
+	// prow (the default) reads the Prow jobs' public bucket, gcs reads it with the
+	// credentials file, local reads a directory laid out as the bucket, and s3 reads
+	// a bucket of an S3-compatible storage laid out as the Prow jobs' one
+	Kind            string `yaml:"kind"`
+	CredentialsFile string `yaml:"credentials_file"`
+	Dir             string `yaml:"dir"`
+	S3Endpoint      string `yaml:"s3_endpoint"`
+	S3Bucket        string `yaml:"s3_bucket"`
+	// the region the requests are signed for, us-east-1 by default
+	S3Region string `yaml:"s3_region"`
+	// files containing the access key the requests are signed with, the
+	// bucket being read anonymously when they aren't set
+	S3AccessKeyIDFile     string `yaml:"s3_access_key_id_file"`
+	S3SecretAccessKeyFile string `yaml:"s3_secret_access_key_file"`
+}
+
+// QueueConfig runs the analyses on a pool of workers, the webhook's requests
+// returning once the events are validated
+type QueueConfig struct {
+	// the analyses run within the webhook's requests when zero
+	Workers int `yaml:"workers"`
+	// the analyses queued at most, defaults to 100
+	Capacity int `yaml:"capacity"`
+	// number of attempts of each failing analysis, defaults to 3
+	Attempts int `yaml:"attempts"`
+	// delay before the first retry, doubled for each of the next ones, defaults to 30s
+	Backoff time.Duration `yaml:"backoff"`
+	// how long an attempt of an analysis runs before the worker is deemed
+	// wedged and the liveness probe fails, defaults to 1h
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+}
+
+// InfraChangesConfig lists the changes merged into the repository deploying the
+// test environments shortly before the jobs failing because of the infrastructure
+type InfraChangesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// the repository's full name, defaults to "redhat-appstudio/infra-deployments"
+	Repository string `yaml:"repository"`
+	// the branch the changes are merged into, defaults to "main"
+	Branch string `yaml:"branch"`
+	// how long before the job started the changes are listed, defaults to 6h
+	Window time.Duration `yaml:"window"`
+	// the most recent changes listed at most, defaults to 5
+	MaxChanges int `yaml:"max_changes"`
+}
+
+// FailureStoreConfig persists the failed test cases in a database, rather than
+// in memory, and notes in the reports how many times they failed recently
+type FailureStoreConfig struct {
+	// "memory" (default), "postgres" or "sqlite" (e.g. for the local runs)
+	Kind string `yaml:"kind"`
+	// the database/sql driver, defaults to "pgx" or "sqlite"
+	Driver string `yaml:"driver"`
+	// the data source name of the database, e.g. "postgres://user@host/db" or "failures.db"
+	DSN string `yaml:"dsn"`
+	// the file holding the DSN when it holds credentials, read instead of DSN
+	DSNFile string `yaml:"dsn_file"`
+	// note the number of times each failed test case failed recently in the reports
+	History bool `yaml:"history"`
+	// how far back the failures are counted, defaults to 14 days
+	HistoryWindow time.Duration `yaml:"history_window"`
+}
+
+// JiraConfig maps the failure kinds to the components and labels of the Jira
+// tickets filed for the failures, and keeps the open auto-filed tickets in line
+// with the latest classification of their failure's fingerprint
+type JiraConfig struct {
+	// URL of the Jira instance (e.g. https://issues.redhat.com), the integration is disabled when empty
+	URL string `yaml:"url"`
+	// file containing the personal access token sent as a bearer token
+	TokenFile string `yaml:"token_file"`
+	// the project of the auto-filed tickets
+	Project string `yaml:"project"`
+	// the label marking the auto-filed tickets, defaults to "ci-helper-auto-filed"
+	Label string `yaml:"label"`
+	// how often the tickets are reconciled, defaults to 1h
+	Interval time.Duration `yaml:"interval"`
+	// how far back the failures' latest classification is looked for, defaults to 14 days
+	Lookback time.Duration `yaml:"lookback"`
+	// the components and labels of the tickets, keyed by failure kind (e.g. "infra", "e2e")
+	Taxonomy map[string]JiraTaxonomyConfig `yaml:"taxonomy"`
+}
+
+type JiraTaxonomyConfig struct {
+	Components []string `yaml:"components"`
+	Labels     []string `yaml:"labels"`
+}
+
+// DevServerConfig is only read when running the developer sandbox (the
+// devserver argument), which replays recorded fixtures against a fake GitHub
+type DevServerConfig struct {
+	// directory holding the webhooks/, artifacts/ and github/ fixtures
+	FixturesDir string `yaml:"fixtures_dir"`
+	// directory the comments and check runs posted to the fake GitHub are rendered to
+	OutputDir string `yaml:"output_dir"`
+}
+
+// PRLocksConfig serializes the analyses of each PR across the replicas of
+// the app, with locks held in the failure store shared by the replicas
+type PRLocksConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// how long a lock outlives its replica at most, e.g. when it crashed
+	TTL time.Duration `yaml:"ttl"`
+	// how long an analysis waits for another replica to release the lock, before giving up
+	Wait time.Duration `yaml:"wait"`
+}
+
+// JobCostsConfig notes the analysed jobs' durations against the p50 and p95
+// of their earlier runs, and estimates their compute cost
+type JobCostsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// how far back the earlier runs of the jobs are looked up
+	Window time.Duration `yaml:"window"`
+	// the compute cost of an hour of a job's run, the jobs without cost being only timed
+	CostPerHour float64 `yaml:"cost_per_hour"`
+	// the hourly costs of the jobs whose cost differs, keyed by job name
+	Jobs     map[string]float64 `yaml:"jobs"`
+	Currency string             `yaml:"currency"`
+}
+
+// ScalingConfig declares how many replicas of the app the deployment runs at
+// most, e.g. with the autoscaled overlay of the manifests
+type ScalingConfig struct {
+	// the app refuses to start with more than one replica unless the replicas share
+	// the failure store (postgres) and serialize the analyses of each PR (pr_locks)
+	MaxReplicas int `yaml:"max_replicas"`
+}
+
+// HeaderRuleConfig applies once a job failed 'threshold' times in a row on a PR, with
+// the same failure kind. The header is a Go template of the headerData (e.g. {{.Count}})
+type HeaderRuleConfig struct {
+	// when set, the rule only applies to the reports of this failure kind
+	Kind      string `yaml:"kind"`
+	Threshold int    `yaml:"threshold"`
+	Header    string `yaml:"header"`
+	// overrides the on-call user or team mentioned by the header
+	Mention string `yaml:"mention"`
+}
+
+// CircuitBreakerConfig configures the circuit breakers of the optional
+// dependencies of the analyses (e.g. Deck), which the reports skip
+// while the dependencies are failing
+type CircuitBreakerConfig struct {
+	// consecutive failures opening the circuit
+	FailureThreshold int `yaml:"failure_threshold"`
+	// period after which a call probes whether the dependency recovered
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// AnalysisRetriesConfig sets how the analyses which panic get retried by the work queue
+type AnalysisRetriesConfig struct {
+	// number of attempts of each analysis, defaults to 3
+	Attempts int `yaml:"attempts"`
+	// delay before the first retry, doubled for each of the next ones
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// RegionsConfig enables recording the cloud region and cluster
+// profile of the analysed jobs, served by /admin/regions
+type RegionsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type AnalysisJUnitConfig struct {
+	// GCS bucket the analyses are uploaded to as junit files, under
+	// "<prefix>/<job>/<build ID>/junit_ci-helper.xml", along with their
+	// JSON in the API's schema (ci-helper-analysis.json)
+	GCSBucket string `yaml:"gcs_bucket"`
+	Prefix    string `yaml:"prefix"`
+}
+
+type OutageConfig struct {
+	// start the app read-only: the events are analysed, but nothing is written to GitHub
+	// until switched back via the admin API
+	ReadOnly bool `yaml:"read_only"`
+}
+
+type SinkTemplatesConfig struct {
+	// directory with the Go templates overriding how the reports render for the
+	// outbound sinks, named "<sink>[.<locale>].tmpl" (e.g. "slack.tmpl", "jira.de.tmpl")
+	Dir string `yaml:"dir"`
+}
+
+type MetricsConfig struct {
+	// number of repositories reported under their own name, the rest are reported as "other"
+	TopRepositories int `yaml:"top_repositories"`
+	// number of test suites reported under their own name, the rest are reported as "other"
+	TopSuites int `yaml:"top_suites"`
+	// test names are reported as one of this many hash buckets, defaults to 256
+	TestNameBuckets int `yaml:"test_name_buckets"`
+}
+
+type AccessConfig struct {
+	// when set, the app only acts on these orgs and repositories ("org/repo")
+	AllowedOrgs  []string `yaml:"allowed_orgs"`
+	AllowedRepos []string `yaml:"allowed_repos"`
+	// the deny lists take precedence over the allow lists
+	DeniedOrgs  []string `yaml:"denied_orgs"`
+	DeniedRepos []string `yaml:"denied_repos"`
+	// when true, the app only acts on repositories containing the .ci-helper.yaml file
+	OptIn bool `yaml:"opt_in"`
+}
+
+type PayloadArchiveConfig struct {
+	// directory where the (scrubbed, gzipped) webhook payloads are archived, disabled when empty
+	Dir string `yaml:"dir"`
+	// period after which the archived payloads are removed, defaults to 30 days
+	Retention time.Duration `yaml:"retention"`
+}
+
+type ProwPluginConfig struct {
+	// when true, the app serves the events forwarded by Prow's hook instead of the
+	// GitHub App's webhook, github.app.webhook_secret must then be set to hook's HMAC secret
+	Enabled bool `yaml:"enabled"`
+	// file containing the token of the bot account acting on the PRs
+	GithubTokenFile string `yaml:"github_token_file"`
+}
+
+type ErrorBudgetConfig struct {
+	// targeted pass rate of the Prow jobs (e.g. 0.95), the tracking is disabled when 0.
+	// The outcomes of the jobs are read from the "status" events
+	Target float64       `yaml:"target"`
+	Window time.Duration `yaml:"window"`
+	// per job overrides of the target
+	Jobs map[string]float64 `yaml:"jobs"`
+}
+
+type DeckConfig struct {
+	// URL of Prow's Deck (e.g. https://prow.ci.openshift.org), the integration is disabled when empty
+	URL string `yaml:"url"`
+	// file containing the bearer token sent to Deck's API, when it's behind an authenticating proxy
+	TokenFile string `yaml:"token_file"`
+}
+
+type TelemetryConfig struct {
+	// opts in to reporting anonymous usage counts of the app's features to the endpoint
+	Enabled  bool          `yaml:"enabled"`
+	Endpoint string        `yaml:"endpoint"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// FaultInjectionConfig is meant for staging only, to validate
+// the behaviour of the app when its dependencies misbehave
+type FaultInjectionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// faults injected per dependency: "github" or "gcs"
+	Targets map[string]FaultConfig `yaml:"targets"`
+}
+
+type FaultConfig struct {
+	// share of the requests which fail, between 0 and 1
+	ErrorRate float64 `yaml:"error_rate"`
+	// status code of the failed requests, they fail with a connection error when 0
+	StatusCode int `yaml:"status_code"`
+	// delay added to every request
+	Latency time.Duration `yaml:"latency"`
+}
+
+type RepositoryConfig struct {
+	// "full" (default), "compact" or "summary" (a short comment, the full report in a check run)
+	ReportFormat string `yaml:"report_format"`
+	// extra links rendered in the report's footer
+	LinkTemplates []LinkTemplateConfig `yaml:"link_templates"`
+	// overrides the text of the next steps, keyed by rule name (e.g. "infra", "e2e")
+	NextSteps map[string]string `yaml:"next_steps"`
+	// overrides the signature of the reports
+	Signature string `yaml:"signature"`
+	// labels marking the PRs which won't be merged soon, defaults to
+	// "do-not-merge/hold", "do-not-merge/work-in-progress" and "wip"
+	HoldLabels []string `yaml:"hold_labels"`
+	// how the held PRs get analysed: "compact" (default), "skip" or "full"
+	OnHold string `yaml:"on_hold"`
+	// the images built from the repository (e.g. "quay.io/konflux-ci/build-service"), the
+	// reports warn when the test cluster didn't run them as built from the PR's head commit
+	ComponentImages []string `yaml:"component_images"`
+	// the comments are only updated with the reports of at least that many failures
+	MinFailures int `yaml:"min_failures"`
+	// "known" (default) updates the comments with any report, "new" only with
+	// the reports of failures which aren't known issues nor failing on main
+	MinSeverity string `yaml:"min_severity"`
+	// the team's own classification of the failures, added to the inherited ones
+	Classifiers []ClassifierConfig `yaml:"classifiers"`
+	// a CEL expression of the comment's author, body and PR's labels and base_branch,
+	// selecting the comments whose job gets analysed. Defaults to the Prow bot's comments
+	Trigger string `yaml:"trigger"`
+	// the most inline review comments posted per report on the spec files of
+	// the failures, when the PR changes these files. 0 (default) disables them
+	ReviewComments int `yaml:"review_comments"`
+	// the conclusion of the check run holding the report and an annotation per
+	// failed test case: "off" (default), "neutral" or "failure" (e.g. for the
+	// branch protection to require it)
+	CheckRun string `yaml:"check_run"`
+	// the names of the junit suites holding the e2e tests, defaults to "Red Hat App Studio E2E tests"
+	E2ESuiteNames []string `yaml:"e2e_suite_names"`
+	// the regular expression the names of the jobs' junit files match, defaults to "junit\.xml"
+	JUnitFilePattern string `yaml:"junit_file_pattern"`
+	// overrides the header of the reports, keyed by failure kind (e.g. "infra", "e2e")
+	Headers map[string]string `yaml:"headers"`
+	// "edit" (default) adds the reports to the comments of the failures,
+	// "new" posts them as new comments
+	CommentMode string `yaml:"comment_mode"`
+	// the teams owning the failures, the first team owning a failure being its owner
+	Teams []TeamConfig `yaml:"teams"`
+	// "off" (default) reports the failures regardless of their team, "sections" groups
+	// them by team mentioning each team, and "comments" also posts a comment per team
+	// listing only the team's failures, the teams being mentioned by these comments only
+	TeamReports string `yaml:"team_reports"`
+	// "off" (default) analyses the failed jobs right away, "required_contexts" holds
+	// their analyses (noting so in their comments) until all the required contexts
+	// of the PR's head commit completed
+	AnalysisGating string `yaml:"analysis_gating"`
+	// the contexts (commit statuses and check runs) the analyses wait for, defaulting
+	// to those the protection of the PR's base branch requires
+	RequiredContexts []string `yaml:"required_contexts"`
+}
+
+// TeamConfig is a team owning failures, e.g. of a monorepo-style e2e suite covering several teams
+type TeamConfig struct {
+	// the user or team mentioned, e.g. "org/build-team"
+	Name string `yaml:"name"`
+	// the Ginkgo labels of the team's tests, also matching their Ginkgo owner (the "owner:X" label)
+	Labels []string `yaml:"labels"`
+	// a regular expression of the names of the team's tests
+	TestPattern string `yaml:"test_pattern"`
+}
+
+// ClassifierConfig classifies the failures matching a CEL rule, evaluated against
+// the failure's name, message, suite, status, duration (in seconds), the report's
+// kind and the fetched artifacts, e.g. `suite == "e2e" && message.contains("quay.io")`
+type ClassifierConfig struct {
+	Name string `yaml:"name"`
+	Rule string `yaml:"rule"`
+	// rendered next to the matching failures
+	Note string `yaml:"note"`
+	// reclassifies the report (e.g. "infra"), which picks its next steps
+	Kind string `yaml:"kind"`
+}
+
+// RepositoryGroupConfig is the settings shared by the group's repositories
+type RepositoryGroupConfig struct {
+	// the full names of the group's repositories, a repository belongs to a single group
+	Repositories     []string `yaml:"repositories"`
+	RepositoryConfig `yaml:",inline"`
+}
+
+// LinkTemplateConfig is a Go template of a link, rendered
+// with the metadata of the analysed job (e.g. {{.JobID}})
+type LinkTemplateConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
 func ReadConfig(path string) (*Config, error) {
 	var c Config
 
@@ -40,11 +671,187 @@ func ReadConfig(path string) (*Config, error) {
 		return nil, errors.Wrapf(err, "failed reading server config file: %s", path)
 	}
 
+	if err := validateFile(configSchema, path, bytes); err != nil {
+		return nil, err
+	}
+
 	if err := yaml.UnmarshalStrict(bytes, &c); err != nil {
 		return nil, errors.Wrap(err, "failed parsing configuration file")
 	}
 
+	if err := c.validateRepositoryGroups(); err != nil {
+		return nil, err
+	}
+	if err := c.validateClassifiers(); err != nil {
+		return nil, err
+	}
+	if err := c.validateTriggers(); err != nil {
+		return nil, err
+	}
+	if err := c.validateRepositoryPatterns(); err != nil {
+		return nil, err
+	}
+	if err := c.validatePropertyAliases(); err != nil {
+		return nil, err
+	}
+	if err := c.validateScaling(); err != nil {
+		return nil, err
+	}
+
 	c.Github.SetValuesFromEnv("")
+	c.hash = fmt.Sprintf("%x", sha256.Sum256(bytes))[:12]
+
+	if v, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		c.Admin.Token = v
+	}
+	if v, ok := os.LookupEnv("API_TOKEN"); ok {
+		c.API.Token = v
+	}
 
 	return &c, nil
 }
+
+// validateRepositoryGroups makes sure that no repository belongs to several
+// groups, whose settings would otherwise override each other arbitrarily
+func (c *Config) validateRepositoryGroups() error {
+	groups := map[string]string{}
+	for name, group := range c.RepositoryGroups {
+		for _, repo := range group.Repositories {
+			if other, ok := groups[repo]; ok {
+				return fmt.Errorf("the repository %s belongs to both the %s and %s groups", repo, other, name)
+			}
+			groups[repo] = name
+		}
+	}
+	return nil
+}
+
+// validateScaling makes sure that several replicas share the state they can't
+// keep each, i.e. the failures and the locks of the PRs being analysed
+func (c *Config) validateScaling() error {
+	if c.Scaling.MaxReplicas <= 1 {
+		return nil
+	}
+	if kind := c.FailureStore.Kind; kind != failureStorePostgres {
+		if kind == "" {
+			kind = failureStoreMemory
+		}
+		return fmt.Errorf("%d replicas need a failure store they share (postgres), not the %s one", c.Scaling.MaxReplicas, kind)
+	}
+	if !c.PRLocks.Enabled {
+		return fmt.Errorf("%d replicas need the pr_locks, else they'd analyse the same PR at once", c.Scaling.MaxReplicas)
+	}
+	if c.ReportPages.BaseURL != "" && c.ReportPages.GCSBucket == "" {
+		return fmt.Errorf("%d replicas need the report pages persisted in a bucket, else a replica can't serve those of the others", c.Scaling.MaxReplicas)
+	}
+	return nil
+}
+
+// validatePropertyAliases makes sure that the aliases are
+// those of the properties the report reads
+func (c *Config) validatePropertyAliases() error {
+	for name := range c.PropertyAliases {
+		if name != podsPropertyName && name != cRsPropertyName && name != junitSummaryPropertyName {
+			return fmt.Errorf("unknown junit property %s, the aliases are those of %s, %s or %s", name, podsPropertyName, cRsPropertyName, junitSummaryPropertyName)
+		}
+	}
+	return nil
+}
+
+// repositoryConfig returns the settings of the given repository, inheriting
+// its organization's defaults, then its group's settings
+func (c *Config) repositoryConfig(repoFullName string) RepositoryConfig {
+	org := strings.SplitN(repoFullName, "/", 2)[0]
+	rc := c.Organizations[org]
+	for _, group := range c.RepositoryGroups {
+		if containsFold(group.Repositories, repoFullName) {
+			rc = rc.overriddenBy(group.RepositoryConfig)
+			break
+		}
+	}
+	return rc.overriddenBy(c.Repositories[repoFullName])
+}
+
+// overriddenBy returns the settings with the ones set by the override, the
+// next steps are overridden rule by rule and the headers kind by kind
+func (rc RepositoryConfig) overriddenBy(override RepositoryConfig) RepositoryConfig {
+	if override.ReportFormat != "" {
+		rc.ReportFormat = override.ReportFormat
+	}
+	if override.LinkTemplates != nil {
+		rc.LinkTemplates = override.LinkTemplates
+	}
+	if len(override.NextSteps) > 0 {
+		nextSteps := map[string]string{}
+		for rule, text := range rc.NextSteps {
+			nextSteps[rule] = text
+		}
+		for rule, text := range override.NextSteps {
+			nextSteps[rule] = text
+		}
+		rc.NextSteps = nextSteps
+	}
+	if override.Signature != "" {
+		rc.Signature = override.Signature
+	}
+	if override.HoldLabels != nil {
+		rc.HoldLabels = override.HoldLabels
+	}
+	if override.OnHold != "" {
+		rc.OnHold = override.OnHold
+	}
+	if override.ComponentImages != nil {
+		rc.ComponentImages = override.ComponentImages
+	}
+	if override.MinFailures != 0 {
+		rc.MinFailures = override.MinFailures
+	}
+	if override.MinSeverity != "" {
+		rc.MinSeverity = override.MinSeverity
+	}
+	if override.ReviewComments != 0 {
+		rc.ReviewComments = override.ReviewComments
+	}
+	if override.Trigger != "" {
+		rc.Trigger = override.Trigger
+	}
+	if override.CheckRun != "" {
+		rc.CheckRun = override.CheckRun
+	}
+	if override.E2ESuiteNames != nil {
+		rc.E2ESuiteNames = override.E2ESuiteNames
+	}
+	if override.JUnitFilePattern != "" {
+		rc.JUnitFilePattern = override.JUnitFilePattern
+	}
+	if len(override.Headers) > 0 {
+		headers := map[string]string{}
+		for kind, header := range rc.Headers {
+			headers[kind] = header
+		}
+		for kind, header := range override.Headers {
+			headers[kind] = header
+		}
+		rc.Headers = headers
+	}
+	if override.CommentMode != "" {
+		rc.CommentMode = override.CommentMode
+	}
+	if len(override.Teams) > 0 {
+		rc.Teams = override.Teams
+	}
+	if override.TeamReports != "" {
+		rc.TeamReports = override.TeamReports
+	}
+	if override.AnalysisGating != "" {
+		rc.AnalysisGating = override.AnalysisGating
+	}
+	if override.RequiredContexts != nil {
+		rc.RequiredContexts = override.RequiredContexts
+	}
+	if len(override.Classifiers) > 0 {
+		// the more specific classifiers are evaluated first
+		rc.Classifiers = append(append([]ClassifierConfig{}, override.Classifiers...), rc.Classifiers...)
+	}
+	return rc
+}
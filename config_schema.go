@@ -0,0 +1,232 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ConfigValidationRoute string = "/admin/config/validate"
+	ConfigSchemaRoute     string = "/admin/config/schema"
+	durationPattern              = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+)
+
+// schemaEnums restricts the values of the fields, keyed by "<Go type>.<YAML key>"
+var schemaEnums = map[string][]interface{}{
+	"RepositoryConfig.report_format":   {reportFormatFull, reportFormatCompact, reportFormatSummary},
+	"RepositoryConfig.on_hold":         {onHoldCompact, onHoldSkip, onHoldFull},
+	"RepositoryConfig.min_severity":    {severityKnown, severityNew},
+	"RepositoryConfig.check_run":       {checkRunOff, checkRunNeutral, checkRunFailure},
+	"RepositoryConfig.comment_mode":    {commentModeEdit, commentModeNew},
+	"RepositoryConfig.team_reports":    {teamReportsOff, teamReportsSections, teamReportsComments},
+	"RepositoryConfig.analysis_gating": {analysisGatingOff, analysisGatingRequiredContexts},
+	"FailureStoreConfig.kind":          {failureStoreMemory, failureStorePostgres, failureStoreSQLite},
+	"ArtifactSourceConfig.kind":        {artifactSourceProw, artifactSourceGCS, artifactSourceLocal, artifactSourceS3},
+	"IssueReconcilerConfig.action":     {issueActionClose, issueActionComment},
+	"RemediationEntry.kind":            {failureKindInfra, failureKindClusterPool, failureKindBootstrap, failureKindImageBuild, failureKindE2E, failureKindPolicy},
+	"ClassifierConfig.kind":            {failureKindInfra, failureKindClusterPool, failureKindBootstrap, failureKindImageBuild, failureKindE2E, failureKindPolicy},
+	"HeaderRuleConfig.kind":            {failureKindInfra, failureKindClusterPool, failureKindBootstrap, failureKindImageBuild, failureKindE2E, failureKindPolicy},
+}
+
+var (
+	configSchema      = schemaFor(reflect.TypeOf(Config{}))
+	repositorySchema  = schemaFor(reflect.TypeOf(RepositoryConfig{}))
+	remediationSchema = schemaFor(reflect.TypeOf(remediationKBFile{}))
+)
+
+// schemaError lists the violations of a file's schema
+type schemaError struct {
+	file       string
+	violations []string
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("%s doesn't match its schema:\n  %s", e.file, strings.Join(e.violations, "\n  "))
+}
+
+// schemaFor returns the JSON schema of the YAML documents yaml.v2 decodes into the
+// given type, so that the schemas can't drift away from the configuration types
+func schemaFor(t reflect.Type) *spec.Schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return &spec.Schema{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"string", "integer"}, Pattern: durationPattern}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return spec.BooleanProperty()
+	case reflect.String:
+		return spec.StringProperty()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &spec.Schema{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"integer"}}}
+	case reflect.Float32, reflect.Float64:
+		return &spec.Schema{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"number"}}}
+	case reflect.Slice, reflect.Array:
+		return spec.ArrayProperty(schemaFor(t.Elem()))
+	case reflect.Map:
+		return spec.MapProperty(schemaFor(t.Elem()))
+	case reflect.Struct:
+		schema := &spec.Schema{SchemaProps: spec.SchemaProps{
+			Type:                 spec.StringOrArray{"object"},
+			Properties:           map[string]spec.Schema{},
+			AdditionalProperties: &spec.SchemaOrBool{Allows: false},
+		}}
+		addStructProperties(schema, t)
+		return schema
+	default:
+		return &spec.Schema{}
+	}
+}
+
+// addStructProperties adds the (YAML) fields of the struct to the schema's properties
+func addStructProperties(schema *spec.Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			addStructProperties(schema, field.Type)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		property := schemaFor(field.Type)
+		if enum, ok := schemaEnums[t.Name()+"."+name]; ok {
+			property.Enum = enum
+		}
+		schema.Properties[name] = *property
+	}
+}
+
+// validateSchema returns the violations of the schema by the YAML content
+func validateSchema(schema *spec.Schema, content []byte) ([]string, error) {
+	jsonContent, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	if err := json.Unmarshal(jsonContent, &data); err != nil {
+		return nil, err
+	}
+	// an empty document
+	if data == nil {
+		return nil, nil
+	}
+
+	var violations []string
+	result := validate.NewSchemaValidator(schema, nil, "", strfmt.Default).Validate(data)
+	for _, err := range result.Errors {
+		violations = append(violations, err.Error())
+	}
+	sort.Strings(violations)
+
+	return violations, nil
+}
+
+// validateFile returns a *schemaError when the YAML file doesn't match the schema
+func validateFile(schema *spec.Schema, path string, content []byte) error {
+	violations, err := validateSchema(schema, content)
+	if err != nil {
+		return fmt.Errorf("failed parsing %s: %+v", path, err)
+	}
+	if len(violations) > 0 {
+		return &schemaError{file: path, violations: violations}
+	}
+	return nil
+}
+
+// ConfigValidationHandler validates the configuration files on
+// disk, e.g. before restarting the app with their new versions
+type ConfigValidationHandler struct {
+	ConfigPath string
+	KBPath     string
+}
+
+type configValidationResult struct {
+	Valid      bool                `json:"valid"`
+	Violations map[string][]string `json:"violations"`
+}
+
+func (h *ConfigValidationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := configValidationResult{Valid: true, Violations: map[string][]string{}}
+
+	files := map[string]*spec.Schema{h.ConfigPath: configSchema}
+	if h.KBPath != "" {
+		files[h.KBPath] = remediationSchema
+	}
+	for path, schema := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		violations, err := validateSchema(schema, content)
+		if err != nil {
+			violations = []string{err.Error()}
+		}
+		if len(violations) > 0 {
+			result.Valid = false
+			result.Violations[path] = violations
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ConfigSchemaHandler serves the JSON schemas of the configuration files
+type ConfigSchemaHandler struct{}
+
+func (h *ConfigSchemaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]*spec.Schema{
+		"config":      configSchema,
+		"repository":  repositorySchema,
+		"remediation": remediationSchema,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
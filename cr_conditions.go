@@ -0,0 +1,218 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+	"sigs.k8s.io/yaml"
+)
+
+const maxCRReferencesPerFailure = 3
+
+// crReferenceRegex matches the mentions of Konflux CRs within failure
+// messages, e.g. `PipelineRun "build-abc12" failed` or `component my-comp`
+var crReferenceRegex = regexp.MustCompile(`(?i)\b(application|component|snapshot|pipelinerun)s?\s+["'\x60]?([a-z0-9][-a-z0-9.]*[a-z0-9])`)
+
+// crKindDirectories maps the lowercased kinds of the CRs to
+// the directory names the gather step stores them under
+var crKindDirectories = map[string][]string{
+	"application": {"applications", "applications.appstudio.redhat.com"},
+	"component":   {"components", "components.appstudio.redhat.com"},
+	"snapshot":    {"snapshots", "snapshots.appstudio.redhat.com"},
+	"pipelinerun": {"pipelineruns", "pipelineruns.tekton.dev"},
+}
+
+type crReference struct {
+	kind string
+	name string
+}
+
+type crCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+// gatheredCR is the subset of a CR (or of a list of CRs) dumped by the gather step
+type gatheredCR struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []crCondition `json:"conditions"`
+	} `json:"status"`
+	Items []gatheredCR `json:"items"`
+}
+
+// findCRReferences returns the distinct CRs mentioned by the message
+func findCRReferences(message string) []crReference {
+	var refs []crReference
+	seen := map[crReference]bool{}
+
+	for _, m := range crReferenceRegex.FindAllStringSubmatch(message, -1) {
+		ref := crReference{kind: strings.ToLower(m[1]), name: m[2]}
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+		if len(refs) == maxCRReferencesPerFailure {
+			break
+		}
+	}
+
+	return refs
+}
+
+// inlineCRConditions adds the status.conditions of the CRs mentioned
+// by the failures, as found within the gather step's artifacts, and
+// the oc commands inspecting them, as notes of the failures
+func (failedTCReport *FailedTestCasesReport) inlineCRConditions(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner) {
+	refsByFailure := map[int][]crReference{}
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		if refs := findCRReferences(tc.message); len(refs) > 0 {
+			refsByFailure[i] = refs
+		}
+	}
+	if len(refsByFailure) == 0 || scanner.ArtifactDirectoryPrefix == "" {
+		return
+	}
+
+	objects, err := listGatheredCRs(ctx, scanner.Client, scanner.ArtifactDirectoryPrefix+cRsPropertyName+"/")
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the CRs gathered by the Prow job")
+		return
+	}
+
+	for i, refs := range refsByFailure {
+		for _, ref := range refs {
+			object := findGatheredCR(objects, ref)
+			if object == "" {
+				continue
+			}
+			content, err := readGCSObject(ctx, scanner.Client, object)
+			if err != nil {
+				logger.Error().Err(err).Msgf("Failed to read the gathered CR %s", object)
+				continue
+			}
+			cr, err := parseGatheredCR([]byte(content), ref.name)
+			if err != nil {
+				logger.Debug().Err(err).Msgf("Failed to parse the gathered CR %s", object)
+				continue
+			}
+			if note := crConditionsNote(cr); note != "" {
+				failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, note)
+			}
+			failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, ocSnippetNote(cr, ref, object))
+		}
+	}
+}
+
+// listGatheredCRs returns the names of the YAML and JSON objects under the prefix
+func listGatheredCRs(ctx context.Context, client *storage.Client, prefix string) ([]string, error) {
+	if client == nil {
+		return nil, errNoGCSClient
+	}
+	var objects []string
+
+	it := client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ext := path.Ext(attrs.Name); ext == ".yaml" || ext == ".yml" || ext == ".json" {
+			objects = append(objects, attrs.Name)
+		}
+	}
+
+	return objects, nil
+}
+
+// findGatheredCR returns the object holding the referenced CR: either the
+// CR's own file, or the file listing all the CRs of its kind
+func findGatheredCR(objects []string, ref crReference) string {
+	list := ""
+	for _, object := range objects {
+		dir := path.Base(path.Dir(object))
+		base := strings.TrimSuffix(path.Base(object), path.Ext(object))
+		for _, kindDir := range crKindDirectories[ref.kind] {
+			if dir == kindDir && base == ref.name {
+				return object
+			}
+			if base == kindDir && list == "" {
+				list = object
+			}
+		}
+	}
+	return list
+}
+
+// parseGatheredCR parses the CR with the given name from the content, which
+// is either the CR itself or a list of CRs
+func parseGatheredCR(content []byte, name string) (*gatheredCR, error) {
+	cr := &gatheredCR{}
+	if err := yaml.Unmarshal(content, cr); err != nil {
+		return nil, err
+	}
+	if len(cr.Items) == 0 {
+		return cr, nil
+	}
+	for i := range cr.Items {
+		if cr.Items[i].Metadata.Name == name {
+			return &cr.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the CR %s isn't part of the list", name)
+}
+
+// crConditionsNote renders the CR's conditions as a table within a dropdown
+func crConditionsNote(cr *gatheredCR) string {
+	if len(cr.Status.Conditions) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<details>\n<summary>:mag: status.conditions of the %s <code>%s/%s</code></summary>\n\n",
+		cr.Kind, cr.Metadata.Namespace, cr.Metadata.Name)
+	b.WriteString("| Type | Status | Reason | Message | Last transition |\n|---|---|---|---|---|\n")
+	for _, c := range cr.Status.Conditions {
+		message := strings.ReplaceAll(strings.ReplaceAll(c.Message, "\n", " "), "|", "\\|")
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", c.Type, c.Status, c.Reason, message, c.LastTransitionTime)
+	}
+	b.WriteString("</details>")
+
+	return b.String()
+}
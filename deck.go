@@ -0,0 +1,179 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	deckClientTimeout     = 30 * time.Second
+	deckCompletionTimeout = 10 * time.Minute
+	// the container of the Prow jobs' pods running the tests
+	deckTestContainer = "test"
+)
+
+// deckClient talks to the API of Prow's Deck, e.g. https://prow.ci.openshift.org
+type deckClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	gcs        *storage.Client
+	breaker    *circuitBreaker
+}
+
+func newDeckClient(cfg DeckConfig, gcs *storage.Client) (*deckClient, error) {
+	c := &deckClient{
+		baseURL:    strings.TrimSuffix(cfg.URL, "/"),
+		httpClient: &http.Client{Timeout: deckClientTimeout},
+		gcs:        gcs,
+	}
+
+	if cfg.TokenFile != "" {
+		token, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading the Deck token file: %s", cfg.TokenFile)
+		}
+		c.token = strings.TrimSpace(string(token))
+	}
+
+	return c, nil
+}
+
+// prowJob returns the ProwJob with the given name
+func (c *deckClient) prowJob(ctx context.Context, name string) (*prowJob, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/prowjob?prowjob="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the ProwJob %s from Deck", name)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the ProwJob %s", name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get the ProwJob %s from Deck: %s: %s", name, resp.Status, body)
+	}
+
+	// Deck serves the ProwJobs as YAML
+	pj := &prowJob{}
+	if err := yaml.Unmarshal(body, pj); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the ProwJob %s", name)
+	}
+
+	return pj, nil
+}
+
+// liveLog returns the log of the running Prow job's test container, which
+// Deck serves from the job's pod until the job's artifacts get uploaded
+func (c *deckClient) liveLog(ctx context.Context, job, buildID string) (string, error) {
+	query := url.Values{"container": {deckTestContainer}, "id": {buildID}, "job": {job}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/log?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get the log of %s/%s from Deck", job, buildID)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the log of %s/%s", job, buildID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get the log of %s/%s from Deck: %s", job, buildID, resp.Status)
+	}
+
+	return string(body), nil
+}
+
+// waitForCompletion waits for the Prow job with the given URL to finish
+// and returns its ProwJob, as stored by Deck
+func (c *deckClient) waitForCompletion(ctx context.Context, logger zerolog.Logger, prowJobURL string) (*prowJob, error) {
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+	// the name of the ProwJob isn't part of its URL
+	stored, err := fetchProwJob(ctx, c.gcs, jobPrefix)
+	if err != nil {
+		return nil, err
+	}
+	name := stored.Metadata.Name
+
+	var pj *prowJob
+	err = wait.PollUntilContextTimeout(ctx, 15*time.Second, deckCompletionTimeout, true, func(ctx context.Context) (done bool, err error) {
+		err = c.breaker.call(func() (err error) {
+			pj, err = c.prowJob(ctx, name)
+			return err
+		})
+		if errors.Is(err, errCircuitOpen) {
+			// Deck is down, don't delay the report any further
+			return false, err
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to get the state of the Prow job...Retrying")
+			return false, nil
+		}
+		if !prowJobFinished(pj.Status.State) {
+			logger.Debug().Msgf("The Prow job %s is still %s", name, pj.Status.State)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "the Prow job %s didn't finish", name)
+	}
+	pj.Metadata.Name = name
+
+	return pj, nil
+}
+
+// rerunURL returns the link to Deck's (authenticated) rerun page of the ProwJob
+func (c *deckClient) rerunURL(name string) string {
+	return c.baseURL + "/rerun?prowjob=" + url.QueryEscape(name)
+}
+
+func prowJobFinished(state string) bool {
+	return state != "" && state != "triggered" && state != "pending"
+}
@@ -0,0 +1,424 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/shurcooL/githubv4"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// the argument running the app in the developer sandbox, e.g. ./ci-helper-app devserver
+	devServerCommand            = "devserver"
+	DevServerReplayRoute string = "/devserver/replay"
+
+	defaultDevServerFixturesDir = "testdata/devserver"
+	defaultDevServerOutputDir   = "devserver-out"
+	fakeGithubBotLogin          = "ci-helper-app[bot]"
+)
+
+var (
+	fakeIssueCommentsRegex = regexp.MustCompile(`^repos/([^/]+)/([^/]+)/issues/(\d+)/comments$`)
+	fakeIssueCommentRegex  = regexp.MustCompile(`^repos/([^/]+)/([^/]+)/issues/comments/(\d+)$`)
+	fakeCheckRunsRegex     = regexp.MustCompile(`^repos/([^/]+)/([^/]+)/check-runs(?:/(\d+))?$`)
+)
+
+// devServer runs the app against the recorded fixtures of a directory, so that
+// the contributors iterate on the reports without any credential. The fixtures
+// directory holds:
+//   - webhooks/: the deliveries replayed on start, archived by the payload
+//     archive (<delivery ID>.json.gz) or uncompressed (<delivery ID>.json)
+//   - artifacts/: the jobs' artifacts, laid out as the Prow jobs' bucket
+//   - github/: the responses of the fake GitHub API to the GET requests, e.g.
+//     github/repos/<owner>/<repo>/pulls/<number>.json
+//
+// The comments and check runs posted to the fake GitHub are rendered to the output directory
+type devServer struct {
+	fixturesDir string
+	github      *fakeGithub
+	logger      zerolog.Logger
+}
+
+func newDevServer(cfg DevServerConfig, logger zerolog.Logger) (*devServer, error) {
+	if cfg.FixturesDir == "" {
+		cfg.FixturesDir = defaultDevServerFixturesDir
+	}
+	if cfg.OutputDir == "" {
+		cfg.OutputDir = defaultDevServerOutputDir
+	}
+	if err := os.MkdirAll(cfg.OutputDir, 0o750); err != nil {
+		return nil, errors.Wrapf(err, "failed creating the devserver's output directory: %s", cfg.OutputDir)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for the fake GitHub API")
+	}
+	baseURL, err := url.Parse("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		return nil, err
+	}
+	fake := &fakeGithub{
+		baseURL:   baseURL,
+		dir:       filepath.Join(cfg.FixturesDir, "github"),
+		outputDir: cfg.OutputDir,
+		logger:    logger,
+		comments:  map[int64]*fakeComment{},
+		checkRuns: map[int64]*github.CheckRun{},
+	}
+	go func() {
+		if err := http.Serve(listener, fake); err != nil {
+			logger.Error().Err(err).Msg("The fake GitHub API stopped")
+		}
+	}()
+	logger.Warn().Msgf("Running the developer sandbox: the fake GitHub API listens on %s, the reports are rendered to %s", baseURL, cfg.OutputDir)
+
+	return &devServer{fixturesDir: cfg.FixturesDir, github: fake, logger: logger}, nil
+}
+
+// artifactSource returns the configuration of the source reading the recorded artifacts
+func (d *devServer) artifactSource() ArtifactSourceConfig {
+	return ArtifactSourceConfig{Kind: artifactSourceLocal, Dir: filepath.Join(d.fixturesDir, "artifacts")}
+}
+
+// replay handles the recorded deliveries in the order of their file names,
+// each by the first of the handlers handling its event type, as the dispatcher does
+func (d *devServer) replay(ctx context.Context, handlers []githubapp.EventHandler) error {
+	dir := filepath.Join(d.fixturesDir, "webhooks")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list the recorded deliveries of %s", dir)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), archivedPayloadSuffix) || strings.HasSuffix(entry.Name(), ".json")) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	archive := &payloadArchive{dir: dir}
+	ctx = d.logger.WithContext(ctx)
+	for _, name := range names {
+		var delivery *archivedPayload
+		if strings.HasSuffix(name, archivedPayloadSuffix) {
+			delivery, err = archive.load(strings.TrimSuffix(name, archivedPayloadSuffix))
+		} else {
+			delivery, err = readDelivery(filepath.Join(dir, name))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read the recorded delivery %s", name)
+		}
+		if delivery.DeliveryID == "" {
+			delivery.DeliveryID = strings.TrimSuffix(name, ".json")
+		}
+		d.github.seed(delivery)
+
+		handler := handlerOf(handlers, delivery.EventType)
+		if handler == nil {
+			d.logger.Warn().Msgf("No handler handles the %s event of the delivery %s, skipping it", delivery.EventType, delivery.DeliveryID)
+			continue
+		}
+		d.logger.Info().Msgf("Replaying the %s event of the delivery %s", delivery.EventType, delivery.DeliveryID)
+		if err := handler.Handle(ctx, delivery.EventType, delivery.DeliveryID, delivery.Payload); err != nil {
+			d.logger.Error().Err(err).Msgf("Failed to handle the delivery %s", delivery.DeliveryID)
+		}
+	}
+	return nil
+}
+
+// readDelivery reads an uncompressed delivery, in the payload archive's format
+func readDelivery(file string) (*archivedPayload, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &archivedPayload{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handlerOf returns the first of the handlers handling the event type
+func handlerOf(handlers []githubapp.EventHandler, eventType string) githubapp.EventHandler {
+	for _, h := range handlers {
+		for _, handled := range h.Handles() {
+			if handled == eventType {
+				return h
+			}
+		}
+	}
+	return nil
+}
+
+// DevServerReplayHandler replays the recorded deliveries again, e.g. once the report's code changed
+type DevServerReplayHandler struct {
+	DevServer *devServer
+	Handlers  []githubapp.EventHandler
+}
+
+func (h *DevServerReplayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.DevServer.replay(context.Background(), h.Handlers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fakeComment is an issue comment known to the fake GitHub API
+type fakeComment struct {
+	repoFullName string
+	number       int
+	comment      *github.IssueComment
+}
+
+// fakeGithub serves the subset of GitHub's REST API the app calls: the issue
+// comments and check runs are kept in memory and rendered to the output
+// directory, the other GET requests are answered with the fixtures, and the
+// other writes are only logged. It's also the ClientCreator of the app's
+// clients, which call it without any credential
+type fakeGithub struct {
+	baseURL   *url.URL
+	dir       string
+	outputDir string
+	logger    zerolog.Logger
+
+	mu        sync.Mutex
+	lastID    int64
+	comments  map[int64]*fakeComment
+	checkRuns map[int64]*github.CheckRun
+}
+
+// seed makes the comment of a replayed issue_comment delivery known, so that it gets edited
+func (g *fakeGithub) seed(delivery *archivedPayload) {
+	if delivery.EventType != "issue_comment" {
+		return
+	}
+	var event github.IssueCommentEvent
+	if err := json.Unmarshal(delivery.Payload, &event); err != nil || event.GetComment().GetID() == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.comments[event.GetComment().GetID()] = &fakeComment{
+		repoFullName: event.GetRepo().GetFullName(),
+		number:       event.GetIssue().GetNumber(),
+		comment:      event.GetComment(),
+	}
+	g.render(event.GetRepo().GetFullName(), fmt.Sprintf("comment-%d.md", event.GetComment().GetID()), event.GetComment().GetBody())
+}
+
+func (g *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(r.Body)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch m := fakeIssueCommentsRegex.FindStringSubmatch(p); {
+	case m != nil && r.Method == http.MethodPost:
+		number, _ := strconv.Atoi(m[3])
+		comment := &github.IssueComment{}
+		if err := json.Unmarshal(body, comment); err != nil {
+			g.reply(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		g.lastID++
+		comment.ID = github.Int64(g.lastID)
+		comment.User = &github.User{Login: github.String(fakeGithubBotLogin)}
+		comment.HTMLURL = github.String(fmt.Sprintf("%s%s/%s/pull/%d#issuecomment-%d", g.baseURL, m[1], m[2], number, g.lastID))
+		g.comments[g.lastID] = &fakeComment{repoFullName: m[1] + "/" + m[2], number: number, comment: comment}
+		g.render(m[1]+"/"+m[2], fmt.Sprintf("comment-%d.md", g.lastID), comment.GetBody())
+		g.reply(w, http.StatusCreated, comment)
+		return
+	case m != nil && r.Method == http.MethodGet:
+		number, _ := strconv.Atoi(m[3])
+		comments := []*github.IssueComment{}
+		for _, c := range g.comments {
+			if c.repoFullName == m[1]+"/"+m[2] && c.number == number {
+				comments = append(comments, c.comment)
+			}
+		}
+		sort.Slice(comments, func(i, j int) bool { return comments[i].GetID() < comments[j].GetID() })
+		g.reply(w, http.StatusOK, comments)
+		return
+	}
+
+	if m := fakeIssueCommentRegex.FindStringSubmatch(p); m != nil {
+		id, _ := strconv.ParseInt(m[3], 10, 64)
+		c, ok := g.comments[id]
+		if !ok {
+			g.reply(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			g.reply(w, http.StatusOK, c.comment)
+		case http.MethodPatch:
+			edit := &github.IssueComment{}
+			if err := json.Unmarshal(body, edit); err != nil {
+				g.reply(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+			c.comment.Body = edit.Body
+			g.render(c.repoFullName, fmt.Sprintf("comment-%d.md", id), c.comment.GetBody())
+			g.reply(w, http.StatusOK, c.comment)
+		case http.MethodDelete:
+			delete(g.comments, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			g.reply(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method Not Allowed"})
+		}
+		return
+	}
+
+	if m := fakeCheckRunsRegex.FindStringSubmatch(p); m != nil && (r.Method == http.MethodPost || r.Method == http.MethodPatch) {
+		checkRun := &github.CheckRun{}
+		if err := json.Unmarshal(body, checkRun); err != nil {
+			g.reply(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseInt(m[3], 10, 64)
+		if id == 0 {
+			g.lastID++
+			id = g.lastID
+		} else if previous, ok := g.checkRuns[id]; ok && checkRun.Name == nil {
+			checkRun.Name = previous.Name
+		}
+		checkRun.ID = github.Int64(id)
+		checkRun.HTMLURL = github.String(fmt.Sprintf("%s%s/%s/runs/%d", g.baseURL, m[1], m[2], id))
+		g.checkRuns[id] = checkRun
+		g.render(m[1]+"/"+m[2], fmt.Sprintf("check-run-%d.md", id), renderFakeCheckRun(checkRun))
+		g.reply(w, http.StatusCreated, checkRun)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		g.logger.Info().Msgf("Fake GitHub API: %s /%s %s", r.Method, p, body)
+		g.reply(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	content, err := os.ReadFile(filepath.Join(g.dir, filepath.FromSlash(p)+".json"))
+	if err != nil {
+		g.logger.Debug().Msgf("Fake GitHub API: no fixture for GET /%s", p)
+		g.reply(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(content)
+}
+
+// reply writes the JSON response
+func (g *fakeGithub) reply(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		g.logger.Error().Err(err).Msg("Fake GitHub API: failed to write the response")
+	}
+}
+
+// render writes the content posted to the repository within the output directory
+func (g *fakeGithub) render(repoFullName, name, content string) {
+	dir := filepath.Join(g.outputDir, filepath.FromSlash(path.Clean("/"+repoFullName)))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		g.logger.Error().Err(err).Msgf("Failed to create the output directory %s", dir)
+		return
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0o640); err != nil {
+		g.logger.Error().Err(err).Msgf("Failed to render %s", file)
+		return
+	}
+	g.logger.Info().Msgf("Rendered %s", file)
+}
+
+// renderFakeCheckRun renders the check run's output as markdown
+func renderFakeCheckRun(checkRun *github.CheckRun) string {
+	output := checkRun.GetOutput()
+	return fmt.Sprintf("# %s (%s)\n\n## %s\n\n%s\n\n%s\n", checkRun.GetName(), checkRun.GetConclusion(), output.GetTitle(), output.GetSummary(), output.GetText())
+}
+
+func (g *fakeGithub) client() *github.Client {
+	client := github.NewClient(nil)
+	baseURL := *g.baseURL
+	client.BaseURL, client.UploadURL = &baseURL, &baseURL
+	return client
+}
+
+func (g *fakeGithub) v4Client() *githubv4.Client {
+	return githubv4.NewEnterpriseClient(g.baseURL.String()+"graphql", http.DefaultClient)
+}
+
+func (g *fakeGithub) NewAppClient() (*github.Client, error) {
+	return g.client(), nil
+}
+
+func (g *fakeGithub) NewAppV4Client() (*githubv4.Client, error) {
+	return g.v4Client(), nil
+}
+
+func (g *fakeGithub) NewInstallationClient(installationID int64) (*github.Client, error) {
+	return g.client(), nil
+}
+
+func (g *fakeGithub) NewInstallationV4Client(installationID int64) (*githubv4.Client, error) {
+	return g.v4Client(), nil
+}
+
+func (g *fakeGithub) NewTokenSourceClient(ts oauth2.TokenSource) (*github.Client, error) {
+	return g.client(), nil
+}
+
+func (g *fakeGithub) NewTokenSourceV4Client(ts oauth2.TokenSource) (*githubv4.Client, error) {
+	return g.v4Client(), nil
+}
+
+func (g *fakeGithub) NewTokenClient(token string) (*github.Client, error) {
+	return g.client(), nil
+}
+
+func (g *fakeGithub) NewTokenV4Client(token string) (*githubv4.Client, error) {
+	return g.v4Client(), nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the structured report qe-tools writes, one JSON file per spec
+	e2eReportFilenameRegex = `(\/e2e-report\/[^/]+\.json)$`
+	e2eReportLogLines      = 50
+	maxSnapshotsPerSpec    = 5
+)
+
+// e2eReportSpec is a spec of the qe-tools' e2e-report
+type e2eReportSpec struct {
+	Suite   string `json:"suite"`
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Failure *struct {
+		Message  string `json:"message"`
+		Location string `json:"location"`
+	} `json:"failure"`
+	Logs string `json:"logs"`
+	// the cluster resources related to the spec, as of its failure
+	Resources []e2eReportResource `json:"resources"`
+}
+
+type e2eReportResource struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Snapshot  string `json:"snapshot"`
+}
+
+// getE2EReportSpecs returns the specs of the e2e-report fetched by the scanner
+func getE2EReportSpecs(scanner *prow.ArtifactScanner, logger zerolog.Logger) []e2eReportSpec {
+	r := regexp.MustCompile(e2eReportFilenameRegex)
+	var specs []e2eReportSpec
+
+	for _, artifactsFilenameMap := range scanner.ArtifactStepMap {
+		for _, artifact := range artifactsFilenameMap {
+			if !r.MatchString(artifact.FullName) {
+				continue
+			}
+
+			var spec e2eReportSpec
+			if err := json.Unmarshal([]byte(artifact.Content), &spec); err != nil {
+				logger.Error().Err(err).Msgf("cannot decode the e2e-report spec %s", artifact.FullName)
+				continue
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	// the scanner's maps aren't ordered
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].Suite+specs[i].Name < specs[j].Suite+specs[j].Name
+	})
+
+	return specs
+}
+
+// extractFailedSpecsFromE2EReport initialises the FailedTestCasesReport
+// struct's 'failedTestCases' field with the failed specs of the
+// e2e-report, and returns whether any failed spec was found
+func (failedTCReport *FailedTestCasesReport) extractFailedSpecsFromE2EReport(logger zerolog.Logger, specs []e2eReportSpec) bool {
+	found := false
+
+	for _, spec := range specs {
+		if spec.Failure == nil {
+			continue
+		}
+		found = true
+		logger.Debug().Msgf("Found a spec (suiteName/specName): %s/%s, that didn't pass within the e2e-report", spec.Suite, spec.Name)
+
+		state := spec.State
+		if state == "" {
+			state = "failed"
+		}
+		failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+			suiteName: spec.Suite,
+			name:      spec.Name,
+			status:    state,
+			message:   spec.Failure.Message,
+			details:   e2eReportSpecDetails(spec),
+			location:  spec.Failure.Location,
+		})
+	}
+
+	return found
+}
+
+// e2eReportSpecDetails renders where and why the spec failed,
+// followed by the snapshots of its cluster resources
+func e2eReportSpecDetails(spec e2eReportSpec) string {
+	details := ""
+	if spec.Failure.Location != "" {
+		details = "Failed in " + inlineCode(spec.Failure.Location) + "\n"
+	}
+	details = details + codeBlock(spec.Failure.Message)
+
+	if spec.Logs != "" {
+		details = details + "\n" + returnContentWrappedInDropdown(dropdownSummaryString, returnLastNLines(spec.Logs, e2eReportLogLines))
+	}
+
+	for i, resource := range spec.Resources {
+		if i == maxSnapshotsPerSpec {
+			details = details + fmt.Sprintf("\n_%d more resource(s) within the e2e-report_", len(spec.Resources)-i)
+			break
+		}
+		name := resource.Name
+		if resource.Namespace != "" {
+			name = resource.Namespace + "/" + name
+		}
+		details = details + fmt.Sprintf("\n<details><summary>:package: %s <code>%s</code></summary>\n\n%s\n</details>",
+			html.EscapeString(resource.Kind), html.EscapeString(name), codeBlock(strings.TrimSpace(resource.Snapshot)))
+	}
+
+	return details
+}
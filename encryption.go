@@ -0,0 +1,351 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	EncryptionReloadRoute    string = "/admin/encryption/reload"
+	EncryptionReencryptRoute string = "/admin/encryption/reencrypt"
+	encryptedValuePrefix            = "enc:v1:"
+	// what the messages sealed with a key missing from the keyring are listed as
+	undecryptableFailureMessage = "(the failure message can't be decrypted, its encryption key isn't available)"
+)
+
+// errEncryptionKeyNotAvailable is returned when decrypting a
+// value sealed with a key missing from the keyring
+var errEncryptionKeyNotAvailable = errors.New("the encryption key isn't available")
+
+// keyring holds the AES-256 keys used for encrypting the stored
+// failure messages. Every file within the keys directory is a key
+// (base64 encoded, 32 bytes) named by its ID, e.g. as mounted from a
+// KMS-backed secret. New values are always encrypted with the key
+// having the greatest ID, while older keys are kept for decryption,
+// so a key gets rotated by adding a newer file and reloading.
+type keyring struct {
+	mu        sync.RWMutex
+	keysDir   string
+	primaryID string
+	keys      map[string]cipher.AEAD
+}
+
+func newKeyring(keysDir string) (*keyring, error) {
+	k := &keyring{keysDir: keysDir}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// reload (re-)reads all the keys from the keyring's directory
+func (k *keyring) reload() error {
+	entries, err := os.ReadDir(k.keysDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading encryption keys directory: %s", k.keysDir)
+	}
+
+	keys := map[string]cipher.AEAD{}
+	var ids []string
+	for _, entry := range entries {
+		// skip directories and the hidden files created by Kubernetes secret mounts
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(k.keysDir, entry.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "failed reading encryption key: %s", entry.Name())
+		}
+		rawKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return errors.Wrapf(err, "failed decoding encryption key: %s", entry.Name())
+		}
+		if len(rawKey) != 32 {
+			return fmt.Errorf("encryption key %s must be 32 bytes long, got %d", entry.Name(), len(rawKey))
+		}
+
+		block, err := aes.NewCipher(rawKey)
+		if err != nil {
+			return errors.Wrapf(err, "invalid encryption key: %s", entry.Name())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return errors.Wrapf(err, "invalid encryption key: %s", entry.Name())
+		}
+
+		keys[entry.Name()] = aead
+		ids = append(ids, entry.Name())
+	}
+
+	if len(ids) == 0 {
+		return fmt.Errorf("no encryption keys found within the directory: %s", k.keysDir)
+	}
+	sort.Strings(ids)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.primaryID = ids[len(ids)-1]
+
+	return nil
+}
+
+// encrypt encrypts the given value with the primary key, the
+// result has the format "enc:v1:<key ID>:<base64(nonce|ciphertext)>"
+func (k *keyring) encrypt(plaintext string) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead := k.keys[k.primaryID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed generating nonce")
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.primaryID))
+	return encryptedValuePrefix + k.primaryID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt reverses encrypt. Values which weren't
+// encrypted are returned unchanged
+func (k *keyring) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+
+	sp := strings.SplitN(strings.TrimPrefix(value, encryptedValuePrefix), ":", 2)
+	if len(sp) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	keyID := sp[0]
+
+	k.mu.RLock()
+	aead, ok := k.keys[keyID]
+	k.mu.RUnlock()
+	if !ok {
+		return "", errors.Wrapf(errEncryptionKeyNotAvailable, "key %s", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(sp[1])
+	if err != nil {
+		return "", errors.Wrap(err, "failed decoding encrypted value")
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed decrypting value with key %s", keyID)
+	}
+
+	return string(plaintext), nil
+}
+
+// reencrypt re-encrypts the value with the primary key, unless it's already
+// encrypted with it. It returns whether the value changed, the values which
+// weren't encrypted yet getting encrypted too
+func (k *keyring) reencrypt(value string) (string, bool, error) {
+	if strings.HasPrefix(value, encryptedValuePrefix) {
+		keyID := strings.SplitN(strings.TrimPrefix(value, encryptedValuePrefix), ":", 2)[0]
+		k.mu.RLock()
+		primary := keyID == k.primaryID
+		k.mu.RUnlock()
+		if primary {
+			return value, false, nil
+		}
+	}
+
+	plaintext, err := k.decrypt(value)
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, err := k.encrypt(plaintext)
+	return encrypted, err == nil, err
+}
+
+// encryptingFailureStore is a FailureStore which encrypts the
+// failure messages before passing them to the underlying store
+type encryptingFailureStore struct {
+	FailureStore
+	keyring *keyring
+	logger  zerolog.Logger
+}
+
+func (s *encryptingFailureStore) RecordFailures(ctx context.Context, records []FailureRecord) error {
+	encrypted := make([]FailureRecord, 0, len(records))
+	for _, r := range records {
+		message, err := s.keyring.encrypt(r.Message)
+		if err != nil {
+			return err
+		}
+		r.Message = message
+		encrypted = append(encrypted, r)
+	}
+
+	return s.FailureStore.RecordFailures(ctx, encrypted)
+}
+
+// CountFailures counts the failures without decrypting their messages
+func (s *encryptingFailureStore) CountFailures(ctx context.Context, testCases []string, since time.Time, exceptJobURL string) (map[string]int, error) {
+	return countFailures(ctx, s.FailureStore, testCases, since, exceptJobURL)
+}
+
+func (s *encryptingFailureStore) RecordJobDurations(ctx context.Context, durations []JobDuration) error {
+	return recordJobDurations(ctx, s.FailureStore, durations)
+}
+
+func (s *encryptingFailureStore) ListJobDurations(ctx context.Context, from, to time.Time) ([]JobDuration, error) {
+	return listJobDurations(ctx, s.FailureStore, from, to)
+}
+
+func (s *encryptingFailureStore) RecordCommentHash(ctx context.Context, commentID int64, hash string, at time.Time) error {
+	return recordCommentHash(ctx, s.FailureStore, commentID, hash, at)
+}
+
+func (s *encryptingFailureStore) CommentHash(ctx context.Context, commentID int64) (string, time.Time, error) {
+	return commentHash(ctx, s.FailureStore, commentID)
+}
+
+func (s *encryptingFailureStore) SetMentionOptOut(ctx context.Context, login string, optedOut bool) error {
+	return setMentionOptOut(ctx, s.FailureStore, login, optedOut)
+}
+
+func (s *encryptingFailureStore) ListMentionOptOuts(ctx context.Context) ([]string, error) {
+	return listMentionOptOuts(ctx, s.FailureStore)
+}
+
+func (s *encryptingFailureStore) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return acquireLock(ctx, s.FailureStore, key, owner, ttl)
+}
+
+func (s *encryptingFailureStore) ReleaseLock(ctx context.Context, key, owner string) error {
+	return releaseLock(ctx, s.FailureStore, key, owner)
+}
+
+func (s *encryptingFailureStore) ListFailures(ctx context.Context, from, to time.Time) ([]FailureRecord, error) {
+	records, err := s.FailureStore.ListFailures(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// a retired key only loses the messages, not the records
+	undecryptable := 0
+	for i := range records {
+		message, err := s.keyring.decrypt(records[i].Message)
+		if err != nil {
+			message = undecryptableFailureMessage
+			undecryptable++
+		}
+		records[i].Message = message
+	}
+	if undecryptable > 0 {
+		s.logger.Warn().Msgf("Failed to decrypt the messages of %d failures, re-encrypt them before retiring their keys", undecryptable)
+	}
+
+	return records, nil
+}
+
+// reencrypt re-encrypts the stored failure messages with the primary key, so
+// that the older keys can be retired. It returns the number of re-encrypted
+// messages and of those which can't be decrypted anymore
+func (s *encryptingFailureStore) reencrypt(ctx context.Context) (int, int, error) {
+	undecryptable := 0
+	rewritten, err := rewriteFailureMessages(ctx, s.FailureStore, func(message string) (string, bool, error) {
+		reencrypted, changed, err := s.keyring.reencrypt(message)
+		if errors.Is(err, errEncryptionKeyNotAvailable) {
+			undecryptable++
+			return message, false, nil
+		}
+		return reencrypted, changed, err
+	})
+	return rewritten, undecryptable, err
+}
+
+// KeyringReloadHandler re-reads the encryption keys, making
+// a newly added key the one used for encrypting new values
+type KeyringReloadHandler struct {
+	Keyring *keyring
+	Logger  zerolog.Logger
+}
+
+func (h *KeyringReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.Keyring.reload(); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to reload the encryption keys")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.Keyring.mu.RLock()
+	defer h.Keyring.mu.RUnlock()
+	fmt.Fprintf(w, "primary key: %s\n", h.Keyring.primaryID)
+}
+
+// KeyringReencryptHandler re-encrypts the stored failure messages, and those
+// offloaded to the cold storage, with the primary key. The keys no message
+// is encrypted with anymore can then be removed from the keys directory
+type KeyringReencryptHandler struct {
+	Store  *encryptingFailureStore
+	Cold   *coldStorage
+	Logger zerolog.Logger
+}
+
+func (h *KeyringReencryptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rewritten, undecryptable, err := h.Store.reencrypt(r.Context())
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to re-encrypt the failure messages")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "re-encrypted failure messages: %d, undecryptable: %d\n", rewritten, undecryptable)
+
+	if h.Cold == nil {
+		return
+	}
+	rewritten, undecryptable, err = h.Cold.reencrypt(r.Context())
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to re-encrypt the cold storage's failure messages")
+		fmt.Fprintf(w, "failed to re-encrypt the cold storage's failure messages: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "re-encrypted cold storage's failure messages: %d, undecryptable: %d\n", rewritten, undecryptable)
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// output of "ec validate image --output json"
+	ecReportFilenameRegex = `/(ec|enterprise-contract)[^/]*\.json$`
+	ecSuiteName           = "Enterprise Contract"
+	ecRuleDocsURLFormat   = "https://conforma.dev/docs/policy/packages/release_%s.html#%s__%s"
+	ecViolationsHeader    = ":rotating_light: **Enterprise Contract policy violations found, list of violated rule(s)**: \n"
+)
+
+// ecReport contains the subset of the EC validation output used in the report
+type ecReport struct {
+	Success    bool `json:"success"`
+	Components []struct {
+		Name           string        `json:"name"`
+		ContainerImage string        `json:"containerImage"`
+		Violations     []ecViolation `json:"violations"`
+	} `json:"components"`
+}
+
+type ecViolation struct {
+	Msg      string `json:"msg"`
+	Metadata struct {
+		Code     string `json:"code"`
+		Title    string `json:"title"`
+		Solution string `json:"solution"`
+	} `json:"metadata"`
+}
+
+// ecRuleDocsURL returns the link to the documentation of
+// the given rule, e.g. "cve.cve_blockers"
+func ecRuleDocsURL(code string) string {
+	sp := strings.SplitN(code, ".", 2)
+	if len(sp) != 2 {
+		return ""
+	}
+	return fmt.Sprintf(ecRuleDocsURLFormat, sp[0], sp[0], sp[1])
+}
+
+// extractECViolations appends the policy rules violated according to the
+// EC reports fetched by the scanner to the report's 'failedTestCases'
+func (failedTCReport *FailedTestCasesReport) extractECViolations(scanner *prow.ArtifactScanner, logger zerolog.Logger) {
+	r := regexp.MustCompile(ecReportFilenameRegex)
+	hadFailures := len(failedTCReport.failedTestCases) > 0
+	found := false
+
+	for _, artifactsFilenameMap := range scanner.ArtifactStepMap {
+		for _, artifact := range artifactsFilenameMap {
+			if !r.MatchString(artifact.FullName) {
+				continue
+			}
+
+			report := ecReport{}
+			if err := json.Unmarshal([]byte(artifact.Content), &report); err != nil {
+				logger.Debug().Err(err).Msgf("%s is not an EC report", artifact.FullName)
+				continue
+			}
+			if report.Success {
+				continue
+			}
+
+			for _, component := range report.Components {
+				for _, v := range component.Violations {
+					found = true
+					failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+						suiteName: ecSuiteName,
+						name:      fmt.Sprintf("%s (component: %s)", v.Metadata.Code, component.Name),
+						status:    "violation",
+						message:   v.Msg,
+						details:   ecViolationDetails(v, component.ContainerImage),
+					})
+				}
+			}
+		}
+	}
+
+	if found && !hadFailures {
+		failedTCReport.headerString = ecViolationsHeader
+		failedTCReport.failureKind = failureKindPolicy
+	}
+}
+
+// ecViolationDetails renders the violation's message, the
+// violating image and the rule's solution and documentation
+func ecViolationDetails(v ecViolation, image string) string {
+	details := codeBlock(v.Msg) + "\n"
+	details = details + "Image: " + inlineCode(image) + "\n"
+	if v.Metadata.Solution != "" {
+		details = details + "Solution: " + v.Metadata.Solution + "\n"
+	}
+	if docsURL := ecRuleDocsURL(v.Metadata.Code); docsURL != "" {
+		details = details + fmt.Sprintf("[Rule documentation: %s](%s)\n", v.Metadata.Title, docsURL)
+	}
+	return details
+}
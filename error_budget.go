@@ -0,0 +1,271 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ErrorBudgetsRoute         string = "/admin/error-budgets"
+	prowStatusContextPrefix          = "ci/prow/"
+	defaultErrorBudgetWindow         = 7 * 24 * time.Hour
+	defaultErrorBudgetMaxJobs        = 200
+)
+
+var (
+	jobPassRateDesc = prometheus.NewDesc("ci_helper_job_pass_rate",
+		"Pass rate of the job's runs within the error budget window.", []string{"job"}, nil)
+	jobErrorBudgetRemainingDesc = prometheus.NewDesc("ci_helper_job_error_budget_remaining",
+		"Ratio of the job's error budget left within the window, negative once overspent.", []string{"job"}, nil)
+	jobRunsDesc = prometheus.NewDesc("ci_helper_job_runs",
+		"Number of the job's runs within the error budget window.", []string{"job"}, nil)
+)
+
+type jobOutcome struct {
+	runID     string
+	timestamp time.Time
+	passed    bool
+}
+
+// budgetStatus is the state of a job's error budget within the window
+type budgetStatus struct {
+	Job      string  `json:"job"`
+	Runs     int     `json:"runs"`
+	Failures int     `json:"failures"`
+	PassRate float64 `json:"pass_rate"`
+	Target   float64 `json:"target"`
+	// ratio of the allowed failures not spent yet, negative once overspent
+	Remaining float64 `json:"remaining"`
+}
+
+// errorBudgets tracks the outcomes of the Prow jobs over a rolling
+// window and compares their pass rates to the configured targets
+type errorBudgets struct {
+	cfg  ErrorBudgetConfig
+	jobs *labelGuard
+
+	mu       sync.Mutex
+	outcomes map[string][]jobOutcome
+}
+
+func newErrorBudgets(cfg ErrorBudgetConfig) *errorBudgets {
+	if cfg.Window == 0 {
+		cfg.Window = defaultErrorBudgetWindow
+	}
+	return &errorBudgets{
+		cfg:      cfg,
+		jobs:     newLabelGuard(defaultErrorBudgetMaxJobs),
+		outcomes: map[string][]jobOutcome{},
+	}
+}
+
+func (b *errorBudgets) target(job string) float64 {
+	if target, ok := b.cfg.Jobs[job]; ok {
+		return target
+	}
+	return b.cfg.Target
+}
+
+// record adds the outcome of a job's run, ignoring
+// the runs whose outcome was already recorded
+func (b *errorBudgets) record(job, runID string, passed bool, timestamp time.Time) {
+	job = b.jobs.value(job)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range b.outcomes[job] {
+		if o.runID == runID {
+			return
+		}
+	}
+	b.outcomes[job] = append(b.prune(job), jobOutcome{runID: runID, timestamp: timestamp, passed: passed})
+}
+
+// prune drops the job's outcomes older than the window, b.mu must be held
+func (b *errorBudgets) prune(job string) []jobOutcome {
+	cutoff := time.Now().Add(-b.cfg.Window)
+	outcomes := b.outcomes[job][:0]
+	for _, o := range b.outcomes[job] {
+		if o.timestamp.After(cutoff) {
+			outcomes = append(outcomes, o)
+		}
+	}
+	return outcomes
+}
+
+// statuses returns the error budget status of each job with runs within the window
+func (b *errorBudgets) statuses() []budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var statuses []budgetStatus
+	for job := range b.outcomes {
+		b.outcomes[job] = b.prune(job)
+		outcomes := b.outcomes[job]
+		if len(outcomes) == 0 {
+			continue
+		}
+
+		s := budgetStatus{Job: job, Runs: len(outcomes), Target: b.target(job)}
+		for _, o := range outcomes {
+			if !o.passed {
+				s.Failures++
+			}
+		}
+		s.PassRate = float64(s.Runs-s.Failures) / float64(s.Runs)
+
+		allowed := (1 - s.Target) * float64(s.Runs)
+		switch {
+		case s.Failures == 0:
+			s.Remaining = 1
+		case allowed > 0:
+			s.Remaining = 1 - float64(s.Failures)/allowed
+		default:
+			s.Remaining = -float64(s.Failures)
+		}
+		statuses = append(statuses, s)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Job < statuses[j].Job })
+	return statuses
+}
+
+// statusLine summarises the job's error budget in a single Markdown line
+func (s budgetStatus) statusLine(window time.Duration) string {
+	icon := ":white_check_mark:"
+	if s.Remaining <= 0 {
+		icon = ":fire:"
+	} else if s.Remaining < 0.25 {
+		icon = ":warning:"
+	}
+
+	line := fmt.Sprintf("%s `%s`: %.1f%% pass rate over %d run(s) within the last %s (target %.1f%%), ",
+		icon, s.Job, s.PassRate*100, s.Runs, window, s.Target*100)
+	if s.Remaining <= 0 {
+		return line + "error budget exhausted"
+	}
+	return line + fmt.Sprintf("%.0f%% of the error budget left", s.Remaining*100)
+}
+
+func (b *errorBudgets) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobPassRateDesc
+	ch <- jobErrorBudgetRemainingDesc
+	ch <- jobRunsDesc
+}
+
+func (b *errorBudgets) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range b.statuses() {
+		ch <- prometheus.MustNewConstMetric(jobPassRateDesc, prometheus.GaugeValue, s.PassRate, s.Job)
+		ch <- prometheus.MustNewConstMetric(jobErrorBudgetRemainingDesc, prometheus.GaugeValue, s.Remaining, s.Job)
+		ch <- prometheus.MustNewConstMetric(jobRunsDesc, prometheus.GaugeValue, float64(s.Runs), s.Job)
+	}
+}
+
+// StatusHandler records the outcomes of the Prow jobs reported as commit
+// statuses into the error budgets, and the pending ones into the watchdog.
+// It also resumes the analyses held for the commits, on any of their statuses
+type StatusHandler struct {
+	Budgets  *errorBudgets
+	Watchdog *pendingWatchdog
+	Gates    *AnalysisGatesHandler
+}
+
+func (h *StatusHandler) Handles() []string {
+	return []string{"status"}
+}
+
+func (h *StatusHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	var event github.StatusEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return errors.Wrap(err, "failed to parse status event payload")
+	}
+
+	if event.GetState() != "pending" {
+		h.Gates.contextCompleted(ctx, event.GetRepo().GetFullName(), event.GetSHA())
+	}
+	if !strings.HasPrefix(event.GetContext(), prowStatusContextPrefix) {
+		return nil
+	}
+
+	if h.Watchdog != nil {
+		h.Watchdog.observe(event)
+	}
+	if h.Budgets == nil {
+		return nil
+	}
+
+	var passed bool
+	switch event.GetState() {
+	case "success":
+		passed = true
+	case "failure", "error":
+		passed = false
+	default:
+		return nil
+	}
+
+	job := strings.TrimPrefix(event.GetContext(), prowStatusContextPrefix)
+	runID := event.GetTargetURL()
+	if _, err := gcsPathFromProwJobURL(runID); err == nil {
+		job = jobNameFromProwJobURL(runID)
+	}
+	if runID == "" {
+		runID = event.GetSHA() + "/" + event.GetContext()
+	}
+
+	timestamp := event.GetUpdatedAt().Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	h.Budgets.record(job, runID, passed, timestamp)
+	return nil
+}
+
+// ErrorBudgetsHandler serves the error budget status of the jobs, as
+// Markdown status lines or as JSON when "format" is set to "json"
+type ErrorBudgetsHandler struct {
+	Budgets *errorBudgets
+}
+
+func (h *ErrorBudgetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := h.Budgets.statuses()
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown")
+	for _, s := range statuses {
+		fmt.Fprintln(w, s.statusLine(h.Budgets.cfg.Window))
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ExportRoute         string = "/admin/export"
+	defaultExportWindow        = 7 * 24 * time.Hour
+	exportFormatCSV            = "csv"
+)
+
+var failureRecordCSVHeader = []string{"timestamp", "repository", "pull_request", "prow_job_url", "suite_name", "test_case", "status", "message"}
+
+// ExportHandler serves the failures recorded within a time range
+// as CSV, or uploads them to the configured GCS bucket when the
+// "upload" query parameter is set to "gcs". Parquet and S3 are out
+// of scope
+type ExportHandler struct {
+	Store FailureStore
+	// the client of the configured GCS bucket, nil when there's none
+	Client *storage.Client
+	Config ExportConfig
+	Logger zerolog.Logger
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r, defaultExportWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" && format != exportFormatCSV {
+		http.Error(w, fmt.Sprintf("unsupported export format: %s, only %s is supported", format, exportFormatCSV), http.StatusBadRequest)
+		return
+	}
+
+	records, err := h.Store.ListFailures(r.Context(), from, to)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to list failures for export")
+		http.Error(w, "failed to list failures", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("upload") == "gcs" {
+		object, err := h.uploadToGCS(r.Context(), records, from, to)
+		if err != nil {
+			h.Logger.Error().Err(err).Msg("Failed to upload the failures export to GCS")
+			http.Error(w, "failed to upload export", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "gs://%s/%s\n", h.Config.GCSBucket, object)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(from, to)))
+	if err := writeFailureRecordsCSV(w, records); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to write the failures export")
+	}
+}
+
+// uploadToGCS writes the given records as a CSV object into the
+// configured GCS bucket and returns the name of the created object
+func (h *ExportHandler) uploadToGCS(ctx context.Context, records []FailureRecord, from, to time.Time) (string, error) {
+	if h.Client == nil {
+		return "", fmt.Errorf("no GCS bucket is configured for exports")
+	}
+
+	object := exportFileName(from, to)
+	writer := h.Client.Bucket(h.Config.GCSBucket).Object(object).NewWriter(ctx)
+	writer.ContentType = "text/csv"
+
+	if err := writeFailureRecordsCSV(writer, records); err != nil {
+		writer.Close()
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to finalize GCS object %s: %+v", object, err)
+	}
+
+	return object, nil
+}
+
+// writeFailureRecordsCSV writes the given records,
+// preceded by a header row, in CSV format to w
+func writeFailureRecordsCSV(w io.Writer, records []FailureRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(failureRecordCSVHeader); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		row := []string{
+			r.Timestamp.UTC().Format(time.RFC3339),
+			r.Repository,
+			strconv.Itoa(r.PullRequest),
+			r.ProwJobURL,
+			r.SuiteName,
+			r.TestCase,
+			r.Status,
+			r.Message,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseTimeRange reads the RFC3339 'from' and 'to' query parameters,
+// defaulting to the given window ending now when they're not set
+func parseTimeRange(r *http.Request, window time.Duration) (time.Time, time.Time, error) {
+	to := time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'to' parameter: %+v", err)
+		}
+		to = t
+	}
+
+	from := to.Add(-window)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'from' parameter: %+v", err)
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("'from' (%s) must be before 'to' (%s)", from, to)
+	}
+
+	return from, to, nil
+}
+
+func exportFileName(from, to time.Time) string {
+	return fmt.Sprintf("failures-%s-%s.csv", from.UTC().Format("20060102T150405Z"), to.UTC().Format("20060102T150405Z"))
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultFailureHistoryWindow = 14 * 24 * time.Hour
+
+// failureHistory notes how many times each failed test case failed recently,
+// in the other jobs recorded by the failure store, so that the flaky tests
+// stand out. A nil failureHistory notes nothing
+type failureHistory struct {
+	store  FailureStore
+	window time.Duration
+}
+
+func newFailureHistory(store FailureStore, window time.Duration) *failureHistory {
+	if window == 0 {
+		window = defaultFailureHistoryWindow
+	}
+	return &failureHistory{store: store, window: window}
+}
+
+// annotate notes the recent failures of the report's failed test cases
+func (h *failureHistory) annotate(ctx context.Context, logger zerolog.Logger, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	if h == nil {
+		return
+	}
+
+	var names []string
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.status != "" && tc.name != "" {
+			names = append(names, tc.name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	counts, err := countFailures(ctx, h.store, names, time.Now().Add(-h.window), prowJobURL)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to count the recent failures of the failed test cases")
+		return
+	}
+
+	for i, tc := range failedTCReport.failedTestCases {
+		if count := counts[tc.name]; count > 0 && tc.status != "" {
+			failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, failureHistoryNote(count, h.window))
+		}
+	}
+}
+
+// failureHistoryNote tells how many times a test case failed within the window
+func failureHistoryNote(count int, window time.Duration) string {
+	within := window.String()
+	if days := int(window / (24 * time.Hour)); days > 0 && window%(24*time.Hour) == 0 {
+		within = fmt.Sprintf("%d days", days)
+	}
+	return fmt.Sprintf(":chart_with_upwards_trend: Failed %d time(s) in the last %s", count, within)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+)
+
+const (
+	faultTargetGithub = "github"
+	faultTargetGCS    = "gcs"
+)
+
+var errInjectedFault = errors.New("injected fault: connection reset")
+
+// faultTransport delays the requests and makes a share of them fail, to
+// exercise the retries, timeouts and partial reports in staging
+type faultTransport struct {
+	base   http.RoundTripper
+	target string
+	cfg    FaultConfig
+}
+
+// newFaultTransport wraps the base transport with the faults configured for the
+// target, or returns it as is when the fault injection is disabled
+func newFaultTransport(base http.RoundTripper, cfg FaultInjectionConfig, target string) http.RoundTripper {
+	fc, ok := cfg.Targets[target]
+	if !cfg.Enabled || !ok {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &faultTransport{base: base, target: target, cfg: fc}
+}
+
+// faultInjectionMiddleware injects the faults configured for the target into the GitHub clients
+func faultInjectionMiddleware(cfg FaultInjectionConfig, target string) githubapp.ClientMiddleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return newFaultTransport(next, cfg, target)
+	}
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cfg.Latency > 0 {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.cfg.Latency):
+		}
+	}
+
+	if rand.Float64() >= t.cfg.ErrorRate {
+		return t.base.RoundTrip(req)
+	}
+
+	if t.cfg.StatusCode == 0 {
+		return nil, errInjectedFault
+	}
+	body := fmt.Sprintf("fault injected into the %s client", t.target)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.cfg.StatusCode, http.StatusText(t.cfg.StatusCode)),
+		StatusCode:    t.cfg.StatusCode,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
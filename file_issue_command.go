@@ -0,0 +1,136 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+const (
+	fileIssueCommand = "file-issue"
+	// the length of the failure message quoted within the filed issues
+	filedIssueMessageLength = 2000
+)
+
+// handleCIHelperFileIssue files an issue in the PR's repository for a failed
+// test case of the PR's latest report, on request of a member of the
+// repository's org. The issue carries the failure's fingerprint marker and
+// the auto-filed label, so that the issue reconciler resolves it once the
+// failure stops occurring. A failure already having an open auto-filed
+// issue gets it linked rather than another one filed
+func (h *PRCommentHandler) handleCIHelperFileIssue(ctx context.Context, logger zerolog.Logger, ghClient *github.Client, event github.IssueCommentEvent, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s <test case>", ciHelperCommand, fileIssueCommand)
+	}
+	name := strings.Join(args, " ")
+
+	login := event.GetComment().GetUser().GetLogin()
+	member, err := isOrgMember(ctx, ghClient, event)
+	if err != nil {
+		return fmt.Errorf("failed to check whether %s is a member of %s: %+v", login, event.GetRepo().GetOwner().GetLogin(), err)
+	}
+	if !member {
+		logger.Info().Msgf("Ignoring the issue requested by %s, who isn't a member of the org", login)
+		return nil
+	}
+
+	repoFullName := event.GetRepo().GetFullName()
+	prNumber := event.GetIssue().GetNumber()
+	a := h.Analyses.get(repoFullName, prNumber)
+	if a == nil {
+		return fmt.Errorf("the PR has no report to file an issue from")
+	}
+	var failed *failedTestCase
+	for i, tc := range a.report.failedTestCases {
+		if tc.name == name || client.NormalizeTestName(tc.name) == client.NormalizeTestName(name) {
+			failed = &a.report.failedTestCases[i]
+			break
+		}
+	}
+	if failed == nil {
+		return fmt.Errorf("%s didn't fail within the PR's latest report", name)
+	}
+
+	label := h.Config.IssueReconciler.Label
+	if label == "" {
+		label = defaultAutoFiledIssueLabel
+	}
+	repoOwner, repoName := event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName()
+	fingerprints := failureFingerprints(failed.suiteName, failed.name)
+	issue, err := findAutoFiledIssue(ctx, ghClient, repoOwner, repoName, label, fingerprints)
+	if err != nil {
+		return err
+	}
+	reply := ":memo: The failure of %s already has the issue %s."
+	if issue == nil {
+		title := "Failing test: " + excerpt(failed.name, 200)
+		body := filedIssueBody(failed, a.prowJobURL, prNumber, h.Mentions.mention(login), fingerprints[0])
+		labels := []string{label}
+		if issue, _, err = ghClient.Issues.Create(ctx, repoOwner, repoName, &github.IssueRequest{Title: &title, Body: &body, Labels: &labels}); err != nil {
+			return fmt.Errorf("failed to file the issue of %s: %+v", failed.name, err)
+		}
+		logger.Info().Msgf("Filed the issue %s as requested by %s", issue.GetHTMLURL(), login)
+		reply = ":memo: Filed the issue of the failure of %s: %s."
+	}
+
+	body := fmt.Sprintf(reply, inlineCode(failed.name), issue.GetHTMLURL())
+	if _, _, err := ghClient.Issues.CreateComment(ctx, repoOwner, repoName, prNumber, &github.IssueComment{Body: &body}); err != nil {
+		return fmt.Errorf("failed to link the issue: %+v", err)
+	}
+	return nil
+}
+
+// findAutoFiledIssue returns the open auto-filed issue of the repository
+// carrying the marker of any of the fingerprints, or nil if there's none
+func findAutoFiledIssue(ctx context.Context, ghClient *github.Client, owner, repo, label string, fingerprints []string) (*github.Issue, error) {
+	opts := &github.IssueListByRepoOptions{State: "open", Labels: []string{label}, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		issues, resp, err := ghClient.Issues.ListByRepo(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the auto-filed issues: %+v", err)
+		}
+		for _, issue := range issues {
+			if containsFold(fingerprints, extractFingerprint(issue.GetBody())) {
+				return issue, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// filedIssueBody renders the body of the issue filed for the failed test case
+func filedIssueBody(tc *failedTestCase, prowJobURL string, prNumber int, requester, fingerprint string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s failed in the Prow job %s, on #%d.\n\n", inlineCode(tc.name), prowJobURL, prNumber)
+	if tc.suiteName != "" {
+		fmt.Fprintf(&b, "Suite: %s\n\n", inlineCode(tc.suiteName))
+	}
+	if tc.message != "" {
+		b.WriteString(codeBlock(excerpt(tc.message, filedIssueMessageLength)))
+		b.WriteString("\n\n")
+	}
+	fmt.Fprintf(&b, "Filed by the CI helper as requested by %s. The issue gets resolved once the failure stops occurring.\n\n", requester)
+	b.WriteString(fingerprintMarker(fingerprint))
+	return b.String()
+}
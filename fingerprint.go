@@ -0,0 +1,61 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+)
+
+const (
+	fingerprintMarkerFormat = "<!-- ci-helper-fingerprint: %s -->"
+	fingerprintMarkerRegex  = `<!-- ci-helper-fingerprint: ([0-9a-f]+) -->`
+)
+
+// failureFingerprint identifies a failure across Prow job runs, the
+// fingerprints being part of the analyses served by the API
+func failureFingerprint(suiteName, testCaseName string) string {
+	return client.Fingerprint(suiteName, testCaseName)
+}
+
+// failureFingerprints returns the fingerprint of the failure, followed by its
+// legacy fingerprint when it differs, so that the markers written before the
+// test cases' names were normalized keep matching
+func failureFingerprints(suiteName, testCaseName string) []string {
+	fingerprint := client.Fingerprint(suiteName, testCaseName)
+	if legacy := client.LegacyFingerprint(suiteName, testCaseName); legacy != fingerprint {
+		return []string{fingerprint, legacy}
+	}
+	return []string{fingerprint}
+}
+
+// fingerprintMarker returns the hidden marker the app embeds in the bodies
+// of the issues it files (see handleCIHelperFileIssue) to link them with
+// the given fingerprint
+func fingerprintMarker(fingerprint string) string {
+	return fmt.Sprintf(fingerprintMarkerFormat, fingerprint)
+}
+
+// extractFingerprint returns the fingerprint from the marker
+// embedded in the given body, or "" if there's none
+func extractFingerprint(body string) string {
+	r := regexp.MustCompile(fingerprintMarkerRegex)
+	if m := r.FindStringSubmatch(body); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the permissions GitHub would have accepted for a forbidden call
+	acceptedPermissionsHeader = "X-Accepted-GitHub-Permissions"
+	fallbackCheckRunName      = "ci-helper-app"
+
+	// how the report was posted: within the job's comment, or else by a fallback
+	reportedByEdit   = "edit"
+	fallbackComment  = "comment"
+	fallbackCheckRun = "check-run"
+	fallbackNone     = "none"
+)
+
+// isGone returns whether the GitHub call failed as the comment was deleted,
+// or its PR transferred or deleted
+func isGone(err error) bool {
+	var errResp *github.ErrorResponse
+	return errors.As(err, &errResp) && errResp.Response != nil &&
+		(errResp.Response.StatusCode == http.StatusNotFound || errResp.Response.StatusCode == http.StatusGone)
+}
+
+// isForbidden returns whether the GitHub call failed as the installation
+// lacks the permission, e.g. to edit the comments of a fork-originated PR
+func isForbidden(err error) bool {
+	var errResp *github.ErrorResponse
+	return errors.As(err, &errResp) && errResp.Response != nil && errResp.Response.StatusCode == http.StatusForbidden
+}
+
+// acceptedPermissions returns the permissions the forbidden call needed, if GitHub told
+func acceptedPermissions(err error) string {
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.Header.Get(acceptedPermissionsHeader)
+	}
+	return ""
+}
+
+// prCapabilities is what the installation was allowed to do on a PR,
+// logged when the app falls back from editing the job's comment
+type prCapabilities struct {
+	repository  string
+	prNumber    int
+	fork        bool
+	editComment bool
+	// the permissions which would have allowed editing the comment
+	requiredPermissions string
+	createComment       bool
+	createCheckRun      bool
+	fallback            string
+}
+
+func (c prCapabilities) log(logger zerolog.Logger) {
+	logger.Warn().
+		Str("repository", c.repository).
+		Int("pr", c.prNumber).
+		Bool("fork", c.fork).
+		Bool("edit_comment", c.editComment).
+		Str("required_permissions", c.requiredPermissions).
+		Bool("create_comment", c.createComment).
+		Bool("create_check_run", c.createCheckRun).
+		Str("fallback", c.fallback).
+		Msg("The comment of the Prow job can't be edited, reporting the failures elsewhere")
+}
+
+// newCommentBody returns the body of a new comment reporting
+// the failures of the job reported by the event's comment
+func (failedTCReport *FailedTestCasesReport) newCommentBody(logger zerolog.Logger, lint *commentLint, event github.IssueCommentEvent, format string) string {
+	sections := failedTCReport.sections(format)
+	body := fmt.Sprintf("The failures of the job reported [above](%s):\n\n", event.GetComment().GetHTMLURL()) +
+		renderReportBlock(failedTCReport.identity, lint.repairSections(logger, sections))
+	return lint.fitComment(logger, failedTCReport.identity, body, sections)
+}
+
+// reportWithoutEditing reports the failures when the job's comment can't be
+// edited (e.g. the installation isn't allowed to, or the comment was deleted),
+// in a new comment or else in a check run of the PR's head commit. It fails
+// only if neither of them can be created
+func (failedTCReport *FailedTestCasesReport) reportWithoutEditing(ctx context.Context, logger zerolog.Logger, client *github.Client, lint *commentLint, event github.IssueCommentEvent, format string, editErr error) error {
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	prNumber := event.GetIssue().GetNumber()
+	capabilities := prCapabilities{
+		repository:          event.GetRepo().GetFullName(),
+		prNumber:            prNumber,
+		requiredPermissions: acceptedPermissions(editErr),
+		fallback:            fallbackNone,
+	}
+	defer func() {
+		capabilities.log(logger)
+		failedTCReport.reportedBy = capabilities.fallback
+	}()
+
+	pr, _, err := client.PullRequests.Get(ctx, repoOwner, repoName, prNumber)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to fetch the PR the failures are reported on")
+	} else {
+		capabilities.fork = !strings.EqualFold(pr.GetHead().GetRepo().GetFullName(), event.GetRepo().GetFullName())
+	}
+
+	body := failedTCReport.newCommentBody(logger, lint, event, format)
+	_, _, err = client.Issues.CreateComment(ctx, repoOwner, repoName, prNumber, &github.IssueComment{Body: &body})
+	if err == nil {
+		capabilities.createComment, capabilities.fallback = true, fallbackComment
+		return nil
+	}
+	if pr == nil {
+		return errors.Wrapf(err, "failed to edit the comment (%v) and to comment the report on the PR", editErr)
+	}
+	logger.Error().Err(err).Msg("Failed to comment the report on the PR, reporting it in a check run")
+	summary := fitCheckRunOutput(body)
+	_, _, err = client.Checks.CreateCheckRun(ctx, repoOwner, repoName, github.CreateCheckRunOptions{
+		Name:       fallbackCheckRunName,
+		HeadSHA:    pr.GetHead().GetSHA(),
+		Status:     github.String("completed"),
+		Conclusion: github.String("neutral"),
+		Output: &github.CheckRunOutput{
+			Title:   github.String(fmt.Sprintf("%d failure(s) of the Prow job", len(failedTCReport.failedTestCases))),
+			Summary: &summary,
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to edit the comment (%v) and to comment on the PR, and to create a check run", editErr)
+	}
+	capabilities.createCheckRun, capabilities.fallback = true, fallbackCheckRun
+	return nil
+}
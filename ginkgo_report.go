@@ -0,0 +1,122 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/onsi/ginkgo/v2/types"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// produced by "ginkgo --json-report=report.json"
+	ginkgoJSONReportFilenameRegex = `(\/(ginkgo-)?report\.json)$`
+)
+
+// getGinkgoReportsFromJSONFiles returns the Ginkgo reports
+// found within the JSON report files fetched by the scanner
+func getGinkgoReportsFromJSONFiles(scanner *prow.ArtifactScanner, logger zerolog.Logger) []types.Report {
+	r := regexp.MustCompile(ginkgoJSONReportFilenameRegex)
+	var reports []types.Report
+
+	for _, artifactsFilenameMap := range scanner.ArtifactStepMap {
+		for _, artifact := range artifactsFilenameMap {
+			if !r.MatchString(artifact.FullName) {
+				continue
+			}
+
+			var fileReports []types.Report
+			if err := json.Unmarshal([]byte(artifact.Content), &fileReports); err != nil {
+				logger.Error().Err(err).Msgf("cannot decode the Ginkgo JSON report %s", artifact.FullName)
+				continue
+			}
+			reports = append(reports, fileReports...)
+		}
+	}
+
+	return reports
+}
+
+// ginkgoSpecName returns the name Ginkgo's JUnit reporter gives to the
+// spec, so that both report formats yield the same test case names
+func ginkgoSpecName(spec types.SpecReport) string {
+	name := fmt.Sprintf("[%s]", spec.LeafNodeType)
+	if spec.FullText() != "" {
+		name = name + " " + spec.FullText()
+	}
+	if labels := spec.Labels(); len(labels) > 0 {
+		name = name + " [" + strings.Join(labels, ", ") + "]"
+	}
+	return strings.TrimSpace(name)
+}
+
+// extractFailedSpecsFromGinkgoReports initialises the FailedTestCasesReport
+// struct's 'failedTestCases' field with the failed specs of the given
+// Ginkgo reports, and returns whether any failed spec was found
+func (failedTCReport *FailedTestCasesReport) extractFailedSpecsFromGinkgoReports(logger zerolog.Logger, reports []types.Report) bool {
+	found := false
+
+	for _, report := range reports {
+		for _, spec := range report.SpecReports {
+			if !spec.Failed() {
+				continue
+			}
+			found = true
+
+			name := ginkgoSpecName(spec)
+			logger.Debug().Msgf("Found a spec (suiteName/specName): %s/%s, that didn't pass", report.SuiteDescription, name)
+
+			failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+				suiteName: report.SuiteDescription,
+				name:      name,
+				status:    spec.State.String(),
+				message:   spec.FailureMessage(),
+				details:   ginkgoSpecDetails(spec),
+				duration:  spec.RunTime,
+				location:  fmt.Sprintf("%s:%d", spec.LeafNodeLocation.FileName, spec.LeafNodeLocation.LineNumber),
+			})
+		}
+	}
+
+	return found
+}
+
+// ginkgoSpecDetails renders where and why the given spec failed
+func ginkgoSpecDetails(spec types.SpecReport) string {
+	details := ""
+
+	failedIn := inlineCode(spec.FailureLocation().String())
+	if spec.Failure.FailureNodeContext != types.FailureNodeIsLeafNode {
+		failedIn = fmt.Sprintf("`[%s]` at %s", spec.Failure.FailureNodeType, failedIn)
+	}
+	details = details + "Failed in " + failedIn + "\n"
+
+	message := spec.FailureMessage()
+	if spec.Failure.ForwardedPanic != "" {
+		message = message + "\n" + spec.Failure.ForwardedPanic
+	}
+	details = details + codeBlock(message)
+
+	if spec.State.Is(types.SpecStateTimedout|types.SpecStateInterrupted) && spec.CapturedGinkgoWriterOutput != "" {
+		details = details + "\n" + returnContentWrappedInDropdown(dropdownSummaryString, spec.CapturedGinkgoWriterOutput)
+	}
+
+	return details
+}
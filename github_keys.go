@@ -0,0 +1,198 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/shurcooL/githubv4"
+	"golang.org/x/oauth2"
+)
+
+const (
+	GithubKeysReloadRoute string = "/admin/github/keys/reload"
+	appKeyVerifyTimeout          = 10 * time.Second
+)
+
+// appKeyring is a ClientCreator authenticating with one of the GitHub App's
+// private keys. Every file within the keys directory is a PEM-encoded key
+// named by its ID. The clients use the key having the greatest ID among the
+// keys GitHub accepts, so a key gets rotated without downtime by adding a
+// newer file, reloading, and only then revoking the older key on GitHub.
+type appKeyring struct {
+	mu         sync.RWMutex
+	keysDir    string
+	newCreator func(privateKey []byte) (githubapp.ClientCreator, error)
+	logger     zerolog.Logger
+	primaryID  string
+	primary    githubapp.ClientCreator
+}
+
+func newAppKeyring(ctx context.Context, keysDir string, newCreator func([]byte) (githubapp.ClientCreator, error), logger zerolog.Logger) (*appKeyring, error) {
+	k := &appKeyring{keysDir: keysDir, newCreator: newCreator, logger: logger}
+	if err := k.reload(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// reload (re-)reads the keys from the keyring's directory and switches to
+// the newest key GitHub accepts. The current key is kept when none is accepted
+func (k *appKeyring) reload(ctx context.Context) error {
+	entries, err := os.ReadDir(k.keysDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading the GitHub App keys directory: %s", k.keysDir)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		// skip directories and the hidden files created by Kubernetes secret mounts
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	for _, id := range ids {
+		content, err := os.ReadFile(filepath.Join(k.keysDir, id))
+		if err != nil {
+			return errors.Wrapf(err, "failed reading the GitHub App key: %s", id)
+		}
+		creator, err := k.newCreator(content)
+		if err != nil {
+			return errors.Wrapf(err, "invalid GitHub App key: %s", id)
+		}
+		if err := verifyAppKey(ctx, creator); err != nil {
+			k.logger.Warn().Err(err).Msgf("GitHub rejected the App key %s, trying the older keys", id)
+			continue
+		}
+
+		k.mu.Lock()
+		if k.primaryID != id {
+			k.logger.Info().Msgf("Authenticating with the GitHub App key %s", id)
+		}
+		k.primaryID, k.primary = id, creator
+		k.mu.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("GitHub accepted none of the %d keys within %s", len(ids), k.keysDir)
+}
+
+// verifyAppKey makes sure GitHub accepts the key the creator authenticates with
+func verifyAppKey(ctx context.Context, creator githubapp.ClientCreator) error {
+	client, err := creator.NewAppClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, appKeyVerifyTimeout)
+	defer cancel()
+	_, _, err = client.Apps.Get(ctx, "")
+	return err
+}
+
+// run reloads the keys every interval until the context is done, so that
+// newly mounted keys get picked up and revoked keys get dropped
+func (k *appKeyring) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reload(ctx); err != nil {
+				k.logger.Error().Err(err).Msg("Failed to reload the GitHub App keys")
+			}
+		}
+	}
+}
+
+func (k *appKeyring) creator() githubapp.ClientCreator {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+func (k *appKeyring) NewAppClient() (*github.Client, error) {
+	return k.creator().NewAppClient()
+}
+
+func (k *appKeyring) NewAppV4Client() (*githubv4.Client, error) {
+	return k.creator().NewAppV4Client()
+}
+
+func (k *appKeyring) NewInstallationClient(installationID int64) (*github.Client, error) {
+	return k.creator().NewInstallationClient(installationID)
+}
+
+func (k *appKeyring) NewInstallationV4Client(installationID int64) (*githubv4.Client, error) {
+	return k.creator().NewInstallationV4Client(installationID)
+}
+
+func (k *appKeyring) NewTokenSourceClient(ts oauth2.TokenSource) (*github.Client, error) {
+	return k.creator().NewTokenSourceClient(ts)
+}
+
+func (k *appKeyring) NewTokenSourceV4Client(ts oauth2.TokenSource) (*githubv4.Client, error) {
+	return k.creator().NewTokenSourceV4Client(ts)
+}
+
+func (k *appKeyring) NewTokenClient(token string) (*github.Client, error) {
+	return k.creator().NewTokenClient(token)
+}
+
+func (k *appKeyring) NewTokenV4Client(token string) (*githubv4.Client, error) {
+	return k.creator().NewTokenV4Client(token)
+}
+
+// AppKeysReloadHandler re-reads the GitHub App keys, switching
+// to a newly added key once GitHub accepts it
+type AppKeysReloadHandler struct {
+	Keys   *appKeyring
+	Logger zerolog.Logger
+}
+
+func (h *AppKeysReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.Keys.reload(r.Context()); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to reload the GitHub App keys")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.Keys.mu.RLock()
+	defer h.Keys.mu.RUnlock()
+	fmt.Fprintf(w, "primary key: %s\n", h.Keys.primaryID)
+}
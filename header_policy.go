@@ -0,0 +1,176 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFailureStreakTTL = 7 * 24 * time.Hour
+	alarmHeaderPrefix       = ":rotating_light: "
+)
+
+// defaultHeaderRules are used when the header policy doesn't configure any rule:
+// the first failure gets a calm header, the third infra failure in a row is escalated
+var defaultHeaderRules = []HeaderRuleConfig{
+	{Threshold: 1, Header: ":information_source: {{.Header}}"},
+	{Kind: failureKindInfra, Threshold: 3, Header: ":fire: **The CI system failed this job {{.Count}} times in a row on this PR.** {{.Header}}" +
+		"{{with .Mention}}\n\ncc {{.}}, please take a look{{end}}"},
+}
+
+// headerData is what the header templates get rendered with
+type headerData struct {
+	// the header the analysis picked, without its emoji
+	Header string
+	Kind   string
+	// the number of consecutive failures of the job on the PR with the same kind
+	Count   int
+	Mention string
+}
+
+type headerRule struct {
+	HeaderRuleConfig
+	template *template.Template
+}
+
+// failureStreak counts the consecutive failures of a job on a PR
+type failureStreak struct {
+	kind     string
+	count    int
+	failedAt time.Time
+}
+
+// headerPolicy picks the report's header from the job's history on
+// the PR, escalating its wording when the job keeps failing
+type headerPolicy struct {
+	rules  []headerRule
+	onCall string
+	ttl    time.Duration
+	// defers the mentions outside of the business hours, if set
+	hours *businessHours
+
+	mu      sync.Mutex
+	streaks map[string]*failureStreak
+}
+
+func newHeaderPolicy(cfg HeaderPolicyConfig) (*headerPolicy, error) {
+	p := &headerPolicy{onCall: cfg.OnCall, ttl: cfg.StreakTTL, streaks: map[string]*failureStreak{}}
+	if p.ttl == 0 {
+		p.ttl = defaultFailureStreakTTL
+	}
+
+	rules := cfg.Rules
+	if len(rules) == 0 {
+		rules = defaultHeaderRules
+	}
+	for _, rule := range rules {
+		if rule.Threshold < 1 {
+			return nil, fmt.Errorf("the threshold of the header rules must be at least 1, got %d", rule.Threshold)
+		}
+		t, err := template.New(fmt.Sprintf("header-%s-%d", rule.Kind, rule.Threshold)).Parse(rule.Header)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid header template for the %d failure(s) threshold", rule.Threshold)
+		}
+		p.rules = append(p.rules, headerRule{HeaderRuleConfig: rule, template: t})
+	}
+
+	return p, nil
+}
+
+// record counts the failure of the job on the PR, and returns the
+// number of consecutive failures of the job with the same kind
+func (p *headerPolicy) record(key, kind string) int {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for k, streak := range p.streaks {
+		if now.Sub(streak.failedAt) > p.ttl {
+			delete(p.streaks, k)
+		}
+	}
+
+	streak, ok := p.streaks[key]
+	if !ok || streak.kind != kind {
+		streak = &failureStreak{kind: kind}
+		p.streaks[key] = streak
+	}
+	streak.count++
+	streak.failedAt = now
+
+	return streak.count
+}
+
+// match returns the rule with the greatest threshold reached by the failures' count
+func (p *headerPolicy) match(kind string, count int) *headerRule {
+	var matched *headerRule
+	for i, rule := range p.rules {
+		if rule.Kind != "" && rule.Kind != kind {
+			continue
+		}
+		if rule.Threshold <= count && (matched == nil || rule.Threshold > matched.Threshold) {
+			matched = &p.rules[i]
+		}
+	}
+	return matched
+}
+
+// apply records the report's failure and rewrites its header with the matching rule, if any
+func (p *headerPolicy) apply(logger zerolog.Logger, mentions *mentionOptOuts, repoFullName string, prNumber int, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	if p == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%s", prKey(repoFullName, prNumber), jobNameFromProwJobURL(prowJobURL))
+	count := p.record(key, failedTCReport.failureKind)
+	rule := p.match(failedTCReport.failureKind, count)
+	if rule == nil {
+		return
+	}
+
+	data := headerData{
+		Header: strings.TrimSpace(strings.TrimPrefix(failedTCReport.headerString, alarmHeaderPrefix)),
+		Kind:   failedTCReport.failureKind,
+		Count:  count,
+	}
+	onCall := rule.Mention
+	if onCall == "" {
+		onCall = p.onCall
+	}
+	switch {
+	case onCall != "" && p.hours.defers(failedTCReport.failureKind, time.Now()):
+		// named without notifying them, until the next working window
+		data.Mention = inlineCode(onCall)
+		failedTCReport.deferredMention = onCall
+	case onCall != "":
+		data.Mention = mentions.mention(onCall)
+	}
+
+	var b strings.Builder
+	if err := rule.template.Execute(&b, data); err != nil {
+		logger.Error().Err(err).Msgf("Failed to render the header for the %d failure(s) threshold", rule.Threshold)
+		return
+	}
+	failedTCReport.headerString = b.String() + "\n"
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HealthzRoute string = "/healthz"
+	ReadyzRoute  string = "/readyz"
+)
+
+// serverReadiness tells whether the webhook server accepts connections: from
+// when its listener is bound until it starts shutting down, so that Kubernetes
+// stops routing the deliveries to a replica being terminated
+type serverReadiness struct {
+	listening atomic.Bool
+}
+
+// HealthzHandler is the liveness probe: it fails when an analysis of the
+// queue's workers has been running for longer than the stall timeout, the
+// worker loop being wedged (e.g. on a read without a deadline)
+type HealthzHandler struct {
+	Queue  *workQueue
+	Logger zerolog.Logger
+}
+
+func (h *HealthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if key, since := h.Queue.stalled(); key != "" {
+		h.Logger.Error().Msgf("The analysis of %s has been running for %s, the worker is wedged", key, since.Round(time.Second))
+		http.Error(w, fmt.Sprintf("an analysis has been running for %s", since.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ReadyzHandler is the readiness probe: it fails until the webhook server
+// accepts connections, once it shuts down, and while the GitHub App's
+// credentials can't be loaded (e.g. a rotated key which doesn't parse)
+type ReadyzHandler struct {
+	ClientCreator githubapp.ClientCreator
+	Readiness     *serverReadiness
+	Logger        zerolog.Logger
+}
+
+func (h *ReadyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.Readiness.listening.Load() {
+		http.Error(w, "the webhook server isn't accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+	// creating the app's client doesn't call GitHub, but parses its private key
+	if _, err := h.ClientCreator.NewAppClient(); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to load the GitHub App's credentials")
+		http.Error(w, "the GitHub App's credentials can't be loaded", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeatmapRoute         string = "/admin/heatmap"
+	heatmapCommand              = "/heatmap"
+	heatmapRuns                 = 20
+	defaultHeatmapWindow        = 30 * 24 * time.Hour
+	heatmapFailedCell           = "🟥"
+	heatmapPassedCell           = "⬜"
+)
+
+var heatmapHTMLTemplate = template.Must(template.New("heatmap").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Job}}</title>
+<style>
+td.failed { background-color: #d73a49; }
+td.passed { background-color: #eeeeee; }
+td { min-width: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Job}}</h1>
+<table>
+<tr><th>Test</th><th>Failures</th>{{range $i, $run := .Runs}}<th><a href="{{$run}}">{{$i}}</a></th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Test}}</td><td>{{.Failures}}</td>{{range .Cells}}<td class="{{if .}}failed{{else}}passed{{end}}"></td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// heatmap shows which tests failed within the latest analysed runs of a job,
+// the runs being ordered from the oldest to the most recent one
+type heatmap struct {
+	Job  string
+	Runs []string
+	Rows []heatmapRow
+}
+
+type heatmapRow struct {
+	Test     string
+	Failures int
+	// Cells[i] is true when the test failed within Runs[i]
+	Cells []bool
+}
+
+// buildHeatmap builds the heatmap of the last 'maxRuns' runs of the given job
+// from the recorded failures, optionally limited to a single test suite
+func buildHeatmap(records []FailureRecord, job, suite string, maxRuns int) *heatmap {
+	firstSeen := map[string]time.Time{}
+	for _, r := range records {
+		if r.TestCase == "" || jobNameFromProwJobURL(r.ProwJobURL) != job || (suite != "" && r.SuiteName != suite) {
+			continue
+		}
+		if t, ok := firstSeen[r.ProwJobURL]; !ok || r.Timestamp.Before(t) {
+			firstSeen[r.ProwJobURL] = r.Timestamp
+		}
+	}
+
+	runs := make([]string, 0, len(firstSeen))
+	for url := range firstSeen {
+		runs = append(runs, url)
+	}
+	sort.Slice(runs, func(i, j int) bool { return firstSeen[runs[i]].Before(firstSeen[runs[j]]) })
+	if len(runs) > maxRuns {
+		runs = runs[len(runs)-maxRuns:]
+	}
+
+	runIndex := map[string]int{}
+	for i, url := range runs {
+		runIndex[url] = i
+	}
+
+	rows := map[string]*heatmapRow{}
+	for _, r := range records {
+		i, ok := runIndex[r.ProwJobURL]
+		if !ok || r.TestCase == "" || (suite != "" && r.SuiteName != suite) {
+			continue
+		}
+		name := client.NormalizeTestName(r.TestCase)
+		row, ok := rows[name]
+		if !ok {
+			row = &heatmapRow{Test: r.TestCase, Cells: make([]bool, len(runs))}
+			rows[name] = row
+		}
+		if !row.Cells[i] {
+			row.Cells[i] = true
+			row.Failures++
+		}
+	}
+
+	h := &heatmap{Job: job, Runs: runs}
+	for _, row := range rows {
+		h.Rows = append(h.Rows, *row)
+	}
+	sort.Slice(h.Rows, func(i, j int) bool {
+		if h.Rows[i].Failures != h.Rows[j].Failures {
+			return h.Rows[i].Failures > h.Rows[j].Failures
+		}
+		return h.Rows[i].Test < h.Rows[j].Test
+	})
+
+	return h
+}
+
+// markdown renders the heatmap as a Markdown table
+func (h *heatmap) markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "### Failure heatmap of `%s`\n\n", h.Job)
+	if len(h.Rows) == 0 {
+		b.WriteString("No failures were recorded for this job.\n")
+		return b.String()
+	}
+
+	b.WriteString("| Test | Failures |")
+	for i, run := range h.Runs {
+		fmt.Fprintf(&b, " [%d](%s) |", i, run)
+	}
+	b.WriteString("\n|---|---|" + strings.Repeat("---|", len(h.Runs)) + "\n")
+
+	for _, row := range h.Rows {
+		fmt.Fprintf(&b, "| %s | %d |", strings.ReplaceAll(row.Test, "|", "\\|"), row.Failures)
+		for _, failed := range row.Cells {
+			if failed {
+				b.WriteString(" " + heatmapFailedCell + " |")
+			} else {
+				b.WriteString(" " + heatmapPassedCell + " |")
+			}
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\nThe columns are the last %d analysed runs of the job, from the oldest to the most recent one.\n", len(h.Runs))
+
+	return b.String()
+}
+
+// HeatmapHandler serves the failure heatmap of the job given by the "job"
+// query parameter, as HTML or as Markdown when "format" is set to "markdown"
+type HeatmapHandler struct {
+	Store  FailureStore
+	Logger zerolog.Logger
+}
+
+func (h *HeatmapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	job := r.URL.Query().Get("job")
+	if job == "" {
+		http.Error(w, "the job query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseTimeRange(r, defaultHeatmapWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := h.Store.ListFailures(r.Context(), from, to)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to list failures for the heatmap")
+		http.Error(w, "failed to list failures", http.StatusInternalServerError)
+		return
+	}
+
+	hm := buildHeatmap(records, job, r.URL.Query().Get("suite"), heatmapRuns)
+
+	if r.URL.Query().Get("format") == "markdown" {
+		w.Header().Set("Content-Type", "text/markdown")
+		fmt.Fprint(w, hm.markdown())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := heatmapHTMLTemplate.Execute(w, hm); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to render the heatmap")
+	}
+}
+
+// handleHeatmapCommand posts the failure heatmap of the given job to the PR
+func (h *PRCommentHandler) handleHeatmapCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: %s <job> [suite]", heatmapCommand)
+	}
+	suite := ""
+	if len(args) == 2 {
+		suite = args[1]
+	}
+
+	now := time.Now()
+	records, err := h.Store.ListFailures(ctx, now.Add(-defaultHeatmapWindow), now)
+	if err != nil {
+		return fmt.Errorf("failed to list failures: %+v", err)
+	}
+	hm := buildHeatmap(records, args[0], suite, heatmapRuns)
+
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	prNumber := event.GetIssue().GetNumber()
+	if _, _, err := client.Issues.CreateComment(ctx, repoOwner, repoName, prNumber, &github.IssueComment{Body: github.String(hm.markdown())}); err != nil {
+		return fmt.Errorf("failed to post the heatmap: %+v", err)
+	}
+	logger.Debug().Msgf("Posted the heatmap of the job %s", args[0])
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/google/go-github/v58/github"
+)
+
+const (
+	// held PRs get a compact report, without the extras costing
+	// further API calls (e.g. the CRs' conditions, the main branch's history)
+	onHoldCompact = "compact"
+	// held PRs aren't analysed at all
+	onHoldSkip = "skip"
+	// held PRs are analysed as any other PR
+	onHoldFull = "full"
+)
+
+// defaultHoldLabels mark the PRs which won't be merged soon
+var defaultHoldLabels = []string{"do-not-merge/hold", "do-not-merge/work-in-progress", "wip"}
+
+// holdLabel returns the first label of the PR marking it as held, if any
+func holdLabel(issue *github.Issue, holdLabels []string) string {
+	if len(holdLabels) == 0 {
+		holdLabels = defaultHoldLabels
+	}
+	for _, label := range issue.Labels {
+		for _, holdLabel := range holdLabels {
+			if label.GetName() == holdLabel {
+				return holdLabel
+			}
+		}
+	}
+	return ""
+}
+
+// onHoldPolicy returns how the PR of the event gets analysed, which is
+// onHoldFull unless the PR is held
+func (h *PRCommentHandler) onHoldPolicy(event github.IssueCommentEvent) (policy string, label string) {
+	repoConfig := h.repositoryConfig(event.GetRepo().GetFullName())
+	label = holdLabel(event.GetIssue(), repoConfig.HoldLabels)
+	if label == "" {
+		return onHoldFull, ""
+	}
+	switch repoConfig.OnHold {
+	case onHoldSkip, onHoldFull:
+		return repoConfig.OnHold, label
+	default:
+		return onHoldCompact, label
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultInfraChangesRepository = "redhat-appstudio/infra-deployments"
+	defaultInfraChangesBranch     = "main"
+	defaultInfraChangesWindow     = 6 * time.Hour
+	defaultInfraChangesMax        = 5
+	// the changes of a window are fetched once per TTL, the windows being rounded to the minute
+	infraChangesTTL = 10 * time.Minute
+)
+
+type infraChange struct {
+	title string
+	url   string
+	at    time.Time
+}
+
+type infraChangesEntry struct {
+	changes   []infraChange
+	fetchedAt time.Time
+}
+
+// infraChanges lists the changes merged into the repository deploying the
+// test environments (infra-deployments) shortly before a job failed because
+// of the infrastructure, as the possible culprits of an environment
+// regression. A nil infraChanges lists nothing
+type infraChanges struct {
+	owner, repo string
+	branch      string
+	window      time.Duration
+	max         int
+
+	mu sync.Mutex
+	// keyed by the window's end
+	cache map[time.Time]infraChangesEntry
+}
+
+func newInfraChanges(cfg InfraChangesConfig) (*infraChanges, error) {
+	c := &infraChanges{branch: cfg.Branch, window: cfg.Window, max: cfg.MaxChanges, cache: map[time.Time]infraChangesEntry{}}
+	repository := cfg.Repository
+	if repository == "" {
+		repository = defaultInfraChangesRepository
+	}
+	sp := strings.Split(repository, "/")
+	if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+		return nil, fmt.Errorf("the repository of the infra changes must be a full name, e.g. org/repo: %q", repository)
+	}
+	c.owner, c.repo = sp[0], sp[1]
+	if c.branch == "" {
+		c.branch = defaultInfraChangesBranch
+	}
+	if c.window == 0 {
+		c.window = defaultInfraChangesWindow
+	}
+	if c.max == 0 {
+		c.max = defaultInfraChangesMax
+	}
+	return c, nil
+}
+
+// list returns the most recent changes merged within the window before the given time
+func (c *infraChanges) list(ctx context.Context, client *github.Client, until time.Time) ([]infraChange, error) {
+	until = until.Truncate(time.Minute)
+	c.mu.Lock()
+	for end, entry := range c.cache {
+		if time.Since(entry.fetchedAt) >= infraChangesTTL {
+			delete(c.cache, end)
+		}
+	}
+	entry, ok := c.cache[until]
+	c.mu.Unlock()
+	if ok {
+		return entry.changes, nil
+	}
+
+	commits, _, err := client.Repositories.ListCommits(ctx, c.owner, c.repo, &github.CommitsListOptions{
+		SHA:         c.branch,
+		Since:       until.Add(-c.window),
+		Until:       until,
+		ListOptions: github.ListOptions{PerPage: c.max},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var changes []infraChange
+	for _, commit := range commits {
+		title, _, _ := strings.Cut(commit.GetCommit().GetMessage(), "\n")
+		changes = append(changes, infraChange{
+			title: title,
+			url:   commit.GetHTMLURL(),
+			at:    commit.GetCommit().GetCommitter().GetDate().Time,
+		})
+	}
+
+	c.mu.Lock()
+	c.cache[until] = infraChangesEntry{changes: changes, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return changes, nil
+}
+
+// annotate lists the infra changes merged before the job started as the possible
+// culprits of its failures, when the job failed because of the infrastructure
+func (c *infraChanges) annotate(ctx context.Context, logger zerolog.Logger, client *github.Client, scanner *prow.ArtifactScanner, scanURL string, failedTCReport *FailedTestCasesReport) {
+	if c == nil || !containsFold(infraFailureKinds, failedTCReport.failureKind) {
+		return
+	}
+	started := fetchJobMetadata(ctx, scanner.Client, scanURL, "", 0).StartTime
+	if started.IsZero() {
+		started = time.Now()
+	}
+
+	changes, err := c.list(ctx, client, started)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to list the changes of %s/%s", c.owner, c.repo)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, ":mag: **Possible culprits**, the changes merged into `%s/%s` within the %s before the job started:", c.owner, c.repo, c.window)
+	for _, change := range changes {
+		fmt.Fprintf(&b, "\n * [%s](%s), %s before", inlineCode(change.title), change.url, started.Sub(change.at).Round(time.Minute))
+	}
+	failedTCReport.warnings = append(failedTCReport.warnings, b.String())
+}
@@ -17,12 +17,12 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	"regexp"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/google/go-github/v58/github"
 	"github.com/konflux-ci/qe-tools/pkg/prow"
 	reporters "github.com/onsi/ginkgo/v2/reporters"
@@ -39,24 +39,116 @@ const (
 	openshiftCITestSuiteName = "openshift-ci job"
 	e2eTestSuiteName         = "Red Hat App Studio E2E tests"
 	LogKeyProwJobURL         = "prow_job_url"
+	LogKeyProwJobType        = "prow_job_type"
 	dropdownSummaryString    = "Click to view logs"
 	cRsPropertyName          = "redhat-appstudio-gather"
 	podsPropertyName         = "gather-extra"
 	junitSummaryPropertyName = "html-report-link"
-	regexToFetchProwURL      = `(https:\/\/prow.ci.openshift.org\/view\/gs\/test-platform-results\/pr-logs\/pull.*)\)`
+	// the Spyglass URLs of the presubmits (and their batches), periodics and postsubmits, on any (private) Deck
+	regexToFetchProwURL    = `(https:\/\/[\w.-]+\/view\/gs\/[\w.-]+\/(?:pr-logs\/pull|logs)\/[^\s)]+)\)`
+	e2eFailureHeaderString = ":rotating_light: **Error occurred while running the E2E tests, list of failed Spec(s)**: \n"
 )
 
 type PRCommentHandler struct {
 	githubapp.ClientCreator
+	Config            *Config
+	Store             FailureStore
+	MainBranchHistory *mainBranchHistory
+	Analyses          *analysisCache
+	Metrics           *failureMetrics
+	Cancellations     *analysisCancellations
+	Access            *accessPolicy
+	Deck              *deckClient
+	Telemetry         *telemetry
+	ReportPages       *reportPages
+	Remediations      *remediationKB
+	ArtifactSizes     *artifactSizePolicies
+	Mentions          *mentionOptOuts
+	PrivateSpyglass   *privateSpyglass
+	Workload          *workload
+	HeaderPolicy      *headerPolicy
+	Dependencies      *dependencyHealth
+	Outage            *outageMode
+	AnalysisJUnit     *analysisJUnitUploader
+	Classifiers       *classifiers
+	Triggers          *triggers
+	Watches           *jobWatches
+	ReviewComments    *reviewComments
+	CommentLint       *commentLint
+	CommentEdits      *commentEdits
+	Regions           *regionHealth
+	RetryAdvisor      *retryAdvisor
+	DeferredMentions  *deferredMentions
+	Bursts            *burstGuard
+	RepoConfigFiles   *repoConfigFiles
+	Status            *appStatus
+	Queue             *workQueue
+	TeamComments      *teamComments
+	InfraChanges      *infraChanges
+	Gates             *analysisGates
+	FailureHistory    *failureHistory
+	Locks             *prLocks
+	JobCosts          *jobCosts
+	// shared by the scanners of the analyses when set
+	GCS *storage.Client
+	// the source of the jobs' artifacts, GCS read with the GCS client when nil
+	Artifacts ArtifactSource
 }
 
 type FailedTestCasesReport struct {
 	headerString         string
 	podsLink             string
-	failedTestCaseNames  []string
+	failedTestCases      []failedTestCase
 	hasBootstrapFailure  bool
 	customResourcesLink  string
 	jUnitSummaryFileLink string
+	extraLinks           []reportLink
+	// rendered right after the header, e.g. when the job tested stale components
+	warnings []string
+	// the stage at which the job failed, used to pick the next steps
+	failureKind string
+	nextStep    string
+	identity    reportIdentity
+	// the user or team whose mention by the header waits for the business hours
+	deferredMention string
+	// the probability that a retest passes, from the retests of the similar runs
+	retestAdvice string
+	// the job's duration compared with its earlier runs, and its estimated cost
+	jobStats   string
+	prowJobURL string
+	// the check run holding the full report, which its summary links to
+	detailsURL string
+	// the headings of the failures of each team, keyed by team, when they're grouped by team
+	teamHeadings map[string]string
+	// how the report was posted, e.g. within the job's comment (reportedByEdit) or by a fallback
+	reportedBy string
+}
+
+// failedTestCase is a single entry of the report. Entries
+// without a status (e.g. a build log dump) aren't test cases
+// and only their details get rendered
+type failedTestCase struct {
+	suiteName string
+	name      string
+	status    string
+	message   string
+	details   string
+	notes     []string
+	// whether the test case also failed within the latest run on the main branch
+	failingOnMain bool
+	// whether the failure matches an entry of the remediations' knowledge base
+	knownIssue bool
+	// how long the test case ran, when its report tells
+	duration time.Duration
+	// whether the test case is a suite-level teardown node, e.g. [AfterSuite]
+	teardown bool
+	// where the spec is defined, as "<path>:<line>", when its report tells
+	location string
+	// the child run of the aggregated job the test case failed in
+	childJobURL string
+	// the test case's Ginkgo owner, and the team owning it
+	owner string
+	team  string
 }
 
 func (h *PRCommentHandler) Handles() []string {
@@ -82,13 +174,37 @@ func (h *PRCommentHandler) Handle(ctx context.Context, eventType, deliveryID str
 		return err
 	}
 
-	author := event.GetComment().GetUser().GetLogin()
 	body := event.GetComment().GetBody()
 
-	if !strings.HasPrefix(author, targetAuthor) {
-		logger.Debug().Msgf("Issue comment was not created by the user: %s. Ignoring this comment", targetAuthor)
+	// the config files of the denied repositories aren't worth fetching
+	allowed := h.isAllowed(ctx, logger, client, event)
+	if allowed {
+		h.RepoConfigFiles.refresh(ctx, logger, client, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName())
+	}
+
+	triggered, err := h.Triggers.matches(ctx, client, event, h.repositoryConfig(event.GetRepo().GetFullName()).Trigger)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to evaluate the repository's trigger, ignoring this comment")
+		return nil
+	}
+	if !triggered {
+		if cmd := parseCommand(body); cmd != nil && (isSelfServiceCommand(cmd) || allowed) {
+			return h.handleCommand(ctx, logger, client, event, deliveryID, cmd)
+		}
+		logger.Debug().Msg("Issue comment doesn't match the repository's trigger. Ignoring this comment")
+		return nil
+	}
+
+	if !allowed {
+		return nil
+	}
+
+	onHold, holdLabel := h.onHoldPolicy(event)
+	if onHold == onHoldSkip {
+		logger.Debug().Msgf("The PR is labeled %s, skipping its analysis", holdLabel)
 		return nil
 	}
+	passive := onHold == onHoldCompact
 
 	// extract the Prow job's URL
 	prowJobURL, err := extractProwJobURLFromCommentBody(body)
@@ -98,18 +214,192 @@ func (h *PRCommentHandler) Handle(ctx context.Context, eventType, deliveryID str
 
 	logger = attachProwURLLogKeysToLogger(ctx, logger, prowJobURL)
 
-	cfg := prow.ScannerConfig{
-		ProwJobURL:     prowJobURL,
-		FileNameFilter: []string{junitFilenameRegex},
+	key := burstKey(event.GetRepo().GetFullName(), event.GetIssue().GetNumber(), prowJobURL)
+	if !passive && h.hold(ctx, logger, client, event, deliveryID, payload, key, h.repositoryConfig(event.GetRepo().GetFullName())) {
+		return nil
+	}
+	return h.Queue.enqueue(ctx, logger, key, func(ctx context.Context) error {
+		return h.Bursts.admit(ctx, logger, key, func(ctx context.Context) error {
+			err := h.Locks.run(ctx, logger, event.GetRepo().GetFullName(), event.GetIssue().GetNumber(), func(ctx context.Context) error {
+				return h.analyzeContained(ctx, logger, client, event, deliveryID, prowJobURL, func(ctx context.Context) error {
+					return h.analyze(ctx, logger, client, event, body, prowJobURL, passive, holdLabel)
+				})
+			})
+			if err == nil {
+				h.Status.recordAnalysis(event.GetRepo().GetOwner().GetLogin())
+			}
+			return err
+		})
+	})
+}
+
+// analyze builds the report of the Prow job's failures, and updates the
+// comment reporting the job's failure with it
+func (h *PRCommentHandler) analyze(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, body, prowJobURL string, passive bool, holdLabel string) error {
+	ctx, done := h.Cancellations.start(ctx, event.GetRepo().GetFullName(), event.GetIssue().GetNumber())
+	defer done()
+
+	var rerunLink *reportLink
+	if h.Deck != nil && !passive {
+		// make sure the job finished uploading its artifacts, and use the URL Prow reports for it
+		if pj, err := h.Deck.waitForCompletion(ctx, logger, prowJobURL); err != nil {
+			logger.Error().Err(err).Msg("Failed to confirm the Prow job finished, scanning its artifacts anyway")
+		} else {
+			if pj.Status.URL != "" {
+				prowJobURL = strings.TrimSuffix(pj.Status.URL, "/")
+			}
+			rerunLink = &reportLink{name: "Rerun the job", url: h.Deck.rerunURL(pj.Metadata.Name)}
+		}
+	}
+
+	rc := h.repositoryConfig(event.GetRepo().GetFullName())
+	failedTCReport, scanner, scanURL, err := h.buildReport(ctx, logger, client, event, prowJobURL, passive, rc)
+	if err != nil {
+		return err
+	}
+	if rerunLink != nil {
+		failedTCReport.extraLinks = append(failedTCReport.extraLinks, *rerunLink)
+	}
+
+	repoFullName := event.GetRepo().GetFullName()
+	prNumber := event.GetIssue().GetNumber()
+	// the failures recorded by a previous analysis of the job aren't counted
+	h.FailureHistory.annotate(ctx, logger, prowJobURL, failedTCReport)
+	h.JobCosts.annotate(ctx, logger, scanner.Client, scanURL, repoFullName, prNumber, prowJobURL, failedTCReport)
+	h.recordFailures(ctx, logger, event, prowJobURL, failedTCReport)
+	if h.Metrics != nil {
+		h.Metrics.observe(event.GetRepo().GetFullName(), failedTCReport.failedTestCases)
+	}
+	if h.MainBranchHistory != nil && !passive {
+		h.MainBranchHistory.annotate(ctx, logger, prowJobURL, failedTCReport)
+	}
+	if !passive {
+		h.RetryAdvisor.advise(ctx, logger, prowJobURL, failedTCReport)
+	}
+	h.HeaderPolicy.apply(logger, h.Mentions, repoFullName, prNumber, prowJobURL, failedTCReport)
+	failedTCReport.nextStep = nextStep(failedTCReport, h.repositoryConfig(repoFullName).NextSteps)
+	failedTCReport.identity = h.reportIdentity(repoFullName)
+	if h.ReportPages != nil && len(failedTCReport.failedTestCases) > 0 {
+		if id, err := newReportPageID(); err != nil {
+			logger.Error().Err(err).Msg("Failed to generate the ID of the report's page")
+		} else {
+			failedTCReport.extraLinks = append(failedTCReport.extraLinks, reportLink{name: reportPageLinkName, url: h.ReportPages.url(id)})
+			h.ReportPages.add(ctx, logger, newReportPage(id, repoFullName, prNumber, prowJobURL, failedTCReport))
+		}
+	}
+
+	// the check run also holds the details the summary format links to
+	if conclusion := h.repositoryConfig(repoFullName).CheckRun; conclusion != "" && conclusion != checkRunOff && !passive && !h.Outage.isReadOnly() && len(failedTCReport.failedTestCases) > 0 {
+		failedTCReport.publishDetails(ctx, logger, client, h.Telemetry, event, conclusion)
+	}
+
+	format := h.reportFormat(repoFullName, prNumber)
+	if passive {
+		logger.Debug().Msgf("The PR is labeled %s, reporting its failures in the compact format", holdLabel)
+		format = reportFormatCompact
 	}
+	if h.Outage.isReadOnly() {
+		logger.Info().Msg("The app is read-only, not updating the comment with the report")
+	} else if reason := failedTCReport.belowNoiseThresholds(rc); reason != "" {
+		logger.Info().Msgf("Not updating the comment with the report, %s", reason)
+		h.Telemetry.count("noise:skipped")
+	} else if err = failedTCReport.updateCommentWithFailedTestCasesReport(ctx, logger, client, h.CommentLint, h.CommentEdits, h.Telemetry, event, body, format, reportCommentMode(event, rc)); err != nil {
+		return err
+	} else if failedTCReport.deferredMention != "" {
+		logger.Debug().Msgf("Deferring the mention of %s to the next working window", failedTCReport.deferredMention)
+		h.DeferredMentions.add(deferredMention{
+			installationID: githubapp.GetInstallationIDFromEvent(&event),
+			owner:          event.GetRepo().GetOwner().GetLogin(),
+			repo:           event.GetRepo().GetName(),
+			prNumber:       prNumber,
+			login:          failedTCReport.deferredMention,
+			kind:           failedTCReport.failureKind,
+		})
+	}
+
+	if rc.TeamReports == teamReportsComments && failedTCReport.teamHeadings != nil && !passive && !h.Outage.isReadOnly() && failedTCReport.belowNoiseThresholds(rc) == "" {
+		h.postTeamReports(ctx, logger, client, event, failedTCReport, format)
+	}
+	if !passive && !h.Outage.isReadOnly() {
+		h.ReviewComments.annotate(ctx, logger, client, event, failedTCReport, h.repositoryConfig(repoFullName).ReviewComments)
+	}
+
+	h.Telemetry.count("analysis:" + failedTCReport.failureKind)
+	h.Regions.observe(ctx, logger, scanner.Client, scanURL, failedTCReport.failureKind)
+
+	if len(failedTCReport.failedTestCases) > 0 {
+		h.Analyses.add(repoFullName, prNumber, &analysis{
+			commentID:   event.GetComment().GetID(),
+			commentBody: body,
+			prowJobURL:  prowJobURL,
+			report:      failedTCReport,
+			reportedBy:  failedTCReport.reportedBy,
+		})
+		h.AnalysisJUnit.upload(ctx, logger, repoFullName, prNumber, prowJobURL, failedTCReport)
+	}
+
+	return nil
+}
 
-	scanner, err := prow.NewArtifactScanner(cfg)
+// buildReport scans the Prow job's artifacts and builds the report of its
+// failures. Without a client (e.g. for the analyze subcommand), the enrichments
+// calling GitHub are skipped. It also returns the scanner and the URL the
+// artifacts were scanned from
+func (h *PRCommentHandler) buildReport(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, prowJobURL string, passive bool, rc RepositoryConfig) (*FailedTestCasesReport, *prow.ArtifactScanner, string, error) {
+	scanner, scanURL, err := h.scanProwJob(ctx, logger, prowJobURL, rc)
 	if err != nil {
-		return fmt.Errorf("failed to initialize ArtifactScanner: %+v", err)
+		return nil, nil, "", err
+	}
+	failedTCReport, overallJUnitSuites, err := h.extractFailures(ctx, logger, scanner, passive, rc)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(overallJUnitSuites.TestSuites) == 0 {
+		h.analyzeChildJobs(ctx, logger, scanner, scanURL, rc, failedTCReport)
+	}
+	failedTCReport.prowJobURL = prowJobURL
+	h.Classifiers.classify(logger, scanner, rc.Classifiers, failedTCReport)
+	if header := rc.Headers[failedTCReport.failureKind]; header != "" {
+		failedTCReport.headerString = header + "\n"
+	}
+	failedTCReport.assignTeams(h.Mentions, rc.Teams, rc.TeamReports)
+	if !passive {
+		failedTCReport.linkSpecArtifacts(ctx, logger, scanner)
+		if client != nil {
+			failedTCReport.checkVersionSkew(ctx, logger, client, scanner, event, rc.ComponentImages)
+		}
+		failedTCReport.checkResourceExhaustion(ctx, logger, scanner, scanURL, h.Config.ResourceExhaustion)
+		if client != nil {
+			h.InfraChanges.annotate(ctx, logger, client, scanner, scanURL, failedTCReport)
+		}
+	}
+
+	if len(rc.LinkTemplates) > 0 {
+		metadata := fetchJobMetadata(ctx, scanner.Client, scanURL, event.GetRepo().GetFullName(), event.GetIssue().GetNumber())
+		metadata.ProwJobURL = prowJobURL
+		failedTCReport.extraLinks = renderLinkTemplates(logger, rc.LinkTemplates, metadata)
+	}
+	failedTCReport.initPodAndCRsLink(overallJUnitSuites, h.propertyAliases())
+	return failedTCReport, scanner, scanURL, nil
+}
+
+// scanProwJob fetches the artifacts of the Prow job the reports are built from.
+// It returns the scanner holding them, and the URL they were scanned from
+func (h *PRCommentHandler) scanProwJob(ctx context.Context, logger zerolog.Logger, prowJobURL string, rc RepositoryConfig) (*prow.ArtifactScanner, string, error) {
+	scanURL, source := prowJobURL, h.Artifacts
+	if source == nil {
+		source = &gcsArtifactSource{client: h.GCS, sizes: h.ArtifactSizes}
+	}
+	// the artifacts of the private jobs are read with the credentials of their Deck
+	if private := h.PrivateSpyglass.match(prowJobURL); private != nil {
+		logger.Debug().Msgf("Reading the artifacts of the private job from %s", private.bucket)
+		scanURL, source = private.scanURL(prowJobURL), &gcsArtifactSource{client: private.client, sizes: h.ArtifactSizes}
 	}
 
-	err = wait.PollUntilContextTimeout(context.Background(), 5*time.Second, 10*time.Minute, true, func(context.Context) (done bool, err error) {
-		if err := scanner.Run(); err != nil {
+	fileNameFilter := []string{"(" + rc.junitFilePattern() + ")", ginkgoJSONReportFilenameRegex, ecReportFilenameRegex, clusterPoolFilenameRegex, e2eReportFilenameRegex}
+	var scanner *prow.ArtifactScanner
+	err := wait.PollUntilContextTimeout(ctx, 5*time.Second, 10*time.Minute, true, func(ctx context.Context) (done bool, err error) {
+		if scanner, err = source.Scan(ctx, logger, scanURL, fileNameFilter); err != nil {
 			logger.Error().Err(err).Msgf("Failed to scan artifacts from the Prow job...Retrying")
 			return false, nil
 		}
@@ -118,24 +408,42 @@ func (h *PRCommentHandler) Handle(ctx context.Context, eventType, deliveryID str
 	})
 	if err != nil {
 		logger.Error().Err(err).Msgf("Timed out while scanning artifacts for Prow job %s. Will Stop processing this comment", prowJobURL)
-		return err
+		return nil, "", err
 	}
 
-	overallJUnitSuites, err := getTestSuitesFromXMLFile(scanner, logger, junitFilename)
+	return scanner, scanURL, nil
+}
+
+// extractFailures builds the report of the failures found within the
+// scanned artifacts. The passive reports don't inline the CRs' conditions
+func (h *PRCommentHandler) extractFailures(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner, passive bool, rc RepositoryConfig) (*FailedTestCasesReport, *reporters.JUnitTestSuites, error) {
+	overallJUnitSuites, err := getTestSuitesFromXMLFiles(ctx, scanner, logger, rc.junitFilePattern())
 	// make sure that the Prow job didn't fail while creating the cluster
-	if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("couldn't find the %s file", junitFilename)) {
-		return fmt.Errorf("failed to get JUnitTestSuites from the file %s: %+v", junitFilename, err)
+	if err != nil && !errors.Is(err, errJUnitNotFound) {
+		return nil, nil, fmt.Errorf("failed to get JUnitTestSuites from the files %s: %+v", rc.junitFilePattern(), err)
 	}
 
 	failedTCReport := setHeaderString(logger, overallJUnitSuites)
-	failedTCReport.extractFailedTestCases(scanner, logger, overallJUnitSuites)
-	failedTCReport.initPodAndCRsLink(overallJUnitSuites)
-
-	if err = failedTCReport.updateCommentWithFailedTestCasesReport(ctx, logger, client, event, body); err != nil {
-		return err
+	// prefer qe-tools' e2e-report, then Ginkgo's JSON report, both richer
+	// than junit, when the job uploaded them
+	if specs := getE2EReportSpecs(scanner, logger); !failedTCReport.hasBootstrapFailure && failedTCReport.extractFailedSpecsFromE2EReport(logger, specs) {
+		failedTCReport.headerString = e2eFailureHeaderString
+		failedTCReport.failureKind = failureKindE2E
+	} else if ginkgoReports := getGinkgoReportsFromJSONFiles(scanner, logger); !failedTCReport.hasBootstrapFailure && failedTCReport.extractFailedSpecsFromGinkgoReports(logger, ginkgoReports) {
+		failedTCReport.headerString = e2eFailureHeaderString
+		failedTCReport.failureKind = failureKindE2E
+	} else {
+		failedTCReport.extractFailedTestCases(scanner, logger, overallJUnitSuites, rc)
+	}
+	failedTCReport.markSuiteTeardowns()
+	failedTCReport.diagnoseFailedSteps(ctx, logger, scanner)
+	failedTCReport.extractECViolations(scanner, logger)
+	if !passive {
+		failedTCReport.inlineCRConditions(ctx, logger, scanner)
 	}
+	failedTCReport.addRemediations(h.Remediations)
 
-	return nil
+	return failedTCReport, overallJUnitSuites, nil
 }
 
 // extractProwJobURLFromCommentBody extracts the
@@ -146,7 +454,11 @@ func extractProwJobURLFromCommentBody(commentBody string) (string, error) {
 
 	for _, matchesAndGroups := range sliceOfMatchingString {
 		for _, subsStr := range matchesAndGroups {
-			if !strings.Contains(subsStr, "images") && !strings.HasSuffix(subsStr, ")") {
+			// the first element is the whole match, up to the link's closing parenthesis
+			if strings.HasSuffix(subsStr, ")") {
+				continue
+			}
+			if _, err := parseProwJobURL(subsStr); err == nil {
 				return subsStr, nil
 			}
 		}
@@ -155,15 +467,18 @@ func extractProwJobURLFromCommentBody(commentBody string) (string, error) {
 	return "", fmt.Errorf("regex string %s found no matches for the comment body: %s", regexToFetchProwURL, commentBody)
 }
 
+// errJUnitNotFound is returned when the job has no junit file, e.g. when it
+// failed while creating the cluster
+var errJUnitNotFound = errors.New("couldn't find the junit file")
+
 // getTestSuitesFromXMLFile returns all the JUnitTestSuites
 // present within a file with the given name
-func getTestSuitesFromXMLFile(scanner *prow.ArtifactScanner, logger zerolog.Logger, filename string) (*reporters.JUnitTestSuites, error) {
-	overallJUnitSuites := &reporters.JUnitTestSuites{}
-
+func getTestSuitesFromXMLFile(ctx context.Context, scanner *prow.ArtifactScanner, logger zerolog.Logger, filename string) (*reporters.JUnitTestSuites, error) {
 	for _, artifactsFilenameMap := range scanner.ArtifactStepMap {
 		for artifactFilename, artifact := range artifactsFilenameMap {
 			if string(artifactFilename) == filename {
-				if err := xml.Unmarshal([]byte(artifact.Content), overallJUnitSuites); err != nil {
+				overallJUnitSuites, err := decodeJUnitArtifact(ctx, scanner, artifact)
+				if err != nil {
 					logger.Error().Err(err).Msg("cannot decode JUnit suite into xml")
 					return &reporters.JUnitTestSuites{}, err
 				}
@@ -172,7 +487,40 @@ func getTestSuitesFromXMLFile(scanner *prow.ArtifactScanner, logger zerolog.Logg
 		}
 	}
 
-	return &reporters.JUnitTestSuites{}, fmt.Errorf("couldn't find the %s file", filename)
+	return &reporters.JUnitTestSuites{}, fmt.Errorf("%w: %s", errJUnitNotFound, filename)
+}
+
+// getTestSuitesFromXMLFiles returns all the JUnitTestSuites present
+// within the files whose name matches the given pattern
+func getTestSuitesFromXMLFiles(ctx context.Context, scanner *prow.ArtifactScanner, logger zerolog.Logger, pattern string) (*reporters.JUnitTestSuites, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return &reporters.JUnitTestSuites{}, err
+	}
+
+	found := false
+	all := &reporters.JUnitTestSuites{}
+	for _, artifactsFilenameMap := range scanner.ArtifactStepMap {
+		for artifactFilename, artifact := range artifactsFilenameMap {
+			if !re.MatchString(string(artifactFilename)) {
+				continue
+			}
+			found = true
+			suites, err := decodeJUnitArtifact(ctx, scanner, artifact)
+			if err != nil {
+				logger.Error().Err(err).Msgf("cannot decode JUnit suite %s into xml", artifactFilename)
+				return &reporters.JUnitTestSuites{}, err
+			}
+			all.Tests += suites.Tests
+			all.Failures += suites.Failures
+			all.Errors += suites.Errors
+			all.TestSuites = append(all.TestSuites, suites.TestSuites...)
+		}
+	}
+	if !found {
+		return all, fmt.Errorf("%w: %s", errJUnitNotFound, pattern)
+	}
+	return all, nil
 }
 
 // setHeaderString initialises struct FailedTestCasesReport's
@@ -182,14 +530,17 @@ func setHeaderString(logger zerolog.Logger, overallJUnitSuites *reporters.JUnitT
 
 	if len(overallJUnitSuites.TestSuites) == 0 {
 		logger.Debug().Msg("The given Prow job failed while creating the cluster")
-		failedTCReport.headerString = ":rotating_light: **This is a CI system failure, please consult with the QE team.**\n"
+		failedTCReport.headerString = ":rotating_light: **This is a CI system failure.**\n"
+		failedTCReport.failureKind = failureKindInfra
 	} else if len(overallJUnitSuites.TestSuites) == 1 && overallJUnitSuites.TestSuites[0].Name == openshiftCITestSuiteName {
 		logger.Debug().Msg("The given Prow job failed during bootstrapping the cluster")
 		failedTCReport.hasBootstrapFailure = true
 		failedTCReport.headerString = ":rotating_light: **Error occurred during the cluster's Bootstrapping phase, list of failed Spec(s)**: \n"
+		failedTCReport.failureKind = failureKindBootstrap
 	} else {
 		logger.Debug().Msg("The given Prow job failed while running the E2E tests")
-		failedTCReport.headerString = ":rotating_light: **Error occurred while running the E2E tests, list of failed Spec(s)**: \n"
+		failedTCReport.headerString = e2eFailureHeaderString
+		failedTCReport.failureKind = failureKindE2E
 	}
 
 	return &failedTCReport
@@ -198,140 +549,415 @@ func setHeaderString(logger zerolog.Logger, overallJUnitSuites *reporters.JUnitT
 // initPodAndCRsLink initialises the FailedTestCasesReport struct's
 // 'podsLink' and 'customResourcesLink' field with the link to the
 // directory where pod logs and generated custom resources are
-// stored, respectively.
-func (failedTCReport *FailedTestCasesReport) initPodAndCRsLink(overallJUnitSuites *reporters.JUnitTestSuites) {
+// stored, respectively. The properties may also be named after
+// any of their aliases, e.g. once the gather steps are renamed
+func (failedTCReport *FailedTestCasesReport) initPodAndCRsLink(overallJUnitSuites *reporters.JUnitTestSuites, aliases map[string][]string) {
 	for _, testSuite := range overallJUnitSuites.TestSuites {
 		if testSuite.Name != openshiftCITestSuiteName {
 			continue
 		}
 
-		foundCRsProperty := false
-		foundPodsProperty := false
-		foundJUnitSummaryProperty := false
+		if value, ok := suiteProperty(testSuite, cRsPropertyName, aliases); ok {
+			failedTCReport.customResourcesLink = value
+		}
+		if value, ok := suiteProperty(testSuite, podsPropertyName, aliases); ok {
+			failedTCReport.podsLink = value + "/pods"
+		}
+		if value, ok := suiteProperty(testSuite, junitSummaryPropertyName, aliases); ok {
+			failedTCReport.jUnitSummaryFileLink = value
+		}
 
-		for _, property := range testSuite.Properties.Properties {
-			if property.Name == cRsPropertyName {
-				failedTCReport.customResourcesLink = property.Value
-				foundCRsProperty = true
-			}
-			if property.Name == podsPropertyName {
-				failedTCReport.podsLink = property.Value + "/pods"
-				foundPodsProperty = true
-			}
-			if property.Name == junitSummaryPropertyName {
-				failedTCReport.jUnitSummaryFileLink = property.Value
-				foundJUnitSummaryProperty = true
-			}
+		break // Exit outer loop early once the 'openshiftCITestSuiteName' test suite is processed
+	}
+}
 
-			if foundCRsProperty && foundPodsProperty && foundJUnitSummaryProperty {
-				break // Exit inner loop early if both properties are found
+// suiteProperty returns the value of the suite's property with the given
+// name or, when it's missing, of the first of its aliases the suite has
+func suiteProperty(testSuite reporters.JUnitTestSuite, name string, aliases map[string][]string) (string, bool) {
+	for _, n := range append([]string{name}, aliases[name]...) {
+		for _, property := range testSuite.Properties.Properties {
+			if property.Name == n {
+				return property.Value, true
 			}
 		}
-
-		break // Exit outer loop early once the 'openshiftCITestSuiteName' test suite is processed
 	}
+	return "", false
 }
 
 // extractFailedTestCases initialises the FailedTestCasesReport struct's
-// 'failedTestCaseNames' field with the names of failed test cases
+// 'failedTestCases' field with the failed test cases
 // within given JUnitTestSuites -- if the given JUnitTestSuites is !nil.
-// And if it's nil, 'failedTestCaseNames' field is init with content of
-// "build-log.txt" file, if it exists.
-func (failedTCReport *FailedTestCasesReport) extractFailedTestCases(scanner *prow.ArtifactScanner, logger zerolog.Logger, overallJUnitSuites *reporters.JUnitTestSuites) {
+// And if it's nil, 'failedTestCases' field is init with content of
+// "build-log.txt" file, if it exists. If that log shows an image build
+// failure, only the failed Dockerfile step and its error are reported.
+// Otherwise, the steps failed according to ci-operator's junit_*.xml
+// files are reported, when the steps didn't upload their own.
+func (failedTCReport *FailedTestCasesReport) extractFailedTestCases(scanner *prow.ArtifactScanner, logger zerolog.Logger, overallJUnitSuites *reporters.JUnitTestSuites, rc RepositoryConfig) {
 	if len(overallJUnitSuites.TestSuites) == 0 {
 		parentStepName := "/"
 		buildLogFileName := "build-log.txt"
 
 		if asMap := scanner.ArtifactStepMap[prow.ArtifactStepName(parentStepName)]; asMap != nil {
 			if asMap[prow.ArtifactFilename(buildLogFileName)].Content == "" {
-				logger.Error().Msgf("Failed to fetch content of the file: %s within the `%s` parent directory", buildLogFileName, parentStepName)
+				if !failedTCReport.extractFailedStepsFromCIOperatorJUnit(scanner, logger) {
+					logger.Error().Msgf("Failed to fetch content of the file: %s within the `%s` parent directory", buildLogFileName, parentStepName)
+				}
 				return
 			}
 
-			testCaseEntry := returnContentWrappedInDropdown(dropdownSummaryString, asMap[prow.ArtifactFilename(buildLogFileName)].Content)
-			failedTCReport.failedTestCaseNames = append(failedTCReport.failedTestCaseNames, testCaseEntry)
-		} else {
+			buildLog := asMap[prow.ArtifactFilename(buildLogFileName)].Content
+			if claimFailure := parseClusterClaimFailure(buildLog); claimFailure != nil {
+				claimFailure.addClusterPoolState(scanner)
+				logger.Debug().Msgf("The given Prow job failed to acquire a cluster: %s", claimFailure.summary())
+				failedTCReport.headerString = ":rotating_light: **This is a CI system failure: " + claimFailure.summary() + ".**\n"
+				failedTCReport.failureKind = failureKindClusterPool
+				failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+					name:    "cluster claim",
+					message: claimFailure.errorMessage,
+					details: codeBlock(claimFailure.errorMessage) + "\n" + returnContentWrappedInDropdown(dropdownSummaryString, claimFailure.logExcerpt),
+				})
+				return
+			}
+			if buildFailure := parseImageBuildFailure(buildLog); buildFailure != nil {
+				logger.Debug().Msgf("The given Prow job failed while building an image: %s", buildFailure.summary())
+				failedTCReport.headerString = ":rotating_light: **Image build " + buildFailure.summary() + "**\n"
+				failedTCReport.failureKind = failureKindImageBuild
+				failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+					name:    "image build",
+					message: buildFailure.errorMessage,
+					details: codeBlock(buildFailure.errorMessage) + "\n" + returnContentWrappedInDropdown(dropdownSummaryString, buildFailure.logExcerpt),
+				})
+				return
+			}
+
+			if failedTCReport.extractFailedStepsFromCIOperatorJUnit(scanner, logger) {
+				return
+			}
+
+			failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{details: returnContentWrappedInDropdown(dropdownSummaryString, buildLog)})
+		} else if !failedTCReport.extractFailedStepsFromCIOperatorJUnit(scanner, logger) {
 			logger.Error().Msgf("Failed to find any files within the directory: %s", parentStepName)
 		}
 		return
 	}
 
 	for _, testSuite := range overallJUnitSuites.TestSuites {
-		if failedTCReport.hasBootstrapFailure || (testSuite.Name == e2eTestSuiteName && (testSuite.Failures > 0 || testSuite.Errors > 0)) {
+		// suites written by non-Go tools (e.g. pytest, Jest) are normalized
+		if flavor := detectJUnitFlavor(testSuite); !failedTCReport.hasBootstrapFailure && testSuite.Name != openshiftCITestSuiteName && flavor != junitFlavorGinkgo {
+			failedTCReport.extractFailedTestCasesOfFlavor(logger, flavor, testSuite)
+			continue
+		}
+		if failedTCReport.hasBootstrapFailure || (rc.isE2ESuite(testSuite.Name) && (testSuite.Failures > 0 || testSuite.Errors > 0)) {
 			for _, tc := range testSuite.TestCases {
 				if tc.Failure != nil || tc.Error != nil {
 					logger.Debug().Msgf("Found a Test Case (suiteName/testCaseName): %s/%s, that didn't pass", testSuite.Name, tc.Name)
 					tcMessage := ""
+					failureMessage := ""
+					if tc.Failure != nil {
+						failureMessage = tc.Failure.Message
+					} else {
+						failureMessage = tc.Error.Message
+					}
 					if failedTCReport.hasBootstrapFailure {
-						tcMessage = "```\n" + returnLastNLines(tc.SystemErr, 16) + "\n```"
+						tcMessage = codeBlock(returnLastNLines(tc.SystemErr, 16))
 					} else if tc.Status == "timedout" {
 						tcMessage = returnContentWrappedInDropdown(dropdownSummaryString, tc.SystemErr)
-					} else if tc.Failure != nil {
-						tcMessage = "```\n" + tc.Failure.Message + "\n```"
 					} else {
-						tcMessage = "```\n" + tc.Error.Message + "\n```"
+						tcMessage = codeBlock(failureMessage)
+					}
+					if timeline := renderSpecTimeline(parseSpecTimeline(tc.SystemOut, tc.SystemErr)); !failedTCReport.hasBootstrapFailure && timeline != "" {
+						tcMessage = tcMessage + "\n" + timeline
 					}
-					testCaseEntry := "* :arrow_right: " + "[**`" + tc.Status + "`**] " + tc.Name + "\n" + tcMessage
-					failedTCReport.failedTestCaseNames = append(failedTCReport.failedTestCaseNames, testCaseEntry)
+					failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+						suiteName: testSuite.Name,
+						name:      tc.Name,
+						status:    tc.Status,
+						message:   failureMessage,
+						details:   tcMessage,
+						duration:  junitDuration(tc),
+						owner:     tc.Owner,
+					})
 				}
 			}
 		}
 	}
 }
 
-// updateCommentWithFailedTestCasesReport updates the
-// PR comment's body with the names of failed test cases
-func (failedTCReport *FailedTestCasesReport) updateCommentWithFailedTestCasesReport(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, commentBody string) error {
+// reportCommentMode returns how the report of the event's comment is posted. Only
+// the comments of openshift-ci and the app's own ones (which have no author within
+// the events of the watched jobs and requested analyses) are edited, the others
+// (e.g. a human's comment matched by the repository's trigger) getting a new one
+func reportCommentMode(event github.IssueCommentEvent, rc RepositoryConfig) string {
+	if author := event.GetComment().GetUser().GetLogin(); author != "" && !strings.HasPrefix(author, targetAuthor) {
+		return commentModeNew
+	}
+	return rc.CommentMode
+}
+
+// updateCommentWithFailedTestCasesReport updates the PR comment's body with the names
+// of failed test cases, or reports them in a new comment when the repository asks so
+func (failedTCReport *FailedTestCasesReport) updateCommentWithFailedTestCasesReport(ctx context.Context, logger zerolog.Logger, client *github.Client, lint *commentLint, edits *commentEdits, t *telemetry, event github.IssueCommentEvent, commentBody, format, mode string) error {
 	repoOwner := event.GetRepo().GetOwner().GetLogin()
 	repoName := event.GetRepo().GetName()
 	commentID := event.GetComment().GetID()
 
-	if failedTCReport.failedTestCaseNames != nil && len(failedTCReport.failedTestCaseNames) > 0 {
-		msg := failedTCReport.headerString
-
-		for _, failedTCName := range failedTCReport.failedTestCaseNames {
-			msg = msg + fmt.Sprintf("\n %s\n", failedTCName)
+	if len(failedTCReport.failedTestCases) > 0 {
+		if format == reportFormatSummary && failedTCReport.detailsURL == "" {
+			failedTCReport.publishDetails(ctx, logger, client, t, event, checkRunNeutral)
 		}
-
-		if failedTCReport.podsLink != "" && failedTCReport.customResourcesLink != "" && failedTCReport.jUnitSummaryFileLink != "" {
-			// Add pods and CRs' links
-			msg = msg + fmt.Sprintf(":see_no_evil: [Link to Pod logs](%s).\n :hear_no_evil: [Link to Custom Resources](%s).\n"+
-				":speak_no_evil: [Link to junit-summary.html](%s).\n", failedTCReport.podsLink, failedTCReport.customResourcesLink,
-				failedTCReport.jUnitSummaryFileLink)
+		if mode == commentModeNew {
+			body := failedTCReport.newCommentBody(logger, lint, event, format)
+			if _, _, err := client.Issues.CreateComment(ctx, repoOwner, repoName, event.GetIssue().GetNumber(), &github.IssueComment{Body: &body}); err != nil {
+				return errors.Wrap(err, "failed to comment the report on the PR")
+			}
+			failedTCReport.reportedBy = fallbackComment
+			logger.Debug().Msg("Successfully commented the names of failed test cases on the PR")
+			return nil
+		}
+		// the report isn't dropped when the comment can't be edited, whatever the reason
+		if err := editReport(ctx, logger, client, lint, edits, repoOwner, repoName, commentID, commentBody, failedTCReport.identity, failedTCReport.sections(format)); err != nil {
+			return failedTCReport.reportWithoutEditing(ctx, logger, client, lint, event, format, err)
 		}
+		failedTCReport.reportedBy = reportedByEdit
 
-		msg = msg + "\n-------------------------------\n\n" + commentBody
+		logger.Debug().Msgf("Successfully updated comment (with ID:%d) with the names of failed test cases", commentID)
+	} else {
+		logger.Debug().Msgf("Unable to find any details to update. Declining to update comment (with ID:%d)", commentID)
+	}
+
+	return nil
+}
+
+// render returns the report in the given format,
+// followed by the original body of the PR comment
+func (failedTCReport *FailedTestCasesReport) render(format, commentBody string) string {
+	return renderReportBlock(failedTCReport.identity, failedTCReport.sections(format)) + commentBody
+}
 
-		prComment := github.IssueComment{
-			Body: &msg,
+// sections returns the report's sections in the given format, each
+// failure being its own section keyed by the failure's fingerprint
+func (failedTCReport *FailedTestCasesReport) sections(format string) []reportSection {
+	if format == reportFormatSummary {
+		if failedTCReport.detailsURL != "" {
+			return failedTCReport.summarySections()
 		}
+		format = reportFormatFull
+	}
+
+	sections := []reportSection{{key: "header", content: failedTCReport.headerString}}
+	if len(failedTCReport.warnings) > 0 {
+		sections = append(sections, reportSection{key: "warnings", content: "\n" + strings.Join(failedTCReport.warnings, "\n\n") + "\n"})
+	}
 
-		err := wait.PollUntilContextTimeout(context.Background(), 15*time.Second, 1*time.Minute, true, func(context.Context) (done bool, err error) {
-			if _, _, err := client.Issues.EditComment(ctx, repoOwner, repoName, commentID, &prComment); err != nil {
-				logger.Error().Err(err).Msgf("Failed to edit the comment...Retrying")
-				return false, nil
+	seen := map[string]int{}
+	childJobURL, team, teamStarted := "", "", false
+	// the entries of the table-driven specs are grouped into a single item
+	for _, group := range groupMatrixFailures(failedTCReport.failedTestCases) {
+		i := group.indices[0]
+		failedTC := failedTCReport.failedTestCases[i]
+		if failedTC.teardown {
+			continue
+		}
+		if failedTCReport.teamHeadings != nil && (failedTC.team != team || !teamStarted) {
+			team, teamStarted = failedTC.team, true
+			sections = append(sections, failedTCReport.teamSection(fmt.Sprintf("team-%d", i), team))
+		}
+		if failedTC.childJobURL != childJobURL {
+			childJobURL = failedTC.childJobURL
+			sections = append(sections, childJobSection(fmt.Sprintf("child-%d", i), childJobURL))
+		}
+		if group.isMatrix() {
+			key := failedFingerprintKey(failedTestCase{suiteName: failedTC.suiteName, name: group.base}, seen)
+			if format == reportFormatCompact {
+				sections = append(sections, reportSection{key: key, content: fmt.Sprintf("%s\n", group.compactEntry(failedTCReport.failedTestCases))})
+			} else {
+				sections = append(sections, reportSection{key: key, content: fmt.Sprintf("\n %s\n", group.entry(failedTCReport.failedTestCases))})
 			}
+			continue
+		}
 
-			return true, nil
-		})
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to edit comment (ID: %v) due to the error: %+v. Will Stop processing this comment", commentID, err)
-			return err
+		key := fmt.Sprintf("entry-%d", i)
+		if failedTC.name != "" {
+			key = failedFingerprintKey(failedTC, seen)
 		}
+		if format == reportFormatCompact {
+			sections = append(sections, reportSection{key: key, content: fmt.Sprintf("%s\n", failedTC.compactEntry())})
+		} else {
+			sections = append(sections, reportSection{key: key, content: fmt.Sprintf("\n %s\n", failedTC.entry())})
+		}
+	}
+	if teardown, ok := failedTCReport.teardownSection(format); ok {
+		sections = append(sections, teardown)
+	}
 
-		logger.Debug().Msgf("Successfully updated comment (with ID:%d) with the names of failed test cases", commentID)
-	} else {
-		logger.Debug().Msgf("Unable to find any details to update. Declining to update comment (with ID:%d)", commentID)
+	links := ""
+	if failedTCReport.podsLink != "" && failedTCReport.customResourcesLink != "" && failedTCReport.jUnitSummaryFileLink != "" {
+		// Add pods and CRs' links
+		links = links + fmt.Sprintf(":see_no_evil: [Link to Pod logs](%s).\n :hear_no_evil: [Link to Custom Resources](%s).\n"+
+			":speak_no_evil: [Link to junit-summary.html](%s).\n", failedTCReport.podsLink, failedTCReport.customResourcesLink,
+			failedTCReport.jUnitSummaryFileLink)
+	}
+	for _, link := range failedTCReport.extraLinks {
+		links = links + fmt.Sprintf(":link: [%s](%s).\n", link.name, link.url)
+	}
+	if links != "" {
+		sections = append(sections, reportSection{key: "links", content: links})
+	}
+
+	if failedTCReport.jobStats != "" {
+		sections = append(sections, reportSection{key: "job-stats", content: "\n" + failedTCReport.jobStats})
+	}
+	if failedTCReport.retestAdvice != "" {
+		sections = append(sections, reportSection{key: "retest-advice", content: "\n" + failedTCReport.retestAdvice + "\n"})
+	}
+	if failedTCReport.nextStep != "" {
+		sections = append(sections, reportSection{key: "next-steps", content: "\n:bulb: **What to do next:** " + failedTCReport.nextStep + "\n"})
+	}
+	if failedTCReport.identity.signature != "" {
+		sections = append(sections, reportSection{key: "signature", content: "\n<sub>" + failedTCReport.identity.signature + "</sub>\n"})
+	}
+
+	return sections
+}
+
+// editComment replaces the body of the PR comment with the given ID, retrying for up to a minute
+func editComment(ctx context.Context, logger zerolog.Logger, client *github.Client, repoOwner, repoName string, commentID int64, body string) error {
+	prComment := github.IssueComment{
+		Body: &body,
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, 15*time.Second, 1*time.Minute, true, func(ctx context.Context) (done bool, err error) {
+		if _, _, err := client.Issues.EditComment(ctx, repoOwner, repoName, commentID, &prComment); err != nil {
+			// retrying won't grant the missing permissions, nor bring the deleted comment back
+			if isForbidden(err) || isGone(err) {
+				return false, err
+			}
+			logger.Error().Err(err).Msgf("Failed to edit the comment...Retrying")
+			return false, nil
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to edit comment (ID: %v) due to the error: %+v. Will Stop processing this comment", commentID, err)
+		return err
 	}
 
 	return nil
 }
 
+// entry renders the failed test case as
+// an item of the report's list of failures
+func (tc failedTestCase) entry() string {
+	entry := tc.details
+	if tc.status != "" {
+		entry = "* :arrow_right: " + "[**`" + tc.status + "`**] " + tc.name + "\n" + tc.details
+	}
+
+	for _, note := range tc.notes {
+		entry = entry + "\n" + note
+	}
+
+	return entry
+}
+
+// compactEntry renders the failed test case as a single line
+func (tc failedTestCase) compactEntry() string {
+	if tc.status != "" {
+		return "* :arrow_right: " + "[**`" + tc.status + "`**] " + tc.name
+	}
+	if tc.name != "" {
+		return "* :arrow_right: " + tc.name + ": " + inlineCode(strings.SplitN(tc.message, "\n", 2)[0])
+	}
+	return tc.details
+}
+
+// repositoryConfig returns the settings of the given repository
+func (h *PRCommentHandler) repositoryConfig(repoFullName string) RepositoryConfig {
+	rc := RepositoryConfig{}
+	if h.Config != nil {
+		rc = h.Config.repositoryConfig(repoFullName)
+	}
+	// the repository's own file has the last word
+	return rc.overriddenBy(h.RepoConfigFiles.get(repoFullName))
+}
+
+// propertyAliases returns the alternative names of the junit properties the report reads
+func (h *PRCommentHandler) propertyAliases() map[string][]string {
+	if h.Config == nil {
+		return nil
+	}
+	return h.Config.PropertyAliases
+}
+
+// reportIdentity returns the identity of the app's reports within the given repository
+func (h *PRCommentHandler) reportIdentity(repoFullName string) reportIdentity {
+	if h.Config == nil {
+		return reportIdentity{}
+	}
+	id := reportIdentity{instance: h.Config.Identity.Instance, signature: h.Config.Identity.Signature}
+	if signature := h.repositoryConfig(repoFullName).Signature; signature != "" {
+		id.signature = signature
+	}
+	return id
+}
+
+// isAllowed returns whether the app may act on the event's repository
+func (h *PRCommentHandler) isAllowed(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent) bool {
+	if h.Access == nil {
+		return true
+	}
+
+	ok, reason := h.Access.allowed(ctx, client, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName())
+	if !ok {
+		logger.Debug().Msgf("Ignoring the comment: %s", reason)
+	}
+	return ok
+}
+
+// recordFailures persists the failed test cases found
+// within the given report into the handler's FailureStore
+func (h *PRCommentHandler) recordFailures(ctx context.Context, logger zerolog.Logger, event github.IssueCommentEvent, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	if h.Store == nil {
+		return
+	}
+
+	now := time.Now()
+	var records []FailureRecord
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.name == "" {
+			continue
+		}
+		records = append(records, FailureRecord{
+			Timestamp:   now,
+			Repository:  event.GetRepo().GetFullName(),
+			PullRequest: event.GetIssue().GetNumber(),
+			ProwJobURL:  prowJobURL,
+			SuiteName:   tc.suiteName,
+			TestCase:    tc.name,
+			Status:      tc.status,
+			Message:     tc.message,
+			FailureKind: failedTCReport.failureKind,
+		})
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	if err := h.Store.RecordFailures(ctx, records); err != nil {
+		logger.Error().Err(err).Msg("Failed to record the failed test cases")
+	}
+}
+
 func attachProwURLLogKeysToLogger(ctx context.Context, logger zerolog.Logger, prowJobURL string) zerolog.Logger {
 	logctx := zerolog.Ctx(ctx).With()
 
 	if prowJobURL != "" {
 		logctx = logctx.Str(LogKeyProwJobURL, prowJobURL)
+		if loc, err := parseProwJobURL(prowJobURL); err == nil {
+			logctx = logctx.Str(LogKeyProwJobType, loc.jobType)
+		}
 		return logctx.Logger()
 	}
 	return logger
@@ -339,9 +965,12 @@ func attachProwURLLogKeysToLogger(ctx context.Context, logger zerolog.Logger, pr
 
 func returnLastNLines(content string, n int) string {
 	systemErrString := strings.Split(content, "\n")
+	if len(systemErrString) <= n {
+		return content
+	}
 	return strings.Join(systemErrString[len(systemErrString)-n:], "\n")
 }
 
 func returnContentWrappedInDropdown(summary, content string) string {
-	return "<details><summary>" + summary + "</summary><br><pre>" + content + "</pre></details>"
+	return "<details><summary>" + summary + "</summary>" + preBlock(content) + "</details>"
 }
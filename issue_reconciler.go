@@ -0,0 +1,192 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultAutoFiledIssueLabel = "ci-helper/auto-filed"
+	issueActionClose           = "close"
+	issueActionComment         = "comment"
+)
+
+// issueReconciler periodically closes (or comments on) the issues
+// filed by the app once their failure's fingerprint hasn't been
+// observed for the configured period
+type issueReconciler struct {
+	clientCreator githubapp.ClientCreator
+	store         FailureStore
+	config        IssueReconcilerConfig
+	logger        zerolog.Logger
+	startedAt     time.Time
+}
+
+func newIssueReconciler(cc githubapp.ClientCreator, store FailureStore, cfg IssueReconcilerConfig, logger zerolog.Logger) *issueReconciler {
+	if cfg.Label == "" {
+		cfg.Label = defaultAutoFiledIssueLabel
+	}
+	if cfg.Action == "" {
+		cfg.Action = issueActionClose
+	}
+	if cfg.StaleAfter == 0 {
+		cfg.StaleAfter = 14 * 24 * time.Hour
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Hour
+	}
+
+	return &issueReconciler{
+		clientCreator: cc,
+		store:         store,
+		config:        cfg,
+		logger:        logger,
+		startedAt:     time.Now(),
+	}
+}
+
+// run reconciles the issues every configured interval until the context is done
+func (r *issueReconciler) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reconcile(ctx); err != nil {
+				r.logger.Error().Err(err).Msg("Failed to reconcile the auto-filed issues")
+			}
+		}
+	}
+}
+
+// reconcile goes through the open auto-filed issues of all installations
+func (r *issueReconciler) reconcile(ctx context.Context) error {
+	// the store only knows about failures observed since the app started
+	if time.Since(r.startedAt) < r.config.StaleAfter {
+		r.logger.Debug().Msg("Not enough failure history yet, skipping the reconciliation of auto-filed issues")
+		return nil
+	}
+
+	now := time.Now()
+	records, err := r.store.ListFailures(ctx, now.Add(-r.config.StaleAfter), now)
+	if err != nil {
+		return err
+	}
+	observed := map[string]bool{}
+	for _, rec := range records {
+		for _, fingerprint := range failureFingerprints(rec.SuiteName, rec.TestCase) {
+			observed[fingerprint] = true
+		}
+	}
+
+	appClient, err := r.clientCreator.NewAppClient()
+	if err != nil {
+		return err
+	}
+	installations, err := listInstallations(ctx, appClient)
+	if err != nil {
+		return err
+	}
+
+	for _, installation := range installations {
+		client, err := r.clientCreator.NewInstallationClient(installation.GetID())
+		if err != nil {
+			return err
+		}
+
+		query := fmt.Sprintf("is:issue is:open label:%q user:%s", r.config.Label, installation.GetAccount().GetLogin())
+		var stale []*github.Issue
+		opts := &github.SearchOptions{ListOptions: github.ListOptions{PerPage: 100}}
+		for {
+			result, resp, err := client.Search.Issues(ctx, query, opts)
+			if err != nil {
+				r.logger.Error().Err(err).Msgf("Failed to search for auto-filed issues of %s", installation.GetAccount().GetLogin())
+				break
+			}
+			for _, issue := range result.Issues {
+				if fingerprint := extractFingerprint(issue.GetBody()); fingerprint != "" && !observed[fingerprint] {
+					stale = append(stale, issue)
+				}
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opts.Page = resp.NextPage
+		}
+
+		// the issues are resolved once the search is over, closing them would shift its pages
+		for _, issue := range stale {
+			if err := r.resolveIssue(ctx, client, issue); err != nil {
+				r.logger.Error().Err(err).Msgf("Failed to resolve the issue %s", issue.GetHTMLURL())
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveIssue comments on the given issue and closes it, unless configured to only comment
+func (r *issueReconciler) resolveIssue(ctx context.Context, client *github.Client, issue *github.Issue) error {
+	owner, repo, err := repositoryFromIssue(issue)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf(":robot: This failure hasn't been observed for %s.", r.config.StaleAfter)
+	if r.config.Action == issueActionClose {
+		msg = msg + " Closing this issue, feel free to reopen it if it occurs again."
+	}
+
+	if _, _, err := client.Issues.CreateComment(ctx, owner, repo, issue.GetNumber(), &github.IssueComment{Body: &msg}); err != nil {
+		return err
+	}
+
+	if r.config.Action == issueActionClose {
+		state := "closed"
+		if _, _, err := client.Issues.Edit(ctx, owner, repo, issue.GetNumber(), &github.IssueRequest{State: &state}); err != nil {
+			return err
+		}
+	}
+
+	r.logger.Info().Msgf("Resolved the stale auto-filed issue %s", issue.GetHTMLURL())
+	return nil
+}
+
+// repositoryFromIssue returns the owner and name of the issue's repository.
+// Search results don't include the repository, only its API URL
+func repositoryFromIssue(issue *github.Issue) (string, string, error) {
+	sp := strings.Split(issue.GetRepositoryURL(), "/repos/")
+	if len(sp) != 2 {
+		return "", "", fmt.Errorf("unexpected repository URL: %s", issue.GetRepositoryURL())
+	}
+
+	ownerAndRepo := strings.Split(sp[1], "/")
+	if len(ownerAndRepo) != 2 {
+		return "", "", fmt.Errorf("unexpected repository URL: %s", issue.GetRepositoryURL())
+	}
+
+	return ownerAndRepo[0], ownerAndRepo[1], nil
+}
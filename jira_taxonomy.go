@@ -0,0 +1,346 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	JiraTaxonomyRoute string = "/admin/jira/taxonomy"
+
+	defaultJiraAutoFiledLabel = "ci-helper-auto-filed"
+	defaultJiraInterval       = time.Hour
+	defaultJiraLookback       = 14 * 24 * time.Hour
+	jiraClientTimeout         = 30 * time.Second
+	// the tickets fetched per page of the search
+	jiraSearchPageSize = 100
+)
+
+// jiraFields are the components and labels of a Jira ticket
+type jiraFields struct {
+	Components []string `json:"components"`
+	Labels     []string `json:"labels"`
+}
+
+// jiraTicket is the subset of a Jira issue the reconciliation reads
+type jiraTicket struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Description string   `json:"description"`
+		Labels      []string `json:"labels"`
+		Components  []struct {
+			Name string `json:"name"`
+		} `json:"components"`
+	} `json:"fields"`
+}
+
+// jiraTaxonomy maps the failure kinds to the components and labels of the
+// Jira tickets filed for the failures, and keeps the auto-filed tickets in
+// line with the latest classification of their failure's fingerprint, so
+// that the Jira dashboards built on them stay accurate
+type jiraTaxonomy struct {
+	baseURL    string
+	token      string
+	config     JiraConfig
+	store      FailureStore
+	httpClient *http.Client
+	logger     zerolog.Logger
+	// counts the failed reconciliations among the subsystems' errors
+	telemetry *telemetry
+}
+
+func newJiraTaxonomy(cfg JiraConfig, store FailureStore, logger zerolog.Logger) (*jiraTaxonomy, error) {
+	for kind := range cfg.Taxonomy {
+		if !containsFold(failureKinds, kind) {
+			return nil, fmt.Errorf("unknown failure kind %q within the Jira taxonomy", kind)
+		}
+	}
+	if cfg.Project == "" {
+		return nil, fmt.Errorf("the Jira project of the auto-filed tickets is required")
+	}
+	if cfg.Label == "" {
+		cfg.Label = defaultJiraAutoFiledLabel
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultJiraInterval
+	}
+	if cfg.Lookback == 0 {
+		cfg.Lookback = defaultJiraLookback
+	}
+
+	t := &jiraTaxonomy{
+		baseURL:    strings.TrimSuffix(cfg.URL, "/"),
+		config:     cfg,
+		store:      store,
+		httpClient: &http.Client{Timeout: jiraClientTimeout},
+		logger:     logger,
+	}
+	if cfg.TokenFile != "" {
+		token, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading the Jira token file: %s", cfg.TokenFile)
+		}
+		t.token = strings.TrimSpace(string(token))
+	}
+
+	return t, nil
+}
+
+// fields returns the components and labels of the tickets filed for a failure of the given kind
+func (t *jiraTaxonomy) fields(kind string) jiraFields {
+	entry := t.config.Taxonomy[kind]
+	return jiraFields{Components: append([]string{}, entry.Components...), Labels: append([]string{}, entry.Labels...)}
+}
+
+// run reconciles the auto-filed tickets every configured interval until the context is done
+func (t *jiraTaxonomy) run(ctx context.Context) {
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.reconcile(ctx); err != nil {
+				t.logger.Error().Err(err).Msg("Failed to reconcile the taxonomy of the auto-filed Jira tickets")
+				t.telemetry.countError("jira")
+			}
+		}
+	}
+}
+
+// reconcile updates the components and labels of the open auto-filed tickets
+// whose failure's latest classification maps to other ones. The components and
+// labels outside of the taxonomy (e.g. set by the triagers) are left untouched
+func (t *jiraTaxonomy) reconcile(ctx context.Context) error {
+	now := time.Now()
+	records, err := t.store.ListFailures(ctx, now.Add(-t.config.Lookback), now)
+	if err != nil {
+		return err
+	}
+	// the records are listed from the oldest, the latest classification wins
+	kinds := map[string]string{}
+	for _, rec := range records {
+		if rec.FailureKind != "" {
+			for _, fingerprint := range failureFingerprints(rec.SuiteName, rec.TestCase) {
+				kinds[fingerprint] = rec.FailureKind
+			}
+		}
+	}
+
+	jql := fmt.Sprintf("project = %q AND labels = %q AND statusCategory != Done", t.config.Project, t.config.Label)
+	for startAt := 0; ; startAt += jiraSearchPageSize {
+		tickets, total, err := t.search(ctx, jql, startAt)
+		if err != nil {
+			return err
+		}
+		for _, ticket := range tickets {
+			kind, ok := kinds[extractFingerprint(ticket.Fields.Description)]
+			if !ok {
+				continue
+			}
+			if err := t.align(ctx, ticket, kind); err != nil {
+				t.logger.Error().Err(err).Msgf("Failed to update the taxonomy of the Jira ticket %s", ticket.Key)
+			}
+		}
+		if startAt+len(tickets) >= total || len(tickets) == 0 {
+			return nil
+		}
+	}
+}
+
+// align adds the components and labels of the failure's kind to the ticket,
+// and removes those of the other kinds
+func (t *jiraTaxonomy) align(ctx context.Context, ticket jiraTicket, kind string) error {
+	wanted := t.fields(kind)
+	var others jiraFields
+	for other, entry := range t.config.Taxonomy {
+		if other != kind {
+			others.Components = append(others.Components, entry.Components...)
+			others.Labels = append(others.Labels, entry.Labels...)
+		}
+	}
+
+	current := jiraFields{Labels: ticket.Fields.Labels}
+	for _, component := range ticket.Fields.Components {
+		current.Components = append(current.Components, component.Name)
+	}
+	addedComponents, removedComponents := taxonomyChanges(current.Components, wanted.Components, others.Components)
+	addedLabels, removedLabels := taxonomyChanges(current.Labels, wanted.Labels, others.Labels)
+	if len(addedComponents)+len(removedComponents)+len(addedLabels)+len(removedLabels) == 0 {
+		return nil
+	}
+
+	var components, labels []map[string]interface{}
+	for _, name := range addedComponents {
+		components = append(components, map[string]interface{}{"add": map[string]string{"name": name}})
+	}
+	for _, name := range removedComponents {
+		components = append(components, map[string]interface{}{"remove": map[string]string{"name": name}})
+	}
+	for _, label := range addedLabels {
+		labels = append(labels, map[string]interface{}{"add": label})
+	}
+	for _, label := range removedLabels {
+		labels = append(labels, map[string]interface{}{"remove": label})
+	}
+	update := map[string]interface{}{}
+	if len(components) > 0 {
+		update["components"] = components
+	}
+	if len(labels) > 0 {
+		update["labels"] = labels
+	}
+
+	if _, err := t.do(ctx, http.MethodPut, "/rest/api/2/issue/"+url.PathEscape(ticket.Key), map[string]interface{}{"update": update}); err != nil {
+		return err
+	}
+	t.logger.Info().Msgf("Updated the taxonomy of the Jira ticket %s to the failure kind %s", ticket.Key, kind)
+	return nil
+}
+
+// taxonomyChanges returns the wanted values missing from the current ones,
+// and the current values belonging to the other kinds only
+func taxonomyChanges(current, wanted, others []string) ([]string, []string) {
+	has := map[string]bool{}
+	for _, value := range current {
+		has[value] = true
+	}
+	isWanted := map[string]bool{}
+	var added []string
+	for _, value := range wanted {
+		isWanted[value] = true
+		if !has[value] {
+			added = append(added, value)
+		}
+	}
+	var removed []string
+	for _, value := range others {
+		if has[value] && !isWanted[value] {
+			removed = append(removed, value)
+			// the same value may belong to several other kinds
+			has[value] = false
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// search returns a page of the tickets matching the JQL query, and the number of matching tickets
+func (t *jiraTaxonomy) search(ctx context.Context, jql string, startAt int) ([]jiraTicket, int, error) {
+	query := url.Values{
+		"jql":        {jql},
+		"fields":     {"description,labels,components"},
+		"startAt":    {fmt.Sprint(startAt)},
+		"maxResults": {fmt.Sprint(jiraSearchPageSize)},
+	}
+	body, err := t.do(ctx, http.MethodGet, "/rest/api/2/search?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var result struct {
+		Total  int          `json:"total"`
+		Issues []jiraTicket `json:"issues"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to parse the Jira search results")
+	}
+	return result.Issues, result.Total, nil
+}
+
+// do sends a request to Jira's REST API, and returns the response's body
+func (t *jiraTaxonomy) do(ctx context.Context, method, path string, payload interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to call Jira's %s %s", method, path)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the response of Jira's %s %s", method, path)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("failed to call Jira's %s %s: %s: %s", method, path, resp.Status, body)
+	}
+	return body, nil
+}
+
+// JiraTaxonomyHandler serves the components and labels of the Jira tickets filed
+// for each failure kind, or for the 'kind' query parameter only, so that the
+// tools filing the tickets set them right away
+type JiraTaxonomyHandler struct {
+	Taxonomy *jiraTaxonomy
+}
+
+func (h *JiraTaxonomyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response interface{}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		response = h.Taxonomy.fields(kind)
+	} else {
+		taxonomy := map[string]jiraFields{}
+		for kind := range h.Taxonomy.config.Taxonomy {
+			taxonomy[kind] = h.Taxonomy.fields(kind)
+		}
+		response = taxonomy
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
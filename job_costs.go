@@ -0,0 +1,269 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog"
+)
+
+const (
+	JobCostsRoute string = "/admin/ci-cost"
+
+	defaultJobCostsWindow       = 30 * 24 * time.Hour
+	defaultJobCostsDigestWindow = 7 * 24 * time.Hour
+	defaultJobCostsCurrency     = "$"
+	// the fewest earlier runs the job's percentiles are computed from
+	minJobDurationSamples = 5
+)
+
+// jobCosts notes how long the analysed job ran within its report, compared
+// with the p50 and p95 durations of the job's earlier runs recorded within the
+// failure store (apart from the failures), and estimates its compute cost. The
+// durations are recorded for the analysed (i.e. failed) runs only. A nil
+// jobCosts notes nothing
+type jobCosts struct {
+	store  jobDurationStore
+	config JobCostsConfig
+}
+
+func newJobCosts(cfg JobCostsConfig, store FailureStore) (*jobCosts, error) {
+	durationStore, ok := store.(jobDurationStore)
+	if !ok {
+		return nil, fmt.Errorf("the failure store doesn't keep the jobs' durations")
+	}
+	if cfg.Window == 0 {
+		cfg.Window = defaultJobCostsWindow
+	}
+	if cfg.Currency == "" {
+		cfg.Currency = defaultJobCostsCurrency
+	}
+	return &jobCosts{store: durationStore, config: cfg}, nil
+}
+
+// jobDurationStats are the percentiles of a job's durations
+type jobDurationStats struct {
+	runs int
+	p50  time.Duration
+	p95  time.Duration
+}
+
+// annotate notes the job's duration and cost within the report, and records
+// the duration for the next runs' comparisons
+func (c *jobCosts) annotate(ctx context.Context, logger zerolog.Logger, client *storage.Client, scanURL, repoFullName string, prNumber int, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	if c == nil {
+		return
+	}
+
+	metadata := fetchJobMetadata(ctx, client, scanURL, repoFullName, prNumber)
+	if metadata.StartTime.IsZero() || metadata.EndTime.IsZero() || !metadata.EndTime.After(metadata.StartTime) {
+		logger.Debug().Msg("The job's duration is unknown, not noting its cost")
+		return
+	}
+	duration := metadata.EndTime.Sub(metadata.StartTime)
+
+	now := time.Now()
+	recorded, err := c.store.ListJobDurations(ctx, now.Add(-c.config.Window), now)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the durations of the job's earlier runs")
+	}
+	var earlier []time.Duration
+	for url, d := range jobDurations(recorded, metadata.JobName) {
+		if url != prowJobURL {
+			earlier = append(earlier, d)
+		}
+	}
+	failedTCReport.jobStats = c.render(metadata.JobName, duration, durationStats(earlier))
+
+	record := JobDuration{
+		Timestamp:   now,
+		Repository:  repoFullName,
+		PullRequest: prNumber,
+		ProwJobURL:  prowJobURL,
+		JobName:     metadata.JobName,
+		Duration:    duration,
+	}
+	if err := c.store.RecordJobDurations(ctx, []JobDuration{record}); err != nil {
+		logger.Error().Err(err).Msg("Failed to record the job's duration")
+	}
+}
+
+// render tells how long the job ran compared with its earlier runs, and what it cost
+func (c *jobCosts) render(job string, duration time.Duration, stats *jobDurationStats) string {
+	var b strings.Builder
+	if stats != nil && duration > stats.p95 {
+		fmt.Fprintf(&b, ":snail: **The job ran for %s, unusually long**", duration.Round(time.Minute))
+	} else {
+		fmt.Fprintf(&b, ":stopwatch: The job ran for %s", duration.Round(time.Minute))
+	}
+	if stats != nil {
+		fmt.Fprintf(&b, " (p50 %s, p95 %s over its last %d analysed runs)", stats.p50.Round(time.Minute), stats.p95.Round(time.Minute), stats.runs)
+	}
+	if cost, ok := c.cost(job, duration); ok {
+		fmt.Fprintf(&b, ", estimated compute cost: %s%.2f", c.config.Currency, cost)
+	}
+	b.WriteString(".\n")
+	return b.String()
+}
+
+// cost estimates the compute cost of running the job for the duration
+func (c *jobCosts) cost(job string, duration time.Duration) (float64, bool) {
+	perHour := c.config.CostPerHour
+	if jobCost, ok := c.config.Jobs[job]; ok {
+		perHour = jobCost
+	}
+	return perHour * duration.Hours(), perHour > 0
+}
+
+// jobDurations returns the recorded durations of the job's runs (of all
+// jobs when empty), keyed by the runs' URLs, the latest record of each run winning
+func jobDurations(recorded []JobDuration, job string) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	for _, d := range recorded {
+		if job == "" || d.JobName == job {
+			durations[d.ProwJobURL] = d.Duration
+		}
+	}
+	return durations
+}
+
+// durationStats returns the percentiles of the durations, or nil when there are too few of them
+func durationStats(durations []time.Duration) *jobDurationStats {
+	if len(durations) < minJobDurationSamples {
+		return nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	// the nearest-rank percentile
+	percentile := func(p int) time.Duration {
+		rank := (p*len(durations) + 99) / 100
+		return durations[rank-1]
+	}
+	return &jobDurationStats{runs: len(durations), p50: percentile(50), p95: percentile(95)}
+}
+
+// jobCostRow is the cost of a job's runs within the digest
+type jobCostRow struct {
+	job      string
+	runs     int
+	total    time.Duration
+	cost     float64
+	stats    *jobDurationStats
+	longRuns int
+}
+
+// digest renders the "CI cost" section of the analysed runs recorded within the time range
+func (c *jobCosts) digest(recorded []JobDuration, from, to time.Time) string {
+	byJob := map[string][]time.Duration{}
+	for _, d := range recorded {
+		byJob[d.JobName] = nil
+	}
+	for job := range byJob {
+		for _, d := range jobDurations(recorded, job) {
+			byJob[job] = append(byJob[job], d)
+		}
+	}
+
+	var rows []jobCostRow
+	var totalCost float64
+	var totalDuration time.Duration
+	for job, durations := range byJob {
+		row := jobCostRow{job: job, runs: len(durations)}
+		for _, d := range durations {
+			row.total += d
+			cost, _ := c.cost(job, d)
+			row.cost += cost
+		}
+		row.stats = durationStats(append([]time.Duration{}, durations...))
+		if row.stats != nil {
+			for _, d := range durations {
+				if d > row.stats.p95 {
+					row.longRuns++
+				}
+			}
+		}
+		totalCost += row.cost
+		totalDuration += row.total
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].cost != rows[j].cost {
+			return rows[i].cost > rows[j].cost
+		}
+		if rows[i].total != rows[j].total {
+			return rows[i].total > rows[j].total
+		}
+		return rows[i].job < rows[j].job
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## CI cost\n\n%s to %s: %d analysed run(s) of %d job(s), %s of compute", from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339),
+		len(jobDurations(recorded, "")), len(rows), totalDuration.Round(time.Minute))
+	if totalCost > 0 {
+		fmt.Fprintf(&b, ", estimated at %s%.2f", c.config.Currency, totalCost)
+	}
+	b.WriteString(".\n")
+	if len(rows) == 0 {
+		return b.String()
+	}
+
+	b.WriteString("\n| Job | Runs | Compute | Estimated cost | p50 | p95 | Unusually long runs |\n|---|---|---|---|---|---|---|\n")
+	for _, row := range rows {
+		p50, p95, longRuns := "-", "-", "-"
+		if row.stats != nil {
+			p50, p95, longRuns = row.stats.p50.Round(time.Minute).String(), row.stats.p95.Round(time.Minute).String(), strconv.Itoa(row.longRuns)
+		}
+		cost := "-"
+		if row.cost > 0 {
+			cost = fmt.Sprintf("%s%.2f", c.config.Currency, row.cost)
+		}
+		fmt.Fprintf(&b, "| %s | %d | %s | %s | %s | %s | %s |\n", inlineCode(row.job), row.runs, row.total.Round(time.Minute), cost, p50, p95, longRuns)
+	}
+	return b.String()
+}
+
+// JobCostsHandler serves the markdown "CI cost" section of the weekly digest,
+// from the durations of the runs analysed within the last 7 days by default
+// (or within the 'from' and 'to' RFC3339 query parameters)
+type JobCostsHandler struct {
+	Costs  *jobCosts
+	Store  FailureStore
+	Logger zerolog.Logger
+}
+
+func (h *JobCostsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r, defaultJobCostsDigestWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recorded, err := listJobDurations(r.Context(), h.Store, from, to)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to list the jobs' durations")
+		http.Error(w, "failed to list the jobs' durations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	fmt.Fprint(w, h.Costs.digest(recorded, from, to))
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog"
+)
+
+// jobMetadata describes a Prow job run, its fields are
+// available to the link templates of the repositories
+type jobMetadata struct {
+	JobName     string
+	JobID       string
+	ProwJobURL  string
+	Repository  string
+	PullRequest int
+	// Start and End are formatted as RFC3339, StartTime and
+	// EndTime can be used for custom formatting within templates
+	Start     string
+	End       string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// reportLink is an extra link rendered in the report's footer
+type reportLink struct {
+	name string
+	url  string
+}
+
+// fetchJobMetadata returns the metadata of the given Prow job, reading its
+// start and end time from the started.json and finished.json files
+func fetchJobMetadata(ctx context.Context, client *storage.Client, prowJobURL, repoFullName string, prNumber int) *jobMetadata {
+	prowJobURL = strings.TrimSuffix(prowJobURL, "/")
+	metadata := &jobMetadata{
+		JobName:     jobNameFromProwJobURL(prowJobURL),
+		JobID:       path.Base(prowJobURL),
+		ProwJobURL:  prowJobURL,
+		Repository:  repoFullName,
+		PullRequest: prNumber,
+	}
+
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return metadata
+	}
+
+	var timestamp struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if content, err := readGCSObject(ctx, client, jobPrefix+"/"+startedFileName); err == nil && json.Unmarshal([]byte(content), &timestamp) == nil {
+		metadata.StartTime = time.Unix(timestamp.Timestamp, 0).UTC()
+		metadata.Start = metadata.StartTime.Format(time.RFC3339)
+	}
+	if content, err := readGCSObject(ctx, client, jobPrefix+"/"+finishedFileName); err == nil && json.Unmarshal([]byte(content), &timestamp) == nil {
+		metadata.EndTime = time.Unix(timestamp.Timestamp, 0).UTC()
+		metadata.End = metadata.EndTime.Format(time.RFC3339)
+	}
+
+	return metadata
+}
+
+// renderLinkTemplates renders the given link templates with the
+// job's metadata, skipping (and logging) the invalid ones
+func renderLinkTemplates(logger zerolog.Logger, templates []LinkTemplateConfig, metadata *jobMetadata) []reportLink {
+	var links []reportLink
+
+	for _, lt := range templates {
+		t, err := template.New(lt.Name).Parse(lt.URL)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Invalid link template %s", lt.Name)
+			continue
+		}
+
+		var b bytes.Buffer
+		if err := t.Execute(&b, metadata); err != nil {
+			logger.Error().Err(err).Msgf("Failed to render the link template %s", lt.Name)
+			continue
+		}
+		links = append(links, reportLink{name: lt.Name, url: b.String()})
+	}
+
+	return links
+}
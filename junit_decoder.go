@@ -0,0 +1,452 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	reporters "github.com/onsi/ginkgo/v2/reporters"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the test cases decoded at most per junit file, e.g. the stress suites
+	// write hundreds of thousands of them within junits of 200MB
+	maxJUnitTestCases = 500000
+	// the longest text (e.g. the failure's description or the captured
+	// output) kept per test case, its end being kept as it explains the failure
+	maxJUnitTextLength = 1024 * 1024
+)
+
+// decodeJUnitArtifact decodes the junit file, streamed from GCS when the scan
+// deferred its download, so that the file is never held in memory whole
+func decodeJUnitArtifact(ctx context.Context, scanner *prow.ArtifactScanner, artifact prow.Artifact) (*reporters.JUnitTestSuites, error) {
+	if artifact.Content != "" || scanner.Client == nil {
+		return decodeJUnit(strings.NewReader(artifact.Content))
+	}
+
+	rc, err := scanner.Client.Bucket(prowArtifactsBucketName).Object(artifact.FullName).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create reader for %s", artifact.FullName)
+	}
+	defer rc.Close()
+	return decodeJUnit(rc)
+}
+
+// decodeJUnit parses a junit file, whose root element is either <testsuites>
+// or, as written by some tools, a single <testsuite>. The test cases are decoded
+// one token at a time: only the end of their texts is kept while they're read,
+// and the captured output of those which passed is dropped, so that the decoded
+// suites stay small whatever the size of the file
+func decodeJUnit(r io.Reader) (*reporters.JUnitTestSuites, error) {
+	d := xml.NewDecoder(newJUnitTextLimiter(r))
+	testCases := 0
+
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the junit file has no <testsuites> nor <testsuite> element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "testsuites":
+			suites := &reporters.JUnitTestSuites{XMLName: start.Name}
+			if err := decodeSuitesAttrs(start, suites); err != nil {
+				return nil, err
+			}
+			if err := decodeChildren(d, func(child xml.StartElement) error {
+				if child.Name.Local != "testsuite" {
+					return d.Skip()
+				}
+				suite, err := decodeSuite(d, child, &testCases)
+				if err != nil {
+					return err
+				}
+				suites.TestSuites = append(suites.TestSuites, *suite)
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+			return suites, nil
+		case "testsuite":
+			suite, err := decodeSuite(d, start, &testCases)
+			if err != nil {
+				return nil, err
+			}
+			return &reporters.JUnitTestSuites{
+				TestSuites: []reporters.JUnitTestSuite{*suite},
+				Tests:      suite.Tests,
+				Failures:   suite.Failures,
+				Errors:     suite.Errors,
+			}, nil
+		default:
+			return nil, fmt.Errorf("unexpected root element <%s> of the junit file", start.Name.Local)
+		}
+	}
+}
+
+// decodeSuite decodes the <testsuite> element which starts with the given token
+func decodeSuite(d *xml.Decoder, start xml.StartElement, testCases *int) (*reporters.JUnitTestSuite, error) {
+	suite := &reporters.JUnitTestSuite{}
+	if err := decodeSuiteAttrs(start, suite); err != nil {
+		return nil, err
+	}
+
+	err := decodeChildren(d, func(child xml.StartElement) error {
+		switch child.Name.Local {
+		case "properties":
+			return d.DecodeElement(&suite.Properties, &child)
+		case "testcase":
+			if *testCases++; *testCases > maxJUnitTestCases {
+				return fmt.Errorf("the junit file has more than %d test cases", maxJUnitTestCases)
+			}
+			tc, err := decodeTestCase(d, child)
+			if err != nil {
+				return err
+			}
+			suite.TestCases = append(suite.TestCases, boundTestCase(*tc))
+			return nil
+		default:
+			return d.Skip()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// decodeChildren calls decode with each child element of the element being
+// decoded, until its end. decode must consume the child element entirely
+func decodeChildren(d *xml.Decoder, decode func(child xml.StartElement) error) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if err := decode(t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// decodeTestCase decodes the <testcase> element which starts with the given token
+func decodeTestCase(d *xml.Decoder, start xml.StartElement) (*reporters.JUnitTestCase, error) {
+	tc := &reporters.JUnitTestCase{}
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "name":
+			tc.Name = attr.Value
+		case "classname":
+			tc.Classname = attr.Value
+		case "status":
+			tc.Status = attr.Value
+		case "owner":
+			tc.Owner = attr.Value
+		case "time":
+			var err error
+			if tc.Time, err = junitAttrFloat(attr.Value); err != nil {
+				return nil, fmt.Errorf("invalid time attribute of <testcase> %q: %+v", tc.Name, err)
+			}
+		}
+	}
+
+	err := decodeChildren(d, func(child xml.StartElement) error {
+		var err error
+		switch child.Name.Local {
+		case "skipped":
+			tc.Skipped = &reporters.JUnitSkipped{Message: junitAttr(child, "message")}
+			return d.Skip()
+		case "failure":
+			tc.Failure = &reporters.JUnitFailure{Message: junitAttr(child, "message"), Type: junitAttr(child, "type")}
+			tc.Failure.Description, err = decodeJUnitText(d)
+		case "error":
+			tc.Error = &reporters.JUnitError{Message: junitAttr(child, "message"), Type: junitAttr(child, "type")}
+			tc.Error.Description, err = decodeJUnitText(d)
+		case "system-out":
+			tc.SystemOut, err = decodeJUnitText(d)
+		case "system-err":
+			tc.SystemErr, err = decodeJUnitText(d)
+		default:
+			return d.Skip()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// decodeJUnitText decodes the text of the element being decoded, until its
+// end, keeping its last maxJUnitTextLength bytes as they're read
+func decodeJUnitText(d *xml.Decoder) (string, error) {
+	var text []byte
+	depth := 0
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text = append(text, t...)
+			if len(text) > 2*maxJUnitTextLength {
+				text = text[:copy(text, text[len(text)-maxJUnitTextLength:])]
+			}
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return string(keepJUnitTextTail(text)), nil
+			}
+			depth--
+		}
+	}
+}
+
+// junitTextLimiter reads a junit file keeping only the last maxJUnitTextLength
+// bytes of each run of text and of each CDATA section, and dropping the
+// comments, so that the XML decoder never reads a whole captured output at once
+type junitTextLimiter struct {
+	r *bufio.Reader
+	// the markup and the texts read but not returned yet
+	pending []byte
+	err     error
+}
+
+func newJUnitTextLimiter(r io.Reader) *junitTextLimiter {
+	return &junitTextLimiter{r: bufio.NewReader(r)}
+}
+
+func (l *junitTextLimiter) Read(p []byte) (int, error) {
+	for len(l.pending) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		l.pending, l.err = l.next()
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+// next reads the next run of text, CDATA section, comment or tag
+func (l *junitTextLimiter) next() ([]byte, error) {
+	start, err := l.r.Peek(len("<![CDATA["))
+	switch {
+	case len(start) > 0 && start[0] != '<':
+		// a run of text, until the next markup
+		text, err := l.readTail([]byte("<"))
+		if err == nil {
+			err = l.r.UnreadByte()
+		}
+		return text, err
+	case bytes.HasPrefix(start, []byte("<![CDATA[")):
+		l.r.Discard(len(start))
+		text, err := l.readTail([]byte("]]>"))
+		return append(append([]byte("<![CDATA["), text...), "]]>"...), err
+	case bytes.HasPrefix(start, []byte("<!--")):
+		l.r.Discard(len("<!--"))
+		_, err := l.readTail([]byte("-->"))
+		return nil, err
+	case len(start) > 0:
+		return l.readTag()
+	}
+	return nil, err
+}
+
+// readTail reads until the delimiter, which it consumes, and returns the last
+// maxJUnitTextLength bytes read before it, starting at a character's boundary
+func (l *junitTextLimiter) readTail(delim []byte) ([]byte, error) {
+	var text []byte
+	for {
+		chunk, err := l.r.ReadSlice(delim[len(delim)-1])
+		text = append(text, chunk...)
+		if err == nil && bytes.HasSuffix(text, delim) {
+			text = text[:len(text)-len(delim)]
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return keepJUnitTextTail(text), err
+		}
+		// trimmed once twice as long, so that the text isn't copied for each chunk
+		if len(text) > 2*maxJUnitTextLength {
+			text = text[:copy(text, text[len(text)-maxJUnitTextLength-len(delim):])]
+		}
+	}
+	return keepJUnitTextTail(text), nil
+}
+
+// keepJUnitTextTail returns the last maxJUnitTextLength bytes of the text, starting at a character's boundary
+func keepJUnitTextTail(text []byte) []byte {
+	if overflow := len(text) - maxJUnitTextLength; overflow > 0 {
+		text = text[overflow:]
+		for len(text) > 0 && !utf8.RuneStart(text[0]) {
+			text = text[1:]
+		}
+	}
+	return text
+}
+
+// readTag reads a tag, whose attributes' values may hold '>'
+func (l *junitTextLimiter) readTag() ([]byte, error) {
+	var tag []byte
+	var quote byte
+	for {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			return tag, err
+		}
+		tag = append(tag, b)
+		switch {
+		case quote != 0:
+			if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case b == '>':
+			return tag, nil
+		}
+	}
+}
+
+// junitAttr returns the value of the element's attribute, empty when it has none
+func junitAttr(start xml.StartElement, name string) string {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// boundTestCase drops the captured output of the test case if it passed,
+// and truncates its messages otherwise, its texts being bounded when decoded
+func boundTestCase(tc reporters.JUnitTestCase) reporters.JUnitTestCase {
+	if tc.Failure == nil && tc.Error == nil {
+		tc.SystemOut, tc.SystemErr = "", ""
+		return tc
+	}
+
+	if tc.Failure != nil {
+		tc.Failure.Message = truncateJUnitText(tc.Failure.Message)
+	}
+	if tc.Error != nil {
+		tc.Error.Message = truncateJUnitText(tc.Error.Message)
+	}
+	return tc
+}
+
+// truncateJUnitText keeps the end of the text, at most maxJUnitTextLength long.
+// The copy lets the decoded text be garbage collected
+func truncateJUnitText(text string) string {
+	if len(text) <= maxJUnitTextLength {
+		return text
+	}
+	return string([]byte(text[len(text)-maxJUnitTextLength:]))
+}
+
+// decodeSuitesAttrs decodes the attributes of the <testsuites> element
+func decodeSuitesAttrs(start xml.StartElement, suites *reporters.JUnitTestSuites) error {
+	for _, attr := range start.Attr {
+		var err error
+		switch attr.Name.Local {
+		case "tests":
+			suites.Tests, err = junitAttrInt(attr.Value)
+		case "disabled":
+			suites.Disabled, err = junitAttrInt(attr.Value)
+		case "errors":
+			suites.Errors, err = junitAttrInt(attr.Value)
+		case "failures":
+			suites.Failures, err = junitAttrInt(attr.Value)
+		case "time":
+			suites.Time, err = junitAttrFloat(attr.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s attribute of <testsuites>: %+v", attr.Name.Local, err)
+		}
+	}
+	return nil
+}
+
+// decodeSuiteAttrs decodes the attributes of a <testsuite> element
+func decodeSuiteAttrs(start xml.StartElement, suite *reporters.JUnitTestSuite) error {
+	for _, attr := range start.Attr {
+		var err error
+		switch attr.Name.Local {
+		case "name":
+			suite.Name = attr.Value
+		case "package":
+			suite.Package = attr.Value
+		case "timestamp":
+			suite.Timestamp = attr.Value
+		case "tests":
+			suite.Tests, err = junitAttrInt(attr.Value)
+		case "disabled":
+			suite.Disabled, err = junitAttrInt(attr.Value)
+		case "skipped":
+			suite.Skipped, err = junitAttrInt(attr.Value)
+		case "errors":
+			suite.Errors, err = junitAttrInt(attr.Value)
+		case "failures":
+			suite.Failures, err = junitAttrInt(attr.Value)
+		case "time":
+			suite.Time, err = junitAttrFloat(attr.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s attribute of <testsuite> %q: %+v", attr.Name.Local, suite.Name, err)
+		}
+	}
+	return nil
+}
+
+// junitAttrInt parses a number attribute the way xml.Unmarshal does, an empty one being 0
+func junitAttrInt(value string) (int, error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// junitAttrFloat parses a decimal attribute the way xml.Unmarshal does, an empty one being 0
+func junitAttrFloat(value string) (float64, error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	reporters "github.com/onsi/ginkgo/v2/reporters"
+	"github.com/rs/zerolog"
+)
+
+const (
+	junitFlavorGinkgo  = "ginkgo"
+	junitFlavorPytest  = "pytest"
+	junitFlavorJest    = "jest"
+	junitFlavorGeneric = "generic"
+
+	junitDetailsMaxLines = 30
+)
+
+var jsTestFileExtensions = []string{".js", ".jsx", ".ts", ".tsx", ".mjs", ".cjs"}
+
+// detectJUnitFlavor returns which tool most likely wrote the test suite,
+// as each of them follows its own conventions for the junit attributes
+func detectJUnitFlavor(suite reporters.JUnitTestSuite) string {
+	if suite.Name == junitFlavorPytest {
+		return junitFlavorPytest
+	}
+
+	for _, tc := range suite.TestCases {
+		switch {
+		// Ginkgo is the only one setting the status attribute
+		case tc.Status != "":
+			return junitFlavorGinkgo
+		// jest-junit uses the test file's path as the class name
+		case isJSTestFile(tc.Classname) || isJSTestFile(suite.Name):
+			return junitFlavorJest
+		// pytest uses the module (and class) path as the class name
+		case strings.HasPrefix(tc.Name, "test") && strings.Contains(tc.Classname, "test_"):
+			return junitFlavorPytest
+		}
+	}
+
+	return junitFlavorGeneric
+}
+
+func isJSTestFile(name string) bool {
+	ext := path.Ext(name)
+	for _, e := range jsTestFileExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// extractFailedTestCasesOfFlavor appends the failed test cases of a suite
+// written by a non-Go tool to the report's 'failedTestCases', normalizing
+// their names, statuses and messages
+func (failedTCReport *FailedTestCasesReport) extractFailedTestCasesOfFlavor(logger zerolog.Logger, flavor string, testSuite reporters.JUnitTestSuite) {
+	for _, tc := range testSuite.TestCases {
+		if tc.Failure == nil && tc.Error == nil {
+			continue
+		}
+
+		name, status, message, description := normalizeJUnitTestCase(flavor, tc)
+		logger.Debug().Msgf("Found a %s Test Case (suiteName/testCaseName): %s/%s, that didn't pass", flavor, testSuite.Name, name)
+
+		details := codeBlock(message)
+		if description != "" && description != message {
+			details = details + "\n" + returnContentWrappedInDropdown(dropdownSummaryString, returnLastNLines(description, junitDetailsMaxLines))
+		}
+
+		failedTCReport.failedTestCases = append(failedTCReport.failedTestCases, failedTestCase{
+			suiteName: testSuite.Name,
+			name:      name,
+			status:    status,
+			message:   message,
+			details:   details,
+			duration:  junitDuration(tc),
+		})
+	}
+}
+
+// junitDuration returns how long the test case ran
+func junitDuration(tc reporters.JUnitTestCase) time.Duration {
+	return time.Duration(tc.Time * float64(time.Second))
+}
+
+// normalizeJUnitTestCase returns the name, status, message and
+// description (e.g. a traceback) of the failed test case
+func normalizeJUnitTestCase(flavor string, tc reporters.JUnitTestCase) (name, status, message, description string) {
+	status = "failed"
+	if tc.Failure != nil {
+		message, description = tc.Failure.Message, tc.Failure.Description
+	} else {
+		status = "error"
+		message, description = tc.Error.Message, tc.Error.Description
+	}
+	description = strings.TrimSpace(description)
+
+	// jest-junit leaves the message attribute empty, the message
+	// being the first line of the failure's body
+	if strings.TrimSpace(message) == "" {
+		message = strings.SplitN(description, "\n", 2)[0]
+	}
+
+	switch flavor {
+	case junitFlavorPytest:
+		// same as pytest's node IDs, e.g. "tests.e2e.test_build::test_build_succeeds"
+		name = tc.Classname + "::" + tc.Name
+	case junitFlavorJest:
+		name = tc.Name
+		if isJSTestFile(tc.Classname) {
+			name = name + " (" + tc.Classname + ")"
+		}
+	default:
+		name = tc.Name
+		if tc.Classname != "" && !strings.Contains(tc.Name, tc.Classname) {
+			name = tc.Classname + "." + tc.Name
+		}
+	}
+
+	return name, status, message, description
+}
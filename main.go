@@ -15,23 +15,43 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/gregjones/httpcache"
 	"github.com/palantir/go-githubapp/githubapp"
 	"github.com/rcrowley/go-metrics"
 	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
 )
 
 const (
 	DefaultWebhookRoute string = "/"
+	configPath                 = "config.yaml"
+	shutdownTimeout            = 30 * time.Second
 )
 
 func main() {
-	config, err := ReadConfig("config.yaml")
+	if len(os.Args) > 1 && os.Args[1] == analyzeCommand {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runAnalyzeCLI(ctx, os.Args[2:], os.Stdout, os.Stderr)
+		stop()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := ReadConfig(configPath)
 	if err != nil {
 		panic(err)
 	}
@@ -39,33 +59,471 @@ func main() {
 	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
 	zerolog.DefaultContextLogger = &logger
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var devServer *devServer
+	if len(os.Args) > 1 && os.Args[1] == devServerCommand {
+		if devServer, err = newDevServer(config.DevServer, logger); err != nil {
+			panic(err)
+		}
+		config.ArtifactSource = devServer.artifactSource()
+	}
+
 	metricsRegistry := metrics.DefaultRegistry
+	outage := newOutageMode(config.Outage)
+	if outage.isReadOnly() {
+		logger.Warn().Msg("The app is read-only, nothing will be written to GitHub")
+	}
 
-	cc, err := githubapp.NewDefaultCachingClientCreator(
-		config.Github,
-		githubapp.WithClientUserAgent("ci-helper-app/1.0.0"),
-		githubapp.WithClientTimeout(3*time.Second),
-		githubapp.WithClientCaching(false, func() httpcache.Cache { return httpcache.NewMemoryCache() }),
-		githubapp.WithClientMiddleware(
-			githubapp.ClientMetrics(metricsRegistry),
-		),
-	)
-	if err != nil {
+	newClientCreator := func(privateKey []byte) (githubapp.ClientCreator, error) {
+		githubConfig := config.Github
+		githubConfig.App.PrivateKey = string(privateKey)
+		return githubapp.NewDefaultCachingClientCreator(
+			githubConfig,
+			githubapp.WithClientUserAgent("ci-helper-app/"+appVersion),
+			githubapp.WithClientTimeout(3*time.Second),
+			githubapp.WithClientCaching(false, func() httpcache.Cache { return httpcache.NewMemoryCache() }),
+			githubapp.WithClientMiddleware(
+				githubapp.ClientMetrics(metricsRegistry),
+				faultInjectionMiddleware(config.FaultInjection, faultTargetGithub),
+				outageMiddleware(outage, logger),
+			),
+		)
+	}
+
+	var cc githubapp.ClientCreator
+	if devServer != nil {
+		cc = devServer.github
+	} else if config.GithubKeys.KeysDir != "" {
+		keys, err := newAppKeyring(ctx, config.GithubKeys.KeysDir, newClientCreator, logger)
+		if err != nil {
+			panic(err)
+		}
+		if config.GithubKeys.ReloadInterval > 0 {
+			go keys.run(ctx, config.GithubKeys.ReloadInterval)
+		}
+		http.Handle(GithubKeysReloadRoute, requireAdminToken(config.Admin.Token, &AppKeysReloadHandler{
+			Keys:   keys,
+			Logger: logger,
+		}))
+		cc = keys
+	} else if cc, err = newClientCreator([]byte(config.Github.App.PrivateKey)); err != nil {
 		panic(err)
 	}
 
+	var dispatcherOpts []githubapp.DispatcherOption
+	if config.ProwPlugin.Enabled {
+		if cc, err = newTokenClientCreator(cc, config.ProwPlugin.GithubTokenFile); err != nil {
+			panic(err)
+		}
+		// Prow's hook doesn't wait for the external plugins to handle its events
+		dispatcherOpts = append(dispatcherOpts, githubapp.WithScheduler(githubapp.AsyncScheduler()))
+	}
+
+	if config.Identity.Instance == "" && config.Identity.DetectSlug {
+		if config.Identity.Instance, err = detectAppSlug(ctx, cc); err != nil {
+			panic(err)
+		}
+		logger.Info().Msgf("Qualifying the reports with the app's slug: %s", config.Identity.Instance)
+	}
+
+	var failureStore FailureStore = newMemoryFailureStore(defaultFailureStoreCapacity)
+	if kind := config.FailureStore.Kind; kind == failureStorePostgres || kind == failureStoreSQLite {
+		if failureStore, err = newSQLFailureStore(ctx, config.FailureStore); err != nil {
+			panic(err)
+		}
+	}
+	var kr *keyring
+	var encryptingStore *encryptingFailureStore
+	if config.Encryption.KeysDir != "" {
+		if kr, err = newKeyring(config.Encryption.KeysDir); err != nil {
+			panic(err)
+		}
+		encryptingStore = &encryptingFailureStore{FailureStore: failureStore, keyring: kr, logger: logger}
+		failureStore = encryptingStore
+		http.Handle(EncryptionReloadRoute, requireAdminToken(config.Admin.Token, &KeyringReloadHandler{
+			Keyring: kr,
+			Logger:  logger,
+		}))
+	}
+	var cold *coldStorage
+	if config.ColdStorage.GCSBucket != "" {
+		if cold, err = newColdStorage(ctx, config.ColdStorage, kr); err != nil {
+			panic(err)
+		}
+		excerptLength := config.ColdStorage.ExcerptLength
+		if excerptLength <= 0 {
+			excerptLength = defaultColdStorageExcerptLength
+		}
+		failureStore = &tieredFailureStore{FailureStore: failureStore, cold: cold, excerptLength: excerptLength, logger: logger}
+	}
+	if encryptingStore != nil {
+		http.Handle(EncryptionReencryptRoute, requireAdminToken(config.Admin.Token, &KeyringReencryptHandler{
+			Store:  encryptingStore,
+			Cold:   cold,
+			Logger: logger,
+		}))
+	}
+
+	failureMetrics := newFailureMetrics(config.Metrics)
+
+	cancellations := newAnalysisCancellations()
+
+	var usageTelemetry *telemetry
+	if config.Telemetry.Enabled && config.Telemetry.Endpoint != "" {
+		usageTelemetry = newTelemetry(config.Telemetry, config, logger)
+		go usageTelemetry.run(ctx)
+	}
+
 	prCommentHandler := &PRCommentHandler{
 		ClientCreator: cc,
+		Config:        config,
+		Store:         failureStore,
+		Analyses:      newAnalysisCache(defaultAnalysisCacheCapacity),
+		Metrics:       failureMetrics,
+		Cancellations: cancellations,
+		Access:        newAccessPolicy(config.Access),
+		Telemetry:     usageTelemetry,
+		Outage:        outage,
+		Classifiers:   newClassifiers(),
+		Triggers:      newTriggers(),
+	}
+
+	// the SQL stores share the opt-outs between the replicas and across restarts
+	var optOutStore FailureStore
+	if kind := config.FailureStore.Kind; kind == failureStorePostgres || kind == failureStoreSQLite {
+		optOutStore = failureStore
+	}
+	if prCommentHandler.Mentions, err = loadMentionOptOuts(ctx, config.Mentions.OptOutFile, optOutStore); err != nil {
+		panic(err)
+	}
+	go prCommentHandler.Mentions.run(ctx, logger)
+
+	gcsClientOpts := []option.ClientOption{option.WithoutAuthentication()}
+	if config.FaultInjection.Enabled {
+		logger.Warn().Msgf("Fault injection is enabled for %v, this must never be the case in production", config.FaultInjection.Targets)
+		gcsClientOpts = []option.ClientOption{option.WithHTTPClient(&http.Client{
+			Transport: newFaultTransport(http.DefaultTransport, config.FaultInjection, faultTargetGCS),
+		})}
+	}
+	gcsClient, err := storage.NewClient(ctx, gcsClientOpts...)
+	if err != nil {
+		panic(err)
+	}
+	prCommentHandler.GCS = gcsClient
+	if len(config.PrivateSpyglass) > 0 {
+		if prCommentHandler.PrivateSpyglass, err = newPrivateSpyglass(ctx, config.PrivateSpyglass, config.FaultInjection); err != nil {
+			panic(err)
+		}
+	}
+	if prCommentHandler.ArtifactSizes, err = newArtifactSizePolicies(config.ArtifactSizes); err != nil {
+		panic(err)
+	}
+	if prCommentHandler.Artifacts, err = newArtifactSource(ctx, config.ArtifactSource, gcsClient, prCommentHandler.ArtifactSizes); err != nil {
+		panic(err)
+	}
+	if config.Remediation.KBFile != "" {
+		if prCommentHandler.Remediations, err = loadRemediationKB(config.Remediation.KBFile, logger); err != nil {
+			panic(err)
+		}
+		if config.Remediation.ReloadInterval > 0 {
+			go prCommentHandler.Remediations.run(ctx, config.Remediation.ReloadInterval)
+		}
+		http.Handle(RemediationReloadRoute, requireAdminToken(config.Admin.Token, &RemediationReloadHandler{
+			KB:     prCommentHandler.Remediations,
+			Logger: logger,
+		}))
+	}
+	sinkTemplates, err := loadSinkTemplates(config.SinkTemplates.Dir)
+	if err != nil {
+		panic(err)
+	}
+	if config.HeaderPolicy.Enabled {
+		if prCommentHandler.HeaderPolicy, err = newHeaderPolicy(config.HeaderPolicy); err != nil {
+			panic(err)
+		}
+	}
+	if config.BusinessHours.Enabled {
+		hours, err := newBusinessHours(config.BusinessHours)
+		if err != nil {
+			panic(err)
+		}
+		if prCommentHandler.HeaderPolicy != nil {
+			prCommentHandler.HeaderPolicy.hours = hours
+		}
+		prCommentHandler.DeferredMentions = newDeferredMentions(hours, cc, prCommentHandler.Mentions, logger)
+		go prCommentHandler.DeferredMentions.run(ctx)
+	}
+	if config.AnalysisJUnit.GCSBucket != "" {
+		if prCommentHandler.AnalysisJUnit, err = newAnalysisJUnitUploader(ctx, config.AnalysisJUnit); err != nil {
+			panic(err)
+		}
+		prCommentHandler.AnalysisJUnit.telemetry = usageTelemetry
+	}
+	if config.ReportPages.BaseURL != "" {
+		if prCommentHandler.ReportPages, err = newReportPages(ctx, config.ReportPages); err != nil {
+			panic(err)
+		}
+		http.Handle(ReportPageRoute, &ReportPageHandler{Pages: prCommentHandler.ReportPages, Logger: logger})
+	}
+	prCommentHandler.Dependencies = newDependencyHealth(config.CircuitBreaker, failureMetrics.registry, usageTelemetry)
+	prCommentHandler.CommentLint = newCommentLint(failureMetrics.registry)
+	prCommentHandler.CommentEdits = newCommentEdits(failureStore)
+	prCommentHandler.ReviewComments = newReviewComments()
+	prCommentHandler.RepoConfigFiles = newRepoConfigFiles()
+	prCommentHandler.Status = newAppStatus()
+	prCommentHandler.TeamComments = newTeamComments()
+	if config.PRLocks.Enabled {
+		if prCommentHandler.Locks, err = newPRLocks(config.PRLocks, failureStore); err != nil {
+			panic(err)
+		}
+		if config.FailureStore.Kind == "" || config.FailureStore.Kind == failureStoreMemory {
+			logger.Warn().Msg("The PR locks are held in the memory failure store, they only serialize the analyses within each replica")
+		}
+	}
+	if config.JobCosts.Enabled {
+		if prCommentHandler.JobCosts, err = newJobCosts(config.JobCosts, failureStore); err != nil {
+			panic(err)
+		}
+	}
+	if config.FailureStore.History {
+		prCommentHandler.FailureHistory = newFailureHistory(failureStore, config.FailureStore.HistoryWindow)
+	}
+	if config.InfraChanges.Enabled {
+		if prCommentHandler.InfraChanges, err = newInfraChanges(config.InfraChanges); err != nil {
+			panic(err)
+		}
+	}
+	if config.Burst.Cooldown > 0 {
+		prCommentHandler.Bursts = newBurstGuard(config.Burst)
+	}
+	if config.Regions.Enabled {
+		prCommentHandler.Regions = newRegionHealth()
+		http.Handle(RegionsRoute, requireAdminToken(config.Admin.Token, &RegionsHandler{
+			Regions: prCommentHandler.Regions,
+			Logger:  logger,
+		}))
+	}
+	if len(config.MainBranchHistory.Jobs) > 0 {
+		prCommentHandler.MainBranchHistory = newMainBranchHistory(gcsClient, config.MainBranchHistory)
+		prCommentHandler.MainBranchHistory.breaker = prCommentHandler.Dependencies.breaker(dependencyMainBranchHistory)
+	}
+	if config.RetryAdvisor.Enabled {
+		prCommentHandler.RetryAdvisor = newRetryAdvisor(gcsClient, failureStore, config.RetryAdvisor)
+	}
+	if config.Deck.URL != "" {
+		if prCommentHandler.Deck, err = newDeckClient(config.Deck, gcsClient); err != nil {
+			panic(err)
+		}
+		prCommentHandler.Deck.breaker = prCommentHandler.Dependencies.breaker(dependencyDeck)
+		prCommentHandler.Watches = newJobWatches()
+	}
+
+	if config.IssueReconciler.Enabled && config.ProwPlugin.Enabled {
+		logger.Warn().Msg("The issue reconciler needs the app's installations, it's disabled when running as a Prow plugin")
+	} else if config.IssueReconciler.Enabled {
+		go newIssueReconciler(cc, failureStore, config.IssueReconciler, logger).run(ctx)
+	}
+	if config.Jira.URL != "" {
+		taxonomy, err := newJiraTaxonomy(config.Jira, failureStore, logger)
+		if err != nil {
+			panic(err)
+		}
+		taxonomy.telemetry = usageTelemetry
+		go taxonomy.run(ctx)
+		http.Handle(JiraTaxonomyRoute, requireAdminToken(config.Admin.Token, &JiraTaxonomyHandler{Taxonomy: taxonomy}))
+	}
+	if config.CommentReconciler.Enabled && config.ProwPlugin.Enabled {
+		logger.Warn().Msg("The comment reconciler needs the app's installations, it's disabled when running as a Prow plugin")
+	} else if config.CommentReconciler.Enabled {
+		go newCommentReconciler(cc, prCommentHandler, config.CommentReconciler, reportIdentity{instance: config.Identity.Instance}, logger).run(ctx)
 	}
 
-	webhookHandler := githubapp.NewDefaultEventDispatcher(config.Github, prCommentHandler)
+	prHandler := &PRHandler{
+		Cancellations: cancellations,
+	}
+
+	handlers := []githubapp.EventHandler{prCommentHandler, prHandler}
+	statusHandler := &StatusHandler{}
+	if config.ErrorBudget.Target > 0 {
+		statusHandler.Budgets = newErrorBudgets(config.ErrorBudget)
+		failureMetrics.registry.MustRegister(statusHandler.Budgets)
+		http.Handle(ErrorBudgetsRoute, requireAdminToken(config.Admin.Token, &ErrorBudgetsHandler{
+			Budgets: statusHandler.Budgets,
+		}))
+	}
+	if config.PendingWatchdog.Enabled {
+		statusHandler.Watchdog = newPendingWatchdog(cc, config.PendingWatchdog, prCommentHandler.Mentions, logger)
+		go statusHandler.Watchdog.run(ctx)
+	}
+	// the repositories' own files may enable the gating, the gates' events are always handled
+	prCommentHandler.Gates = newAnalysisGates()
+	statusHandler.Gates = &AnalysisGatesHandler{Handler: prCommentHandler, Logger: logger}
+	go statusHandler.Gates.run(ctx)
+	handlers = append(handlers, statusHandler, statusHandler.Gates)
+	for i, h := range handlers {
+		handlers[i] = &statusEventHandler{EventHandler: h, status: prCommentHandler.Status}
+	}
+	eventWorkload := newWorkload(failureMetrics.registry)
+	prCommentHandler.Workload = eventWorkload
+	if config.Queue.Workers > 0 {
+		prCommentHandler.Queue = newWorkQueue(config.Queue, failureMetrics.registry, eventWorkload, prCommentHandler.Status)
+		prCommentHandler.Queue.run(config.Queue.Workers)
+		prHandler.Queue = prCommentHandler.Queue
+	}
+	for i, h := range handlers {
+		handlers[i] = &workloadEventHandler{EventHandler: h, workload: eventWorkload}
+	}
+	if usageTelemetry != nil {
+		for i, h := range handlers {
+			handlers[i] = &telemetryEventHandler{EventHandler: h, telemetry: usageTelemetry}
+		}
+	}
+	if config.PayloadArchive.Dir != "" {
+		archive, err := newPayloadArchive(config.PayloadArchive, logger)
+		if err != nil {
+			panic(err)
+		}
+		for i, h := range handlers {
+			handlers[i] = &archivingEventHandler{EventHandler: h, archive: archive}
+		}
+		go archive.runRetention(ctx)
+		http.Handle(PayloadsRoute, requireAdminToken(config.Admin.Token, &PayloadsHandler{
+			Archive: archive,
+		}))
+	}
+
+	if devServer != nil {
+		go func() {
+			if err := devServer.replay(ctx, handlers); err != nil {
+				logger.Error().Err(err).Msg("Failed to replay the recorded deliveries")
+			}
+		}()
+		http.Handle(DevServerReplayRoute, &DevServerReplayHandler{DevServer: devServer, Handlers: handlers})
+	}
+
+	webhookHandler := githubapp.NewEventDispatcher(handlers, config.Github.App.WebhookSecret, dispatcherOpts...)
+	if config.ProwPlugin.Enabled {
+		http.Handle(ProwPluginHelpRoute, &ProwPluginHelpHandler{Handlers: handlers})
+	}
 
 	http.Handle(DefaultWebhookRoute, webhookHandler)
+	http.Handle(MetricsRoute, failureMetrics.handler())
+	http.Handle(AutoscalingRoute, &AutoscalingHandler{Workload: eventWorkload})
+	readiness := &serverReadiness{}
+	http.Handle(HealthzRoute, &HealthzHandler{
+		Queue:  prCommentHandler.Queue,
+		Logger: logger,
+	})
+	http.Handle(ReadyzRoute, &ReadyzHandler{
+		ClientCreator: cc,
+		Readiness:     readiness,
+		Logger:        logger,
+	})
+	http.Handle(StatusPageRoute, &StatusPageHandler{
+		Status:       prCommentHandler.Status,
+		Dependencies: prCommentHandler.Dependencies,
+		Outage:       outage,
+		Logger:       logger,
+	})
+	http.Handle(CancelAnalysesRoute, requireAdminToken(config.Admin.Token, &CancelAnalysesHandler{
+		Cancellations: cancellations,
+		Queue:         prCommentHandler.Queue,
+	}))
+	http.Handle(OutageRoute, requireAdminToken(config.Admin.Token, &OutageHandler{
+		Outage: outage,
+		Logger: logger,
+	}))
+	http.Handle(ConfigValidationRoute, requireAdminToken(config.Admin.Token, &ConfigValidationHandler{
+		ConfigPath: configPath,
+		KBPath:     config.Remediation.KBFile,
+	}))
+	http.Handle(ConfigSchemaRoute, requireAdminToken(config.Admin.Token, &ConfigSchemaHandler{}))
+	http.Handle(AnalysisJUnitRoute, requireAdminToken(config.Admin.Token, &AnalysisJUnitHandler{
+		Analyses: prCommentHandler.Analyses,
+	}))
+	http.Handle(SinkPreviewRoute, requireAdminToken(config.Admin.Token, &SinkPreviewHandler{
+		Templates: sinkTemplates,
+		Analyses:  prCommentHandler.Analyses,
+	}))
+	http.Handle(HeatmapRoute, requireAdminToken(config.Admin.Token, &HeatmapHandler{
+		Store:  failureStore,
+		Logger: logger,
+	}))
+	http.Handle(AnalysesAPIRoute, requireAdminToken(config.API.Token, &AnalysesAPIHandler{
+		ClientCreator: cc,
+		Handler:       prCommentHandler,
+		Logger:        logger,
+	}))
+	http.Handle(FlakesAPIRoute, requireAdminToken(config.API.Token, &FlakesAPIHandler{
+		Store:  failureStore,
+		Logger: logger,
+	}))
+	if cold != nil {
+		http.Handle(FailureMessagesAPIRoute, requireAdminToken(config.API.Token, &FailureMessagesAPIHandler{
+			Cold:   cold,
+			Logger: logger,
+		}))
+	}
+	if config.Archive.Enabled {
+		archive, err := newArchive(ctx, config.Archive, failureStore, prCommentHandler.MainBranchHistory, cc, logger)
+		if err != nil {
+			panic(err)
+		}
+		go archive.run(ctx)
+		http.Handle(ArchiveRoute, requireAdminToken(config.Admin.Token, &ArchiveHandler{Archive: archive}))
+	}
+	http.Handle(CommentConflictsRoute, requireAdminToken(config.Admin.Token, &CommentConflictsHandler{
+		Edits:  prCommentHandler.CommentEdits,
+		Logger: logger,
+	}))
+	exportHandler := &ExportHandler{
+		Store:  failureStore,
+		Config: config.Export,
+		Logger: logger,
+	}
+	if config.Export.GCSBucket != "" {
+		if exportHandler.Client, err = storage.NewClient(ctx); err != nil {
+			panic(err)
+		}
+	}
+	http.Handle(ExportRoute, requireAdminToken(config.Admin.Token, exportHandler))
+	if prCommentHandler.JobCosts != nil {
+		http.Handle(JobCostsRoute, requireAdminToken(config.Admin.Token, &JobCostsHandler{
+			Costs:  prCommentHandler.JobCosts,
+			Store:  failureStore,
+			Logger: logger,
+		}))
+	}
 
 	addr := fmt.Sprintf("%s:%d", config.Server.Address, config.Server.Port)
+	server := &http.Server{Addr: addr}
+	shutdownDone := make(chan struct{})
+
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logger.Info().Msg("Shutting down the server...")
+		readiness.listening.Store(false)
+		cancellations.cancelAll()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error().Err(err).Msg("Failed to gracefully shut down the server")
+		}
+	}()
+
 	logger.Info().Msgf("Starting server on %s...", addr)
-	err = http.ListenAndServe(addr, nil)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		panic(err)
 	}
+	readiness.listening.Store(true)
+	err = server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	<-shutdownDone
 }
@@ -0,0 +1,299 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultMainBranchLookback = 10
+	startedFileName           = "started.json"
+	finishedFileName          = "finished.json"
+	// how long the listing of a main branch job's runs is reused
+	mainBranchListingTTL = 5 * time.Minute
+)
+
+// mainBranchRun is a finished run of a main branch job
+type mainBranchRun struct {
+	buildID     string
+	started     time.Time
+	failedTests map[string]bool
+}
+
+// mainBranchHistory looks up whether the failures of a presubmit
+// job also occur in the corresponding main branch (periodic) job
+type mainBranchHistory struct {
+	client   *storage.Client
+	jobs     map[string]string
+	lookback int
+	breaker  *circuitBreaker
+
+	mu sync.Mutex
+	// finished runs never change, so they're cached by their GCS prefix,
+	// up to 'capacity' of them, the oldest cached being evicted first
+	runs     map[string]*mainBranchRun
+	runOrder []string
+	capacity int
+	// the recent listings of the jobs' runs, by the jobs' name
+	listings map[string]mainBranchListing
+}
+
+// mainBranchListing is the listing of a main branch job's runs
+type mainBranchListing struct {
+	buildPrefixes []string
+	listedAt      time.Time
+}
+
+func newMainBranchHistory(client *storage.Client, cfg MainBranchHistoryConfig) *mainBranchHistory {
+	lookback := cfg.Lookback
+	if lookback <= 0 {
+		lookback = defaultMainBranchLookback
+	}
+
+	// the runs looked back at for each main branch job, and those which replace them
+	mainJobs := map[string]bool{}
+	for _, mainJob := range cfg.Jobs {
+		mainJobs[mainJob] = true
+	}
+	return &mainBranchHistory{
+		client:   client,
+		jobs:     cfg.Jobs,
+		lookback: lookback,
+		runs:     map[string]*mainBranchRun{},
+		capacity: 2 * lookback * (len(mainJobs) + 1),
+		listings: map[string]mainBranchListing{},
+	}
+}
+
+// jobNameFromProwJobURL returns the name of the Prow job, e.g.
+// ".../pull/org_repo/1/pull-ci-org-repo-main-e2e/123" -> "pull-ci-org-repo-main-e2e"
+func jobNameFromProwJobURL(prowJobURL string) string {
+	return path.Base(path.Dir(strings.TrimSuffix(prowJobURL, "/")))
+}
+
+// annotate adds a note to each of the report's failed test cases
+// saying whether (and since when) it also fails on the main branch
+func (h *mainBranchHistory) annotate(ctx context.Context, logger zerolog.Logger, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	mainJob, ok := h.jobs[jobNameFromProwJobURL(prowJobURL)]
+	if !ok {
+		return
+	}
+
+	var runs []*mainBranchRun
+	err := h.breaker.call(func() (err error) {
+		runs, err = h.recentRuns(ctx, logger, mainJob)
+		return err
+	})
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to fetch the history of the main branch job %s", mainJob)
+		return
+	}
+	if len(runs) == 0 {
+		return
+	}
+
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, mainBranchNote(tc.name, runs))
+		failedTCReport.failedTestCases[i].failingOnMain = runs[0].failedTests[client.NormalizeTestName(tc.name)]
+	}
+}
+
+// mainBranchNote summarises the results of the given test case
+// within the given main branch runs, ordered from the newest
+func mainBranchNote(testCaseName string, runs []*mainBranchRun) string {
+	testCaseName = client.NormalizeTestName(testCaseName)
+	consecutive := 0
+	for _, run := range runs {
+		if !run.failedTests[testCaseName] {
+			break
+		}
+		consecutive++
+	}
+
+	if consecutive > 0 {
+		return fmt.Sprintf(":warning: Also failing on `main` since %s (%d consecutive run(s))",
+			runs[consecutive-1].started.UTC().Format(time.RFC1123), consecutive)
+	}
+
+	failures := 0
+	var lastFailure time.Time
+	for _, run := range runs {
+		if run.failedTests[testCaseName] {
+			if failures == 0 {
+				lastFailure = run.started
+			}
+			failures++
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Sprintf(":information_source: Failed on `main` in %d of the last %d run(s), most recently on %s",
+			failures, len(runs), lastFailure.UTC().Format(time.RFC1123))
+	}
+
+	return fmt.Sprintf(":white_check_mark: Not failing on `main` in the last %d run(s)", len(runs))
+}
+
+// recentRuns returns the latest finished runs of the given
+// main branch job, ordered from the newest
+func (h *mainBranchHistory) recentRuns(ctx context.Context, logger zerolog.Logger, jobName string) ([]*mainBranchRun, error) {
+	buildPrefixes, err := h.listRuns(ctx, jobName)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*mainBranchRun
+	for _, buildPrefix := range buildPrefixes {
+		if len(runs) == h.lookback {
+			break
+		}
+
+		run, err := h.run(ctx, buildPrefix)
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Skipping the main branch run %s", buildPrefix)
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// listRuns returns the GCS prefixes of the given main branch job's runs,
+// ordered from the newest, reusing the job's listing for a while
+func (h *mainBranchHistory) listRuns(ctx context.Context, jobName string) ([]string, error) {
+	h.mu.Lock()
+	listing, ok := h.listings[jobName]
+	h.mu.Unlock()
+	if ok && time.Since(listing.listedAt) < mainBranchListingTTL {
+		return listing.buildPrefixes, nil
+	}
+
+	jobPrefix := "logs/" + jobName + "/"
+	it := h.client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: jobPrefix, Delimiter: "/"})
+
+	var buildPrefixes []string
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the runs of %s", jobName)
+		}
+		if attrs.Prefix != "" {
+			buildPrefixes = append(buildPrefixes, strings.TrimSuffix(attrs.Prefix, "/"))
+		}
+	}
+
+	// build IDs are increasing numbers, so the newest runs come first once sorted numerically
+	sort.Slice(buildPrefixes, func(i, j int) bool {
+		a, _ := strconv.ParseUint(path.Base(buildPrefixes[i]), 10, 64)
+		b, _ := strconv.ParseUint(path.Base(buildPrefixes[j]), 10, 64)
+		return a > b
+	})
+
+	h.mu.Lock()
+	h.listings[jobName] = mainBranchListing{buildPrefixes: buildPrefixes, listedAt: time.Now()}
+	h.mu.Unlock()
+	return buildPrefixes, nil
+}
+
+// run returns the given finished main branch run, with the
+// names of its failed test cases, fetching it if not cached
+func (h *mainBranchHistory) run(ctx context.Context, buildPrefix string) (*mainBranchRun, error) {
+	h.mu.Lock()
+	run, ok := h.runs[buildPrefix]
+	h.mu.Unlock()
+	if ok {
+		return run, nil
+	}
+
+	// the run is still in progress until finished.json gets uploaded
+	if _, err := readGCSObject(ctx, h.client, buildPrefix+"/"+finishedFileName); err != nil {
+		return nil, err
+	}
+
+	startedContent, err := readGCSObject(ctx, h.client, buildPrefix+"/"+startedFileName)
+	if err != nil {
+		return nil, err
+	}
+	var started struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if err := json.Unmarshal([]byte(startedContent), &started); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", startedFileName)
+	}
+
+	plan, err := planScanForJobPrefix(ctx, h.client, buildPrefix)
+	if err != nil {
+		return nil, err
+	}
+	scanner := &prow.ArtifactScanner{Client: h.client}
+	if err := plan.execute(ctx, zerolog.Nop(), scanner, []string{junitFilenameRegex}); err != nil {
+		return nil, err
+	}
+
+	run = &mainBranchRun{
+		buildID:     path.Base(buildPrefix),
+		started:     time.Unix(started.Timestamp, 0),
+		failedTests: map[string]bool{},
+	}
+
+	overallJUnitSuites, err := getTestSuitesFromXMLFile(ctx, scanner, zerolog.Nop(), junitFilename)
+	if err == nil {
+		for _, testSuite := range overallJUnitSuites.TestSuites {
+			for _, tc := range testSuite.TestCases {
+				if tc.Failure != nil || tc.Error != nil {
+					run.failedTests[client.NormalizeTestName(tc.Name)] = true
+				}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	if _, ok := h.runs[buildPrefix]; !ok {
+		h.runOrder = append(h.runOrder, buildPrefix)
+	}
+	h.runs[buildPrefix] = run
+	if overflow := len(h.runOrder) - h.capacity; overflow > 0 {
+		for _, evicted := range h.runOrder[:overflow] {
+			delete(h.runs, evicted)
+		}
+		h.runOrder = append([]string(nil), h.runOrder[overflow:]...)
+	}
+	h.mu.Unlock()
+
+	return run, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// The failures embed arbitrary content (logs, messages) into the comment's
+// markdown, which must never be able to end the block holding it early
+
+// codeBlock fences the content with a fence longer than any run of
+// backticks within the content, so that no line of it closes the block
+func codeBlock(content string) string {
+	n := longestRun(content, '`') + 1
+	if n < 3 {
+		n = 3
+	}
+	fence := strings.Repeat("`", n)
+
+	return fence + "\n" + strings.TrimSuffix(content, "\n") + "\n" + fence
+}
+
+// inlineCode wraps the (single line) content in a code span
+// delimited by more backticks than any run within the content
+func inlineCode(content string) string {
+	content = strings.ReplaceAll(content, "\n", " ")
+	delimiter := strings.Repeat("`", longestRun(content, '`')+1)
+	if strings.HasPrefix(content, "`") || strings.HasSuffix(content, "`") {
+		content = " " + content + " "
+	}
+	return delimiter + content + delimiter
+}
+
+// preBlock escapes the content within a <pre> element, which starts
+// its own line so that blank lines within the content don't end it
+func preBlock(content string) string {
+	return "\n\n<pre>" + html.EscapeString(content) + "</pre>\n"
+}
+
+// longestRun returns the length of the longest run of c within s
+func longestRun(s string, c byte) int {
+	longest, current := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != c {
+			current = 0
+			continue
+		}
+		current++
+		if current > longest {
+			longest = current
+		}
+	}
+	return longest
+}
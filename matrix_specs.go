@@ -0,0 +1,120 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// the parameters suffixing the names of the table-driven specs, e.g. Ginkgo's
+// "... Entry: go, 1.21" (the default description of the entries), "... [go]" or "... (go)"
+var specParametersRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`^(.+?)\s+Entry:\s+(.+)$`),
+	regexp.MustCompile(`^(.+?)\s*\[([^\[\]]+)\]$`),
+	regexp.MustCompile(`^(.+?)\s*\(([^()]+)\)$`),
+}
+
+// matrixFailure groups the failures of the entries of a table-driven spec,
+// or holds a single failure
+type matrixFailure struct {
+	base string
+	// the indices of the failures within the report, and their parameters
+	indices    []int
+	parameters []string
+}
+
+// splitSpecParameters splits the spec's name into its base name and the
+// parameters of its table entry, if any
+func splitSpecParameters(name string) (string, string, bool) {
+	for _, r := range specParametersRegexes {
+		if m := r.FindStringSubmatch(name); m != nil {
+			return strings.TrimSpace(m[1]), strings.TrimSpace(m[2]), true
+		}
+	}
+	return "", "", false
+}
+
+// groupMatrixFailures groups the failures of the same suite and status sharing
+// a base name with different parameters, in the order of their first failure
+func groupMatrixFailures(failedTestCases []failedTestCase) []matrixFailure {
+	var groups []matrixFailure
+	byBase := map[string]int{}
+	for i, tc := range failedTestCases {
+		base, parameters, ok := splitSpecParameters(tc.name)
+		if !ok || tc.status == "" {
+			groups = append(groups, matrixFailure{indices: []int{i}})
+			continue
+		}
+		key := tc.childJobURL + "\x00" + tc.team + "\x00" + tc.suiteName + "\x00" + tc.status + "\x00" + base
+		if g, ok := byBase[key]; ok {
+			groups[g].indices = append(groups[g].indices, i)
+			groups[g].parameters = append(groups[g].parameters, parameters)
+			continue
+		}
+		byBase[key] = len(groups)
+		groups = append(groups, matrixFailure{base: base, indices: []int{i}, parameters: []string{parameters}})
+	}
+
+	// a single failed entry is reported as is
+	for i := range groups {
+		if len(groups[i].indices) == 1 {
+			groups[i].base, groups[i].parameters = "", nil
+		}
+	}
+	return groups
+}
+
+// isMatrix returns whether the group holds several entries of a table-driven spec
+func (g matrixFailure) isMatrix() bool {
+	return len(g.indices) > 1
+}
+
+// entry renders the failed entries as a single item of the report's list
+// of failures, their details being collapsed per parameters
+func (g matrixFailure) entry(failedTestCases []failedTestCase) string {
+	first := failedTestCases[g.indices[0]]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "* :arrow_right: [**`%s`**] %s, failed with %d parameters: %s\n",
+		first.status, g.base, len(g.indices), g.parameterList())
+	b.WriteString("<details><summary>Failures per parameters</summary>\n\n")
+	for i, index := range g.indices {
+		tc := failedTestCases[index]
+		fmt.Fprintf(&b, "%s\n%s\n", inlineCode(g.parameters[i]), tc.details)
+		for _, note := range tc.notes {
+			b.WriteString(note + "\n")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("</details>")
+
+	return b.String()
+}
+
+// compactEntry renders the failed entries as a single line
+func (g matrixFailure) compactEntry(failedTestCases []failedTestCase) string {
+	first := failedTestCases[g.indices[0]]
+	return fmt.Sprintf("* :arrow_right: [**`%s`**] %s, failed with %d parameters: %s", first.status, g.base, len(g.indices), g.parameterList())
+}
+
+func (g matrixFailure) parameterList() string {
+	var parameters []string
+	for _, p := range g.parameters {
+		parameters = append(parameters, inlineCode(p))
+	}
+	return strings.Join(parameters, ", ")
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	unsubscribeCommand = "unsubscribe"
+	subscribeCommand   = "subscribe"
+	// how often the opt-outs made through the other replicas are picked up
+	mentionOptOutsRefreshInterval = time.Minute
+)
+
+// mentionOptOuts is the registry of the users who don't want
+// the app to @mention them. A nil registry opts out no one
+type mentionOptOuts struct {
+	mu sync.Mutex
+	// the file persisting the registry, if any
+	path string
+	// the failure store persisting the registry instead of the file, if any
+	store  FailureStore
+	logins map[string]bool
+}
+
+// loadMentionOptOuts reads the registry from the failure store when given
+// one, or else from the given JSON file, which doesn't need to exist yet.
+// Without either, the registry can't be changed, see persisted
+func loadMentionOptOuts(ctx context.Context, path string, store FailureStore) (*mentionOptOuts, error) {
+	r := &mentionOptOuts{path: path, store: store, logins: map[string]bool{}}
+	if store != nil {
+		return r, r.refresh(ctx)
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the mention opt-outs: %s", path)
+	}
+
+	var logins []string
+	if err := json.Unmarshal(content, &logins); err != nil {
+		return nil, errors.Wrapf(err, "failed parsing the mention opt-outs: %s", path)
+	}
+	for _, login := range logins {
+		r.logins[strings.ToLower(login)] = true
+	}
+
+	return r, nil
+}
+
+// refresh reloads the registry from the failure store
+func (r *mentionOptOuts) refresh(ctx context.Context) error {
+	logins, err := listMentionOptOuts(ctx, r.store)
+	if err != nil {
+		return err
+	}
+	optedOut := make(map[string]bool, len(logins))
+	for _, login := range logins {
+		optedOut[login] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logins = optedOut
+	return nil
+}
+
+// run picks up the opt-outs made through the other replicas
+// until the context is done, if the failure store persists them
+func (r *mentionOptOuts) run(ctx context.Context, logger zerolog.Logger) {
+	if r == nil || r.store == nil {
+		return
+	}
+	ticker := time.NewTicker(mentionOptOutsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.refresh(ctx); err != nil {
+				logger.Error().Err(err).Msg("Failed to refresh the mention opt-outs")
+			}
+		}
+	}
+}
+
+// persisted returns whether the changes to the registry outlive the app,
+// and are seen by all of its replicas when the failure store persists them
+func (r *mentionOptOuts) persisted() bool {
+	return r != nil && (r.store != nil || r.path != "")
+}
+
+// set opts the user out of (or back into) the mentions
+func (r *mentionOptOuts) set(ctx context.Context, login string, optedOut bool) error {
+	if !r.persisted() {
+		return fmt.Errorf("nothing persists the mention opt-outs")
+	}
+	login = strings.ToLower(login)
+	if r.store != nil {
+		if err := setMentionOptOut(ctx, r.store, login, optedOut); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.logins[login] == optedOut {
+		return nil
+	}
+	if optedOut {
+		r.logins[login] = true
+	} else {
+		delete(r.logins, login)
+	}
+
+	return r.save()
+}
+
+// save writes the registry to its file, if any
+func (r *mentionOptOuts) save() error {
+	if r.store != nil || r.path == "" {
+		return nil
+	}
+
+	logins := make([]string, 0, len(r.logins))
+	for login := range r.logins {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	content, err := json.MarshalIndent(logins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// don't leave a truncated registry behind a crash
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".mention-opt-outs-*")
+	if err != nil {
+		return errors.Wrap(err, "failed saving the mention opt-outs")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed saving the mention opt-outs")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed saving the mention opt-outs")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), r.path), "failed saving the mention opt-outs")
+}
+
+// isOptedOut returns whether the user opted out of the mentions
+func (r *mentionOptOuts) isOptedOut(login string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.logins[strings.ToLower(login)]
+}
+
+// mention returns the @mention of the user, or their
+// plain login when they opted out of the mentions
+func (r *mentionOptOuts) mention(login string) string {
+	if r.isOptedOut(login) {
+		return inlineCode(login)
+	}
+	return "@" + login
+}
+
+// isSelfServiceCommand returns whether the command only affects
+// its author, so that anyone may run it regardless of the access policy
+func isSelfServiceCommand(cmd *command) bool {
+	return cmd.name == ciHelperCommand && len(cmd.args) > 0 &&
+		(cmd.args[0] == unsubscribeCommand || cmd.args[0] == subscribeCommand)
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	MetricsRoute                  string = "/metrics"
+	otherLabelValue                      = "other"
+	defaultMetricsTopRepos               = 50
+	defaultMetricsTopSuites              = 50
+	defaultMetricsTestNameBuckets        = 256
+)
+
+// labelGuard bounds the number of distinct values of a metric label:
+// the first 'limit' values seen are kept, any other value is reported
+// as "other". A limit <= 0 disables the guard
+type labelGuard struct {
+	mu       sync.Mutex
+	limit    int
+	admitted map[string]bool
+}
+
+func newLabelGuard(limit int) *labelGuard {
+	return &labelGuard{limit: limit, admitted: map[string]bool{}}
+}
+
+func (g *labelGuard) value(v string) string {
+	if g.limit <= 0 {
+		return v
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.admitted[v] {
+		return v
+	}
+	if len(g.admitted) < g.limit {
+		g.admitted[v] = true
+		return v
+	}
+	return otherLabelValue
+}
+
+// testNameLabel hashes the given test name into one of 'buckets'
+// buckets, so that the label's value stays short and its cardinality
+// bounded however many tests fail
+func testNameLabel(testName string, buckets int) string {
+	h := fnv.New32a()
+	h.Write([]byte(testName))
+	return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(buckets))
+}
+
+// failureMetrics exports the failures found by the analyses as
+// Prometheus metrics, guarding the cardinality of their labels
+type failureMetrics struct {
+	registry        *prometheus.Registry
+	repos           *labelGuard
+	suites          *labelGuard
+	testNameBuckets int
+
+	analyses        *prometheus.CounterVec
+	failedTestCases *prometheus.CounterVec
+}
+
+func newFailureMetrics(cfg MetricsConfig) *failureMetrics {
+	topRepos := cfg.TopRepositories
+	if topRepos == 0 {
+		topRepos = defaultMetricsTopRepos
+	}
+	topSuites := cfg.TopSuites
+	if topSuites == 0 {
+		topSuites = defaultMetricsTopSuites
+	}
+	testNameBuckets := cfg.TestNameBuckets
+	if testNameBuckets <= 0 {
+		testNameBuckets = defaultMetricsTestNameBuckets
+	}
+
+	m := &failureMetrics{
+		registry:        prometheus.NewRegistry(),
+		repos:           newLabelGuard(topRepos),
+		suites:          newLabelGuard(topSuites),
+		testNameBuckets: testNameBuckets,
+		analyses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_analyses_total",
+			Help: "Number of analysed Prow jobs.",
+		}, []string{"repository"}),
+		failedTestCases: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_failed_test_cases_total",
+			Help: "Number of failed test cases found by the analyses, test names are hashed into buckets.",
+		}, []string{"repository", "suite", "test"}),
+	}
+	m.registry.MustRegister(m.analyses, m.failedTestCases)
+
+	return m
+}
+
+// observe records an analysis of the given repository's Prow job
+func (m *failureMetrics) observe(repoFullName string, failedTestCases []failedTestCase) {
+	repo := m.repos.value(repoFullName)
+	m.analyses.WithLabelValues(repo).Inc()
+
+	for _, tc := range failedTestCases {
+		if tc.name == "" {
+			continue
+		}
+		m.failedTestCases.WithLabelValues(repo, m.suites.value(tc.suiteName), testNameLabel(tc.name, m.testNameBuckets)).Inc()
+	}
+}
+
+func (m *failureMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
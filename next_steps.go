@@ -0,0 +1,112 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+const (
+	failureKindInfra       = "infra"
+	failureKindClusterPool = "cluster-pool"
+	failureKindBootstrap   = "bootstrap"
+	failureKindImageBuild  = "image-build"
+	failureKindE2E         = "e2e"
+	failureKindPolicy      = "policy"
+)
+
+// failureKinds are the kinds the jobs' failures are classified as
+var failureKinds = []string{failureKindInfra, failureKindClusterPool, failureKindBootstrap, failureKindImageBuild, failureKindE2E, failureKindPolicy}
+
+// nextStepRule suggests what the PR author should do next
+// when the report matches the rule
+type nextStepRule struct {
+	name    string
+	matches func(failedTCReport *FailedTestCasesReport) bool
+	text    string
+}
+
+// nextStepRules are evaluated in order, the first matching rule wins
+var nextStepRules = []nextStepRule{
+	{
+		name:    failureKindClusterPool,
+		matches: isFailureKind(failureKindClusterPool),
+		text:    ":construction: No cluster could be claimed from the pool, `/retest` won't help until the pool has ready clusters again. If it doesn't recover, escalate it to the CI infrastructure team.",
+	},
+	{
+		name:    failureKindInfra,
+		matches: isFailureKind(failureKindInfra),
+		text:    ":recycle: This looks like an infrastructure failure unrelated to your changes, comment `/retest` to re-run the job. If it keeps failing, please consult with the QE team.",
+	},
+	{
+		name:    failureKindBootstrap,
+		matches: isFailureKind(failureKindBootstrap),
+		text:    ":recycle: The cluster failed to bootstrap, which is unrelated to your changes. Comment `/retest` to re-run the job.",
+	},
+	{
+		name:    failureKindImageBuild,
+		matches: isFailureKind(failureKindImageBuild),
+		text:    ":hammer_and_wrench: Fix the failing build step shown above and push the changes.",
+	},
+	{
+		name:    failureKindPolicy,
+		matches: isFailureKind(failureKindPolicy),
+		text:    ":hammer_and_wrench: Fix the violated policy rules following the solutions above, or request an exception for them.",
+	},
+	{
+		name:    "failing-on-main",
+		matches: allFailingOnMain,
+		text:    ":recycle: All the failed spec(s) also fail on `main`, so they're likely unrelated to your changes. Comment `/retest` once they're fixed there.",
+	},
+	{
+		name:    failureKindE2E,
+		matches: isFailureKind(failureKindE2E),
+		text:    ":hammer_and_wrench: If the failed spec(s) cover your changes, fix them and push. Otherwise they may be flaky, comment `/retest` to re-run the job.",
+	},
+}
+
+// nextStep returns the text of the first rule matching the report,
+// preferring the repository's override of that rule's text if any
+func nextStep(failedTCReport *FailedTestCasesReport, overrides map[string]string) string {
+	for _, rule := range nextStepRules {
+		if !rule.matches(failedTCReport) {
+			continue
+		}
+		if text, ok := overrides[rule.name]; ok {
+			return text
+		}
+		return rule.text
+	}
+
+	return ""
+}
+
+func isFailureKind(kind string) func(*FailedTestCasesReport) bool {
+	return func(failedTCReport *FailedTestCasesReport) bool {
+		return failedTCReport.failureKind == kind
+	}
+}
+
+// allFailingOnMain returns whether each of the failed test
+// cases also failed within the latest run on the main branch
+func allFailingOnMain(failedTCReport *FailedTestCasesReport) bool {
+	found := false
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		if !tc.failingOnMain {
+			return false
+		}
+		found = true
+	}
+	return found
+}
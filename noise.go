@@ -0,0 +1,51 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+const (
+	// the report's failures are all known issues, or also fail on main
+	severityKnown = "known"
+	// at least one of the report's failures isn't known
+	severityNew = "new"
+)
+
+// severity returns the severity of the report's failures
+func (failedTCReport *FailedTestCasesReport) severity() string {
+	for _, tc := range failedTCReport.failedTestCases {
+		if !tc.knownIssue && !tc.failingOnMain {
+			return severityNew
+		}
+	}
+	return severityKnown
+}
+
+// belowNoiseThresholds returns why the report isn't worth updating the PR's
+// comment with, according to the repository's thresholds, or "" if it is.
+// The failures are recorded (and counted in the metrics) either way
+func (failedTCReport *FailedTestCasesReport) belowNoiseThresholds(repoConfig RepositoryConfig) string {
+	failures := len(failedTCReport.failedTestCases)
+	if failures == 0 {
+		return ""
+	}
+	if failures < repoConfig.MinFailures {
+		return fmt.Sprintf("it has %d failure(s), below the repository's threshold of %d", failures, repoConfig.MinFailures)
+	}
+	if repoConfig.MinSeverity == severityNew && failedTCReport.severity() == severityKnown {
+		return "all of its failures are known issues or also fail on main"
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"strings"
+)
+
+// the public URL of the objects of the Prow artifacts bucket
+const gcsPublicURL = "https://storage.googleapis.com/"
+
+// ocSnippetNote renders copy-pasteable commands inspecting the CR, both as
+// gathered by the job (from the given object) and on a live cluster
+func ocSnippetNote(cr *gatheredCR, ref crReference, object string) string {
+	resource := ref.kind
+	if dirs := crKindDirectories[ref.kind]; len(dirs) > 0 {
+		// the fully qualified resource, e.g. pipelineruns.tekton.dev
+		resource = dirs[len(dirs)-1]
+	}
+	kind := cr.Kind
+	if kind == "" {
+		kind = ref.kind
+	}
+	name := cr.Metadata.Name
+	namespace := ""
+	if cr.Metadata.Namespace != "" {
+		namespace = " -n " + cr.Metadata.Namespace
+	}
+
+	var commands []string
+	commands = append(commands, fmt.Sprintf("# the %s as gathered by the job", kind))
+	download := fmt.Sprintf("curl -sSL %s%s/%s", gcsPublicURL, prowArtifactsBucketName, object)
+	if strings.TrimSuffix(path.Base(object), path.Ext(object)) != name {
+		// the object lists all the CRs of the kind
+		download = download + fmt.Sprintf(" | yq '.items[] | select(.metadata.name == %q)'", name)
+	}
+	commands = append(commands, download, "",
+		"# on a cluster reproducing the failure",
+		fmt.Sprintf("oc get %s %s%s -o yaml", resource, name, namespace),
+		fmt.Sprintf("oc describe %s %s%s", resource, name, namespace))
+	if namespace != "" {
+		commands = append(commands, fmt.Sprintf("oc get events%s --sort-by=.lastTimestamp", namespace))
+	}
+
+	return fmt.Sprintf("<details>\n<summary>:computer: Inspect the %s <code>%s</code> with <code>oc</code></summary>\n\n%s\n</details>",
+		html.EscapeString(kind), html.EscapeString(name), codeBlock(strings.Join(commands, "\n")))
+}
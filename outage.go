@@ -0,0 +1,157 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const OutageRoute string = "/admin/outage"
+
+var errReadOnly = errors.New("the app is read-only, the write to GitHub was skipped")
+
+// outageMode switches the app to read-only, e.g. during an incident or when a
+// report's formatting is broken in production: the events are still analysed
+// and the analyses stored, but nothing gets written to GitHub
+type outageMode struct {
+	mu       sync.Mutex
+	readOnly bool
+	reason   string
+	since    time.Time
+	// number of writes skipped since the app was switched to read-only
+	skipped int
+}
+
+type outageStatus struct {
+	ReadOnly bool       `json:"read_only"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	Skipped  int        `json:"skipped_writes"`
+}
+
+func newOutageMode(cfg OutageConfig) *outageMode {
+	m := &outageMode{}
+	if cfg.ReadOnly {
+		m.set(true, "set by the configuration")
+	}
+	return m
+}
+
+// isReadOnly returns whether the writes to GitHub are paused, a nil mode never pauses them
+func (m *outageMode) isReadOnly() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.readOnly
+}
+
+func (m *outageMode) set(readOnly bool, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if readOnly != m.readOnly {
+		m.since = time.Now()
+		m.skipped = 0
+	}
+	m.readOnly = readOnly
+	m.reason = reason
+}
+
+func (m *outageMode) status() outageStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := outageStatus{ReadOnly: m.readOnly, Reason: m.reason, Skipped: m.skipped}
+	if m.readOnly {
+		since := m.since
+		status.Since = &since
+	}
+	return status
+}
+
+// skip returns whether the request writes to GitHub while the app is read-only.
+// The GraphQL queries are POST requests too, but the app doesn't send any
+func (m *outageMode) skip(req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readOnly {
+		m.skipped++
+	}
+	return m.readOnly
+}
+
+// readOnlyTransport fails the writes of the GitHub clients while the app is read-only
+type readOnlyTransport struct {
+	base   http.RoundTripper
+	outage *outageMode
+	logger zerolog.Logger
+}
+
+// outageMiddleware pauses the GitHub clients' writes while the app is read-only,
+// whichever feature sends them. The installation tokens are still refreshed, as
+// the middleware wraps the transport authenticating the requests
+func outageMiddleware(m *outageMode, logger zerolog.Logger) githubapp.ClientMiddleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &readOnlyTransport{base: next, outage: m, logger: logger}
+	}
+}
+
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.outage.skip(req) {
+		t.logger.Info().Msgf("The app is read-only, skipping %s %s", req.Method, req.URL.Path)
+		return nil, errReadOnly
+	}
+	return t.base.RoundTrip(req)
+}
+
+// OutageHandler returns whether the app is read-only, and switches
+// it with a POST request, e.g. "?read_only=true&reason=INC-123"
+type OutageHandler struct {
+	Outage *outageMode
+	Logger zerolog.Logger
+}
+
+func (h *OutageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		readOnly, err := strconv.ParseBool(r.URL.Query().Get("read_only"))
+		if err != nil {
+			http.Error(w, "the 'read_only' query parameter must be a boolean", http.StatusBadRequest)
+			return
+		}
+		h.Outage.set(readOnly, r.URL.Query().Get("reason"))
+		h.Logger.Warn().Msgf("Switched the app's read-only mode to %t: %s", readOnly, r.URL.Query().Get("reason"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Outage.status()); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to encode the outage mode's status")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultAnalysisAttempts = 3
+	defaultAnalysisBackoff  = 30 * time.Second
+
+	// the suite and status of the records of the analyses which panicked
+	analysisPanicSuiteName = "ci-helper"
+	analysisPanicStatus    = "analysis-panicked"
+)
+
+// analysisPanic is the error of an analysis which panicked, e.g.
+// when parsing malformed artifacts
+type analysisPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *analysisPanic) Error() string {
+	return fmt.Sprintf("the analysis panicked: %v", p.value)
+}
+
+// runContained runs the analysis, turning its panic (if any) into an *analysisPanic
+func runContained(ctx context.Context, analyze func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &analysisPanic{value: r, stack: debug.Stack()}
+		}
+	}()
+	return analyze(ctx)
+}
+
+// analyzeContained runs the analysis, retrying it with an exponential backoff
+// when it panics. Once the attempts are exhausted, the panic is recorded within
+// the store and a notice posted to the PR, instead of dropping the event silently.
+// The analyses run within the webhook's requests (i.e. without the work queue)
+// aren't retried, as the backoff would hold the request past GitHub's timeout
+func (h *PRCommentHandler) analyzeContained(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, deliveryID, prowJobURL string, analyze func(ctx context.Context) error) error {
+	attempts, backoff := 1, defaultAnalysisBackoff
+	if h.Queue != nil {
+		attempts = defaultAnalysisAttempts
+	}
+	if h.Queue != nil && h.Config != nil {
+		if h.Config.AnalysisRetries.Attempts > 0 {
+			attempts = h.Config.AnalysisRetries.Attempts
+		}
+		if h.Config.AnalysisRetries.Backoff > 0 {
+			backoff = h.Config.AnalysisRetries.Backoff
+		}
+	}
+
+	var p *analysisPanic
+	for attempt := 1; ; attempt++ {
+		err := runContained(ctx, analyze)
+		if !errors.As(err, &p) {
+			return err
+		}
+		logger.Error().Str("stack", string(p.stack)).Msgf("The analysis panicked (attempt %d of %d): %v", attempt, attempts, p.value)
+		h.Telemetry.countError("analysis:panic")
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	h.recordAnalysisPanic(ctx, logger, event, prowJobURL, p)
+	body := fmt.Sprintf(":warning: **ci-helper-app failed to analyse [the Prow job](%s) internally**, after %d attempt(s). "+
+		"Its maintainers can find the details within the app's logs of the delivery `%s`.", prowJobURL, attempts, deliveryID)
+	if _, _, err := client.Issues.CreateComment(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber(), &github.IssueComment{Body: &body}); err != nil {
+		logger.Error().Err(err).Msg("Failed to post the notice of the failed analysis")
+	}
+
+	return p
+}
+
+// recordAnalysisPanic records the failed analysis within the store, so
+// that the jobs the app can't analyse show up within its exports
+func (h *PRCommentHandler) recordAnalysisPanic(ctx context.Context, logger zerolog.Logger, event github.IssueCommentEvent, prowJobURL string, p *analysisPanic) {
+	if h.Store == nil {
+		return
+	}
+
+	record := FailureRecord{
+		Timestamp:   time.Now(),
+		Repository:  event.GetRepo().GetFullName(),
+		PullRequest: event.GetIssue().GetNumber(),
+		ProwJobURL:  prowJobURL,
+		SuiteName:   analysisPanicSuiteName,
+		TestCase:    jobNameFromProwJobURL(prowJobURL),
+		Status:      analysisPanicStatus,
+		Message:     fmt.Sprint(p.value),
+	}
+	if err := h.Store.RecordFailures(ctx, []FailureRecord{record}); err != nil {
+		logger.Error().Err(err).Msg("Failed to record the failed analysis")
+	}
+}
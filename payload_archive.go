@@ -0,0 +1,247 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	PayloadsRoute           string = "/admin/payloads/"
+	archivedPayloadSuffix          = ".json.gz"
+	defaultPayloadRetention        = 30 * 24 * time.Hour
+	scrubbedValue                  = "<scrubbed>"
+)
+
+var (
+	deliveryIDRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+	emailRegex      = regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`)
+	// keys of the payload whose values are always scrubbed
+	piiKeys = map[string]bool{"email": true}
+)
+
+// archivedPayload is the content of an archived webhook delivery
+type archivedPayload struct {
+	DeliveryID string          `json:"delivery_id"`
+	EventType  string          `json:"event_type"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// payloadArchive stores the (scrubbed, gzipped) webhook
+// payloads within a directory, one file per delivery
+type payloadArchive struct {
+	dir       string
+	retention time.Duration
+	logger    zerolog.Logger
+}
+
+func newPayloadArchive(cfg PayloadArchiveConfig, logger zerolog.Logger) (*payloadArchive, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, errors.Wrapf(err, "failed creating the payload archive directory: %s", cfg.Dir)
+	}
+
+	retention := cfg.Retention
+	if retention == 0 {
+		retention = defaultPayloadRetention
+	}
+
+	return &payloadArchive{dir: cfg.Dir, retention: retention, logger: logger}, nil
+}
+
+// store archives the payload of the given delivery
+func (a *payloadArchive) store(deliveryID, eventType string, payload []byte) error {
+	if !deliveryIDRegex.MatchString(deliveryID) {
+		return fmt.Errorf("invalid delivery ID: %q", deliveryID)
+	}
+
+	scrubbed, err := scrubPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(archivedPayload{
+		DeliveryID: deliveryID,
+		EventType:  eventType,
+		ReceivedAt: time.Now().UTC(),
+		Payload:    scrubbed,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(a.dir, deliveryID+archivedPayloadSuffix))
+	if err != nil {
+		return errors.Wrap(err, "failed creating the archive file")
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(content); err != nil {
+		return errors.Wrap(err, "failed writing the archive file")
+	}
+	return zw.Close()
+}
+
+// load returns the archived payload of the given delivery
+func (a *payloadArchive) load(deliveryID string) (*archivedPayload, error) {
+	if !deliveryIDRegex.MatchString(deliveryID) {
+		return nil, fmt.Errorf("invalid delivery ID: %q", deliveryID)
+	}
+
+	f, err := os.Open(filepath.Join(a.dir, deliveryID+archivedPayloadSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading the archive file")
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading the archive file")
+	}
+
+	p := &archivedPayload{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, errors.Wrap(err, "failed parsing the archive file")
+	}
+	return p, nil
+}
+
+// runRetention removes the payloads older than the retention period, every hour
+func (a *payloadArchive) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	a.removeExpired()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.removeExpired()
+		}
+	}
+}
+
+func (a *payloadArchive) removeExpired() {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Failed to list the archived payloads")
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), archivedPayloadSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < a.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir, entry.Name())); err != nil {
+			a.logger.Error().Err(err).Msgf("Failed to remove the archived payload %s", entry.Name())
+		}
+	}
+}
+
+// scrubPayload replaces e-mail addresses and the values of
+// the 'piiKeys' within the given JSON payload
+func scrubPayload(payload []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, errors.Wrap(err, "failed parsing the payload")
+	}
+	return json.Marshal(scrubValue(v))
+}
+
+func scrubValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			if piiKeys[strings.ToLower(k)] && item != nil {
+				value[k] = scrubbedValue
+				continue
+			}
+			value[k] = scrubValue(item)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = scrubValue(item)
+		}
+		return value
+	case string:
+		return emailRegex.ReplaceAllString(value, scrubbedValue)
+	default:
+		return value
+	}
+}
+
+// archivingEventHandler archives the payloads of the events
+// before passing them to the wrapped handler
+type archivingEventHandler struct {
+	githubapp.EventHandler
+	archive *payloadArchive
+}
+
+func (h *archivingEventHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	if err := h.archive.store(deliveryID, eventType, payload); err != nil {
+		h.archive.logger.Error().Err(err).Msgf("Failed to archive the payload of the delivery %s", deliveryID)
+	}
+	return h.EventHandler.Handle(ctx, eventType, deliveryID, payload)
+}
+
+// PayloadsHandler serves the archived payload of
+// the delivery given by the path, e.g. /admin/payloads/<ID>
+type PayloadsHandler struct {
+	Archive *payloadArchive
+}
+
+func (h *PayloadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	deliveryID := strings.TrimPrefix(r.URL.Path, PayloadsRoute)
+
+	p, err := h.Archive.load(deliveryID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		h.Archive.logger.Error().Err(err).Msg("Failed to write the archived payload")
+	}
+}
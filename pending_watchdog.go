@@ -0,0 +1,194 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultPendingThreshold        = 4 * time.Hour
+	defaultPendingWatchdogInterval = 15 * time.Minute
+	// pending jobs are forgotten after this long, noticed or not
+	pendingJobMaxAge = 48 * time.Hour
+)
+
+// pendingJob is a Prow job whose commit status was last reported as pending
+type pendingJob struct {
+	installationID int64
+	owner          string
+	repo           string
+	sha            string
+	context        string
+	targetURL      string
+	since          time.Time
+	noticed        bool
+}
+
+// pendingWatchdog notices the Prow jobs whose commit status stays pending
+// for too long (e.g. a lost webhook, a Prow hiccup), and tells the
+// authors of their PRs, which would otherwise wait silently
+type pendingWatchdog struct {
+	clientCreator githubapp.ClientCreator
+	config        PendingWatchdogConfig
+	mentions      *mentionOptOuts
+	logger        zerolog.Logger
+
+	mu      sync.Mutex
+	pending map[string]*pendingJob
+}
+
+func newPendingWatchdog(cc githubapp.ClientCreator, cfg PendingWatchdogConfig, mentions *mentionOptOuts, logger zerolog.Logger) *pendingWatchdog {
+	if cfg.Threshold == 0 {
+		cfg.Threshold = defaultPendingThreshold
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultPendingWatchdogInterval
+	}
+
+	return &pendingWatchdog{
+		clientCreator: cc,
+		config:        cfg,
+		mentions:      mentions,
+		logger:        logger,
+		pending:       map[string]*pendingJob{},
+	}
+}
+
+// observe tracks the pending Prow jobs reported by the status event
+func (w *pendingWatchdog) observe(event github.StatusEvent) {
+	owner, repo := event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName()
+	key := fmt.Sprintf("%s/%s@%s/%s", owner, repo, event.GetSHA(), event.GetContext())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if event.GetState() != "pending" {
+		delete(w.pending, key)
+		return
+	}
+	// a job re-triggered for the same commit stays pending since its first report
+	if job, ok := w.pending[key]; ok {
+		job.targetURL = event.GetTargetURL()
+		return
+	}
+	w.pending[key] = &pendingJob{
+		installationID: githubapp.GetInstallationIDFromEvent(&event),
+		owner:          owner,
+		repo:           repo,
+		sha:            event.GetSHA(),
+		context:        event.GetContext(),
+		targetURL:      event.GetTargetURL(),
+		since:          time.Now(),
+	}
+}
+
+// run checks the pending jobs every configured interval until the context is done
+func (w *pendingWatchdog) run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, job := range w.overdue() {
+				if err := w.notice(ctx, job); err != nil {
+					w.logger.Error().Err(err).Msgf("Failed to notice the pending job %s of %s/%s", job.context, job.owner, job.repo)
+				}
+			}
+		}
+	}
+}
+
+// overdue returns the jobs pending for longer than the threshold which
+// weren't noticed yet, and forgets the ones pending for far too long
+func (w *pendingWatchdog) overdue() []*pendingJob {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var jobs []*pendingJob
+	for key, job := range w.pending {
+		age := time.Since(job.since)
+		if age > pendingJobMaxAge {
+			delete(w.pending, key)
+			continue
+		}
+		if !job.noticed && age > w.config.Threshold {
+			job.noticed = true
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// notice comments on the open PRs of the job's commit, unless
+// GitHub shows the job isn't pending anymore (e.g. the status
+// event reporting its completion was lost)
+func (w *pendingWatchdog) notice(ctx context.Context, job *pendingJob) error {
+	client, err := w.clientCreator.NewInstallationClient(job.installationID)
+	if err != nil {
+		return err
+	}
+
+	statuses, _, err := client.Repositories.GetCombinedStatus(ctx, job.owner, job.repo, job.sha, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses.Statuses {
+		if status.GetContext() == job.context && status.GetState() != "pending" {
+			w.logger.Debug().Msgf("The job %s of %s/%s@%s isn't pending anymore", job.context, job.owner, job.repo, job.sha)
+			return nil
+		}
+	}
+
+	prs, _, err := client.PullRequests.ListPullRequestsWithCommit(ctx, job.owner, job.repo, job.sha, &github.ListOptions{PerPage: 10})
+	if err != nil {
+		return err
+	}
+	for _, pr := range prs {
+		if pr.GetState() != "open" || pr.GetHead().GetSHA() != job.sha {
+			continue
+		}
+		body := w.mentions.mention(pr.GetUser().GetLogin()) + " " + job.noticeBody(w.config.Threshold)
+		if _, _, err := client.Issues.CreateComment(ctx, job.owner, job.repo, pr.GetNumber(), &github.IssueComment{Body: &body}); err != nil {
+			return err
+		}
+		w.logger.Info().Msgf("Noticed the pending job %s on %s/%s#%d", job.context, job.owner, job.repo, pr.GetNumber())
+	}
+
+	return nil
+}
+
+// noticeBody renders the comment telling the job seems stuck
+func (job *pendingJob) noticeBody(threshold time.Duration) string {
+	name := strings.TrimPrefix(job.context, prowStatusContextPrefix)
+
+	body := fmt.Sprintf(":hourglass: The job `%s` has been pending for more than %s. Its result may have been lost, or Prow may have hit a hiccup.\n",
+		name, threshold)
+	if job.targetURL != "" {
+		body = body + fmt.Sprintf("\nCheck its state on [Deck](%s). ", job.targetURL)
+	}
+	return body + fmt.Sprintf("If it isn't running anymore, comment `/test %s` to rerun it.\n", name)
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/rs/zerolog"
+)
+
+const (
+	pingCommand = "ping"
+)
+
+// handleCIHelperPing replies with the diagnostics of the app, as seen by the PR
+func (h *PRCommentHandler) handleCIHelperPing(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent) error {
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	prNumber := event.GetIssue().GetNumber()
+
+	body := h.pingReply(event)
+	if _, _, err := client.Issues.CreateComment(ctx, repoOwner, repoName, prNumber, &github.IssueComment{Body: &body}); err != nil {
+		return fmt.Errorf("failed to reply to the ping: %+v", err)
+	}
+	logger.Debug().Msg("Replied to the ping")
+
+	return nil
+}
+
+// pingReply renders the app's version, configuration, features and workload
+func (h *PRCommentHandler) pingReply(event github.IssueCommentEvent) string {
+	repoFullName := event.GetRepo().GetFullName()
+	repoConfig := h.repositoryConfig(repoFullName)
+
+	subsystems := enabledSubsystems(h.Config)
+	sort.Strings(subsystems)
+	features := "none"
+	if len(subsystems) > 0 {
+		features = inlineCode(strings.Join(subsystems, ", "))
+	}
+
+	onHold, holdLabel := h.onHoldPolicy(event)
+	held := "no"
+	if holdLabel != "" {
+		held = fmt.Sprintf("yes (%s), analysed in the %s format", inlineCode(holdLabel), onHold)
+		if onHold == onHoldSkip {
+			held = fmt.Sprintf("yes (%s), not analysed", inlineCode(holdLabel))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, ":ping_pong: **ci-helper-app** `%s` is alive\n\n", appVersion)
+	b.WriteString("| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Configuration | `%s` |\n", h.Config.hash)
+	fmt.Fprintf(&b, "| Features | %s |\n", features)
+	fmt.Fprintf(&b, "| Report format | %s |\n", h.reportFormat(repoFullName, event.GetIssue().GetNumber()))
+	fmt.Fprintf(&b, "| On hold | %s |\n", held)
+	fmt.Fprintf(&b, "| Link templates | %d |\n", len(repoConfig.LinkTemplates))
+	if h.Dependencies != nil {
+		if states := h.Dependencies.states(); len(states) > 0 {
+			fmt.Fprintf(&b, "| Dependencies | %s |\n", strings.Join(states, ", "))
+		}
+	}
+	if h.Workload != nil {
+		status := h.Workload.status()
+		fmt.Fprintf(&b, "| Queue | %d event(s) in flight, the oldest for %s, %.1f received/min |\n",
+			status.InFlight, (time.Duration(status.OldestInFlightSeconds) * time.Second).String(), status.ReceivedPerMinute)
+	}
+
+	return b.String()
+}
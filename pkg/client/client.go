@@ -0,0 +1,231 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client calls the API of ci-helper-app, e.g.
+//
+//	c := client.New("https://ci-helper.example.com", client.WithToken(token))
+//	analysis, err := c.GetAnalysis(ctx, "konflux-ci/e2e-tests", 1234)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = time.Second
+	defaultTimeout = 30 * time.Second
+)
+
+// ErrNotFound is returned when the app has no such resource, e.g. no recent analysis of the PR
+var ErrNotFound = errors.New("not found")
+
+// APIError is a response of the app with an unexpected status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ci-helper-app responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// Client calls the API of a ci-helper-app instance, retrying the
+// requests failing with a network error or a 429 and 5xx status. The
+// POST requests, which aren't idempotent, are only retried on a 429
+// or 503 status, with which the app rejects them without acting on them
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken authenticates the requests with the app's API token
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient sends the requests with the given HTTP client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries sets how many times the failed requests are retried, and the delay
+// before the first retry, doubled for each of the next ones
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// New returns a client of the app served at the given base URL
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// TriggerAnalysis asks the app to analyse the PR's failure comment. The
+// analysis is queued, its report updating the comment, and the request
+// is retried while the app's queue is full
+func (c *Client) TriggerAnalysis(ctx context.Context, req TriggerAnalysisRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, AnalysesPath, nil, body, nil)
+}
+
+// GetAnalysis returns the latest analysis of the PR, or ErrNotFound
+func (c *Client) GetAnalysis(ctx context.Context, repository string, pullRequest int) (*Analysis, error) {
+	query := url.Values{}
+	query.Set("repository", repository)
+	query.Set("pull_request", strconv.Itoa(pullRequest))
+
+	// the analyses served by older versions of the app are converted to the current schema
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, AnalysesPath, query, nil, &raw); err != nil {
+		return nil, err
+	}
+	return DecodeAnalysis(raw)
+}
+
+// QueryFlakes returns the test cases which failed on several PRs, the most widespread first
+func (c *Client) QueryFlakes(ctx context.Context, q FlakesQuery) ([]Flake, error) {
+	query := url.Values{}
+	if q.Repository != "" {
+		query.Set("repository", q.Repository)
+	}
+	if !q.From.IsZero() {
+		query.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		query.Set("to", q.To.Format(time.RFC3339))
+	}
+	if q.MinPullRequests > 0 {
+		query.Set("min_pull_requests", strconv.Itoa(q.MinPullRequests))
+	}
+
+	var flakes []Flake
+	if err := c.do(ctx, http.MethodGet, FlakesPath, query, nil, &flakes); err != nil {
+		return nil, err
+	}
+	return flakes, nil
+}
+
+// GetFailureMessage returns the full message of a recorded failure, given
+// its reference in the cold storage, or ErrNotFound
+func (c *Client) GetFailureMessage(ctx context.Context, ref string) (*FailureMessage, error) {
+	query := url.Values{}
+	query.Set("ref", ref)
+
+	message := &FailureMessage{}
+	if err := c.do(ctx, http.MethodGet, FailureMessagesPath, query, nil, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// do sends the request, retrying it when it may succeed later, and decodes the response into 'out'
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	backoff := c.backoff
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		retry, err := c.send(ctx, method, target, body, out)
+		if err == nil || !retry {
+			return err
+		}
+		lastErr = err
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", c.retries+1, lastErr)
+}
+
+// send sends the request once, and returns whether it's worth retrying on failure
+func (c *Client) send(ctx context.Context, method, target string, body []byte, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	// a POST whose outcome is unknown may have been acted on
+	idempotent := method != http.MethodPost
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return idempotent && ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, ErrNotFound
+	case resp.StatusCode >= 300:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		rejected := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		return rejected || (idempotent && resp.StatusCode >= 500), err
+	}
+
+	if out == nil {
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("failed to decode the response: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// the type of the node Ginkgo v2 prefixes the specs' names with, e.g. "[It] "
+	ginkgoNodeTypeRegex = regexp.MustCompile(`^\[(It|BeforeEach|AfterEach|JustBeforeEach|JustAfterEach|BeforeAll|AfterAll)\]\s+`)
+	// the labels (e.g. "[build-service, slow]") and the tags of Ginkgo v1 (e.g. "[sig-build]"),
+	// the brackets within the words (e.g. "items[0]") being part of the name
+	testNameLabelsRegex = regexp.MustCompile(`(?:^|\s)\[([^\[\]]+)\]`)
+)
+
+// NormalizeTestName returns the name of the test case regardless of the
+// Ginkgo version which reported it: without the type of its node, and with
+// its labels (or tags) sorted at its end, e.g. both "[It] Build should pass
+// [slow, build-service]" and "Build [build-service] should pass [slow]" are
+// "Build should pass [build-service] [slow]". The names without labels are
+// left as they are, apart from their whitespace
+func NormalizeTestName(name string) string {
+	name = ginkgoNodeTypeRegex.ReplaceAllString(strings.TrimSpace(name), "")
+
+	seen := map[string]bool{}
+	var labels []string
+	for _, m := range testNameLabelsRegex.FindAllStringSubmatch(name, -1) {
+		for _, label := range strings.Split(m[1], ",") {
+			if label = strings.TrimSpace(label); label != "" && !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	name = strings.Join(strings.Fields(testNameLabelsRegex.ReplaceAllString(name, " ")), " ")
+	if len(labels) == 0 {
+		return name
+	}
+
+	sort.Strings(labels)
+	return name + " [" + strings.Join(labels, "] [") + "]"
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// AnalysisSchemaVersion is the version of the Analysis' JSON the app
+// produces. The analyses of the older versions, which lack the
+// 'schema_version' field for the first one, are converted on decoding:
+//
+//	1: the initial schema
+//	2: adds the failures' fingerprint and the report's links
+const AnalysisSchemaVersion = 2
+
+// analysisConverters upgrade the JSON object of an analysis from
+// the version they're keyed by to the next one
+var analysisConverters = map[int]func(analysis map[string]interface{}) error{
+	1: convertAnalysisV1,
+}
+
+// Fingerprint identifies a failure across Prow job runs, and across analyses.
+// The test case's name is normalized (see NormalizeTestName), so that the
+// fingerprint doesn't change when the suite bumps its Ginkgo version
+func Fingerprint(suite, name string) string {
+	sum := sha256.Sum256([]byte(suite + "\x00" + NormalizeTestName(name)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// LegacyFingerprint is the fingerprint of the failure from before the test
+// cases' names were normalized, which the markers written back then (e.g.
+// within the auto-filed issues and Jira tickets) still carry
+func LegacyFingerprint(suite, name string) string {
+	sum := sha256.Sum256([]byte(suite + "\x00" + name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// DecodeAnalysis parses the JSON of an analysis of any schema version up to
+// AnalysisSchemaVersion, converting the older ones to the current schema
+func DecodeAnalysis(data []byte) (*Analysis, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if v, ok := object["schema_version"].(float64); ok {
+		version = int(v)
+	}
+	if version < 1 || version > AnalysisSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d of the analysis, the latest known being %d", version, AnalysisSchemaVersion)
+	}
+	for ; version < AnalysisSchemaVersion; version++ {
+		if err := analysisConverters[version](object); err != nil {
+			return nil, fmt.Errorf("failed to convert the analysis from schema version %d: %w", version, err)
+		}
+	}
+	object["schema_version"] = AnalysisSchemaVersion
+
+	converted, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	analysis := &Analysis{}
+	if err := json.Unmarshal(converted, analysis); err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// convertAnalysisV1 fingerprints the failures, which the first schema lacked
+func convertAnalysisV1(analysis map[string]interface{}) error {
+	failures, _ := analysis["failures"].([]interface{})
+	for _, f := range failures {
+		failure, ok := f.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid failure %v", f)
+		}
+		suite, _ := failure["suite"].(string)
+		name, _ := failure["name"].(string)
+		failure["fingerprint"] = Fingerprint(suite, name)
+	}
+	return nil
+}
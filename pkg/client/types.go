@@ -0,0 +1,93 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import "time"
+
+// the paths of the app's API
+const (
+	AnalysesPath        = "/api/v1/analyses"
+	FlakesPath          = "/api/v1/flakes"
+	FailureMessagesPath = "/api/v1/failure-messages"
+)
+
+// TriggerAnalysisRequest asks the app to analyse the failure comment of
+// a PR, as if it was just posted. The report updates the comment
+type TriggerAnalysisRequest struct {
+	// the repository's full name, e.g. "konflux-ci/e2e-tests"
+	Repository  string `json:"repository"`
+	PullRequest int    `json:"pull_request"`
+	// the ID of the comment reporting the Prow job's failure
+	CommentID int64 `json:"comment_id"`
+}
+
+// Analysis is the latest analysis of a PR's failed Prow job, in
+// the schema of the given version (see AnalysisSchemaVersion)
+type Analysis struct {
+	Repository  string    `json:"repository"`
+	PullRequest int       `json:"pull_request"`
+	ProwJobURL  string    `json:"prow_job_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Header      string    `json:"header"`
+	FailureKind string    `json:"failure_kind"`
+	Failures    []Failure `json:"failures"`
+	NextStep    string    `json:"next_step,omitempty"`
+	Links       []Link    `json:"links,omitempty"`
+	// the version of the analysis' schema
+	SchemaVersion int `json:"schema_version"`
+}
+
+// Failure is a failed test case found by an analysis
+type Failure struct {
+	Suite   string `json:"suite"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// identifies the failure across Prow job runs, see Fingerprint
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Link is a link of the analysis' report, e.g. to the job's logs or its rerun
+type Link struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// FlakesQuery selects the recorded failures the flakes are computed from
+type FlakesQuery struct {
+	// limits the failures to the repository's, when set
+	Repository string
+	// the time range of the failures, defaults to the last 7 days
+	From, To time.Time
+	// the test cases which failed on fewer PRs are left out, defaults to 2
+	MinPullRequests int
+}
+
+// Flake is a test case failing on several PRs, most likely regardless of their changes
+type Flake struct {
+	Suite        string    `json:"suite"`
+	Name         string    `json:"name"`
+	Failures     int       `json:"failures"`
+	PullRequests int       `json:"pull_requests"`
+	Repositories []string  `json:"repositories"`
+	LastFailure  time.Time `json:"last_failure"`
+}
+
+// FailureMessage is the full message of a recorded failure, which
+// the failure store only keeps the excerpt of
+type FailureMessage struct {
+	Ref     string `json:"ref"`
+	Message string `json:"message"`
+}
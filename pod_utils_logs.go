@@ -0,0 +1,171 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	sidecarLogsFileName = "sidecar-logs.json"
+	// the entrypoint logs why it stopped the step at the end of the step's build log
+	podUtilsLogTailSize = 64 * 1024
+)
+
+// podUtilsFailure is a failure of the pod utilities (the entrypoint wrapping
+// the step's process, the sidecar uploading its artifacts), found in their logs
+type podUtilsFailure struct {
+	component string
+	pattern   *regexp.Regexp
+	// formatted with the pattern's first group when it has one
+	cause string
+}
+
+// podUtilsFailures are matched in order against the pod utilities' log lines
+var podUtilsFailures = []podUtilsFailure{
+	{
+		component: "entrypoint",
+		pattern:   regexp.MustCompile(`Process did not finish before (\S+) timeout`),
+		cause:     "the step exceeded its %s timeout",
+	},
+	{
+		component: "entrypoint",
+		pattern:   regexp.MustCompile(`Process did not exit before (\S+) grace period`),
+		cause:     "the step didn't exit within its %s grace period once interrupted",
+	},
+	{
+		component: "entrypoint",
+		pattern:   regexp.MustCompile(`Entrypoint received interrupt: (\w+)`),
+		cause:     "the step was killed by the %s signal",
+	},
+	{
+		component: "sidecar",
+		pattern:   regexp.MustCompile(`(?i)upload.*(deadline exceeded|timed out|timeout)`),
+		cause:     "the sidecar timed out uploading the step's artifacts",
+	},
+	{
+		component: "sidecar",
+		pattern:   regexp.MustCompile(`(?i)failed to upload`),
+		cause:     "the sidecar failed to upload the step's artifacts",
+	},
+}
+
+// podUtilsLogLine is a line logged by the pod utilities, in logrus' JSON format
+type podUtilsLogLine struct {
+	Component string `json:"component"`
+	Msg       string `json:"msg"`
+	Error     string `json:"error"`
+}
+
+// diagnoseFailedSteps looks for the infrastructure causes of the failures of
+// the steps identified from ci-operator's junit (i.e. which didn't upload
+// their own junit) within the logs of their entrypoint and sidecar
+func (failedTCReport *FailedTestCasesReport) diagnoseFailedSteps(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner) {
+	if scanner.ArtifactDirectoryPrefix == "" {
+		return
+	}
+
+	var causes []string
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.suiteName != ciOperatorStepName {
+			continue
+		}
+		stepPrefix := scanner.ArtifactDirectoryPrefix + tc.name + "/"
+
+		var lines []string
+		for _, name := range []string{rootBuildLogFileName, sidecarLogsFileName} {
+			content, err := readObjectTail(ctx, scanner.Client, stepPrefix+name, podUtilsLogTailSize)
+			if err != nil {
+				logger.Debug().Err(err).Msgf("Failed to read the %s of the step %s", name, tc.name)
+				continue
+			}
+			lines = append(lines, strings.Split(content, "\n")...)
+		}
+
+		cause, line := matchPodUtilsFailure(lines)
+		if cause == "" {
+			continue
+		}
+		logger.Debug().Msgf("The step %s failed as %s", tc.name, cause)
+		causes = append(causes, fmt.Sprintf("%s in %s", cause, inlineCode(tc.name)))
+		failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes,
+			fmt.Sprintf(":gear: **Infrastructure:** %s\n%s", cause, codeBlock(line)))
+	}
+
+	if len(causes) > 0 {
+		failedTCReport.headerString = ":rotating_light: **This is a CI system failure: " + strings.Join(causes, ", ") + ".**\n"
+		failedTCReport.failureKind = failureKindInfra
+	}
+}
+
+// matchPodUtilsFailure returns the cause of the first pod utilities' failure
+// the log lines show, and the line showing it
+func matchPodUtilsFailure(lines []string) (string, string) {
+	for _, failure := range podUtilsFailures {
+		for _, line := range lines {
+			text := line
+			var parsed podUtilsLogLine
+			if json.Unmarshal([]byte(line), &parsed) == nil {
+				if parsed.Component != "" && parsed.Component != failure.component {
+					continue
+				}
+				text = strings.TrimSpace(parsed.Msg + " " + parsed.Error)
+			}
+			m := failure.pattern.FindStringSubmatch(text)
+			if m == nil {
+				continue
+			}
+			if strings.Contains(failure.cause, "%s") {
+				return fmt.Sprintf(failure.cause, m[1]), strings.TrimSpace(line)
+			}
+			return failure.cause, strings.TrimSpace(line)
+		}
+	}
+	return "", ""
+}
+
+// readObjectTail reads the last n bytes of the object, from its first complete line
+func readObjectTail(ctx context.Context, client *storage.Client, objectName string, n int64) (string, error) {
+	if client == nil {
+		return "", errNoGCSClient
+	}
+	rc, err := client.Bucket(prowArtifactsBucketName).Object(objectName).NewRangeReader(ctx, -n, -1)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create reader for %s", objectName)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", objectName)
+	}
+	content := string(data)
+	if rc.Attrs.Size > int64(len(data)) {
+		if i := strings.IndexByte(content, '\n'); i >= 0 {
+			content = content[i+1:]
+		}
+	}
+	return content, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultPRLockTTL  = 2 * time.Minute
+	defaultPRLockWait = 15 * time.Minute
+	// how often a replica checks whether the lock held by another one was released
+	prLockRetryInterval = 5 * time.Second
+)
+
+// prLocks serializes the analyses of each PR across the replicas of the app,
+// so that two replicas never analyse the PR and edit its comments at the same
+// time. The locks are leases held in the failure store the replicas share,
+// which outlive the replica holding them by their TTL at most (e.g. when it
+// crashed), and are renewed while the analysis runs. Each acquisition has
+// its own owner, so that the analyses of a PR running on the same replica
+// wait for each other too. A nil prLocks locks nothing
+type prLocks struct {
+	store prLocker
+	// identifies the replica, e.g. <pod name>-<random suffix>
+	replica string
+	// the acquisitions of the replica, numbering their owners
+	acquisitions atomic.Uint64
+	ttl          time.Duration
+	wait         time.Duration
+}
+
+func newPRLocks(cfg PRLocksConfig, store FailureStore) (*prLocks, error) {
+	locker, ok := store.(prLocker)
+	if !ok {
+		return nil, fmt.Errorf("the failure store doesn't hold locks")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultPRLockTTL
+	}
+	if cfg.Wait == 0 {
+		cfg.Wait = defaultPRLockWait
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	return &prLocks{store: locker, replica: hostname + "-" + hex.EncodeToString(suffix), ttl: cfg.TTL, wait: cfg.Wait}, nil
+}
+
+// run runs the function while holding the PR's lock, waiting for the other
+// replicas to release it for up to the configured wait. The function runs
+// without the lock when the store fails to hold it, rather than not at all
+func (l *prLocks) run(ctx context.Context, logger zerolog.Logger, repoFullName string, prNumber int, fn func(ctx context.Context) error) error {
+	if l == nil {
+		return fn(ctx)
+	}
+
+	key := prKey(repoFullName, prNumber)
+	// e.g. <replica>-42, never reused, so that the lock is never taken twice nor released by another analysis
+	owner := l.replica + "-" + strconv.FormatUint(l.acquisitions.Add(1), 10)
+	deadline := time.Now().Add(l.wait)
+	for waited := false; ; waited = true {
+		acquired, err := l.store.AcquireLock(ctx, key, owner, l.ttl)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to acquire the PR's lock, analysing it without the lock")
+			return fn(ctx)
+		}
+		if acquired {
+			break
+		}
+		if !waited {
+			logger.Info().Msg("Another analysis of the PR is running, waiting for it to finish")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for another analysis to release the lock of %s", l.wait, key)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(prLockRetryInterval):
+		}
+	}
+
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	go l.renew(renewCtx, logger, key, owner)
+	defer func() {
+		stopRenewing()
+		// the lock is released even when the analysis was canceled
+		if err := l.store.ReleaseLock(detachedContext{ctx}, key, owner); err != nil {
+			logger.Error().Err(err).Msg("Failed to release the PR's lock, it expires after its TTL")
+		}
+	}()
+
+	return fn(ctx)
+}
+
+// renew extends the lease of the lock every third of its TTL, until the context is done
+func (l *prLocks) renew(ctx context.Context, logger zerolog.Logger, key, owner string) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			acquired, err := l.store.AcquireLock(ctx, key, owner, l.ttl)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to renew the PR's lock")
+			} else if !acquired {
+				logger.Warn().Msg("The PR's lock expired and was taken by another analysis")
+			}
+		}
+	}
+}
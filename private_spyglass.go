@@ -0,0 +1,142 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+// spyglassSource is a private Deck, whose jobs' artifacts are only
+// readable with credentials from a bucket of their own
+type spyglassSource struct {
+	host   string
+	bucket string
+	client *storage.Client
+}
+
+// privateSpyglass are the private Decks the analysed jobs may come from
+type privateSpyglass struct {
+	sources []*spyglassSource
+}
+
+// newPrivateSpyglass creates the authenticated storage clients of the private Decks
+func newPrivateSpyglass(ctx context.Context, cfgs []PrivateSpyglassConfig, faults FaultInjectionConfig) (*privateSpyglass, error) {
+	p := &privateSpyglass{}
+	for _, cfg := range cfgs {
+		if cfg.Host == "" || cfg.Bucket == "" {
+			return nil, fmt.Errorf("the private spyglass sources need both a host and a bucket")
+		}
+		if cfg.TokenFile == "" && cfg.CookieFile == "" {
+			return nil, fmt.Errorf("the private spyglass source %s has neither a token nor a cookie file", cfg.Host)
+		}
+
+		transport := &spyglassTransport{
+			base:       newFaultTransport(http.DefaultTransport, faults, faultTargetGCS),
+			bucket:     cfg.Bucket,
+			tokenFile:  cfg.TokenFile,
+			cookieFile: cfg.CookieFile,
+		}
+		opts := []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: transport})}
+		if cfg.Endpoint != "" {
+			opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+		}
+		client, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed creating the storage client of %s", cfg.Host)
+		}
+
+		p.sources = append(p.sources, &spyglassSource{host: cfg.Host, bucket: cfg.Bucket, client: client})
+	}
+
+	return p, nil
+}
+
+// match returns the private Deck the Prow job's URL points to, if any
+func (p *privateSpyglass) match(prowJobURL string) *spyglassSource {
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(prowJobURL)
+	if err != nil {
+		return nil
+	}
+	for _, source := range p.sources {
+		if strings.EqualFold(u.Host, source.host) {
+			return source
+		}
+	}
+	return nil
+}
+
+// scanURL returns the Prow job's URL as if its artifacts were stored within
+// the public bucket, which both the scan planner and qe-tools' scanner
+// expect, the source's storage client maps it back to the private bucket
+func (s *spyglassSource) scanURL(prowJobURL string) string {
+	return strings.Replace(prowJobURL, "/"+s.bucket+"/", "/"+prowArtifactsBucketName+"/", 1)
+}
+
+// spyglassTransport authenticates the storage requests with an OIDC
+// token and/or the session cookie of the private Deck, and reads the
+// objects of the public bucket from the private bucket instead
+type spyglassTransport struct {
+	base       http.RoundTripper
+	bucket     string
+	tokenFile  string
+	cookieFile string
+}
+
+func (t *spyglassTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	// the credentials get rotated on disk, e.g. by a projected service account token
+	if t.tokenFile != "" {
+		token, err := os.ReadFile(t.tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading the private spyglass token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if t.cookieFile != "" {
+		cookie, err := os.ReadFile(t.cookieFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading the private spyglass cookie")
+		}
+		req.Header.Set("Cookie", strings.TrimSpace(string(cookie)))
+	}
+
+	// the JSON API names the bucket after /b/, the XML API (used for reads) at the path's root
+	req.URL.Path = t.mapBucket(req.URL.Path)
+	req.URL.RawPath = t.mapBucket(req.URL.RawPath)
+
+	return t.base.RoundTrip(req)
+}
+
+// mapBucket replaces the public bucket within the request's path with the private one
+func (t *spyglassTransport) mapBucket(p string) string {
+	public := "/" + prowArtifactsBucketName + "/"
+	if strings.HasPrefix(p, public) {
+		return "/" + t.bucket + "/" + strings.TrimPrefix(p, public)
+	}
+	return strings.Replace(p, "/b/"+prowArtifactsBucketName+"/", "/b/"+t.bucket+"/", 1)
+}
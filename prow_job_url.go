@@ -0,0 +1,83 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	prowJobTypePresubmit  = "presubmit"
+	prowJobTypeBatch      = "batch"
+	prowJobTypePeriodic   = "periodic"
+	prowJobTypePostsubmit = "postsubmit"
+
+	// Spyglass' path prefix of the jobs' artifacts within a bucket
+	spyglassGCSPrefix = "/view/gs/"
+	batchPRNumber     = "batch"
+)
+
+// prowJobLocation is where a Prow job's artifacts are stored, as read from its
+// Spyglass URL. The artifacts of the different job types are laid out as:
+//
+//	pr-logs/pull/<org>_<repo>/<PR>/<job>/<build ID>  presubmits
+//	pr-logs/pull/batch/<job>/<build ID>              batches of presubmits (Tide)
+//	logs/<job>/<build ID>                            periodics and postsubmits
+type prowJobLocation struct {
+	jobType string
+	bucket  string
+	job     string
+	buildID string
+	// the org_repo and PR number of the presubmits
+	orgRepo  string
+	prNumber int
+}
+
+// parseProwJobURL returns the location of the Prow job with the given Spyglass URL
+func parseProwJobURL(prowJobURL string) (*prowJobLocation, error) {
+	sp := strings.SplitN(strings.TrimSuffix(prowJobURL, "/"), spyglassGCSPrefix, 2)
+	if len(sp) != 2 {
+		return nil, fmt.Errorf("not a Spyglass URL: %s", prowJobURL)
+	}
+	parts := strings.Split(sp[1], "/")
+	loc := &prowJobLocation{bucket: parts[0]}
+
+	switch {
+	case len(parts) == 6 && parts[1] == "pr-logs" && parts[2] == "pull" && parts[3] == batchPRNumber:
+		// e.g. bucket/pr-logs/pull/batch/<job>/<build ID>
+		loc.jobType, loc.job, loc.buildID = prowJobTypeBatch, parts[4], parts[5]
+	case len(parts) == 7 && parts[1] == "pr-logs" && parts[2] == "pull":
+		prNumber, err := strconv.Atoi(parts[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid PR number within the Prow job's URL: %s", prowJobURL)
+		}
+		loc.jobType, loc.orgRepo, loc.prNumber, loc.job, loc.buildID = prowJobTypePresubmit, parts[3], prNumber, parts[5], parts[6]
+	case len(parts) == 4 && parts[1] == "logs":
+		loc.jobType, loc.job, loc.buildID = prowJobTypePostsubmit, parts[2], parts[3]
+		if strings.HasPrefix(loc.job, "periodic-") {
+			loc.jobType = prowJobTypePeriodic
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout of the Prow job's URL: %s", prowJobURL)
+	}
+
+	if _, err := strconv.ParseUint(loc.buildID, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid build ID within the Prow job's URL: %s", prowJobURL)
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+	"github.com/shurcooL/githubv4"
+)
+
+// Prow's hook asks the external plugins for their help at <endpoint>/help
+const ProwPluginHelpRoute string = "/help"
+
+// tokenClientCreator creates the "installation" clients using a static token.
+// When running as a Prow external plugin, the events forwarded by Prow's
+// hook aren't tied to an installation of the app, so the app acts as
+// the bot account whose token Prow is configured with
+type tokenClientCreator struct {
+	githubapp.ClientCreator
+	token string
+}
+
+func newTokenClientCreator(cc githubapp.ClientCreator, tokenFile string) (*tokenClientCreator, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the GitHub token file: %s", tokenFile)
+	}
+
+	return &tokenClientCreator{ClientCreator: cc, token: strings.TrimSpace(string(token))}, nil
+}
+
+func (c *tokenClientCreator) NewInstallationClient(installationID int64) (*github.Client, error) {
+	return c.NewTokenClient(c.token)
+}
+
+func (c *tokenClientCreator) NewInstallationV4Client(installationID int64) (*githubv4.Client, error) {
+	return c.NewTokenV4Client(c.token)
+}
+
+// prowPluginHelp mirrors the subset of Prow's pluginhelp.PluginHelp
+// shown by Deck's plugin help page
+type prowPluginHelp struct {
+	Description string
+	Events      []string
+	Commands    []prowPluginCommand
+}
+
+type prowPluginCommand struct {
+	Usage       string
+	Featured    bool
+	Description string
+	Examples    []string
+	WhoCanUse   string
+}
+
+// ProwPluginHelpHandler serves the help of the plugin to Prow's hook
+type ProwPluginHelpHandler struct {
+	Handlers []githubapp.EventHandler
+}
+
+func (h *ProwPluginHelpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	help := prowPluginHelp{
+		Description: "The ci-helper plugin adds the list of failed tests, with their logs, to the failure comments of the Prow jobs.",
+		Commands: []prowPluginCommand{
+			{
+				Usage:       reportFormatCommand + " compact|full|summary",
+				Description: "Re-renders the failure reports of the PR in the given format, summary moving the full reports to check runs.",
+				Examples:    []string{reportFormatCommand + " compact"},
+				WhoCanUse:   "Anyone",
+			},
+			{
+				Usage:       heatmapCommand + " <job> [suite]",
+				Description: "Posts the failure heatmap of the latest runs of the given job.",
+				Examples:    []string{heatmapCommand + " pull-ci-org-repo-main-e2e"},
+				WhoCanUse:   "Anyone",
+			},
+			{
+				Usage:       compareCommand + " <Prow job URL> <Prow job URL>",
+				Description: "Compares the failures and durations of the two Prow jobs.",
+				Examples:    []string{compareCommand + " https://prow.ci.openshift.org/view/gs/test-platform-results/logs/<job>/<build ID> https://prow.ci.openshift.org/view/gs/test-platform-results/logs/<job>/<build ID>"},
+				WhoCanUse:   "Anyone",
+			},
+			{
+				Usage:       watchJobCommand + " <Prow job URL>",
+				Description: "Reports the progress of the running Prow job in a comment, which gets the job's report once it finishes.",
+				Examples:    []string{watchJobCommand + " https://prow.ci.openshift.org/view/gs/test-platform-results/pr-logs/pull/<org>_<repo>/<PR>/<job>/<build ID>"},
+				WhoCanUse:   "Anyone",
+			},
+			{
+				Usage:       ciHelperCommand + " ping",
+				Description: "Replies with the app's version, configuration, features and workload.",
+				Examples:    []string{ciHelperCommand + " ping"},
+				WhoCanUse:   "Anyone",
+			},
+			{
+				Usage:       ciHelperCommand + " analyze <Prow job URL>",
+				Description: "Posts the failure report of the given presubmit job of the PR, as if openshift-ci reported its failure.",
+				Examples:    []string{ciHelperCommand + " analyze https://prow.ci.openshift.org/view/gs/test-platform-results/pr-logs/pull/<org>_<repo>/<PR>/<job>/<build ID>"},
+				WhoCanUse:   "Members of the repository's org",
+			},
+			{
+				Usage:       ciHelperCommand + " file-issue <test case>",
+				Description: "Files an issue for the failed test case of the PR's latest report, which gets resolved once the failure stops occurring.",
+				Examples:    []string{ciHelperCommand + " file-issue TestRegistry"},
+				WhoCanUse:   "Members of the repository's org",
+			},
+			{
+				Usage:       ciHelperCommand + " unsubscribe|subscribe",
+				Description: "Stops (or resumes) the @mentions of the commenter by the app.",
+				Examples:    []string{ciHelperCommand + " unsubscribe"},
+				WhoCanUse:   "Anyone",
+			},
+		},
+	}
+	for _, handler := range h.Handlers {
+		help.Events = append(help.Events, handler.Handles()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(help); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/pkg/errors"
+)
+
+// PRHandler aborts the running and queued analyses of a PR once they
+// become pointless, i.e. when the PR gets closed or new commits get pushed
+type PRHandler struct {
+	Cancellations *analysisCancellations
+	Queue         *workQueue
+}
+
+func (h *PRHandler) Handles() []string {
+	return []string{"pull_request"}
+}
+
+func (h *PRHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	var event github.PullRequestEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return errors.Wrap(err, "failed to parse pull request event payload")
+	}
+
+	if event.GetAction() != "closed" && event.GetAction() != "synchronize" {
+		return nil
+	}
+
+	installationID := githubapp.GetInstallationIDFromEvent(&event)
+	_, logger := githubapp.PreparePRContext(ctx, installationID, event.GetRepo(), event.GetNumber())
+
+	if dropped := h.Queue.cancel(event.GetRepo().GetFullName(), event.GetNumber()); dropped > 0 {
+		logger.Debug().Msgf("Dropped %d queued analyses as the PR got %s", dropped, event.GetAction())
+	}
+	if cancelled := h.Cancellations.cancel(event.GetRepo().GetFullName(), event.GetNumber()); cancelled > 0 {
+		logger.Debug().Msgf("Cancelled %d running analyses as the PR got %s", cancelled, event.GetAction())
+	}
+
+	return nil
+}
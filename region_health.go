@@ -0,0 +1,254 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	RegionsRoute        string = "/admin/regions"
+	defaultRegionWindow        = 7 * 24 * time.Hour
+	// the runs recorded, the oldest being forgotten first
+	maxRegionRuns = 50000
+	// the leases are acquired at the beginning of the job
+	regionBuildLogHead = 256 * 1024
+
+	prowJobCloudLabel          = "ci-operator.openshift.io/cloud"
+	prowJobClusterProfileLabel = "ci-operator.openshift.io/cloud-cluster-profile"
+	unknownRegion              = "unknown"
+)
+
+// the region of the cloud lease ci-operator acquired, e.g.
+// "Acquired 1 lease(s) for aws-quota-slice: [us-east-1--aws-quota-slice-07]"
+var leaseRegionRegex = regexp.MustCompile(`Acquired \d+ lease\(s\) for [\w.-]+: \[([a-z0-9-]+?)--`)
+
+// the failure kinds caused by the cluster rather than by the PR
+var infraFailureKinds = []string{failureKindInfra, failureKindClusterPool, failureKindBootstrap}
+
+// jobPlatform is where a Prow job's test cluster ran
+type jobPlatform struct {
+	Cloud          string `json:"cloud"`
+	Region         string `json:"region"`
+	ClusterProfile string `json:"cluster_profile"`
+}
+
+type platformRun struct {
+	at       time.Time
+	platform jobPlatform
+	infra    bool
+}
+
+type regionStats struct {
+	jobPlatform
+	Runs             int     `json:"runs"`
+	InfraFailures    int     `json:"infra_failures"`
+	InfraFailureRate float64 `json:"infra_failure_rate"`
+}
+
+// regionHealth records the platform of every analysed job and whether
+// it failed because of the infrastructure, to tell the chronically flaky
+// regions and cluster profiles apart. A nil regionHealth records nothing
+type regionHealth struct {
+	mu   sync.Mutex
+	runs []platformRun
+}
+
+func newRegionHealth() *regionHealth {
+	return &regionHealth{}
+}
+
+// fetchJobPlatform reads the job's cloud and cluster profile from the labels
+// of its prowjob.json, and the region from the lease acquired by ci-operator
+func fetchJobPlatform(ctx context.Context, client *storage.Client, prowJobURL string) (*jobPlatform, error) {
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+	pj, err := fetchProwJob(ctx, client, jobPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := &jobPlatform{
+		Cloud:          pj.Metadata.Labels[prowJobCloudLabel],
+		ClusterProfile: pj.Metadata.Labels[prowJobClusterProfileLabel],
+		Region:         unknownRegion,
+	}
+	if platform.Cloud == "" && platform.ClusterProfile == "" {
+		// not a job testing on a cloud cluster
+		return nil, nil
+	}
+
+	head, err := readObjectHead(ctx, client, jobPrefix+"/"+rootBuildLogFileName, regionBuildLogHead)
+	if err != nil {
+		return platform, err
+	}
+	if m := leaseRegionRegex.FindStringSubmatch(head); m != nil {
+		platform.Region = m[1]
+	}
+
+	return platform, nil
+}
+
+// readObjectHead reads the first n bytes of the object
+func readObjectHead(ctx context.Context, client *storage.Client, objectName string, n int64) (string, error) {
+	if client == nil {
+		return "", errNoGCSClient
+	}
+	rc, err := client.Bucket(prowArtifactsBucketName).Object(objectName).NewRangeReader(ctx, 0, n)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create reader for %s", objectName)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", objectName)
+	}
+	return string(data), nil
+}
+
+// record records the analysis of a job run on the platform
+func (h *regionHealth) record(platform jobPlatform, failureKind string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.runs = append(h.runs, platformRun{at: time.Now(), platform: platform, infra: containsFold(infraFailureKinds, failureKind)})
+	if overflow := len(h.runs) - maxRegionRuns; overflow > 0 {
+		h.runs = append([]platformRun(nil), h.runs[overflow:]...)
+	}
+}
+
+// observe records the platform of the analysed job, if it ran on a cloud cluster
+func (h *regionHealth) observe(ctx context.Context, logger zerolog.Logger, client *storage.Client, prowJobURL, failureKind string) {
+	if h == nil {
+		return
+	}
+	platform, err := fetchJobPlatform(ctx, client, prowJobURL)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to read the platform of the job's cluster")
+	}
+	if platform != nil {
+		h.record(*platform, failureKind)
+	}
+}
+
+// stats aggregates the runs within the time range per platform, the
+// highest infrastructure failure rates first
+func (h *regionHealth) stats(from, to time.Time) []regionStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byPlatform := map[jobPlatform]*regionStats{}
+	for _, run := range h.runs {
+		if run.at.Before(from) || !run.at.Before(to) {
+			continue
+		}
+		s, ok := byPlatform[run.platform]
+		if !ok {
+			s = &regionStats{jobPlatform: run.platform}
+			byPlatform[run.platform] = s
+		}
+		s.Runs++
+		if run.infra {
+			s.InfraFailures++
+		}
+	}
+
+	stats := make([]regionStats, 0, len(byPlatform))
+	for _, s := range byPlatform {
+		s.InfraFailureRate = float64(s.InfraFailures) / float64(s.Runs)
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].InfraFailureRate != stats[j].InfraFailureRate {
+			return stats[i].InfraFailureRate > stats[j].InfraFailureRate
+		}
+		if stats[i].Runs != stats[j].Runs {
+			return stats[i].Runs > stats[j].Runs
+		}
+		return fmt.Sprint(stats[i].jobPlatform) < fmt.Sprint(stats[j].jobPlatform)
+	})
+
+	return stats
+}
+
+// digestSection renders the stats as the section of the weekly digest
+func digestSection(stats []regionStats) string {
+	var b strings.Builder
+	b.WriteString("### Infrastructure failures by region\n\n")
+	if len(stats) == 0 {
+		b.WriteString("No job ran on a cloud cluster.\n")
+		return b.String()
+	}
+
+	b.WriteString("| Cloud | Region | Cluster profile | Runs | Infra failures | Rate |\n|---|---|---|---:|---:|---:|\n")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %d | %.0f%% |\n",
+			inlineCode(s.Cloud), inlineCode(s.Region), inlineCode(s.ClusterProfile), s.Runs, s.InfraFailures, s.InfraFailureRate*100)
+	}
+	return b.String()
+}
+
+// RegionsHandler serves the infrastructure failure rates of each cloud region and
+// cluster profile within a time range, as JSON or as the weekly digest's section
+// with "?format=markdown"
+type RegionsHandler struct {
+	Regions *regionHealth
+	Logger  zerolog.Logger
+}
+
+func (h *RegionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := parseTimeRange(r, defaultRegionWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats := h.Regions.stats(from, to)
+
+	switch r.URL.Query().Get("format") {
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		fmt.Fprint(w, digestSection(stats))
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			h.Logger.Error().Err(err).Msg("Failed to encode the regions' stats")
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format: %s", r.URL.Query().Get("format")), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+const RemediationReloadRoute string = "/admin/remediation/reload"
+
+// RemediationEntry is a known failure and how to fix it
+type RemediationEntry struct {
+	Name string `yaml:"name"`
+	// regular expression matched against the failure's name and message
+	Pattern string `yaml:"pattern"`
+	// text the failure's name or message contains, instead of the pattern
+	Substring string `yaml:"substring"`
+	// the ticket tracking the known issue (e.g. a Jira or GitHub issue), linked
+	// by the report instead of the failure's raw details
+	Issue string `yaml:"issue"`
+	// when set, the entry only applies to the reports of this failure kind
+	Kind        string   `yaml:"kind"`
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description"`
+	Docs        []string `yaml:"docs"`
+	Commands    []string `yaml:"commands"`
+
+	pattern *regexp.Regexp
+}
+
+// remediationKBFile is the content of the knowledge base's file
+type remediationKBFile struct {
+	Entries []RemediationEntry `yaml:"entries"`
+}
+
+// remediationKB is the knowledge base of the known failures' fixes. It's
+// reloaded from its file when the file changes, so that the known issues
+// can be added without redeploying the app
+type remediationKB struct {
+	path   string
+	logger zerolog.Logger
+
+	mu      sync.RWMutex
+	entries []RemediationEntry
+	modTime time.Time
+}
+
+// loadRemediationKB reads the knowledge base from the given YAML file
+func loadRemediationKB(path string, logger zerolog.Logger) (*remediationKB, error) {
+	kb := &remediationKB{path: path, logger: logger}
+	if err := kb.reload(); err != nil {
+		return nil, err
+	}
+	return kb, nil
+}
+
+// reload re-reads the knowledge base's file. The current entries are kept
+// when the file is invalid
+func (kb *remediationKB) reload() error {
+	info, err := os.Stat(kb.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading the remediation knowledge base: %s", kb.path)
+	}
+	entries, err := readRemediationKB(kb.path)
+	if err != nil {
+		return err
+	}
+
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+	kb.entries, kb.modTime = entries, info.ModTime()
+	return nil
+}
+
+// run reloads the knowledge base every interval when its file changed, until the context is done
+func (kb *remediationKB) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(kb.path)
+			if err != nil {
+				kb.logger.Error().Err(err).Msg("Failed to check the remediation knowledge base")
+				continue
+			}
+			kb.mu.RLock()
+			changed := !info.ModTime().Equal(kb.modTime)
+			kb.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := kb.reload(); err != nil {
+				kb.logger.Error().Err(err).Msg("Failed to reload the remediation knowledge base, keeping the current entries")
+				continue
+			}
+			kb.logger.Info().Msgf("Reloaded the remediation knowledge base: %d entries", len(kb.list()))
+		}
+	}
+}
+
+// list returns the current entries
+func (kb *remediationKB) list() []RemediationEntry {
+	kb.mu.RLock()
+	defer kb.mu.RUnlock()
+	return kb.entries
+}
+
+// readRemediationKB reads and validates the entries of the knowledge base's file
+func readRemediationKB(path string) ([]RemediationEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading the remediation knowledge base: %s", path)
+	}
+
+	if err := validateFile(remediationSchema, path, content); err != nil {
+		return nil, err
+	}
+
+	var kb remediationKBFile
+	if err := yaml.UnmarshalStrict(content, &kb); err != nil {
+		return nil, errors.Wrap(err, "failed parsing the remediation knowledge base")
+	}
+
+	for i := range kb.Entries {
+		entry := &kb.Entries[i]
+		if (entry.Pattern == "") == (entry.Substring == "") {
+			return nil, fmt.Errorf("the remediation %q needs either a pattern or a substring", entry.Name)
+		}
+		if entry.Pattern == "" {
+			continue
+		}
+		if entry.pattern, err = regexp.Compile(entry.Pattern); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern of the remediation %q", entry.Name)
+		}
+	}
+
+	return kb.Entries, nil
+}
+
+// match returns the first entry matching the failed test case
+func (kb *remediationKB) match(kind string, tc failedTestCase) *RemediationEntry {
+	entries := kb.list()
+	for i, entry := range entries {
+		if entry.Kind != "" && entry.Kind != kind {
+			continue
+		}
+		if entry.matches(tc.name) || entry.matches(tc.message) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// matches returns whether the text matches the entry's pattern, or contains its substring
+func (entry *RemediationEntry) matches(text string) bool {
+	if entry.pattern != nil {
+		return entry.pattern.MatchString(text)
+	}
+	return strings.Contains(text, entry.Substring)
+}
+
+// addRemediations adds the known fix of each failure, if any, as a note of the failure
+func (failedTCReport *FailedTestCasesReport) addRemediations(kb *remediationKB) {
+	if kb == nil {
+		return
+	}
+	for i, tc := range failedTCReport.failedTestCases {
+		entry := kb.match(failedTCReport.failureKind, tc)
+		if entry == nil {
+			continue
+		}
+		failedTCReport.failedTestCases[i].knownIssue = true
+		if entry.Issue != "" {
+			// the known issue's ticket tells more than the raw failure, which is folded
+			failedTCReport.failedTestCases[i].details = ":books: **Known issue:** " + entry.Issue + "\n" +
+				returnContentWrappedInDropdown("Failure details", tc.message)
+			if entry.Description == "" && len(entry.Commands) == 0 && len(entry.Docs) == 0 {
+				continue
+			}
+		}
+		failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes, entry.render())
+	}
+}
+
+// render renders the remediation within a dropdown
+func (entry *RemediationEntry) render() string {
+	title := entry.Title
+	if title == "" {
+		title = entry.Name
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<details>\n<summary>:books: Known issue: %s</summary>\n\n", title)
+	if entry.Description != "" {
+		b.WriteString(strings.TrimSpace(entry.Description) + "\n\n")
+	}
+	if len(entry.Commands) > 0 {
+		b.WriteString(codeBlock(strings.Join(entry.Commands, "\n")) + "\n\n")
+	}
+	for _, doc := range entry.Docs {
+		fmt.Fprintf(&b, "* :link: %s\n", doc)
+	}
+	b.WriteString("</details>")
+
+	return b.String()
+}
+
+// RemediationReloadHandler re-reads the remediation knowledge base
+type RemediationReloadHandler struct {
+	KB     *remediationKB
+	Logger zerolog.Logger
+}
+
+func (h *RemediationReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.KB.reload(); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to reload the remediation knowledge base")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "entries: %d\n", len(h.KB.list()))
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	repoConfigFileTTL = 10 * time.Minute
+
+	commentModeEdit = "edit"
+	commentModeNew  = "new"
+)
+
+type repoConfigFileEntry struct {
+	config    RepositoryConfig
+	fetchedAt time.Time
+}
+
+// repoConfigFiles caches the settings of the repositories' own .ci-helper.yaml,
+// read from their default branch with the client of their installation. These
+// settings override the ones of the app's configuration. A nil repoConfigFiles
+// reads no file
+type repoConfigFiles struct {
+	mu sync.Mutex
+	// keyed by the repository's full name
+	entries map[string]repoConfigFileEntry
+}
+
+func newRepoConfigFiles() *repoConfigFiles {
+	return &repoConfigFiles{entries: map[string]repoConfigFileEntry{}}
+}
+
+// get returns the settings of the repository's file, as last fetched
+func (f *repoConfigFiles) get(repoFullName string) RepositoryConfig {
+	if f == nil {
+		return RepositoryConfig{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.entries[repoFullName].config
+}
+
+// refresh fetches the repository's file, unless it was fetched recently. The
+// repository's settings are left as they were when the file can't be fetched
+// (e.g. without the contents permission), until the next attempt after the
+// TTL, and are reset when the file is invalid
+func (f *repoConfigFiles) refresh(ctx context.Context, logger zerolog.Logger, client *github.Client, owner, repo string) {
+	if f == nil {
+		return
+	}
+	fullName := owner + "/" + repo
+
+	f.mu.Lock()
+	entry, ok := f.entries[fullName]
+	f.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < repoConfigFileTTL {
+		return
+	}
+
+	config := RepositoryConfig{}
+	file, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, repoConfigFileName, nil)
+	switch {
+	case err != nil && resp != nil && resp.StatusCode == http.StatusNotFound:
+		// the repository relies on the app's configuration
+	case err != nil:
+		logger.Error().Err(err).Msgf("Failed to fetch the %s of the repository, keeping its last settings", repoConfigFileName)
+		config = entry.config
+	default:
+		content, err := file.GetContent()
+		if err == nil {
+			config, err = parseRepoConfigFile([]byte(content))
+		}
+		if err != nil {
+			logger.Error().Err(err).Msgf("Ignoring the invalid %s of the repository", repoConfigFileName)
+			config = RepositoryConfig{}
+		}
+	}
+
+	f.mu.Lock()
+	f.entries[fullName] = repoConfigFileEntry{config: config, fetchedAt: time.Now()}
+	f.mu.Unlock()
+}
+
+// parseRepoConfigFile parses and validates the settings of a repository's .ci-helper.yaml
+func parseRepoConfigFile(content []byte) (RepositoryConfig, error) {
+	config := RepositoryConfig{}
+	if err := validateFile(repositorySchema, repoConfigFileName, content); err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, errors.Wrapf(err, "failed parsing %s", repoConfigFileName)
+	}
+
+	if config.Trigger != "" {
+		if _, err := compileTriggerRule(config.Trigger); err != nil {
+			return config, errors.Wrap(err, "invalid trigger")
+		}
+	}
+	for _, cfg := range config.Classifiers {
+		if _, err := compileClassifierRule(cfg.Rule); err != nil {
+			return config, errors.Wrapf(err, "invalid rule of the classifier %q", cfg.Name)
+		}
+	}
+	if err := config.validatePatterns(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// validateJUnitFilePattern makes sure the pattern of the junit files' names compiles
+func validateJUnitFilePattern(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid junit_file_pattern %q: %+v", pattern, err)
+	}
+	return nil
+}
+
+// validatePatterns compiles the patterns of the junit files' names and of the teams' test names
+func (rc RepositoryConfig) validatePatterns() error {
+	if err := validateJUnitFilePattern(rc.JUnitFilePattern); err != nil {
+		return err
+	}
+	return validateTeams(rc.Teams)
+}
+
+// validateRepositoryPatterns compiles the patterns of the settings
+// of all the configured organizations, groups and repositories
+func (c *Config) validateRepositoryPatterns() error {
+	var configs []RepositoryConfig
+	for _, rc := range c.Organizations {
+		configs = append(configs, rc)
+	}
+	for _, group := range c.RepositoryGroups {
+		configs = append(configs, group.RepositoryConfig)
+	}
+	for _, rc := range c.Repositories {
+		configs = append(configs, rc)
+	}
+	for _, rc := range configs {
+		if err := rc.validatePatterns(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// junitFilePattern returns the pattern of the names of the junit files the repository's jobs write
+func (rc RepositoryConfig) junitFilePattern() string {
+	if rc.JUnitFilePattern == "" {
+		return regexp.QuoteMeta(junitFilename)
+	}
+	return rc.JUnitFilePattern
+}
+
+// isE2ESuite returns whether the junit suite holds the repository's e2e tests
+func (rc RepositoryConfig) isE2ESuite(name string) bool {
+	if len(rc.E2ESuiteNames) == 0 {
+		return name == e2eTestSuiteName
+	}
+	for _, suite := range rc.E2ESuiteNames {
+		if name == suite {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ReportPageRoute           string = "/r/"
+	defaultReportPageCapacity        = 5000
+	defaultReportPagePrefix          = "report-pages"
+	reportPageLinkName               = "Full report"
+)
+
+var (
+	// the markdown and HTML decorations of the comment's entries, which
+	// are dropped when rendering them as plain text
+	markdownDecorationRegex = regexp.MustCompile("(?m)^```.*$|<details><summary>[^<]*</summary>\\s*<pre>|</pre>\\s*</details>")
+	// the emphasis and emoji shortcodes of the report's header and next steps
+	markdownEmphasisRegex = regexp.MustCompile(`\*\*|:[a-z_]+:`)
+	reportPageIDRegex     = regexp.MustCompile(`^[a-f0-9]{24}$`)
+)
+
+var reportPageTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Repository}}#{{.PullRequest}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background-color: #f6f8fa; padding: 1em; overflow-x: auto; }
+.status { font-family: monospace; font-weight: bold; color: #d73a49; }
+</style>
+</head>
+<body>
+<h1>{{.Header}}</h1>
+<p><a href="https://github.com/{{.Repository}}/pull/{{.PullRequest}}">{{.Repository}}#{{.PullRequest}}</a>,
+<a href="{{.ProwJobURL}}">Prow job</a>, analysed on {{.CreatedAt.Format "2006-01-02 15:04 MST"}}</p>
+{{range .Failures}}<h3>{{if .Status}}<span class="status">[{{.Status}}]</span> {{end}}{{.Name}}</h3>
+{{if .Message}}<pre>{{.Message}}</pre>
+{{end}}{{if .Logs}}<details><summary>Logs</summary><pre>{{.Logs}}</pre></details>
+{{end}}{{end}}{{if .NextStep}}<p><b>What to do next:</b> {{.NextStep}}</p>
+{{end}}{{if .Links}}<ul>
+{{range .Links}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// reportPage is the read-only page of an analysis, which isn't
+// bound by the size limits of the GitHub comments
+type reportPage struct {
+	ID          string
+	Repository  string
+	PullRequest int
+	ProwJobURL  string
+	CreatedAt   time.Time
+	Header      string
+	Failures    []reportPageFailure
+	Links       []reportPageLink
+	NextStep    string
+}
+
+type reportPageFailure struct {
+	Status  string
+	Name    string
+	Message string
+	Logs    string
+}
+
+type reportPageLink struct {
+	Name string
+	URL  string
+}
+
+// reportPages keeps the pages of up to 'capacity' most recent analyses in
+// memory. The pages are persisted in a GCS bucket when one is configured, so
+// that their links outlive the restarts and evictions, and are served by every
+// replica. Otherwise a page's link stops working once the page is gone
+type reportPages struct {
+	baseURL  string
+	mu       sync.RWMutex
+	capacity int
+	ids      []string
+	pages    map[string]*reportPage
+	// the bucket persisting the pages, if any
+	client *storage.Client
+	bucket string
+	prefix string
+}
+
+func newReportPages(ctx context.Context, cfg ReportPagesConfig) (*reportPages, error) {
+	capacity := cfg.Capacity
+	if capacity == 0 {
+		capacity = defaultReportPageCapacity
+	}
+
+	p := &reportPages{
+		baseURL:  strings.TrimSuffix(cfg.BaseURL, "/"),
+		capacity: capacity,
+		pages:    map[string]*reportPage{},
+	}
+	if cfg.GCSBucket != "" {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %+v", err)
+		}
+		p.client, p.bucket, p.prefix = client, cfg.GCSBucket, strings.Trim(cfg.Prefix, "/")
+		if p.prefix == "" {
+			p.prefix = defaultReportPagePrefix
+		}
+	}
+	return p, nil
+}
+
+// newReportPageID returns a random, unguessable ID
+func newReportPageID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// url returns the link of the page with the given ID
+func (p *reportPages) url(id string) string {
+	return p.baseURL + ReportPageRoute + id
+}
+
+// objectName returns the name of the object persisting the page with the given ID
+func (p *reportPages) objectName(id string) string {
+	return path.Join(p.prefix, id+".json")
+}
+
+// add keeps the page, and persists it when a bucket is configured
+func (p *reportPages) add(ctx context.Context, logger zerolog.Logger, page *reportPage) {
+	p.cache(page)
+	if p.client == nil {
+		return
+	}
+
+	content, err := json.Marshal(page)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode the report's page")
+		return
+	}
+	w := p.client.Bucket(p.bucket).Object(p.objectName(page.ID)).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		logger.Error().Err(err).Msgf("Failed to persist the report's page %s", page.ID)
+		return
+	}
+	if err := w.Close(); err != nil {
+		logger.Error().Err(err).Msgf("Failed to persist the report's page %s", page.ID)
+	}
+}
+
+// cache keeps the page in memory, evicting the oldest one past the capacity
+func (p *reportPages) cache(page *reportPage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pages[page.ID]; !ok {
+		p.ids = append(p.ids, page.ID)
+	}
+	p.pages[page.ID] = page
+
+	if len(p.ids) > p.capacity {
+		delete(p.pages, p.ids[0])
+		p.ids = p.ids[1:]
+	}
+}
+
+// get returns the page with the given ID, or nil if there's no such page
+func (p *reportPages) get(ctx context.Context, id string) (*reportPage, error) {
+	p.mu.RLock()
+	page := p.pages[id]
+	p.mu.RUnlock()
+	if page != nil || p.client == nil {
+		return page, nil
+	}
+
+	rc, err := p.client.Bucket(p.bucket).Object(p.objectName(id)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the report's page %s", id)
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the report's page %s", id)
+	}
+	page = &reportPage{}
+	if err := json.Unmarshal(content, page); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the report's page %s", id)
+	}
+	p.cache(page)
+	return page, nil
+}
+
+// newReportPage builds the page of the given report
+func newReportPage(id, repoFullName string, prNumber int, prowJobURL string, report *FailedTestCasesReport) *reportPage {
+	page := &reportPage{
+		ID:          id,
+		Repository:  repoFullName,
+		PullRequest: prNumber,
+		ProwJobURL:  prowJobURL,
+		CreatedAt:   time.Now().UTC(),
+		Header:      plainText(markdownEmphasisRegex.ReplaceAllString(report.headerString, "")),
+		NextStep:    plainText(markdownEmphasisRegex.ReplaceAllString(report.nextStep, "")),
+	}
+
+	for _, tc := range report.failedTestCases {
+		page.Failures = append(page.Failures, reportPageFailure{
+			Status:  tc.status,
+			Name:    tc.name,
+			Message: tc.message,
+			Logs:    plainText(tc.details),
+		})
+	}
+	for _, link := range report.extraLinks {
+		if link.name != reportPageLinkName {
+			page.Links = append(page.Links, reportPageLink{Name: link.name, URL: link.url})
+		}
+	}
+	if report.podsLink != "" {
+		page.Links = append(page.Links, reportPageLink{Name: "Pod logs", URL: report.podsLink})
+	}
+	if report.customResourcesLink != "" {
+		page.Links = append(page.Links, reportPageLink{Name: "Custom Resources", URL: report.customResourcesLink})
+	}
+
+	return page
+}
+
+// plainText drops the markdown decorations of the given comment content
+func plainText(markdown string) string {
+	return strings.TrimSpace(html.UnescapeString(markdownDecorationRegex.ReplaceAllString(markdown, "")))
+}
+
+// ReportPageHandler serves the pages of the analyses
+type ReportPageHandler struct {
+	Pages  *reportPages
+	Logger zerolog.Logger
+}
+
+func (h *ReportPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, ReportPageRoute)
+	if !reportPageIDRegex.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := h.Pages.get(r.Context(), id)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to retrieve the report's page")
+		http.Error(w, "failed to retrieve the report's page", http.StatusInternalServerError)
+		return
+	}
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := reportPageTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the lines of failures within the summary, which fits in 10 lines
+	// with its header, the link to the details and the next steps
+	maxSummaryFailureLines = 7
+	// the longest text of a check run's output
+	maxCheckRunOutputLength = 65535
+)
+
+// fitCheckRunOutput truncates the text to the length GitHub accepts within a check run's output
+func fitCheckRunOutput(text string) string {
+	if len(text) <= maxCheckRunOutputLength {
+		return text
+	}
+	return strings.ToValidUTF8(text[:maxCheckRunOutputLength], "")
+}
+
+// publishDetails creates a check run of the PR's head commit holding the full
+// report and an annotation per failed test case, which the summary of the report
+// links to. The check run concludes as given, e.g. "failure" for branch protection.
+// Its failures are counted among the telemetry's errors of the checks
+func (failedTCReport *FailedTestCasesReport) publishDetails(ctx context.Context, logger zerolog.Logger, client *github.Client, t *telemetry, event github.IssueCommentEvent, conclusion string) {
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+
+	pr, _, err := client.PullRequests.Get(ctx, repoOwner, repoName, event.GetIssue().GetNumber())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to fetch the head commit of the PR, not publishing the check run")
+		t.countError("checks")
+		return
+	}
+
+	var text strings.Builder
+	for _, s := range failedTCReport.sections(reportFormatFull) {
+		text.WriteString(s.content)
+	}
+	output := func(annotations []*github.CheckRunAnnotation) *github.CheckRunOutput {
+		return &github.CheckRunOutput{
+			Title:       github.String(fmt.Sprintf("%d failure(s) of the Prow job", len(failedTCReport.failedTestCases))),
+			Summary:     github.String(fitCheckRunOutput(failedTCReport.headerString)),
+			Text:        github.String(fitCheckRunOutput(text.String())),
+			Annotations: annotations,
+		}
+	}
+	annotations := failedTCReport.checkRunAnnotations(repoName)
+	batch := annotations
+	if len(batch) > maxAnnotationsPerRequest {
+		batch = batch[:maxAnnotationsPerRequest]
+	}
+
+	checkRun, _, err := client.Checks.CreateCheckRun(ctx, repoOwner, repoName, github.CreateCheckRunOptions{
+		Name:       fmt.Sprintf("%s / %s", fallbackCheckRunName, jobNameFromProwJobURL(failedTCReport.prowJobURL)),
+		HeadSHA:    pr.GetHead().GetSHA(),
+		DetailsURL: github.String(failedTCReport.prowJobURL),
+		Status:     github.String("completed"),
+		Conclusion: github.String(conclusion),
+		Output:     output(batch),
+	})
+	if err != nil {
+		logger.Error().Err(errors.Wrap(err, "failed to create the check run")).Msg("Failed to publish the details of the report")
+		t.countError("checks")
+		return
+	}
+	failedTCReport.detailsURL = checkRun.GetHTMLURL()
+
+	// the annotations beyond the first batch are appended by updating the check run
+	for i := maxAnnotationsPerRequest; i < len(annotations); i += maxAnnotationsPerRequest {
+		batch = annotations[i:]
+		if len(batch) > maxAnnotationsPerRequest {
+			batch = batch[:maxAnnotationsPerRequest]
+		}
+		if _, _, err := client.Checks.UpdateCheckRun(ctx, repoOwner, repoName, checkRun.GetID(), github.UpdateCheckRunOptions{
+			Name:   checkRun.GetName(),
+			Output: output(batch),
+		}); err != nil {
+			logger.Error().Err(err).Msgf("Failed to annotate the check run with %d more failure(s)", len(annotations)-i)
+			t.countError("checks")
+			return
+		}
+	}
+}
+
+// summarySections returns the summary of the report: its header, the first
+// failures in the compact format, the link to the details and the next steps
+func (failedTCReport *FailedTestCasesReport) summarySections() []reportSection {
+	var header, failures, tail []reportSection
+	lines, omitted := 0, 0
+	for _, s := range failedTCReport.sections(reportFormatCompact) {
+		switch s.key {
+		case "header":
+			header = append(header, s)
+		case "next-steps", "signature":
+			tail = append(tail, s)
+		case "warnings", "links", "job-stats", "retest-advice":
+			// only within the details
+		default:
+			n := strings.Count(strings.TrimSpace(s.content), "\n") + 1
+			if lines+n > maxSummaryFailureLines {
+				omitted++
+				continue
+			}
+			lines += n
+			failures = append(failures, s)
+		}
+	}
+
+	details := fmt.Sprintf("\n:clipboard: [All the failures, their logs and history](%s) are in the check run.\n", failedTCReport.detailsURL)
+	if omitted > 0 {
+		details = fmt.Sprintf("\n:clipboard: ...and %d more. [All the failures, their logs and history](%s) are in the check run.\n", omitted, failedTCReport.detailsURL)
+	}
+
+	sections := append(header, failures...)
+	sections = append(sections, reportSection{key: "details", content: details})
+	return append(sections, tail...)
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// the node list dumped by the gather-extra step
+	gatheredNodesFileName = "nodes.json"
+	// the usage (in percent) of the nodes' CPU or memory above which they're saturated
+	defaultSaturationThreshold = 90
+	// the most saturated nodes listed within the warning
+	maxSaturatedNodes = 5
+)
+
+// nodePressureConditions are the conditions the kubelet sets on the nodes running out of resources
+var nodePressureConditions = map[string]string{
+	"MemoryPressure": "memory",
+	"DiskPressure":   "disk",
+	"PIDPressure":    "PIDs",
+}
+
+// gatheredNodes is the subset of the node list dumped by the gather-extra step
+type gatheredNodes struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []struct {
+				Type               string    `json:"type"`
+				Status             string    `json:"status"`
+				LastTransitionTime time.Time `json:"lastTransitionTime"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// nodeSaturation is a node which ran out of (or close to) its resources
+type nodeSaturation struct {
+	node    string
+	reasons []string
+}
+
+// checkResourceExhaustion warns when the test cluster's nodes were under resource
+// pressure during the job, or were CPU or memory saturated when the gather-extra
+// step ran: the timeouts of the tests likely come from the saturated cluster
+func (failedTCReport *FailedTestCasesReport) checkResourceExhaustion(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner, scanURL string, cfg ResourceExhaustionConfig) {
+	if !cfg.Enabled || scanner.ArtifactDirectoryPrefix == "" {
+		return
+	}
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = defaultSaturationThreshold
+	}
+
+	nodesObject, topObjects, err := listGatheredNodeObjects(ctx, scanner.Client, scanner.ArtifactDirectoryPrefix+podsPropertyName+"/")
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the nodes' artifacts of the gather-extra step")
+		return
+	}
+
+	saturated := map[string][]string{}
+	if nodesObject != "" {
+		// the job's start and end bound the window the nodes' pressure is looked for in
+		metadata := fetchJobMetadata(ctx, scanner.Client, scanURL, "", 0)
+		content, err := readGCSObject(ctx, scanner.Client, nodesObject)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to read the nodes gathered from the test cluster")
+		} else if err := nodePressures(content, metadata.StartTime, metadata.EndTime, saturated); err != nil {
+			logger.Debug().Err(err).Msgf("Failed to parse %s", nodesObject)
+		}
+	}
+	for _, object := range topObjects {
+		content, err := readGCSObject(ctx, scanner.Client, object)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to read %s", object)
+			continue
+		}
+		nodeUsages(content, threshold, saturated)
+	}
+	if len(saturated) == 0 {
+		return
+	}
+
+	nodes := make([]nodeSaturation, 0, len(saturated))
+	for node, reasons := range saturated {
+		nodes = append(nodes, nodeSaturation{node: node, reasons: reasons})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if len(nodes[i].reasons) != len(nodes[j].reasons) {
+			return len(nodes[i].reasons) > len(nodes[j].reasons)
+		}
+		return nodes[i].node < nodes[j].node
+	})
+
+	var listed []string
+	for i, n := range nodes {
+		if i == maxSaturatedNodes {
+			listed = append(listed, fmt.Sprintf("...and %d more", len(nodes)-maxSaturatedNodes))
+			break
+		}
+		listed = append(listed, fmt.Sprintf("%s (%s)", inlineCode(n.node), strings.Join(n.reasons, ", ")))
+	}
+
+	logger.Debug().Msgf("%d node(s) of the test cluster were saturated", len(nodes))
+	failedTCReport.warnings = append(failedTCReport.warnings, fmt.Sprintf(
+		":warning: **The test cluster ran out of resources**, the timeouts may be caused by the saturated node(s) rather than by the PR's changes: %s",
+		strings.Join(listed, ", ")))
+}
+
+// listGatheredNodeObjects returns the node list dumped by the gather-extra step, and
+// the outputs of `oc adm top nodes` it holds (e.g. oc_cmds/top_nodes), if any
+func listGatheredNodeObjects(ctx context.Context, client *storage.Client, prefix string) (string, []string, error) {
+	if client == nil {
+		return "", nil, errNoGCSClient
+	}
+	nodes := ""
+	var top []string
+
+	it := client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		base := strings.TrimSuffix(path.Base(attrs.Name), path.Ext(attrs.Name))
+		switch {
+		case path.Base(attrs.Name) == gatheredNodesFileName:
+			// the shallowest one, the nested ones being e.g. those of the hosted clusters
+			if nodes == "" || strings.Count(attrs.Name, "/") < strings.Count(nodes, "/") {
+				nodes = attrs.Name
+			}
+		case strings.Contains(base, "top") && strings.Contains(base, "node"):
+			top = append(top, attrs.Name)
+		}
+	}
+
+	return nodes, top, nil
+}
+
+// nodePressures adds the nodes under resource pressure during the job to 'saturated':
+// either still under pressure when gathered, or which recovered during the job
+func nodePressures(content string, start, end time.Time, saturated map[string][]string) error {
+	nodes := &gatheredNodes{}
+	if err := json.Unmarshal([]byte(content), nodes); err != nil {
+		return err
+	}
+
+	for _, node := range nodes.Items {
+		for _, c := range node.Status.Conditions {
+			resource, ok := nodePressureConditions[c.Type]
+			if !ok {
+				continue
+			}
+			switch {
+			case c.Status == "True":
+				saturated[node.Metadata.Name] = append(saturated[node.Metadata.Name], resource+" pressure")
+			case !start.IsZero() && c.LastTransitionTime.After(start) && (end.IsZero() || c.LastTransitionTime.Before(end)):
+				saturated[node.Metadata.Name] = append(saturated[node.Metadata.Name],
+					fmt.Sprintf("%s pressure until %s", resource, c.LastTransitionTime.UTC().Format("15:04:05")))
+			}
+		}
+	}
+	return nil
+}
+
+// nodeUsages adds the nodes whose CPU or memory usage is above the threshold to
+// 'saturated', from the output of `oc adm top nodes`:
+//
+//	NAME       CPU(cores)   CPU%   MEMORY(bytes)   MEMORY%
+//	worker-0   3870m        98%    14210Mi         93%
+func nodeUsages(content string, threshold int, saturated map[string][]string) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] == "NAME" {
+			continue
+		}
+		for _, usage := range []struct {
+			resource, value string
+		}{{"CPU", fields[2]}, {"memory", fields[4]}} {
+			percent, err := strconv.Atoi(strings.TrimSuffix(usage.value, "%"))
+			if err != nil || !strings.HasSuffix(usage.value, "%") {
+				// e.g. <unknown> while the node's metrics are unavailable
+				continue
+			}
+			if percent >= threshold {
+				saturated[fields[0]] = append(saturated[fields[0]], fmt.Sprintf("%s at %d%%", usage.resource, percent))
+			}
+		}
+	}
+}
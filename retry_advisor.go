@@ -0,0 +1,226 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultRetryAdvisorLookback   = 30 * 24 * time.Hour
+	defaultRetryAdvisorMinSamples = 10
+	defaultRetryAdvisorMaxSamples = 150
+	// the retests above this probability are advised over investigating the failures
+	retestLikelyThreshold = 50
+)
+
+// retryAdvisor estimates the probability that a retest of a failed presubmit
+// passes, from the outcome of the retests of the past runs which failed
+// the same way (i.e. sharing a failure fingerprint) on any PR
+type retryAdvisor struct {
+	client     *storage.Client
+	store      FailureStore
+	lookback   time.Duration
+	minSamples int
+	maxSamples int
+
+	mu sync.Mutex
+	// whether the retest of a run passed, by the run's Prow job URL. Only
+	// the finished retests are cached, as their outcome never changes
+	outcomes map[string]bool
+}
+
+func newRetryAdvisor(client *storage.Client, store FailureStore, cfg RetryAdvisorConfig) *retryAdvisor {
+	a := &retryAdvisor{
+		client:     client,
+		store:      store,
+		lookback:   cfg.Lookback,
+		minSamples: cfg.MinSamples,
+		maxSamples: cfg.MaxSamples,
+		outcomes:   map[string]bool{},
+	}
+	if a.lookback <= 0 {
+		a.lookback = defaultRetryAdvisorLookback
+	}
+	if a.minSamples <= 0 {
+		a.minSamples = defaultRetryAdvisorMinSamples
+	}
+	if a.maxSamples < a.minSamples {
+		a.maxSamples = defaultRetryAdvisorMaxSamples
+	}
+	return a
+}
+
+// advise adds to the report the probability that a retest of the job passes,
+// when enough similar runs were retested within the lookback window
+func (a *retryAdvisor) advise(ctx context.Context, logger zerolog.Logger, prowJobURL string, failedTCReport *FailedTestCasesReport) {
+	if a == nil {
+		return
+	}
+	if loc, err := parseProwJobURL(prowJobURL); err != nil || loc.jobType != prowJobTypePresubmit {
+		return
+	}
+
+	fingerprints := map[string]bool{}
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.status != "" {
+			fingerprints[failureFingerprint(tc.suiteName, tc.name)] = true
+		}
+	}
+	if len(fingerprints) == 0 {
+		return
+	}
+
+	now := time.Now()
+	records, err := a.store.ListFailures(ctx, now.Add(-a.lookback), now)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the failures of the similar runs")
+		return
+	}
+
+	passed, samples := 0, 0
+	// the runs without a (finished) retest don't count, so more of them are looked up
+	for i, runURL := range similarRuns(records, fingerprints, prowJobURL) {
+		if samples == a.maxSamples || i == 2*a.maxSamples {
+			break
+		}
+		retestPassed, ok, err := a.outcome(ctx, runURL)
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Failed to look up the retest of %s", runURL)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		samples++
+		if retestPassed {
+			passed++
+		}
+	}
+
+	if samples < a.minSamples {
+		logger.Debug().Msgf("Only %d similar run(s) were retested, not advising on the retest", samples)
+		return
+	}
+	failedTCReport.retestAdvice = retestAdvice(passed, samples)
+}
+
+// retestAdvice renders the probability that a retest passes
+func retestAdvice(passed, samples int) string {
+	probability := passed * 100 / samples
+	if probability > retestLikelyThreshold {
+		return fmt.Sprintf(":game_die: **Retest likely to pass:** %d%% based on %d similar runs", probability, samples)
+	}
+	return fmt.Sprintf(":mag: **Retest unlikely to pass:** %d%% based on %d similar runs, investigating the failures is advised", probability, samples)
+}
+
+// similarRuns returns the Prow job URLs of the runs sharing a failure
+// fingerprint with the given ones, but the given job's run, newest first
+func similarRuns(records []FailureRecord, fingerprints map[string]bool, prowJobURL string) []string {
+	latest := map[string]time.Time{}
+	for _, r := range records {
+		if r.ProwJobURL == prowJobURL || !fingerprints[failureFingerprint(r.SuiteName, r.TestCase)] {
+			continue
+		}
+		if r.Timestamp.After(latest[r.ProwJobURL]) {
+			latest[r.ProwJobURL] = r.Timestamp
+		}
+	}
+
+	runs := make([]string, 0, len(latest))
+	for runURL := range latest {
+		runs = append(runs, runURL)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return latest[runs[i]].After(latest[runs[j]])
+	})
+	return runs
+}
+
+// outcome returns whether the retest of the given presubmit run (i.e. the next
+// run of the same job on the same PR) passed, and false if it has no finished retest
+func (a *retryAdvisor) outcome(ctx context.Context, prowJobURL string) (bool, bool, error) {
+	a.mu.Lock()
+	passed, ok := a.outcomes[prowJobURL]
+	a.mu.Unlock()
+	if ok {
+		return passed, true, nil
+	}
+
+	loc, err := parseProwJobURL(prowJobURL)
+	if err != nil || loc.jobType != prowJobTypePresubmit {
+		return false, false, err
+	}
+	buildID, _ := strconv.ParseUint(loc.buildID, 10, 64)
+
+	jobPrefix := fmt.Sprintf("pr-logs/pull/%s/%d/%s/", loc.orgRepo, loc.prNumber, loc.job)
+	it := a.client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: jobPrefix, Delimiter: "/"})
+	var retestID uint64
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return false, false, errors.Wrapf(err, "failed to list the runs of %s", jobPrefix)
+		}
+		id, err := strconv.ParseUint(path.Base(strings.TrimSuffix(attrs.Prefix, "/")), 10, 64)
+		if attrs.Prefix == "" || err != nil || id <= buildID {
+			continue
+		}
+		if retestID == 0 || id < retestID {
+			retestID = id
+		}
+	}
+	if retestID == 0 {
+		return false, false, nil
+	}
+
+	// the retest is still in progress until finished.json gets uploaded
+	content, err := readGCSObject(ctx, a.client, fmt.Sprintf("%s%d/%s", jobPrefix, retestID, finishedFileName))
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	var finished struct {
+		Passed bool   `json:"passed"`
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(content), &finished); err != nil {
+		return false, false, errors.Wrapf(err, "failed to parse %s", finishedFileName)
+	}
+	passed = finished.Passed || finished.Result == "SUCCESS"
+
+	a.mu.Lock()
+	a.outcomes[prowJobURL] = passed
+	a.mu.Unlock()
+
+	return passed, true, nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the PR's changed files listed at most, GitHub's own limit being 3000
+	maxReviewedFiles = 3000
+	// the failures remembered as commented on, the oldest PRs being forgotten first
+	maxReviewCommentedFailures = 10000
+	reviewCommentMessageLines  = 10
+)
+
+var (
+	// e.g. "/go/src/github.com/org/repo/tests/build/build.go:123"
+	specLocationRegex = regexp.MustCompile(`^(.+):(\d+)$`)
+	// e.g. "@@ -10,7 +12,9 @@ func ..."
+	diffHunkHeaderRegex = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// reviewComments posts inline review comments on the spec files of the
+// failures which the PR changes, each failure being commented once per PR.
+// A nil reviewComments posts nothing
+type reviewComments struct {
+	mu sync.Mutex
+	// the commented failures, keyed by "<repo>#<PR>/<fingerprint>"
+	posted map[string]bool
+	order  []string
+}
+
+func newReviewComments() *reviewComments {
+	return &reviewComments{posted: map[string]bool{}}
+}
+
+// diffLines are the lines of a file's new version shown by the PR's diff
+type diffLines struct {
+	lines map[int]bool
+	// the first line of the first hunk, where the comments on the
+	// lines outside of the diff get anchored
+	first int
+}
+
+// parseDiffLines returns the lines of the new version of the file shown within its patch
+func parseDiffLines(patch string) diffLines {
+	d := diffLines{lines: map[int]bool{}}
+	line := 0
+	for _, l := range strings.Split(patch, "\n") {
+		if m := diffHunkHeaderRegex.FindStringSubmatch(l); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			if d.first == 0 {
+				d.first = line
+			}
+			continue
+		}
+		if line == 0 || strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`) {
+			continue
+		}
+		d.lines[line] = true
+		line++
+	}
+	return d
+}
+
+// parseSpecLocation splits the spec's location into its file's path and line
+func parseSpecLocation(location string) (string, int, bool) {
+	m := specLocationRegex.FindStringSubmatch(location)
+	if m == nil {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], line, true
+}
+
+// matchChangedFile returns the changed file the location's path points to, the
+// locations being absolute paths within the test's environment (e.g. /go/src/...)
+func matchChangedFile(files map[string]diffLines, path string) string {
+	matched := ""
+	for name := range files {
+		if (path == name || strings.HasSuffix(path, "/"+name)) && len(name) > len(matched) {
+			matched = name
+		}
+	}
+	return matched
+}
+
+// annotate posts a review of the PR commenting the spec files of up to
+// 'max' of the report's failures, when the PR changes these files
+func (rc *reviewComments) annotate(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, failedTCReport *FailedTestCasesReport, max int) {
+	if rc == nil || max <= 0 {
+		return
+	}
+	var located []failedTestCase
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.status != "" && tc.location != "" && !tc.teardown {
+			located = append(located, tc)
+		}
+	}
+	if len(located) == 0 {
+		return
+	}
+
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	prNumber := event.GetIssue().GetNumber()
+	files, err := listChangedFiles(ctx, client, repoOwner, repoName, prNumber)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the files changed by the PR")
+		return
+	}
+
+	var comments []*github.DraftReviewComment
+	var keys []string
+	for _, tc := range located {
+		if len(comments) == max {
+			logger.Debug().Msgf("Reached the maximum of %d review comments", max)
+			break
+		}
+		path, line, ok := parseSpecLocation(tc.location)
+		if !ok {
+			continue
+		}
+		name := matchChangedFile(files, path)
+		if name == "" {
+			continue
+		}
+		key := prKey(event.GetRepo().GetFullName(), prNumber) + "/" + failureFingerprint(tc.suiteName, tc.name)
+		if rc.isPosted(key) {
+			continue
+		}
+
+		body := reviewCommentBody(tc, failedTCReport.prowJobURL)
+		if !files[name].lines[line] {
+			// only the lines shown by the diff can be commented on
+			body = fmt.Sprintf("_The spec is at line %d of this file._\n\n", line) + body
+			line = files[name].first
+		}
+		comments = append(comments, &github.DraftReviewComment{Path: github.String(name), Line: github.Int(line), Side: github.String("RIGHT"), Body: &body})
+		keys = append(keys, key)
+	}
+	if len(comments) == 0 {
+		return
+	}
+
+	review := &github.PullRequestReviewRequest{
+		Body:     github.String(fmt.Sprintf(":rotating_light: %d of the spec(s) this PR changes failed in the [Prow job](%s).", len(comments), failedTCReport.prowJobURL)),
+		Event:    github.String("COMMENT"),
+		Comments: comments,
+	}
+	if _, _, err := client.PullRequests.CreateReview(ctx, repoOwner, repoName, prNumber, review); err != nil {
+		logger.Error().Err(err).Msg("Failed to post the review comments on the failed specs")
+		return
+	}
+	rc.markPosted(keys)
+	logger.Debug().Msgf("Posted %d review comment(s) on the failed specs", len(comments))
+}
+
+// reviewCommentBody renders the failure commented on its spec's file
+func reviewCommentBody(tc failedTestCase, prowJobURL string) string {
+	message := strings.Split(strings.TrimSpace(tc.message), "\n")
+	if len(message) > reviewCommentMessageLines {
+		message = append(message[:reviewCommentMessageLines], "...")
+	}
+	return fmt.Sprintf(":x: [**`%s`**] %s in the [Prow job](%s)\n%s", tc.status, tc.name, prowJobURL, codeBlock(strings.Join(message, "\n")))
+}
+
+// listChangedFiles returns the diff lines of the files changed by the PR, keyed by their path
+func listChangedFiles(ctx context.Context, client *github.Client, repoOwner, repoName string, prNumber int) (map[string]diffLines, error) {
+	files := map[string]diffLines{}
+	opts := &github.ListOptions{PerPage: 100}
+	for len(files) < maxReviewedFiles {
+		page, resp, err := client.PullRequests.ListFiles(ctx, repoOwner, repoName, prNumber, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page {
+			// the removed files have nothing to comment on, nor have the too large diffs
+			if f.GetStatus() == "removed" || f.GetPatch() == "" {
+				continue
+			}
+			files[f.GetFilename()] = parseDiffLines(f.GetPatch())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return files, nil
+}
+
+func (rc *reviewComments) isPosted(key string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.posted[key]
+}
+
+func (rc *reviewComments) markPosted(keys []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for _, key := range keys {
+		rc.posted[key] = true
+		rc.order = append(rc.order, key)
+	}
+	for len(rc.order) > maxReviewCommentedFailures {
+		delete(rc.posted, rc.order[0])
+		rc.order = rc.order[1:]
+	}
+}
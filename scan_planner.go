@@ -0,0 +1,376 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	prowArtifactsBucketName = "test-platform-results"
+	prowJobFileName         = "prowjob.json"
+	rootBuildLogFileName    = "build-log.txt"
+	rootStepName            = "/"
+	// the pod utilities upload the files a step writes to $ARTIFACT_DIR under this directory
+	podUtilsArtifactsDir = "artifacts/"
+)
+
+// podUtilsStepFileNames are the files the pod utilities write
+// at the root of each step's directory
+var podUtilsStepFileNames = []string{rootBuildLogFileName, finishedFileName, sidecarLogsFileName}
+
+// gatherStepNames are the steps which upload huge trees of cluster
+// state, none of which contain files the report is built from
+var gatherStepNames = []string{"gather-extra", "gather-must-gather", "gather-audit-logs", "redhat-appstudio-gather"}
+
+// prowJob contains the subset of the ProwJob fields used for planning a scan
+type prowJob struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		Type    string `json:"type"`
+		Job     string `json:"job"`
+		PodSpec struct {
+			Containers []struct {
+				Args []string `json:"args"`
+			} `json:"containers"`
+		} `json:"pod_spec"`
+	} `json:"spec"`
+	Status struct {
+		State string `json:"state"`
+		URL   string `json:"url"`
+	} `json:"status"`
+}
+
+// scanPlan lists the GCS prefixes which need to be listed
+// to find the files required for analysing a Prow job
+type scanPlan struct {
+	jobPrefix       string
+	artifactsPrefix string
+	stepPrefixes    map[string]string
+	// limits the size of the fetched files
+	sizes *artifactSizePolicies
+}
+
+// gcsPathFromProwJobURL returns the path of the Prow job's
+// directory within the bucket with Prow artifacts
+func gcsPathFromProwJobURL(prowJobURL string) (string, error) {
+	sp := strings.Split(prowJobURL, "/"+prowArtifactsBucketName+"/")
+	if len(sp) != 2 {
+		return "", fmt.Errorf("failed to determine the GCS path of the Prow job: %s", prowJobURL)
+	}
+	return strings.TrimSuffix(sp[1], "/"), nil
+}
+
+// readGCSObject returns the content of the given object from the Prow artifacts bucket
+func readGCSObject(ctx context.Context, client *storage.Client, objectName string) (string, error) {
+	if client == nil {
+		return "", errNoGCSClient
+	}
+	rc, err := client.Bucket(prowArtifactsBucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create reader for %s", objectName)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", objectName)
+	}
+
+	return string(data), nil
+}
+
+// fetchProwJob reads and parses the prowjob.json stored alongside the Prow job's artifacts
+func fetchProwJob(ctx context.Context, client *storage.Client, jobPrefix string) (*prowJob, error) {
+	content, err := readGCSObject(ctx, client, jobPrefix+"/"+prowJobFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	pj := &prowJob{}
+	if err := json.Unmarshal([]byte(content), pj); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", prowJobFileName)
+	}
+
+	return pj, nil
+}
+
+// target returns the ci-operator target the Prow job runs
+func (pj *prowJob) target() (string, error) {
+	for _, container := range pj.Spec.PodSpec.Containers {
+		for _, arg := range container.Args {
+			if strings.HasPrefix(arg, "--target=") {
+				return strings.TrimPrefix(arg, "--target="), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("the Prow job %s doesn't specify a ci-operator target", pj.Spec.Job)
+}
+
+// planScan builds a scanPlan for the Prow job with the given URL
+func planScan(ctx context.Context, client *storage.Client, prowJobURL string) (*scanPlan, error) {
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return planScanForJobPrefix(ctx, client, jobPrefix)
+}
+
+// planScanForJobPrefix builds a scanPlan for the Prow job stored under
+// the given GCS prefix by reading its prowjob.json and listing only
+// the steps run for the job's target
+func planScanForJobPrefix(ctx context.Context, client *storage.Client, jobPrefix string) (*scanPlan, error) {
+	pj, err := fetchProwJob(ctx, client, jobPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := pj.target()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &scanPlan{
+		jobPrefix:       jobPrefix,
+		artifactsPrefix: jobPrefix + "/artifacts/" + target + "/",
+		stepPrefixes:    map[string]string{},
+	}
+
+	it := client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: plan.artifactsPrefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list the steps of the Prow job")
+		}
+		if attrs.Prefix == "" {
+			continue
+		}
+
+		stepName := path.Base(attrs.Prefix)
+		if isGatherStep(stepName) {
+			continue
+		}
+		plan.stepPrefixes[stepName] = attrs.Prefix
+	}
+
+	return plan, nil
+}
+
+// execute downloads the files matching the given filename
+// regexes into the scanner's ArtifactStepMap
+func (plan *scanPlan) execute(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner, fileNameFilter []string) error {
+	var filters []*regexp.Regexp
+	for _, f := range fileNameFilter {
+		r, err := regexp.Compile(f)
+		if err != nil {
+			return errors.Wrapf(err, "invalid file name filter: %s", f)
+		}
+		filters = append(filters, r)
+	}
+
+	scanner.ArtifactDirectoryPrefix = plan.artifactsPrefix
+	scanner.ArtifactStepMap = map[prow.ArtifactStepName]prow.ArtifactFilenameMap{}
+
+	// identify the failed steps even when they didn't upload their own junit files
+	if err := fetchCIOperatorJUnit(ctx, scanner, plan.sizes, plan.jobPrefix); err != nil {
+		return err
+	}
+
+	// same as the ArtifactScanner, fall back to the root build-log.txt when no step ran
+	if len(plan.stepPrefixes) == 0 {
+		logger.Debug().Msgf("No steps found within %s, fetching the root %s", plan.artifactsPrefix, rootBuildLogFileName)
+		return addArtifactToStepMap(ctx, scanner, plan.sizes, rootStepName, plan.jobPrefix+"/"+rootBuildLogFileName, unknownArtifactSize)
+	}
+
+	for stepName, prefix := range plan.stepPrefixes {
+		// the files the step wrote are uploaded within its artifacts directory, the
+		// whole step's directory is listed only when it doesn't have one
+		found, err := listStepArtifacts(ctx, scanner, plan.sizes, stepName, prefix, podUtilsArtifactsDir, filters)
+		if err != nil {
+			return err
+		}
+		if !found {
+			logger.Debug().Msgf("The step %s doesn't follow the pod utilities layout, listing all of its files", stepName)
+			if _, err := listStepArtifacts(ctx, scanner, plan.sizes, stepName, prefix, "", filters); err != nil {
+				return err
+			}
+		}
+
+		// the pod utilities write the well-known files at the root of the step's
+		// directory, they can be fetched without listing anything. They're fetched
+		// last, so that they win over the step's own files of the same name
+		for _, name := range podUtilsStepFileNames {
+			if !matchesAny(filters, prefix+name) {
+				continue
+			}
+			if err := addArtifactToStepMap(ctx, scanner, plan.sizes, stepName, prefix+name, unknownArtifactSize); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// listStepArtifacts fetches the files under the step's directory 'dir' matching the
+// filters, but the well-known pod utilities' files at the root of the step's
+// directory, and returns whether there were any files under the directory at all
+func listStepArtifacts(ctx context.Context, scanner *prow.ArtifactScanner, sizes *artifactSizePolicies, stepName, stepPrefix, dir string, filters []*regexp.Regexp) (bool, error) {
+	found := false
+
+	it := scanner.Client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: stepPrefix + dir})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return found, errors.Wrapf(err, "failed to list artifacts of the step %s", stepName)
+		}
+		found = true
+		if !matchesAny(filters, attrs.Name) || isPodUtilsStepFile(stepPrefix, attrs.Name) {
+			continue
+		}
+		if path.Ext(attrs.Name) == ".xml" && sizes.streamable(attrs.Name, attrs.Size) {
+			// the junit files are decoded while streamed from GCS, however large they are
+			setStepArtifact(scanner, stepName, prow.Artifact{FullName: attrs.Name})
+			continue
+		}
+		if err := addArtifactToStepMap(ctx, scanner, sizes, stepName, attrs.Name, attrs.Size); err != nil {
+			return found, err
+		}
+	}
+
+	return found, nil
+}
+
+// isPodUtilsStepFile returns whether the object is one of the well-known files
+// at the root of the step's directory, which are fetched directly. The files of
+// the same name within its subdirectories are the step's own
+func isPodUtilsStepFile(stepPrefix, objectName string) bool {
+	for _, name := range podUtilsStepFileNames {
+		if objectName == stepPrefix+name {
+			return true
+		}
+	}
+	return false
+}
+
+// addArtifactToStepMap downloads the given object and stores it within
+// the scanner's ArtifactStepMap under the given step, unless the object
+// exceeds the size its policy allows
+func addArtifactToStepMap(ctx context.Context, scanner *prow.ArtifactScanner, sizes *artifactSizePolicies, stepName, objectName string, size int64) error {
+	content, err := sizes.readArtifact(ctx, scanner.Client, objectName, size)
+	if errors.Is(err, errArtifactTooLarge) {
+		zerolog.Ctx(ctx).Debug().Msgf("Skipping %s, which exceeds the maximum size of its type", objectName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	setStepArtifact(scanner, stepName, prow.Artifact{Content: content, FullName: objectName})
+	return nil
+}
+
+// setStepArtifact stores the artifact within the scanner's ArtifactStepMap under the given step.
+// The artifacts without content are read from GCS when needed, e.g. the streamed junit files
+func setStepArtifact(scanner *prow.ArtifactScanner, stepName string, artifact prow.Artifact) {
+	if scanner.ArtifactStepMap == nil {
+		scanner.ArtifactStepMap = map[prow.ArtifactStepName]prow.ArtifactFilenameMap{}
+	}
+	step := prow.ArtifactStepName(stepName)
+	if scanner.ArtifactStepMap[step] == nil {
+		scanner.ArtifactStepMap[step] = prow.ArtifactFilenameMap{}
+	}
+	scanner.ArtifactStepMap[step][prow.ArtifactFilename(path.Base(artifact.FullName))] = artifact
+}
+
+// runScan fetches the Prow job's artifacts with the given client using a
+// targeted scan plan, falling back to the ArtifactScanner's full scan when
+// the plan can't be built (e.g. the prowjob.json file is missing)
+func runScan(ctx context.Context, logger zerolog.Logger, client *storage.Client, prowJobURL string, fileNameFilter []string, sizes *artifactSizePolicies) (*prow.ArtifactScanner, error) {
+	plan, err := planScan(ctx, client, prowJobURL)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Unable to plan a targeted scan, falling back to the full scan")
+		return fullScan(client, prowJobURL, fileNameFilter)
+	}
+
+	plan.sizes = sizes
+
+	scanner := &prow.ArtifactScanner{Client: client}
+	if err := plan.execute(ctx, logger, scanner, fileNameFilter); err != nil {
+		return nil, err
+	}
+	return scanner, nil
+}
+
+// fullScan runs the ArtifactScanner's full scan with the given client. The
+// scanner can only be configured by creating it along with its own client,
+// which is closed right away
+func fullScan(client *storage.Client, prowJobURL string, fileNameFilter []string) (*prow.ArtifactScanner, error) {
+	scanner, err := prow.NewArtifactScanner(prow.ScannerConfig{
+		ProwJobURL:     prowJobURL,
+		FileNameFilter: fileNameFilter,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize ArtifactScanner: %+v", err)
+	}
+	scanner.Client.Close()
+	scanner.Client = client
+
+	if err := scanner.Run(); err != nil {
+		return nil, err
+	}
+	return scanner, nil
+}
+
+func isGatherStep(stepName string) bool {
+	for _, s := range gatherStepNames {
+		if s == stepName {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(regexps []*regexp.Regexp, s string) bool {
+	for _, r := range regexps {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SinkPreviewRoute  string = "/admin/sinks/preview"
+	sinkTemplateExt          = ".tmpl"
+	sinkSlack                = "slack"
+	sinkJira                 = "jira"
+	sinkEmail                = "email"
+	defaultSinkLocale        = "en"
+)
+
+// defaultSinkTemplates render the reports for the outbound sinks, unless
+// the templates directory overrides them. They're executed with the
+// reportPage of the analysis, the structured form of its report
+var defaultSinkTemplates = map[string]string{
+	// Slack's Block Kit
+	sinkSlack: `{"blocks": [
+  {"type": "header", "text": {"type": "plain_text", "text": {{json (truncate .Header 150)}}}},
+  {"type": "section", "text": {"type": "mrkdwn", "text": {{json (printf "<https://github.com/%s/pull/%d|%s#%d> · <%s|Prow job>" .Repository .PullRequest .Repository .PullRequest .ProwJobURL)}}}}
+{{- range .Failures}},
+  {"type": "section", "text": {"type": "mrkdwn", "text": {{json (printf "*%s* %s\n%s" .Status .Name (truncate .Message 500))}}}}
+{{- end}}
+{{- with .NextStep}},
+  {"type": "context", "elements": [{"type": "mrkdwn", "text": {{json .}}}]}
+{{- end}}
+]}
+`,
+	// Jira's wiki markup
+	sinkJira: `h3. {{.Header}}
+[{{.Repository}}#{{.PullRequest}}|https://github.com/{{.Repository}}/pull/{{.PullRequest}}] · [Prow job|{{.ProwJobURL}}]
+{{range .Failures}}
+* *{{.Status}}* {{.Name}}
+{noformat}{{truncate .Message 2000}}{noformat}
+{{- end}}
+{{with .NextStep}}
+_Next step:_ {{.}}
+{{end}}`,
+	sinkEmail: `{{.Header}}
+
+Pull request: https://github.com/{{.Repository}}/pull/{{.PullRequest}}
+Prow job: {{.ProwJobURL}}
+{{range .Failures}}
+- [{{.Status}}] {{.Name}}
+  {{truncate .Message 2000}}
+{{end}}
+{{- with .NextStep}}
+Next step: {{.}}
+{{end}}`,
+}
+
+var sinkTemplateFuncs = template.FuncMap{
+	// quotes the value as a JSON string
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"truncate": func(s string, n int) string {
+		runes := []rune(s)
+		if len(runes) <= n {
+			return s
+		}
+		return string(runes[:n]) + "…"
+	},
+}
+
+// sinkTemplates renders the reports for each outbound sink, in each locale
+type sinkTemplates struct {
+	// keyed by "<sink>" or "<sink>.<locale>"
+	templates map[string]*template.Template
+}
+
+// loadSinkTemplates parses the default templates, and the templates of
+// the directory (if any) named "<sink>[.<locale>].tmpl", e.g. "jira.de.tmpl"
+func loadSinkTemplates(dir string) (*sinkTemplates, error) {
+	sources := map[string]string{}
+	for name, text := range defaultSinkTemplates {
+		sources[name] = text
+	}
+
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+sinkTemplateExt))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed reading the sink template: %s", file)
+			}
+			sources[strings.TrimSuffix(filepath.Base(file), sinkTemplateExt)] = string(content)
+		}
+	}
+
+	t := &sinkTemplates{templates: map[string]*template.Template{}}
+	for name, text := range sources {
+		parsed, err := template.New(name).Funcs(sinkTemplateFuncs).Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sink template %s", name)
+		}
+		t.templates[name] = parsed
+	}
+
+	return t, nil
+}
+
+// render renders the report for the sink in the given locale, falling back to the sink's default template
+func (t *sinkTemplates) render(sink, locale string, page *reportPage) (string, error) {
+	tmpl, ok := t.templates[sink+"."+locale]
+	if !ok {
+		if tmpl, ok = t.templates[sink]; !ok {
+			return "", fmt.Errorf("no template for the sink %s", sink)
+		}
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, page); err != nil {
+		return "", errors.Wrapf(err, "failed rendering the %s template", tmpl.Name())
+	}
+	return b.String(), nil
+}
+
+// SinkPreviewHandler renders the latest report of a PR with a sink's
+// template, so that the templates can be checked before deploying them
+type SinkPreviewHandler struct {
+	Templates *sinkTemplates
+	Analyses  *analysisCache
+}
+
+func (h *SinkPreviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prNumber, err := strconv.Atoi(query.Get("pr"))
+	if err != nil || query.Get("repo") == "" || query.Get("sink") == "" {
+		http.Error(w, "the 'sink', 'repo' and 'pr' query parameters are required", http.StatusBadRequest)
+		return
+	}
+	locale := query.Get("locale")
+	if locale == "" {
+		locale = defaultSinkLocale
+	}
+
+	a := h.Analyses.get(query.Get("repo"), prNumber)
+	if a == nil {
+		http.Error(w, "no recent report for the PR", http.StatusNotFound)
+		return
+	}
+	page := newReportPage("", query.Get("repo"), prNumber, a.prowJobURL, a.report)
+
+	rendered, err := h.Templates.render(query.Get("sink"), locale, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, rendered)
+}
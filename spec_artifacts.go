@@ -0,0 +1,125 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// browses the directories of the Prow artifacts bucket
+	gcsWebURL = "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/"
+	// the directories shorter than this only match the specs' full names
+	minSpecLeafLength = 10
+)
+
+// specArtifactsDirs are where the e2e framework uploads the artifacts of each
+// spec (e.g. its pods' logs), relative to the step's artifacts directory
+var specArtifactsDirs = []string{"rp_preproc/attachments/xunit/", ""}
+
+var specDirNameRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normalizeSpecDirName returns the name as the e2e framework sanitizes it into a directory's name
+func normalizeSpecDirName(name string) string {
+	return strings.Trim(specDirNameRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// linkSpecArtifacts links each failed spec to the directory of the
+// artifacts the e2e framework uploaded for it, if any
+func (failedTCReport *FailedTestCasesReport) linkSpecArtifacts(ctx context.Context, logger zerolog.Logger, scanner *prow.ArtifactScanner) {
+	if scanner.ArtifactDirectoryPrefix == "" {
+		return
+	}
+
+	// the spec directories of the steps which uploaded test results, by their normalized name
+	dirs := map[string]string{}
+	for stepName := range scanner.ArtifactStepMap {
+		if stepName == rootStepName || stepName == ciOperatorStepName {
+			continue
+		}
+		for _, dir := range specArtifactsDirs {
+			prefix := scanner.ArtifactDirectoryPrefix + string(stepName) + "/" + podUtilsArtifactsDir + dir
+			if err := listSpecDirs(ctx, scanner.Client, prefix, dirs); err != nil {
+				logger.Debug().Err(err).Msgf("Failed to list the spec directories of the step %s", stepName)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return
+	}
+
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.name == "" || tc.suiteName == ciOperatorStepName {
+			continue
+		}
+		if dir := matchSpecDir(dirs, tc.name); dir != "" {
+			failedTCReport.failedTestCases[i].notes = append(failedTCReport.failedTestCases[i].notes,
+				fmt.Sprintf(":file_folder: [Artifacts of the spec](%s%s/%s) (e.g. its pods' logs)", gcsWebURL, prowArtifactsBucketName, dir))
+		}
+	}
+}
+
+// listSpecDirs adds the directories right under the prefix to 'dirs'
+func listSpecDirs(ctx context.Context, client *storage.Client, prefix string, dirs map[string]string) error {
+	if client == nil {
+		return errNoGCSClient
+	}
+	it := client.Bucket(prowArtifactsBucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// only the "directories" have a prefix
+		if attrs.Prefix == "" {
+			continue
+		}
+		name := normalizeSpecDirName(path.Base(attrs.Prefix))
+		if _, ok := dirs[name]; !ok && name != "" {
+			dirs[name] = attrs.Prefix
+		}
+	}
+}
+
+// matchSpecDir returns the directory named after the spec, either its full
+// name or, the containers' text being left out, its leaf's text
+func matchSpecDir(dirs map[string]string, specName string) string {
+	name := normalizeSpecDirName(specName)
+	if dir, ok := dirs[name]; ok {
+		return dir
+	}
+
+	// the longest leaf is the most specific one
+	var matched, matchedName string
+	for dirName, dir := range dirs {
+		if len(dirName) >= minSpecLeafLength && strings.HasSuffix(name, "-"+dirName) && len(dirName) > len(matchedName) {
+			matched, matchedName = dir, dirName
+		}
+	}
+	return matched
+}
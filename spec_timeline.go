@@ -0,0 +1,149 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// format of the timestamps Ginkgo adds to its output, e.g. "STEP: ... @ 06/12/24 10:15:32.123"
+	ginkgoTimestampLayout = "01/02/06 15:04:05.000"
+	maxTimelineEvents     = 25
+	maxTimelineEventLen   = 120
+)
+
+const (
+	timelinePhaseSetup    = "setup"
+	timelinePhaseAction   = "action"
+	timelinePhaseFailure  = "failure"
+	timelinePhaseTeardown = "teardown"
+)
+
+var (
+	ginkgoTimestampRegex  = regexp.MustCompile(`\s*@?\s*(\d{2}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{3})\s*$`)
+	rfc3339TimestampRegex = regexp.MustCompile(`^\s*(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2}))\s*`)
+
+	// the markers of the lines making up the timeline, checked in order
+	timelinePhaseMarkers = []struct {
+		phase   string
+		markers []string
+	}{
+		{timelinePhaseFailure, []string{"[FAILED]", "[TIMEDOUT]", "[PANICKED]", "[INTERRUPTED]"}},
+		{timelinePhaseSetup, []string{"[BeforeEach]", "[JustBeforeEach]", "[BeforeAll]", "[BeforeSuite]", "[SynchronizedBeforeSuite]"}},
+		{timelinePhaseTeardown, []string{"[AfterEach]", "[JustAfterEach]", "[AfterAll]", "[AfterSuite]", "[SynchronizedAfterSuite]", "[DeferCleanup"}},
+		{timelinePhaseAction, []string{"STEP:", "[It]"}},
+	}
+)
+
+type timelineEvent struct {
+	timestamp time.Time
+	phase     string
+	text      string
+}
+
+// parseSpecTimeline reconstructs the timeline of a spec from the
+// timestamped Ginkgo steps and nodes found within its output
+func parseSpecTimeline(output ...string) []timelineEvent {
+	var events []timelineEvent
+
+	for _, content := range output {
+		lines := strings.Split(content, "\n")
+		for i, line := range lines {
+			phase := timelinePhase(line)
+			if phase == "" {
+				continue
+			}
+			// Ginkgo prints the location and timestamp of the nodes on the following line
+			if !ginkgoTimestampRegex.MatchString(line) && i+1 < len(lines) && timelinePhase(lines[i+1]) == "" {
+				if m := ginkgoTimestampRegex.FindStringSubmatch(lines[i+1]); m != nil {
+					line = line + " @ " + m[1]
+				}
+			}
+
+			text := line
+			var timestamp time.Time
+			if m := ginkgoTimestampRegex.FindStringSubmatchIndex(line); m != nil {
+				t, err := time.Parse(ginkgoTimestampLayout, line[m[2]:m[3]])
+				if err != nil {
+					continue
+				}
+				timestamp, text = t, line[:m[0]]
+			} else if m := rfc3339TimestampRegex.FindStringSubmatchIndex(line); m != nil {
+				t, err := time.Parse(time.RFC3339Nano, line[m[2]:m[3]])
+				if err != nil {
+					continue
+				}
+				timestamp, text = t.UTC(), line[m[1]:]
+			} else {
+				continue
+			}
+
+			events = append(events, timelineEvent{timestamp: timestamp, phase: phase, text: strings.TrimSpace(text)})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].timestamp.Before(events[j].timestamp) })
+	return events
+}
+
+func timelinePhase(line string) string {
+	for _, pm := range timelinePhaseMarkers {
+		for _, marker := range pm.markers {
+			if strings.Contains(line, marker) {
+				return pm.phase
+			}
+		}
+	}
+	return ""
+}
+
+// renderSpecTimeline renders the timeline as a table within a dropdown,
+// keeping the events closest to the failure when there are too many
+func renderSpecTimeline(events []timelineEvent) string {
+	if len(events) < 2 {
+		return ""
+	}
+
+	start := events[0].timestamp
+	omitted := 0
+	if len(events) > maxTimelineEvents {
+		omitted = len(events) - maxTimelineEvents
+		events = events[omitted:]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<details>\n<summary>Timeline (started at %s)</summary>\n\n", start.Format("15:04:05"))
+	if omitted > 0 {
+		fmt.Fprintf(&b, "_%d earlier event(s) omitted_\n\n", omitted)
+	}
+	b.WriteString("| Elapsed | Phase | Event |\n|---|---|---|\n")
+	for _, e := range events {
+		text := e.text
+		if len(text) > maxTimelineEventLen {
+			text = text[:maxTimelineEventLen] + "..."
+		}
+		text = strings.ReplaceAll(text, "|", "\\|")
+		text = strings.ReplaceAll(text, "`", "'")
+		fmt.Fprintf(&b, "| +%s | %s | `%s` |\n", e.timestamp.Sub(start).Round(time.Millisecond), e.phase, text)
+	}
+	b.WriteString("</details>")
+
+	return b.String()
+}
@@ -0,0 +1,426 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// the database/sql drivers of the failure store
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	failureStoreMemory   = "memory"
+	failureStorePostgres = "postgres"
+	failureStoreSQLite   = "sqlite"
+
+	// the database/sql drivers linked into the binary, github.com/jackc/pgx and modernc.org/sqlite (pure Go)
+	defaultPostgresDriver = "pgx"
+	defaultSQLiteDriver   = "sqlite"
+	// the test cases counted at most per query
+	maxCountedTestCases = 500
+	// the comments' hashes are forgotten once their comment wasn't written for this long
+	commentHashRetention = 30 * 24 * time.Hour
+	// the failures whose messages are rewritten per query
+	rewrittenFailuresBatchSize = 500
+)
+
+// sqlFailureStore is a FailureStore persisted in a Postgres database, or in
+// an SQLite one for the local runs. Another driver must be linked into the binary
+type sqlFailureStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func newSQLFailureStore(ctx context.Context, cfg FailureStoreConfig) (*sqlFailureStore, error) {
+	driver := cfg.Driver
+	if driver == "" {
+		driver = defaultPostgresDriver
+		if cfg.Kind == failureStoreSQLite {
+			driver = defaultSQLiteDriver
+		}
+	}
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driver
+	}
+	if !registered {
+		return nil, fmt.Errorf("the %s database driver isn't linked into the binary", driver)
+	}
+
+	dsn := cfg.DSN
+	if cfg.DSNFile != "" {
+		content, err := os.ReadFile(cfg.DSNFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the failure store's DSN file %s", cfg.DSNFile)
+		}
+		dsn = strings.TrimSpace(string(content))
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open the %s failure store", cfg.Kind)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "failed to connect to the %s failure store", cfg.Kind)
+	}
+
+	s := &sqlFailureStore{db: db, dialect: cfg.Kind}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate creates the failures' table and its indexes, unless they exist
+func (s *sqlFailureStore) migrate(ctx context.Context) error {
+	id := "BIGSERIAL PRIMARY KEY"
+	if s.dialect == failureStoreSQLite {
+		id = "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ci_helper_failures (
+			id ` + id + `,
+			recorded_at TIMESTAMP NOT NULL,
+			repository TEXT NOT NULL,
+			pull_request INTEGER NOT NULL,
+			prow_job_url TEXT NOT NULL,
+			suite_name TEXT NOT NULL,
+			test_case TEXT NOT NULL,
+			status TEXT NOT NULL,
+			message TEXT NOT NULL,
+			message_ref TEXT NOT NULL,
+			failure_kind TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ci_helper_failures_recorded_at ON ci_helper_failures (recorded_at)`,
+		`CREATE INDEX IF NOT EXISTS ci_helper_failures_test_case ON ci_helper_failures (test_case, recorded_at)`,
+		`CREATE TABLE IF NOT EXISTS ci_helper_job_durations (
+			id ` + id + `,
+			recorded_at TIMESTAMP NOT NULL,
+			repository TEXT NOT NULL,
+			pull_request INTEGER NOT NULL,
+			prow_job_url TEXT NOT NULL,
+			job_name TEXT NOT NULL,
+			duration_seconds BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ci_helper_job_durations_recorded_at ON ci_helper_job_durations (recorded_at)`,
+		`CREATE TABLE IF NOT EXISTS ci_helper_comment_hashes (
+			comment_id BIGINT PRIMARY KEY,
+			hash TEXT NOT NULL,
+			written_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ci_helper_comment_hashes_written_at ON ci_helper_comment_hashes (written_at)`,
+		`CREATE TABLE IF NOT EXISTS ci_helper_mention_opt_outs (
+			login TEXT PRIMARY KEY,
+			opted_out_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ci_helper_locks (
+			lock_key TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return errors.Wrap(err, "failed to create the failure store's tables")
+		}
+	}
+	return nil
+}
+
+// placeholder returns the placeholder of the n-th parameter of a query, counted from 1
+func (s *sqlFailureStore) placeholder(n int) string {
+	if s.dialect == failureStoreSQLite {
+		return "?"
+	}
+	return "$" + strconv.Itoa(n)
+}
+
+func (s *sqlFailureStore) RecordFailures(ctx context.Context, records []FailureRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to record the failures")
+	}
+	defer tx.Rollback()
+
+	placeholders := make([]string, 10)
+	for i := range placeholders {
+		placeholders[i] = s.placeholder(i + 1)
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO ci_helper_failures
+		(recorded_at, repository, pull_request, prow_job_url, suite_name, test_case, status, message, message_ref, failure_kind)
+		VALUES (`+strings.Join(placeholders, ", ")+`)`)
+	if err != nil {
+		return errors.Wrap(err, "failed to record the failures")
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err := stmt.ExecContext(ctx, r.Timestamp.UTC(), r.Repository, r.PullRequest, r.ProwJobURL,
+			r.SuiteName, r.TestCase, r.Status, r.Message, r.MessageRef, r.FailureKind); err != nil {
+			return errors.Wrap(err, "failed to record the failures")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to record the failures")
+}
+
+func (s *sqlFailureStore) ListFailures(ctx context.Context, from, to time.Time) ([]FailureRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT recorded_at, repository, pull_request, prow_job_url, suite_name,
+		test_case, status, message, message_ref, failure_kind
+		FROM ci_helper_failures WHERE recorded_at >= `+s.placeholder(1)+` AND recorded_at < `+s.placeholder(2)+`
+		ORDER BY recorded_at`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the failures")
+	}
+	defer rows.Close()
+
+	var records []FailureRecord
+	for rows.Next() {
+		var r FailureRecord
+		if err := rows.Scan(&r.Timestamp, &r.Repository, &r.PullRequest, &r.ProwJobURL, &r.SuiteName,
+			&r.TestCase, &r.Status, &r.Message, &r.MessageRef, &r.FailureKind); err != nil {
+			return nil, errors.Wrap(err, "failed to list the failures")
+		}
+		records = append(records, r)
+	}
+	return records, errors.Wrap(rows.Err(), "failed to list the failures")
+}
+
+// RewriteFailureMessages goes through the failures by batches of their IDs,
+// updating the rewritten messages one by one
+func (s *sqlFailureStore) RewriteFailureMessages(ctx context.Context, rewrite func(message string) (string, bool, error)) (int, error) {
+	type storedMessage struct {
+		id      int64
+		message string
+	}
+
+	rewritten := 0
+	var lastID int64
+	for {
+		rows, err := s.db.QueryContext(ctx, `SELECT id, message FROM ci_helper_failures WHERE id > `+s.placeholder(1)+`
+			ORDER BY id LIMIT `+s.placeholder(2), lastID, rewrittenFailuresBatchSize)
+		if err != nil {
+			return rewritten, errors.Wrap(err, "failed to list the failure messages")
+		}
+		var batch []storedMessage
+		for rows.Next() {
+			var m storedMessage
+			if err := rows.Scan(&m.id, &m.message); err != nil {
+				rows.Close()
+				return rewritten, errors.Wrap(err, "failed to list the failure messages")
+			}
+			batch = append(batch, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rewritten, errors.Wrap(err, "failed to list the failure messages")
+		}
+		if len(batch) == 0 {
+			return rewritten, nil
+		}
+
+		for _, m := range batch {
+			message, changed, err := rewrite(m.message)
+			if err != nil {
+				return rewritten, err
+			}
+			if !changed {
+				continue
+			}
+			if _, err := s.db.ExecContext(ctx, `UPDATE ci_helper_failures SET message = `+s.placeholder(1)+` WHERE id = `+s.placeholder(2), message, m.id); err != nil {
+				return rewritten, errors.Wrapf(err, "failed to rewrite the message of the failure %d", m.id)
+			}
+			rewritten++
+		}
+		lastID = batch[len(batch)-1].id
+	}
+}
+
+// CountFailures counts the jobs each test case failed in since the given
+// time, the given job excepted, within the database rather than in memory
+func (s *sqlFailureStore) CountFailures(ctx context.Context, testCases []string, since time.Time, exceptJobURL string) (map[string]int, error) {
+	counts := map[string]int{}
+	for start := 0; start < len(testCases); start += maxCountedTestCases {
+		batch := testCases[start:]
+		if len(batch) > maxCountedTestCases {
+			batch = batch[:maxCountedTestCases]
+		}
+
+		args := []interface{}{since.UTC(), exceptJobURL}
+		placeholders := make([]string, 0, len(batch))
+		for _, name := range batch {
+			args = append(args, name)
+			placeholders = append(placeholders, s.placeholder(len(args)))
+		}
+		rows, err := s.db.QueryContext(ctx, `SELECT test_case, COUNT(DISTINCT prow_job_url) FROM ci_helper_failures
+			WHERE recorded_at >= `+s.placeholder(1)+` AND prow_job_url <> `+s.placeholder(2)+`
+			AND test_case IN (`+strings.Join(placeholders, ", ")+`) GROUP BY test_case`, args...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to count the failures")
+		}
+		for rows.Next() {
+			var name string
+			var count int
+			if err := rows.Scan(&name, &count); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "failed to count the failures")
+			}
+			counts[name] = count
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to count the failures")
+		}
+	}
+	return counts, nil
+}
+
+func (s *sqlFailureStore) RecordJobDurations(ctx context.Context, durations []JobDuration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to record the jobs' durations")
+	}
+	defer tx.Rollback()
+
+	placeholders := make([]string, 6)
+	for i := range placeholders {
+		placeholders[i] = s.placeholder(i + 1)
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO ci_helper_job_durations
+		(recorded_at, repository, pull_request, prow_job_url, job_name, duration_seconds)
+		VALUES (`+strings.Join(placeholders, ", ")+`)`)
+	if err != nil {
+		return errors.Wrap(err, "failed to record the jobs' durations")
+	}
+	defer stmt.Close()
+
+	for _, d := range durations {
+		if _, err := stmt.ExecContext(ctx, d.Timestamp.UTC(), d.Repository, d.PullRequest, d.ProwJobURL,
+			d.JobName, int64(d.Duration/time.Second)); err != nil {
+			return errors.Wrap(err, "failed to record the jobs' durations")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to record the jobs' durations")
+}
+
+func (s *sqlFailureStore) ListJobDurations(ctx context.Context, from, to time.Time) ([]JobDuration, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT recorded_at, repository, pull_request, prow_job_url, job_name, duration_seconds
+		FROM ci_helper_job_durations WHERE recorded_at >= `+s.placeholder(1)+` AND recorded_at < `+s.placeholder(2)+`
+		ORDER BY recorded_at`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the jobs' durations")
+	}
+	defer rows.Close()
+
+	var durations []JobDuration
+	for rows.Next() {
+		var d JobDuration
+		var seconds int64
+		if err := rows.Scan(&d.Timestamp, &d.Repository, &d.PullRequest, &d.ProwJobURL, &d.JobName, &seconds); err != nil {
+			return nil, errors.Wrap(err, "failed to list the jobs' durations")
+		}
+		d.Duration = time.Duration(seconds) * time.Second
+		durations = append(durations, d)
+	}
+	return durations, errors.Wrap(rows.Err(), "failed to list the jobs' durations")
+}
+
+// RecordCommentHash upserts the comment's hash, and forgets the hashes of the
+// comments which weren't written within the retention
+func (s *sqlFailureStore) RecordCommentHash(ctx context.Context, commentID int64, hash string, at time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO ci_helper_comment_hashes (comment_id, hash, written_at)
+		VALUES (`+s.placeholder(1)+`, `+s.placeholder(2)+`, `+s.placeholder(3)+`)
+		ON CONFLICT (comment_id) DO UPDATE SET hash = excluded.hash, written_at = excluded.written_at`,
+		commentID, hash, at.UTC()); err != nil {
+		return errors.Wrapf(err, "failed to record the hash of the comment %d", commentID)
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM ci_helper_comment_hashes WHERE written_at < `+s.placeholder(1), at.Add(-commentHashRetention).UTC())
+	return errors.Wrap(err, "failed to forget the comments' old hashes")
+}
+
+func (s *sqlFailureStore) CommentHash(ctx context.Context, commentID int64) (string, time.Time, error) {
+	var hash string
+	var at time.Time
+	err := s.db.QueryRowContext(ctx, `SELECT hash, written_at FROM ci_helper_comment_hashes WHERE comment_id = `+s.placeholder(1), commentID).Scan(&hash, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, nil
+	}
+	return hash, at, errors.Wrapf(err, "failed to get the hash of the comment %d", commentID)
+}
+
+// SetMentionOptOut inserts or deletes the user's opt-out
+func (s *sqlFailureStore) SetMentionOptOut(ctx context.Context, login string, optedOut bool) error {
+	var err error
+	if optedOut {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO ci_helper_mention_opt_outs (login, opted_out_at)
+			VALUES (`+s.placeholder(1)+`, `+s.placeholder(2)+`)
+			ON CONFLICT (login) DO NOTHING`, login, time.Now().UTC())
+	} else {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM ci_helper_mention_opt_outs WHERE login = `+s.placeholder(1), login)
+	}
+	return errors.Wrapf(err, "failed to set the mention opt-out of %s", login)
+}
+
+func (s *sqlFailureStore) ListMentionOptOuts(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT login FROM ci_helper_mention_opt_outs`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the mention opt-outs")
+	}
+	defer rows.Close()
+
+	var logins []string
+	for rows.Next() {
+		var login string
+		if err := rows.Scan(&login); err != nil {
+			return nil, errors.Wrap(err, "failed to list the mention opt-outs")
+		}
+		logins = append(logins, login)
+	}
+	return logins, errors.Wrap(rows.Err(), "failed to list the mention opt-outs")
+}
+
+// AcquireLock takes or extends the lock with a single upsert, so that two
+// replicas racing for an expired lock can't both take it
+func (s *sqlFailureStore) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	result, err := s.db.ExecContext(ctx, `INSERT INTO ci_helper_locks (lock_key, owner, expires_at)
+		VALUES (`+s.placeholder(1)+`, `+s.placeholder(2)+`, `+s.placeholder(3)+`)
+		ON CONFLICT (lock_key) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE ci_helper_locks.owner = excluded.owner OR ci_helper_locks.expires_at < `+s.placeholder(4),
+		key, owner, now.Add(ttl), now)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to acquire the lock %s", key)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to acquire the lock %s", key)
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlFailureStore) ReleaseLock(ctx context.Context, key, owner string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM ci_helper_locks WHERE lock_key = `+s.placeholder(1)+` AND owner = `+s.placeholder(2), key, owner)
+	return errors.Wrapf(err, "failed to release the lock %s", key)
+}
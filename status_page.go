@@ -0,0 +1,172 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	StatusPageRoute string = "/status"
+	// the processing errors listed on the status page at most, the oldest being forgotten first
+	maxStatusPageErrors = 20
+)
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>CI helper status</title>
+</head>
+<body>
+<h1>CI helper status</h1>
+<p>Up for {{.Uptime}}, since {{.StartedAt.Format "2006-01-02 15:04:05 MST"}}.</p>
+{{if .Outage.ReadOnly}}<p><strong>The app is read-only, the reports aren't posted to GitHub{{if .Outage.Reason}}: {{.Outage.Reason}}{{end}}.</strong></p>
+{{end}}<h2>Dependencies</h2>
+{{if .Dependencies}}<ul>
+{{range .Dependencies}}<li>{{.}}</li>
+{{end}}</ul>{{else}}<p>No optional dependency is configured.</p>{{end}}
+<h2>Latest successful analyses</h2>
+{{if .Analyses}}<table>
+<tr><th>Installation</th><th>Analysed at</th></tr>
+{{range .Analyses}}<tr><td>{{.Account}}</td><td>{{.At.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{end}}</table>{{else}}<p>No job was analysed since the app started.</p>{{end}}
+<h2>Recent processing errors</h2>
+{{if .Errors}}<table>
+<tr><th>Event</th><th>Failed at</th></tr>
+{{range .Errors}}<tr><td>{{.EventType}}</td><td>{{.At.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{end}}</table>{{else}}<p>No event failed to be processed since the app started.</p>{{end}}
+</body>
+</html>
+`))
+
+type processingError struct {
+	EventType string
+	At        time.Time
+}
+
+type installationAnalysis struct {
+	Account string
+	At      time.Time
+}
+
+// appStatus tracks what the users need to tell whether the app is down when
+// their PR gets no report: the events which failed to be processed, and when
+// a job of each installation was last analysed. The errors' messages aren't
+// kept, the status page being public. A nil appStatus records nothing
+type appStatus struct {
+	startedAt time.Time
+
+	mu     sync.Mutex
+	errors []processingError
+	// keyed by the login of the installation's account
+	analyses map[string]time.Time
+}
+
+func newAppStatus() *appStatus {
+	return &appStatus{startedAt: time.Now(), analyses: map[string]time.Time{}}
+}
+
+// recordError records the failure of the processing of an event
+func (s *appStatus) recordError(eventType string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errors = append(s.errors, processingError{EventType: eventType, At: time.Now()})
+	if overflow := len(s.errors) - maxStatusPageErrors; overflow > 0 {
+		s.errors = append([]processingError(nil), s.errors[overflow:]...)
+	}
+}
+
+// recordAnalysis records the successful analysis of a job of the installation's account
+func (s *appStatus) recordAnalysis(account string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.analyses[account] = time.Now()
+}
+
+// statusEventHandler records the events the wrapped handler failed to process
+type statusEventHandler struct {
+	githubapp.EventHandler
+	status *appStatus
+}
+
+func (h *statusEventHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	err := h.EventHandler.Handle(ctx, eventType, deliveryID, payload)
+	if err != nil {
+		h.status.recordError(eventType)
+	}
+	return err
+}
+
+// StatusPageHandler serves the public status page of the app
+type StatusPageHandler struct {
+	Status       *appStatus
+	Dependencies *dependencyHealth
+	Outage       *outageMode
+	Logger       zerolog.Logger
+}
+
+func (h *StatusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := struct {
+		StartedAt    time.Time
+		Uptime       time.Duration
+		Outage       outageStatus
+		Dependencies []string
+		Analyses     []installationAnalysis
+		Errors       []processingError
+	}{
+		StartedAt:    h.Status.startedAt,
+		Uptime:       time.Since(h.Status.startedAt).Round(time.Second),
+		Outage:       h.Outage.status(),
+		Dependencies: h.Dependencies.states(),
+	}
+
+	h.Status.mu.Lock()
+	for account, at := range h.Status.analyses {
+		page.Analyses = append(page.Analyses, installationAnalysis{Account: account, At: at})
+	}
+	// the most recent errors first
+	for i := len(h.Status.errors) - 1; i >= 0; i-- {
+		page.Errors = append(page.Errors, h.Status.errors[i])
+	}
+	h.Status.mu.Unlock()
+	sort.Slice(page.Analyses, func(i, j int) bool { return page.Analyses[i].Account < page.Analyses[j].Account })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := statusPageTemplate.Execute(w, page); err != nil {
+		h.Logger.Error().Err(err).Msg("Failed to render the status page")
+	}
+}
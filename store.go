@@ -0,0 +1,375 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureStoreCapacity = 100000
+)
+
+// FailureRecord represents a single failed test case
+// observed while analysing a Prow job
+type FailureRecord struct {
+	Timestamp   time.Time
+	Repository  string
+	PullRequest int
+	ProwJobURL  string
+	SuiteName   string
+	TestCase    string
+	Status      string
+	Message     string
+	// the object holding the full message in the cold storage, the
+	// message being only its excerpt when set
+	MessageRef string
+	// the kind of the job's failure, as classified by the analysis
+	FailureKind string
+}
+
+// JobDuration is how long an analysed run of a Prow job ran
+type JobDuration struct {
+	Timestamp   time.Time
+	Repository  string
+	PullRequest int
+	ProwJobURL  string
+	JobName     string
+	Duration    time.Duration
+}
+
+// FailureStore persists the failures found by the analyses
+type FailureStore interface {
+	RecordFailures(ctx context.Context, records []FailureRecord) error
+	ListFailures(ctx context.Context, from, to time.Time) ([]FailureRecord, error)
+}
+
+// failureCounter is implemented by the FailureStores which
+// count the failures of the test cases by themselves
+type failureCounter interface {
+	CountFailures(ctx context.Context, testCases []string, since time.Time, exceptJobURL string) (map[string]int, error)
+}
+
+// prLocker is implemented by the FailureStores holding the per-PR locks
+// shared by the app's replicas, see prLocks
+type prLocker interface {
+	// AcquireLock takes the lock for the owner until the ttl expires, or extends it if the owner
+	// holds it already. It returns false when another owner holds the lock
+	AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLock releases the lock, unless another owner holds it
+	ReleaseLock(ctx context.Context, key, owner string) error
+}
+
+// jobDurationStore is implemented by the FailureStores keeping the durations of
+// the analysed runs apart from their failures, see jobCosts
+type jobDurationStore interface {
+	RecordJobDurations(ctx context.Context, durations []JobDuration) error
+	ListJobDurations(ctx context.Context, from, to time.Time) ([]JobDuration, error)
+}
+
+// recordJobDurations records the durations within the store, if it keeps durations
+func recordJobDurations(ctx context.Context, store FailureStore, durations []JobDuration) error {
+	durationStore, ok := store.(jobDurationStore)
+	if !ok {
+		return fmt.Errorf("the failure store doesn't keep the jobs' durations")
+	}
+	return durationStore.RecordJobDurations(ctx, durations)
+}
+
+// listJobDurations lists the durations recorded within the time range, if the store keeps durations
+func listJobDurations(ctx context.Context, store FailureStore, from, to time.Time) ([]JobDuration, error) {
+	durationStore, ok := store.(jobDurationStore)
+	if !ok {
+		return nil, fmt.Errorf("the failure store doesn't keep the jobs' durations")
+	}
+	return durationStore.ListJobDurations(ctx, from, to)
+}
+
+// commentHashStore is implemented by the FailureStores keeping the hash of the
+// last body the app wrote to each comment, shared by the app's replicas, see
+// commentEdits
+type commentHashStore interface {
+	RecordCommentHash(ctx context.Context, commentID int64, hash string, at time.Time) error
+	// CommentHash returns the hash of the last body written to the comment
+	// and when it was written, or "" when the comment is unknown
+	CommentHash(ctx context.Context, commentID int64) (string, time.Time, error)
+}
+
+// failureMessageRewriter is implemented by the FailureStores able to rewrite
+// the stored failure messages in place, see encryptingFailureStore.reencrypt
+type failureMessageRewriter interface {
+	// RewriteFailureMessages replaces each stored message with what rewrite
+	// returns for it, when changed, and returns the number of rewritten messages
+	RewriteFailureMessages(ctx context.Context, rewrite func(message string) (string, bool, error)) (int, error)
+}
+
+// mentionOptOutStore is implemented by the FailureStores persisting the users
+// who opted out of the mentions, shared by the app's replicas, see mentionOptOuts
+type mentionOptOutStore interface {
+	SetMentionOptOut(ctx context.Context, login string, optedOut bool) error
+	ListMentionOptOuts(ctx context.Context) ([]string, error)
+}
+
+// recordCommentHash records the comment's hash within the store, if it keeps hashes
+func recordCommentHash(ctx context.Context, store FailureStore, commentID int64, hash string, at time.Time) error {
+	hashStore, ok := store.(commentHashStore)
+	if !ok {
+		return fmt.Errorf("the failure store doesn't keep the comments' hashes")
+	}
+	return hashStore.RecordCommentHash(ctx, commentID, hash, at)
+}
+
+// commentHash returns the comment's hash recorded within the store, if it keeps hashes
+func commentHash(ctx context.Context, store FailureStore, commentID int64) (string, time.Time, error) {
+	hashStore, ok := store.(commentHashStore)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("the failure store doesn't keep the comments' hashes")
+	}
+	return hashStore.CommentHash(ctx, commentID)
+}
+
+// rewriteFailureMessages rewrites the messages within the store, if it can
+func rewriteFailureMessages(ctx context.Context, store FailureStore, rewrite func(message string) (string, bool, error)) (int, error) {
+	rewriter, ok := store.(failureMessageRewriter)
+	if !ok {
+		return 0, fmt.Errorf("the failure store can't rewrite the failure messages")
+	}
+	return rewriter.RewriteFailureMessages(ctx, rewrite)
+}
+
+// setMentionOptOut opts the user out of (or back into) the mentions within
+// the store, if it persists the opt-outs
+func setMentionOptOut(ctx context.Context, store FailureStore, login string, optedOut bool) error {
+	optOutStore, ok := store.(mentionOptOutStore)
+	if !ok {
+		return fmt.Errorf("the failure store doesn't persist the mention opt-outs")
+	}
+	return optOutStore.SetMentionOptOut(ctx, login, optedOut)
+}
+
+// listMentionOptOuts returns the users who opted out of the mentions
+// within the store, if it persists the opt-outs
+func listMentionOptOuts(ctx context.Context, store FailureStore) ([]string, error) {
+	optOutStore, ok := store.(mentionOptOutStore)
+	if !ok {
+		return nil, fmt.Errorf("the failure store doesn't persist the mention opt-outs")
+	}
+	return optOutStore.ListMentionOptOuts(ctx)
+}
+
+// acquireLock takes the lock within the store, if it holds locks
+func acquireLock(ctx context.Context, store FailureStore, key, owner string, ttl time.Duration) (bool, error) {
+	locker, ok := store.(prLocker)
+	if !ok {
+		return false, fmt.Errorf("the failure store doesn't hold locks")
+	}
+	return locker.AcquireLock(ctx, key, owner, ttl)
+}
+
+// releaseLock releases the lock within the store, if it holds locks
+func releaseLock(ctx context.Context, store FailureStore, key, owner string) error {
+	locker, ok := store.(prLocker)
+	if !ok {
+		return fmt.Errorf("the failure store doesn't hold locks")
+	}
+	return locker.ReleaseLock(ctx, key, owner)
+}
+
+// countFailures returns the number of jobs each of the test cases failed in
+// since the given time, the given job excepted
+func countFailures(ctx context.Context, store FailureStore, testCases []string, since time.Time, exceptJobURL string) (map[string]int, error) {
+	if counter, ok := store.(failureCounter); ok {
+		return counter.CountFailures(ctx, testCases, since, exceptJobURL)
+	}
+
+	records, err := store.ListFailures(ctx, since, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	jobs := map[string]map[string]bool{}
+	for _, name := range testCases {
+		jobs[name] = map[string]bool{}
+	}
+	for _, r := range records {
+		if failed, ok := jobs[r.TestCase]; ok && r.ProwJobURL != exceptJobURL {
+			failed[r.ProwJobURL] = true
+		}
+	}
+	counts := map[string]int{}
+	for name, failed := range jobs {
+		if len(failed) > 0 {
+			counts[name] = len(failed)
+		}
+	}
+	return counts, nil
+}
+
+// memoryFailureStore is a FailureStore that keeps up
+// to 'capacity' most recent records in memory
+type memoryFailureStore struct {
+	mu       sync.RWMutex
+	capacity int
+	records  []FailureRecord
+	// the durations of the analysed runs, up to 'capacity' of them too
+	durations []JobDuration
+	// the locks of a single replica, keyed by the locks' keys
+	locks map[string]memoryLock
+	// the hashes of the comments' bodies, up to 'capacity' of them too
+	commentHashes    map[int64]memoryCommentHash
+	commentHashOrder []int64
+}
+
+// memoryCommentHash is a comment's hash kept within the memoryFailureStore
+type memoryCommentHash struct {
+	hash string
+	at   time.Time
+}
+
+// memoryLock is a lock held within the memoryFailureStore
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+func newMemoryFailureStore(capacity int) *memoryFailureStore {
+	return &memoryFailureStore{capacity: capacity}
+}
+
+func (s *memoryFailureStore) RecordFailures(ctx context.Context, records []FailureRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, records...)
+	if overflow := len(s.records) - s.capacity; overflow > 0 {
+		s.records = append([]FailureRecord(nil), s.records[overflow:]...)
+	}
+
+	return nil
+}
+
+func (s *memoryFailureStore) ListFailures(ctx context.Context, from, to time.Time) ([]FailureRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var records []FailureRecord
+	for _, r := range s.records {
+		if !r.Timestamp.Before(from) && r.Timestamp.Before(to) {
+			records = append(records, r)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *memoryFailureStore) RewriteFailureMessages(ctx context.Context, rewrite func(message string) (string, bool, error)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rewritten := 0
+	for i := range s.records {
+		message, changed, err := rewrite(s.records[i].Message)
+		if err != nil {
+			return rewritten, err
+		}
+		if changed {
+			s.records[i].Message = message
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+func (s *memoryFailureStore) RecordJobDurations(ctx context.Context, durations []JobDuration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.durations = append(s.durations, durations...)
+	if overflow := len(s.durations) - s.capacity; overflow > 0 {
+		s.durations = append([]JobDuration(nil), s.durations[overflow:]...)
+	}
+
+	return nil
+}
+
+func (s *memoryFailureStore) ListJobDurations(ctx context.Context, from, to time.Time) ([]JobDuration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var durations []JobDuration
+	for _, d := range s.durations {
+		if !d.Timestamp.Before(from) && d.Timestamp.Before(to) {
+			durations = append(durations, d)
+		}
+	}
+
+	return durations, nil
+}
+
+func (s *memoryFailureStore) RecordCommentHash(ctx context.Context, commentID int64, hash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.commentHashes == nil {
+		s.commentHashes = map[int64]memoryCommentHash{}
+	}
+	if _, ok := s.commentHashes[commentID]; !ok {
+		s.commentHashOrder = append(s.commentHashOrder, commentID)
+	}
+	s.commentHashes[commentID] = memoryCommentHash{hash: hash, at: at}
+	if overflow := len(s.commentHashOrder) - s.capacity; overflow > 0 {
+		for _, id := range s.commentHashOrder[:overflow] {
+			delete(s.commentHashes, id)
+		}
+		s.commentHashOrder = append([]int64(nil), s.commentHashOrder[overflow:]...)
+	}
+
+	return nil
+}
+
+func (s *memoryFailureStore) CommentHash(ctx context.Context, commentID int64) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	written := s.commentHashes[commentID]
+	return written.hash, written.at, nil
+}
+
+func (s *memoryFailureStore) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if lock, ok := s.locks[key]; ok && lock.owner != owner && now.Before(lock.expires) {
+		return false, nil
+	}
+	if s.locks == nil {
+		s.locks = map[string]memoryLock{}
+	}
+	s.locks[key] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryFailureStore) ReleaseLock(ctx context.Context, key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lock, ok := s.locks[key]; ok && lock.owner == owner {
+		delete(s.locks, key)
+	}
+	return nil
+}
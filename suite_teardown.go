@@ -0,0 +1,86 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/onsi/ginkgo/v2/types"
+)
+
+const suiteTeardownHeaderString = ":rotating_light: **The E2E tests' specs passed, but the suite's teardown failed**: \n"
+
+// suiteTeardownNodeTypes are the Ginkgo nodes running once the whole suite is
+// over, which both Ginkgo's JUnit and JSON reports name e.g. "[AfterSuite]"
+var suiteTeardownNodeTypes = []types.NodeType{
+	types.NodeTypeAfterSuite,
+	types.NodeTypeSynchronizedAfterSuite,
+	types.NodeTypeReportAfterSuite,
+	types.NodeTypeCleanupAfterSuite,
+}
+
+// isSuiteTeardown returns whether the test case is a suite-level teardown node
+func isSuiteTeardown(name string) bool {
+	for _, t := range suiteTeardownNodeTypes {
+		if strings.HasPrefix(name, "["+t.String()+"]") {
+			return true
+		}
+	}
+	return false
+}
+
+// markSuiteTeardowns flags the failures of the suite's teardown, which get
+// their own section so that they aren't mistaken for regressed specs
+func (failedTCReport *FailedTestCasesReport) markSuiteTeardowns() {
+	specs, teardowns := 0, 0
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		if isSuiteTeardown(tc.name) {
+			failedTCReport.failedTestCases[i].teardown = true
+			teardowns++
+		} else {
+			specs++
+		}
+	}
+
+	if specs == 0 && teardowns > 0 && failedTCReport.headerString == e2eFailureHeaderString {
+		failedTCReport.headerString = suiteTeardownHeaderString
+	}
+}
+
+// teardownSection renders the failures of the suite's teardown, if any
+func (failedTCReport *FailedTestCasesReport) teardownSection(format string) (reportSection, bool) {
+	var b strings.Builder
+	for _, tc := range failedTCReport.failedTestCases {
+		if !tc.teardown {
+			continue
+		}
+		if format == reportFormatCompact {
+			b.WriteString(tc.compactEntry() + "\n")
+		} else {
+			b.WriteString("\n " + tc.entry() + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		return reportSection{}, false
+	}
+
+	return reportSection{
+		key:     "suite-teardown",
+		content: "\n:broom: **Suite teardown failure(s)**, which ran after all the specs and don't mean that any of them regressed:\n" + b.String(),
+	}, true
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/ci-helper-app/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+const (
+	teamReportsOff      = "off"
+	teamReportsSections = "sections"
+	teamReportsComments = "comments"
+
+	// the team comments remembered as posted, the oldest being forgotten first
+	maxTeamComments = 10000
+)
+
+// validateTeams makes sure the patterns of the teams' test names compile
+func validateTeams(teams []TeamConfig) error {
+	for _, team := range teams {
+		if team.Name == "" {
+			return fmt.Errorf("the teams owning the failures need a name")
+		}
+		if _, err := regexp.Compile(team.TestPattern); err != nil {
+			return fmt.Errorf("invalid test_pattern %q of the team %s: %+v", team.TestPattern, team.Name, err)
+		}
+	}
+	return nil
+}
+
+// owns returns whether the team owns the failed test case: its Ginkgo owner
+// (the "owner:X" label) or one of the labels of its name is one of the team's
+// labels, or its name matches the team's pattern
+func (team TeamConfig) owns(tc failedTestCase) bool {
+	name := client.NormalizeTestName(tc.name)
+	for _, label := range team.Labels {
+		if strings.EqualFold(tc.owner, label) || strings.Contains(name, "["+label+"]") {
+			return true
+		}
+	}
+	if team.TestPattern == "" {
+		return false
+	}
+	// the pattern was validated with the configuration
+	re, err := regexp.Compile(team.TestPattern)
+	return err == nil && re.MatchString(tc.name)
+}
+
+// assignTeams assigns each failed test case to the first team owning it, and
+// groups the failures by team, the teams' order and then the failures without
+// a team. The heading of each team's failures mentions the team, unless the
+// team gets a comment of its own
+func (failedTCReport *FailedTestCasesReport) assignTeams(mentions *mentionOptOuts, teams []TeamConfig, mode string) {
+	if len(teams) == 0 || (mode != teamReportsSections && mode != teamReportsComments) {
+		return
+	}
+
+	rank := map[string]int{"": len(teams)}
+	for i, team := range teams {
+		if _, ok := rank[team.Name]; !ok {
+			rank[team.Name] = i
+		}
+	}
+	owned := false
+	for i, tc := range failedTCReport.failedTestCases {
+		if tc.status == "" {
+			continue
+		}
+		for _, team := range teams {
+			if team.owns(tc) {
+				failedTCReport.failedTestCases[i].team = team.Name
+				owned = true
+				break
+			}
+		}
+	}
+	if !owned {
+		return
+	}
+	sort.SliceStable(failedTCReport.failedTestCases, func(i, j int) bool {
+		return rank[failedTCReport.failedTestCases[i].team] < rank[failedTCReport.failedTestCases[j].team]
+	})
+
+	failedTCReport.teamHeadings = map[string]string{"": "\n:grey_question: **Failures without an owning team**\n"}
+	for _, team := range teams {
+		mention := mentions.mention(team.Name)
+		if mode == teamReportsComments {
+			mention = inlineCode(team.Name)
+		}
+		failedTCReport.teamHeadings[team.Name] = fmt.Sprintf("\n:busts_in_silhouette: **Failures owned by %s**\n", mention)
+	}
+}
+
+// teamSection returns the heading of the failures of the team
+func (failedTCReport *FailedTestCasesReport) teamSection(key, team string) reportSection {
+	return reportSection{key: key, content: failedTCReport.teamHeadings[team]}
+}
+
+// teamComments remembers the comments posted to the teams, so that
+// analysing the same job again doesn't ping them twice
+type teamComments struct {
+	mu sync.Mutex
+	// keyed by "<repo>#<comment ID>/<team>"
+	posted map[string]bool
+	order  []string
+}
+
+func newTeamComments() *teamComments {
+	return &teamComments{posted: map[string]bool{}}
+}
+
+// claim returns whether the team's comment about the job's comment is yet to be posted
+func (c *teamComments) claim(key string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.posted[key] {
+		return false
+	}
+	c.posted[key] = true
+	c.order = append(c.order, key)
+	if len(c.order) > maxTeamComments {
+		delete(c.posted, c.order[0])
+		c.order = c.order[1:]
+	}
+	return true
+}
+
+// postTeamReports posts a comment per team owning failures of the report,
+// mentioning the team and listing only the team's failures
+func (h *PRCommentHandler) postTeamReports(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, failedTCReport *FailedTestCasesReport, format string) {
+	var teams []string
+	failures := map[string][]failedTestCase{}
+	for _, tc := range failedTCReport.failedTestCases {
+		if tc.team == "" {
+			continue
+		}
+		if _, ok := failures[tc.team]; !ok {
+			teams = append(teams, tc.team)
+		}
+		failures[tc.team] = append(failures[tc.team], tc)
+	}
+
+	for _, team := range teams {
+		key := fmt.Sprintf("%s#%d/%s", event.GetRepo().GetFullName(), event.GetComment().GetID(), team)
+		if !h.TeamComments.claim(key) {
+			logger.Debug().Msgf("The failures owned by %s were already commented", team)
+			continue
+		}
+
+		teamReport := *failedTCReport
+		teamReport.failedTestCases = failures[team]
+		teamReport.teamHeadings = nil
+		teamReport.headerString = fmt.Sprintf(":busts_in_silhouette: %s, **%d failure(s) of this job are owned by your team**: \n", h.Mentions.mention(team), len(failures[team]))
+		body := teamReport.newCommentBody(logger, h.CommentLint, event, format)
+		if _, _, err := client.Issues.CreateComment(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber(), &github.IssueComment{Body: &body}); err != nil {
+			logger.Error().Err(err).Msgf("Failed to comment the failures owned by %s", team)
+		}
+	}
+}
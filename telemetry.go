@@ -0,0 +1,254 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	appVersion               = "1.0.0"
+	defaultTelemetryInterval = 24 * time.Hour
+	telemetryClientTimeout   = 30 * time.Second
+)
+
+// telemetryReport is the anonymous usage report sent to the telemetry endpoint.
+// It never contains names of orgs, repositories, jobs or tests
+type telemetryReport struct {
+	InstallID  string         `json:"install_id"`
+	Version    string         `json:"version"`
+	Period     string         `json:"period"`
+	Subsystems []string       `json:"subsystems"`
+	Usage      map[string]int `json:"usage"`
+	Errors     map[string]int `json:"errors"`
+}
+
+// telemetry counts the usage of the app's features and their errors,
+// and periodically reports them when the deployment opted in. A nil
+// *telemetry is valid and counts nothing
+type telemetry struct {
+	cfg        TelemetryConfig
+	installID  string
+	subsystems []string
+	client     *http.Client
+	logger     zerolog.Logger
+
+	mu     sync.Mutex
+	usage  map[string]int
+	errors map[string]int
+}
+
+func newTelemetry(cfg TelemetryConfig, config *Config, logger zerolog.Logger) *telemetry {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultTelemetryInterval
+	}
+
+	return &telemetry{
+		cfg:        cfg,
+		installID:  telemetryInstallID(config),
+		subsystems: enabledSubsystems(config),
+		client:     &http.Client{Timeout: telemetryClientTimeout},
+		logger:     logger,
+		usage:      map[string]int{},
+		errors:     map[string]int{},
+	}
+}
+
+// telemetryInstallID returns the ID of the deployment within the reports. It's
+// keyed by the webhook's secret, so that it can't be traced back to the GitHub
+// App by hashing the (public) App IDs, while staying the same across restarts.
+// The deployments without secret get a random ID on each start
+func telemetryInstallID(config *Config) string {
+	secret := []byte(config.Github.App.WebhookSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("ci-helper-app:" + strconv.FormatInt(config.Github.App.IntegrationID, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// enabledSubsystems lists the optional subsystems the deployment configured
+func enabledSubsystems(config *Config) []string {
+	var subsystems []string
+	for name, enabled := range map[string]bool{
+		"analysis_junit":      config.AnalysisJUnit.GCSBucket != "",
+		"api":                 config.API.Token != "",
+		"archive":             config.Archive.Enabled,
+		"artifact_source":     config.ArtifactSource.Kind != "" && config.ArtifactSource.Kind != artifactSourceProw,
+		"business_hours":      config.BusinessHours.Enabled,
+		"burst":               config.Burst.Cooldown > 0,
+		"cold_storage":        config.ColdStorage.GCSBucket != "",
+		"comment_reconciler":  config.CommentReconciler.Enabled,
+		"deck":                config.Deck.URL != "",
+		"encryption":          config.Encryption.KeysDir != "",
+		"error_budget":        config.ErrorBudget.Target > 0,
+		"export_gcs":          config.Export.GCSBucket != "",
+		"failure_store":       config.FailureStore.Kind != "" && config.FailureStore.Kind != failureStoreMemory,
+		"github_keys":         config.GithubKeys.KeysDir != "",
+		"header_policy":       config.HeaderPolicy.Enabled,
+		"infra_changes":       config.InfraChanges.Enabled,
+		"issue_reconciler":    config.IssueReconciler.Enabled,
+		"jira":                config.Jira.URL != "",
+		"job_costs":           config.JobCosts.Enabled,
+		"main_branch_history": len(config.MainBranchHistory.Jobs) > 0,
+		"opt_in":              config.Access.OptIn,
+		"outage_read_only":    config.Outage.ReadOnly,
+		"payload_archive":     config.PayloadArchive.Dir != "",
+		"pending_watchdog":    config.PendingWatchdog.Enabled,
+		"pr_locks":            config.PRLocks.Enabled,
+		"private_spyglass":    len(config.PrivateSpyglass) > 0,
+		"prow_plugin":         config.ProwPlugin.Enabled,
+		"queue":               config.Queue.Workers > 0,
+		"regions":             config.Regions.Enabled,
+		"remediation_kb":      config.Remediation.KBFile != "",
+		"report_pages":        config.ReportPages.BaseURL != "",
+		"resource_exhaustion": config.ResourceExhaustion.Enabled,
+		"retry_advisor":       config.RetryAdvisor.Enabled,
+	} {
+		if enabled {
+			subsystems = append(subsystems, name)
+		}
+	}
+	return subsystems
+}
+
+// count records a usage of the given feature
+func (t *telemetry) count(feature string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.usage[feature]++
+	t.mu.Unlock()
+}
+
+// countError records an error of the given subsystem
+func (t *telemetry) countError(subsystem string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.errors[subsystem]++
+	t.mu.Unlock()
+}
+
+// run sends the report every interval, until the context is done
+func (t *telemetry) run(ctx context.Context) {
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.send(ctx); err != nil {
+				t.logger.Debug().Err(err).Msg("Failed to send the telemetry report")
+			}
+		}
+	}
+}
+
+// send reports (and resets) the counts gathered since the last report. The
+// counts are restored when the report isn't delivered, to be sent next time
+func (t *telemetry) send(ctx context.Context) (err error) {
+	t.mu.Lock()
+	report := telemetryReport{
+		InstallID:  t.installID,
+		Version:    appVersion,
+		Period:     t.cfg.Interval.String(),
+		Subsystems: t.subsystems,
+		Usage:      t.usage,
+		Errors:     t.errors,
+	}
+	t.usage = map[string]int{}
+	t.errors = map[string]int{}
+	t.mu.Unlock()
+	defer func() {
+		if err != nil {
+			t.restore(report)
+		}
+	}()
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the telemetry endpoint responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// restore adds the counts of the undelivered report back to the current ones
+func (t *telemetry) restore(report telemetryReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for feature, n := range report.Usage {
+		t.usage[feature] += n
+	}
+	for subsystem, n := range report.Errors {
+		t.errors[subsystem] += n
+	}
+}
+
+// telemetryEventHandler counts the events handled by
+// the wrapped handler, and the errors it returns
+type telemetryEventHandler struct {
+	githubapp.EventHandler
+	telemetry *telemetry
+}
+
+func (h *telemetryEventHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	h.telemetry.count("event:" + eventType)
+	err := h.EventHandler.Handle(ctx, eventType, deliveryID, payload)
+	if err != nil {
+		h.telemetry.countError("event:" + eventType)
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/go-github/v58/github"
+	"github.com/pkg/errors"
+)
+
+const (
+	triggerBaseBranchVariable = "base_branch"
+	// the cost the evaluation of a trigger or classifier may reach, the rules
+	// of the repositories' config files being untrusted
+	celCostLimit = 1000000
+	// the number of compiled triggers, and of compiled classifiers, kept around
+	celProgramCacheCapacity = 512
+)
+
+// triggerEnv declares the variables the repositories' triggers are evaluated against,
+// e.g. `author == "openshift-ci[bot]" && body.contains("ci/prow/e2e") && !("skip-e2e" in labels)`
+var triggerEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		// the login of the comment's author
+		cel.Variable("author", cel.StringType),
+		// the comment's body
+		cel.Variable("body", cel.StringType),
+		// the names of the PR's labels
+		cel.Variable("labels", cel.ListType(cel.StringType)),
+		// the branch the PR targets, fetched only when the trigger needs it
+		cel.Variable(triggerBaseBranchVariable, cel.StringType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// triggerProgram is a compiled trigger
+type triggerProgram struct {
+	program cel.Program
+	// whether the trigger reads the PR's base branch, which the comment's event lacks
+	needsBaseBranch bool
+}
+
+// triggers compiles the repositories' triggers on first use
+type triggers struct {
+	mu       sync.Mutex
+	programs map[string]*triggerProgram
+	// the rules in compilation order, the oldest being evicted first
+	order []string
+}
+
+func newTriggers() *triggers {
+	return &triggers{programs: map[string]*triggerProgram{}}
+}
+
+// compileTriggerRule compiles the trigger, which must evaluate to a boolean
+func compileTriggerRule(rule string) (*triggerProgram, error) {
+	ast, iss := triggerEnv.Compile(rule)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if ast.OutputType().String() != cel.BoolType.String() {
+		return nil, fmt.Errorf("the trigger evaluates to %s instead of a bool", ast.OutputType())
+	}
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, err
+	}
+	prg, err := triggerEnv.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := &triggerProgram{program: prg}
+	for _, ref := range checked.GetReferenceMap() {
+		if ref.GetName() == triggerBaseBranchVariable {
+			tp.needsBaseBranch = true
+		}
+	}
+	return tp, nil
+}
+
+// validateTriggers compiles the triggers of all the configured
+// organizations, groups and repositories, so that invalid ones fail fast
+func (c *Config) validateTriggers() error {
+	rules := map[string]string{}
+	for name, rc := range c.Organizations {
+		rules[name] = rc.Trigger
+	}
+	for name, group := range c.RepositoryGroups {
+		rules[name] = group.Trigger
+	}
+	for name, rc := range c.Repositories {
+		rules[name] = rc.Trigger
+	}
+	for name, rule := range rules {
+		if rule == "" {
+			continue
+		}
+		if _, err := compileTriggerRule(rule); err != nil {
+			return errors.Wrapf(err, "invalid trigger of %s", name)
+		}
+	}
+	return nil
+}
+
+func (t *triggers) program(rule string) (*triggerProgram, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tp, ok := t.programs[rule]; ok {
+		return tp, nil
+	}
+	tp, err := compileTriggerRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	t.programs[rule] = tp
+	t.order = append(t.order, rule)
+	if overflow := len(t.order) - celProgramCacheCapacity; overflow > 0 {
+		for _, evicted := range t.order[:overflow] {
+			delete(t.programs, evicted)
+		}
+		t.order = append([]string(nil), t.order[overflow:]...)
+	}
+	return tp, nil
+}
+
+// matches returns whether the comment triggers the analysis of the job it
+// reports, the comments of the Prow bot doing so when no trigger is configured
+func (t *triggers) matches(ctx context.Context, client *github.Client, event github.IssueCommentEvent, rule string) (bool, error) {
+	author := event.GetComment().GetUser().GetLogin()
+	if t == nil || rule == "" {
+		return strings.HasPrefix(author, targetAuthor), nil
+	}
+
+	tp, err := t.program(rule)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid trigger")
+	}
+
+	labels := []string{}
+	for _, label := range event.GetIssue().Labels {
+		labels = append(labels, label.GetName())
+	}
+	vars := map[string]interface{}{
+		"author":                  author,
+		"body":                    event.GetComment().GetBody(),
+		"labels":                  labels,
+		triggerBaseBranchVariable: "",
+	}
+	if tp.needsBaseBranch {
+		pr, _, err := client.PullRequests.Get(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber())
+		if err != nil {
+			return false, errors.Wrap(err, "failed to fetch the base branch of the PR")
+		}
+		vars[triggerBaseBranchVariable] = pr.GetBase().GetRef()
+	}
+
+	out, _, err := tp.program.Eval(vars)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to evaluate the trigger")
+	}
+	matched, _ := out.Value().(bool)
+	return matched, nil
+}
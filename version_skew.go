@@ -0,0 +1,168 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/konflux-ci/qe-tools/pkg/prow"
+	"github.com/rs/zerolog"
+	"sigs.k8s.io/yaml"
+)
+
+// the shortest prefix of a commit's SHA identifying it within an image's tag
+const minTagCommitLength = 7
+
+// workloadDirectories are the directory (or list file) names the
+// gather step stores the workloads running the components under
+var workloadDirectories = []string{"deployments", "deployments.apps", "statefulsets", "statefulsets.apps"}
+
+// gatheredWorkload is the subset of a Deployment or StatefulSet (or of
+// a list of them) dumped by the gather step
+type gatheredWorkload struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Containers []struct {
+					Image string `json:"image"`
+				} `json:"containers"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Items []gatheredWorkload `json:"items"`
+}
+
+// deployedImage is an image of a component the test cluster ran
+type deployedImage struct {
+	workload string
+	image    string
+}
+
+// checkVersionSkew warns when the test cluster didn't run the images of the
+// repository's components built from the PR's head commit, i.e. the job tested
+// stale components and its failures may not be related to the PR's changes
+func (failedTCReport *FailedTestCasesReport) checkVersionSkew(ctx context.Context, logger zerolog.Logger, client *github.Client, scanner *prow.ArtifactScanner, event github.IssueCommentEvent, componentImages []string) {
+	if len(componentImages) == 0 || scanner.ArtifactDirectoryPrefix == "" {
+		return
+	}
+
+	pr, _, err := client.PullRequests.Get(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get the PR's head commit, not checking the components' versions")
+		return
+	}
+	headSHA := pr.GetHead().GetSHA()
+
+	images, err := gatheredComponentImages(ctx, scanner, componentImages)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list the images of the components the test cluster ran")
+		return
+	}
+
+	var stale []string
+	for _, img := range images {
+		tag, ok := imageTag(img.image)
+		if !ok {
+			// e.g. pinned by digest, whose commit is unknown
+			continue
+		}
+		if len(headSHA) >= minTagCommitLength && strings.Contains(tag, headSHA[:minTagCommitLength]) {
+			continue
+		}
+		stale = append(stale, fmt.Sprintf("%s (%s)", inlineCode(img.image), img.workload))
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	logger.Debug().Msgf("The test cluster ran %d image(s) not built from %s", len(stale), headSHA)
+	failedTCReport.warnings = append(failedTCReport.warnings, fmt.Sprintf(
+		":warning: **The test cluster ran components which weren't built from the PR's head commit** `%.7s`, the failures may not be related to the PR's changes: %s",
+		headSHA, strings.Join(stale, ", ")))
+}
+
+// gatheredComponentImages returns the images of the given repositories
+// (e.g. "quay.io/konflux-ci/build-service") run by the gathered workloads
+func gatheredComponentImages(ctx context.Context, scanner *prow.ArtifactScanner, componentImages []string) ([]deployedImage, error) {
+	objects, err := listGatheredCRs(ctx, scanner.Client, scanner.ArtifactDirectoryPrefix+cRsPropertyName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var images []deployedImage
+	seen := map[string]bool{}
+	for _, object := range objects {
+		if !isWorkloadObject(object) {
+			continue
+		}
+		content, err := readGCSObject(ctx, scanner.Client, object)
+		if err != nil {
+			return nil, err
+		}
+		workload := &gatheredWorkload{}
+		if yaml.Unmarshal([]byte(content), workload) != nil {
+			continue
+		}
+		for _, w := range append([]gatheredWorkload{*workload}, workload.Items...) {
+			for _, c := range w.Spec.Template.Spec.Containers {
+				repository := strings.SplitN(c.Image, "@", 2)[0]
+				if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+					repository = repository[:i]
+				}
+				if !containsFold(componentImages, repository) || seen[c.Image] {
+					continue
+				}
+				seen[c.Image] = true
+				images = append(images, deployedImage{workload: w.Metadata.Namespace + "/" + w.Metadata.Name, image: c.Image})
+			}
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].image < images[j].image })
+
+	return images, nil
+}
+
+// isWorkloadObject returns whether the gathered object holds Deployments or StatefulSets
+func isWorkloadObject(object string) bool {
+	dir := path.Base(path.Dir(object))
+	base := strings.TrimSuffix(path.Base(object), path.Ext(object))
+	for _, name := range workloadDirectories {
+		if dir == name || base == name {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTag returns the tag of the image reference, unless it's pinned by digest
+func imageTag(image string) (string, bool) {
+	if strings.Contains(image, "@") {
+		return "", false
+	}
+	i := strings.LastIndex(image, ":")
+	if i <= strings.LastIndex(image, "/") {
+		return "", false
+	}
+	return image[i+1:], true
+}
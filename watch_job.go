@@ -0,0 +1,264 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"github.com/rs/zerolog"
+)
+
+const (
+	watchJobCommand = "/watch-job"
+	// how often the watched jobs' state and log are polled
+	watchJobInterval = time.Minute
+	// the longest a job is watched, the longest ci-operator jobs time out after 4h
+	watchJobTimeout = 6 * time.Hour
+	// the most jobs watched at once
+	maxJobWatches = 20
+	// the most recent progress events listed within the comment
+	maxWatchEvents = 20
+)
+
+// watchProgressRegexes match the lines of the job's log worth reporting,
+// e.g. ci-operator's "Running step e2e-tests." and Ginkgo's failures
+var watchProgressRegexes = []struct {
+	regex  *regexp.Regexp
+	format string
+	// whether the line is a failure, the first one being highlighted
+	failure bool
+}{
+	{regex: regexp.MustCompile(`Running step (\S+)\.`), format: ":arrow_forward: Step `%s` started"},
+	{regex: regexp.MustCompile(`Step (\S+) succeeded after (\S+)\.`), format: ":white_check_mark: Step `%s` succeeded after %s"},
+	{regex: regexp.MustCompile(`Step (\S+) failed after (\S+)\.`), format: ":x: Step `%s` failed after %s", failure: true},
+	{regex: regexp.MustCompile(`^\s*\[FAIL\] (.+)$`), format: ":x: Spec %s failed", failure: true},
+}
+
+// jobWatch is a running Prow job whose progress is reported to a PR comment
+type jobWatch struct {
+	prowJobURL string
+	name       string
+	job        string
+	buildID    string
+	commentID  int64
+	state      string
+	events     []string
+	failed     bool
+	// the length of the log already scanned for progress
+	offset int
+}
+
+// jobWatches keeps track of the watched jobs, each one being watched once
+type jobWatches struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newJobWatches() *jobWatches {
+	return &jobWatches{active: map[string]bool{}}
+}
+
+// add registers the job's watch, and returns false if it's
+// already watched or too many jobs are being watched
+func (w *jobWatches) add(prowJobURL string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active[prowJobURL] || len(w.active) >= maxJobWatches {
+		return false
+	}
+	w.active[prowJobURL] = true
+	return true
+}
+
+func (w *jobWatches) remove(prowJobURL string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.active, prowJobURL)
+}
+
+// handleWatchJobCommand posts a comment reporting the progress of the given
+// running Prow job, which gets the job's report once the job finishes
+func (h *PRCommentHandler) handleWatchJobCommand(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <Prow job URL>", watchJobCommand)
+	}
+	if h.Deck == nil || h.Watches == nil {
+		return fmt.Errorf("watching the jobs needs the Deck integration")
+	}
+
+	// tolerate the URLs pasted as autolinks, e.g. <https://...>
+	prowJobURL := strings.TrimSuffix(strings.Trim(args[0], "<>"), "/")
+	loc, err := parseProwJobURL(prowJobURL)
+	if err != nil {
+		return err
+	}
+	jobPrefix, err := gcsPathFromProwJobURL(prowJobURL)
+	if err != nil {
+		return err
+	}
+	// the name of the ProwJob isn't part of its URL
+	stored, err := fetchProwJob(ctx, h.Deck.gcs, jobPrefix)
+	if err != nil {
+		return err
+	}
+
+	if !h.Watches.add(prowJobURL) {
+		return fmt.Errorf("the Prow job %s is already watched, or too many jobs are", prowJobURL)
+	}
+	watch := &jobWatch{prowJobURL: prowJobURL, name: stored.Metadata.Name, job: loc.job, buildID: loc.buildID}
+	body := watch.render()
+	comment, _, err := client.Issues.CreateComment(ctx, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber(), &github.IssueComment{Body: &body})
+	if err != nil {
+		h.Watches.remove(prowJobURL)
+		return fmt.Errorf("failed to post the comment of the watch: %+v", err)
+	}
+	watch.commentID = comment.GetID()
+
+	go h.watchJob(ctx, logger.With().Str(LogKeyProwJobURL, prowJobURL).Logger(), client, event, watch)
+	return nil
+}
+
+// watchJob updates the watch's comment with the job's progress until the job
+// finishes, then analyses the job as if its failure comment was the watch's one
+func (h *PRCommentHandler) watchJob(ctx context.Context, logger zerolog.Logger, client *github.Client, event github.IssueCommentEvent, watch *jobWatch) {
+	defer h.Watches.remove(watch.prowJobURL)
+
+	repoOwner := event.GetRepo().GetOwner().GetLogin()
+	repoName := event.GetRepo().GetName()
+	ctx, done := h.Cancellations.start(ctx, event.GetRepo().GetFullName(), event.GetIssue().GetNumber())
+	defer done()
+	ctx, cancel := context.WithTimeout(ctx, watchJobTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(watchJobInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Stopped watching the Prow job")
+			return
+		case <-ticker.C:
+		}
+
+		if !watch.poll(ctx, logger, h.Deck) {
+			continue
+		}
+		body := watch.render()
+		if err := editComment(ctx, logger, client, repoOwner, repoName, watch.commentID, body); err != nil {
+			logger.Error().Err(err).Msg("Failed to update the comment of the watch")
+		}
+		if !prowJobFinished(watch.state) {
+			continue
+		}
+
+		// the report gets merged into the watch's comment
+		watchEvent := event
+		watchEvent.Comment = &github.IssueComment{ID: github.Int64(watch.commentID), Body: &body}
+		logger.Debug().Msgf("The Prow job finished (%s), analysing it", watch.state)
+		if err := h.analyze(ctx, logger, client, watchEvent, body, watch.prowJobURL, false, ""); err != nil {
+			logger.Error().Err(err).Msg("Failed to analyse the watched Prow job")
+		}
+		return
+	}
+}
+
+// poll fetches the job's state and its new log lines, and
+// returns whether the watch's comment needs to be updated
+func (watch *jobWatch) poll(ctx context.Context, logger zerolog.Logger, deck *deckClient) bool {
+	changed := false
+	if pj, err := deck.prowJob(ctx, watch.name); err != nil {
+		logger.Debug().Err(err).Msg("Failed to get the state of the watched Prow job")
+	} else if pj.Status.State != watch.state {
+		watch.state, changed = pj.Status.State, true
+	}
+
+	log, err := deck.liveLog(ctx, watch.job, watch.buildID)
+	if err != nil {
+		// the log is only served while the job's pod exists
+		logger.Debug().Err(err).Msg("Failed to get the log of the watched Prow job")
+		return changed
+	}
+	if len(log) < watch.offset {
+		watch.offset = 0
+	}
+	// only the complete lines are scanned
+	end := strings.LastIndex(log, "\n") + 1
+	if end <= watch.offset {
+		return changed
+	}
+	for _, line := range strings.Split(log[watch.offset:end], "\n") {
+		if e, failure := watchProgressEvent(line); e != "" {
+			if failure && !watch.failed {
+				watch.failed = true
+				e = ":rotating_light: **First failure detected:** " + e
+			}
+			watch.events = append(watch.events, e)
+			changed = true
+		}
+	}
+	watch.offset = end
+
+	return changed
+}
+
+// watchProgressEvent returns the event reported for the log line, if any
+func watchProgressEvent(line string) (string, bool) {
+	for _, p := range watchProgressRegexes {
+		if m := p.regex.FindStringSubmatch(line); m != nil {
+			args := make([]interface{}, 0, len(m)-1)
+			for _, arg := range m[1:] {
+				args = append(args, strings.TrimSpace(arg))
+			}
+			return fmt.Sprintf(p.format, args...), p.failure
+		}
+	}
+	return "", false
+}
+
+// render returns the body of the watch's comment
+func (watch *jobWatch) render() string {
+	var b strings.Builder
+	state := watch.state
+	if state == "" {
+		state = "pending"
+	}
+	if prowJobFinished(watch.state) {
+		fmt.Fprintf(&b, ":checkered_flag: The Prow job [%s](%s) finished (`%s`).\n", watch.job, watch.prowJobURL, state)
+	} else {
+		fmt.Fprintf(&b, ":eyes: Watching the Prow job [%s](%s) (`%s`), updated every minute until it finishes.\n", watch.job, watch.prowJobURL, state)
+	}
+
+	events := watch.events
+	if len(events) > maxWatchEvents {
+		fmt.Fprintf(&b, "\n_%d earlier event(s) not shown_\n", len(events)-maxWatchEvents)
+		events = events[len(events)-maxWatchEvents:]
+	}
+	if len(events) > 0 {
+		b.WriteString("\n")
+	}
+	for _, e := range events {
+		b.WriteString("* " + e + "\n")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,280 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultQueueCapacity = 100
+	defaultQueueAttempts = 3
+	defaultQueueBackoff  = 30 * time.Second
+	defaultQueueStall    = time.Hour
+	// the event type the queued analyses are accounted as within the workload
+	queuedAnalysisEventType = "queued_analysis"
+)
+
+var errQueueFull = errors.New("the analyses' queue is full")
+
+// runningAnalysis is an analysis a worker of the queue took
+type runningAnalysis struct {
+	// when its current attempt started
+	started time.Time
+	// aborts the wait for its next attempt
+	cancel context.CancelFunc
+}
+
+// queuedAnalysis is an analysis waiting for a worker of the queue
+type queuedAnalysis struct {
+	ctx    context.Context
+	key    string
+	logger zerolog.Logger
+	run    func(ctx context.Context) error
+	// accounts the analysis within the replica's workload until it's done
+	done func()
+}
+
+// workQueue runs the analyses on a pool of workers, so that the webhook's
+// request returns as soon as the event is validated instead of once the job's
+// artifacts are scanned. The analyses of the same PR's job are deduplicated:
+// a queued analysis is replaced by the next one of the PR's job, and the
+// analyses of a PR's job never run concurrently. The failed analyses are
+// retried with an exponential backoff, unless they were cancelled. A nil
+// workQueue runs the analyses within the webhook's request
+type workQueue struct {
+	capacity int
+	attempts int
+	backoff  time.Duration
+	stall    time.Duration
+	workload *workload
+	status   *appStatus
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// the keys (burstKey) of the queued analyses, the oldest first
+	order  []string
+	queued map[string]*queuedAnalysis
+	// the analyses being run, keyed by their keys
+	running map[string]*runningAnalysis
+
+	depth prometheus.Gauge
+}
+
+func newWorkQueue(cfg QueueConfig, registry *prometheus.Registry, w *workload, status *appStatus) *workQueue {
+	q := &workQueue{
+		capacity: cfg.Capacity,
+		attempts: cfg.Attempts,
+		backoff:  cfg.Backoff,
+		stall:    cfg.StallTimeout,
+		workload: w,
+		status:   status,
+		queued:   map[string]*queuedAnalysis{},
+		running:  map[string]*runningAnalysis{},
+		depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ci_helper_queued_analyses",
+			Help: "Number of analyses waiting for a worker of the queue.",
+		}),
+	}
+	if q.capacity == 0 {
+		q.capacity = defaultQueueCapacity
+	}
+	if q.attempts == 0 {
+		q.attempts = defaultQueueAttempts
+	}
+	if q.backoff == 0 {
+		q.backoff = defaultQueueBackoff
+	}
+	if q.stall == 0 {
+		q.stall = defaultQueueStall
+	}
+	q.cond = sync.NewCond(&q.mu)
+	registry.MustRegister(q.depth)
+
+	return q
+}
+
+// run starts the given number of workers
+func (q *workQueue) run(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				q.process(q.next())
+			}
+		}()
+	}
+}
+
+// enqueue queues the analysis of the PR's job, replacing the one of the PR's job
+// already queued if any. It fails when the queue is full, so that GitHub records
+// the delivery as failed and it can be redelivered
+func (q *workQueue) enqueue(ctx context.Context, logger zerolog.Logger, key string, run func(ctx context.Context) error) error {
+	if q == nil {
+		return run(ctx)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queued, ok := q.queued[key]; ok {
+		queued.ctx, queued.logger, queued.run = detachedContext{ctx}, logger, run
+		logger.Info().Msg("Replacing the queued analysis of the PR's job")
+		return nil
+	}
+	if len(q.order) >= q.capacity {
+		return errQueueFull
+	}
+
+	analysis := &queuedAnalysis{ctx: detachedContext{ctx}, key: key, logger: logger, run: run, done: func() {}}
+	if q.workload != nil {
+		analysis.done = q.workload.start(queuedAnalysisEventType)
+	}
+	q.queued[key] = analysis
+	q.order = append(q.order, key)
+	q.depth.Set(float64(len(q.order)))
+	q.cond.Signal()
+
+	logger.Debug().Msgf("Queued the analysis (%d queued)", len(q.order))
+	return nil
+}
+
+// next waits for the oldest queued analysis whose PR's job isn't being analysed,
+// and returns it with the context its retries are cancelled with
+func (q *workQueue) next() (context.Context, *queuedAnalysis) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for i, key := range q.order {
+			if _, ok := q.running[key]; ok {
+				continue
+			}
+			q.order = append(q.order[:i:i], q.order[i+1:]...)
+			analysis := q.queued[key]
+			delete(q.queued, key)
+			ctx, cancel := context.WithCancel(analysis.ctx)
+			q.running[key] = &runningAnalysis{started: time.Now(), cancel: cancel}
+			q.depth.Set(float64(len(q.order)))
+			return ctx, analysis
+		}
+		q.cond.Wait()
+	}
+}
+
+// process runs the analysis, retrying it when it fails. The analyses which
+// panicked aren't retried, as they were retried already, nor are the
+// cancelled ones, e.g. as their PR got closed
+func (q *workQueue) process(ctx context.Context, analysis *queuedAnalysis) {
+	defer func() {
+		analysis.done()
+		q.mu.Lock()
+		q.running[analysis.key].cancel()
+		delete(q.running, analysis.key)
+		q.mu.Unlock()
+		// the analysis of the PR's job queued meanwhile may run now
+		q.cond.Broadcast()
+	}()
+
+	backoff := q.backoff
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			q.mu.Lock()
+			q.running[analysis.key].started = time.Now()
+			q.mu.Unlock()
+		}
+		err := analysis.run(ctx)
+		var p *analysisPanic
+		if err == nil || errors.As(err, &p) {
+			return
+		}
+		if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+			analysis.logger.Info().Msg("The queued analysis was cancelled, not retrying it")
+			return
+		}
+		if attempt == q.attempts {
+			analysis.logger.Error().Err(err).Msgf("The queued analysis failed, after %d attempts", attempt)
+			q.status.recordError(queuedAnalysisEventType)
+			return
+		}
+		analysis.logger.Error().Err(err).Msgf("The queued analysis failed (attempt %d of %d), retrying in %s", attempt, q.attempts, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			analysis.logger.Info().Msg("The queued analysis was cancelled, not retrying it")
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// cancel drops the queued analyses of the PR, and stops retrying the ones being
+// run (the running attempts are aborted by the analysisCancellations). It
+// returns how many analyses were dropped or stopped
+func (q *workQueue) cancel(repoFullName string, prNumber int) int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	prefix := prKey(repoFullName, prNumber) + "/"
+	cancelled := 0
+	order := q.order[:0]
+	for _, key := range q.order {
+		if !strings.HasPrefix(key, prefix) {
+			order = append(order, key)
+			continue
+		}
+		q.queued[key].done()
+		delete(q.queued, key)
+		cancelled++
+	}
+	q.order = order
+	q.depth.Set(float64(len(q.order)))
+	for key, running := range q.running {
+		if strings.HasPrefix(key, prefix) {
+			running.cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// stalled returns the key of the analysis whose current attempt has been
+// running for the longest, if for longer than the stall timeout
+func (q *workQueue) stalled() (string, time.Duration) {
+	if q == nil {
+		return "", 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var key string
+	var longest time.Duration
+	for k, running := range q.running {
+		if since := time.Since(running.started); since > q.stall && since > longest {
+			key, longest = k, since
+		}
+	}
+	return key, longest
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Palantir Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/palantir/go-githubapp/githubapp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	AutoscalingRoute   string = "/autoscaling"
+	workloadRateWindow        = 5 * time.Minute
+)
+
+// workloadStatus is the replica's own workload. It's not the deployment's
+// since each request reaches a single replica, which is why the deployment
+// scales on the sum of the replicas' ci_helper_events_in_flight gauges
+// computed by Prometheus instead (see deploy/overlays/autoscaled/scaledobject.yaml)
+type workloadStatus struct {
+	InFlight              int     `json:"in_flight"`
+	OldestInFlightSeconds float64 `json:"oldest_in_flight_seconds"`
+	ReceivedPerMinute     float64 `json:"received_per_minute"`
+	CompletedPerMinute    float64 `json:"completed_per_minute"`
+}
+
+// workload tracks the events being handled by the replica and the rates
+// at which they're received and completed, as Prometheus metrics which
+// are summed over the replicas to scale the deployment
+type workload struct {
+	mu        sync.Mutex
+	nextID    int64
+	inFlight  map[int64]time.Time
+	received  []time.Time
+	completed []time.Time
+
+	inFlightGauge   *prometheus.GaugeVec
+	receivedTotal   *prometheus.CounterVec
+	completedTotal  *prometheus.CounterVec
+	durationSeconds *prometheus.HistogramVec
+}
+
+func newWorkload(registry *prometheus.Registry) *workload {
+	w := &workload{
+		inFlight: map[int64]time.Time{},
+		inFlightGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ci_helper_events_in_flight",
+			Help: "Number of webhook events being handled by the replica.",
+		}, []string{"event_type"}),
+		receivedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_events_received_total",
+			Help: "Number of webhook events received by the replica.",
+		}, []string{"event_type"}),
+		completedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ci_helper_events_completed_total",
+			Help: "Number of webhook events the replica finished handling.",
+		}, []string{"event_type"}),
+		durationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ci_helper_event_duration_seconds",
+			Help:    "Time taken to handle the webhook events.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+		}, []string{"event_type"}),
+	}
+	registry.MustRegister(w.inFlightGauge, w.receivedTotal, w.completedTotal, w.durationSeconds)
+
+	return w
+}
+
+// start records the reception of an event, the returned
+// function must be called once the event is handled
+func (w *workload) start(eventType string) func() {
+	now := time.Now()
+	w.inFlightGauge.WithLabelValues(eventType).Inc()
+	w.receivedTotal.WithLabelValues(eventType).Inc()
+
+	w.mu.Lock()
+	id := w.nextID
+	w.nextID++
+	w.inFlight[id] = now
+	w.received = append(trimRateWindow(w.received, now), now)
+	w.mu.Unlock()
+
+	return func() {
+		done := time.Now()
+		w.inFlightGauge.WithLabelValues(eventType).Dec()
+		w.completedTotal.WithLabelValues(eventType).Inc()
+		w.durationSeconds.WithLabelValues(eventType).Observe(done.Sub(now).Seconds())
+
+		w.mu.Lock()
+		delete(w.inFlight, id)
+		w.completed = append(trimRateWindow(w.completed, done), done)
+		w.mu.Unlock()
+	}
+}
+
+// status returns the current workload of the replica
+func (w *workload) status() workloadStatus {
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.received = trimRateWindow(w.received, now)
+	w.completed = trimRateWindow(w.completed, now)
+	status := workloadStatus{
+		InFlight:           len(w.inFlight),
+		ReceivedPerMinute:  float64(len(w.received)) / workloadRateWindow.Minutes(),
+		CompletedPerMinute: float64(len(w.completed)) / workloadRateWindow.Minutes(),
+	}
+	for _, startedAt := range w.inFlight {
+		if age := now.Sub(startedAt).Seconds(); age > status.OldestInFlightSeconds {
+			status.OldestInFlightSeconds = age
+		}
+	}
+
+	return status
+}
+
+// trimRateWindow drops the (chronologically ordered) times older than the rate window
+func trimRateWindow(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > workloadRateWindow {
+		i++
+	}
+	return times[i:]
+}
+
+// workloadEventHandler records the events handled by the wrapped handler
+type workloadEventHandler struct {
+	githubapp.EventHandler
+	workload *workload
+}
+
+func (h *workloadEventHandler) Handle(ctx context.Context, eventType, deliveryID string, payload []byte) error {
+	done := h.workload.start(eventType)
+	defer done()
+
+	return h.EventHandler.Handle(ctx, eventType, deliveryID, payload)
+}
+
+// AutoscalingHandler serves the replica's own workload, e.g. to inspect
+// how the analyses are spread over the replicas
+type AutoscalingHandler struct {
+	Workload *workload
+}
+
+func (h *AutoscalingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Workload.status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}